@@ -0,0 +1,133 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// analysisUpdatingMessage is the message shown by the IDE on the regions waiting for the analysis
+const analysisUpdatingMessage = "Analysis updating…"
+
+// AnalysisUpdating is sent to the IDE as an "arduino/analysisUpdating" event with the regions
+// of a .ino tab edited since the last diagnostics published by clangd: the diagnostics shown on
+// these regions may not reflect the latest edits yet. An empty list of ranges clears the regions.
+type AnalysisUpdating struct {
+	URI     lsp.DocumentURI `json:"uri"`
+	Ranges  []lsp.Range     `json:"ranges"`
+	Message string          `json:"message,omitempty"`
+}
+
+// lineSpan is a range of lines, both ends included
+type lineSpan struct {
+	start, end int
+}
+
+// updateEditedLines updates the edited lines of a document after a text change
+func updateEditedLines(spans []lineSpan, change lsp.Range, text string) []lineSpan {
+	addedLines := strings.Count(text, "\n")
+	delta := addedLines - (change.End.Line - change.Start.Line)
+	edited := lineSpan{start: change.Start.Line, end: change.Start.Line + addedLines}
+
+	res := []lineSpan{}
+	for _, span := range spans {
+		switch {
+		case span.end < change.Start.Line:
+			res = append(res, span)
+		case span.start > change.End.Line:
+			res = append(res, lineSpan{start: span.start + delta, end: span.end + delta})
+		default:
+			// Overlapping the change: merged with the edited lines
+			edited.start = min(edited.start, span.start)
+			if span.end > change.End.Line {
+				edited.end = max(edited.end, span.end+delta)
+			}
+		}
+	}
+	res = append(res, edited)
+
+	// Sort and merge the adjacent spans
+	sort.Slice(res, func(i, j int) bool { return res[i].start < res[j].start })
+	merged := []lineSpan{}
+	for _, span := range res {
+		if n := len(merged); n > 0 && span.start <= merged[n-1].end+1 {
+			merged[n-1].end = max(merged[n-1].end, span.end)
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
+
+// lineSpansToRanges converts the spans into ranges covering the whole lines
+func lineSpansToRanges(spans []lineSpan) []lsp.Range {
+	res := []lsp.Range{}
+	for _, span := range spans {
+		res = append(res, lsp.Range{
+			Start: lsp.Position{Line: span.start, Character: 0},
+			End:   lsp.Position{Line: span.end + 1, Character: 0},
+		})
+	}
+	return res
+}
+
+// trackAnalysisUpdating records the regions of a .ino tab changed by the IDE, and notifies the
+// IDE if they are changed. The caller must hold the write lock.
+func (ls *INOLanguageServer) trackAnalysisUpdating(logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI, changes []lsp.TextDocumentContentChangeEvent) {
+	if ls.config.DisableRealTimeDiagnostics {
+		// The diagnostics are not refreshed while editing
+		return
+	}
+	if ls.analysisUpdatingLines == nil {
+		ls.analysisUpdatingLines = map[lsp.DocumentURI][]lineSpan{}
+	}
+	spans := ls.analysisUpdatingLines[ideURI]
+	updated := spans
+	for _, change := range changes {
+		if change.Range != nil {
+			updated = updateEditedLines(updated, *change.Range, change.Text)
+		}
+	}
+	if slices.Equal(spans, updated) {
+		return
+	}
+	ls.analysisUpdatingLines[ideURI] = updated
+	ls.IDE.sendCustomNotification(logger, "arduino/analysisUpdating", &AnalysisUpdating{
+		URI:     ideURI,
+		Ranges:  lineSpansToRanges(updated),
+		Message: analysisUpdatingMessage,
+	})
+}
+
+// clearAnalysisUpdating notifies the IDE that the analysis of all the .ino tabs is up to date,
+// after clangd published the diagnostics of the current version of the sketch. The caller must
+// hold the lock.
+func (ls *INOLanguageServer) clearAnalysisUpdating(logger jsonrpc.FunctionLogger) {
+	uris := []lsp.DocumentURI{}
+	for uri := range ls.analysisUpdatingLines {
+		uris = append(uris, uri)
+	}
+	sort.Slice(uris, func(i, j int) bool { return uris[i].String() < uris[j].String() })
+	for _, uri := range uris {
+		ls.IDE.sendCustomNotification(logger, "arduino/analysisUpdating", &AnalysisUpdating{URI: uri, Ranges: []lsp.Range{}})
+	}
+	ls.analysisUpdatingLines = nil
+}
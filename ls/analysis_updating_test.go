@@ -0,0 +1,93 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestUpdateEditedLines(t *testing.T) {
+	spans := updateEditedLines(nil, testRange(3, 2, 3, 2), "x")
+	require.Equal(t, []lineSpan{{3, 3}}, spans)
+
+	// New lines extend the edited region
+	spans = updateEditedLines(spans, testRange(3, 3, 3, 3), "\n\n")
+	require.Equal(t, []lineSpan{{3, 5}}, spans)
+
+	// Edits after the region are tracked separately
+	spans = updateEditedLines(spans, testRange(10, 0, 10, 0), "y")
+	require.Equal(t, []lineSpan{{3, 5}, {10, 10}}, spans)
+
+	// Edits before the region shift it
+	spans = updateEditedLines(spans, testRange(0, 0, 0, 0), "\n")
+	require.Equal(t, []lineSpan{{0, 1}, {4, 6}, {11, 11}}, spans)
+
+	// Removed lines shift the following regions back and merge the adjacent ones
+	spans = updateEditedLines(spans, testRange(1, 0, 3, 0), "")
+	require.Equal(t, []lineSpan{{0, 4}, {9, 9}}, spans)
+
+	// A deletion across regions merges them
+	spans = updateEditedLines(spans, testRange(4, 0, 9, 1), "")
+	require.Equal(t, []lineSpan{{0, 4}}, spans)
+
+	require.Equal(t, []lsp.Range{testRange(0, 0, 5, 0)}, lineSpansToRanges(spans))
+}
+
+func TestAnalysisUpdating(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	var clangd, ide bytes.Buffer
+	ls.Clangd = &clangdLSPClient{conn: lsp.NewClient(&bytes.Buffer{}, &clangd, nil)}
+	ls.IDE = &IDELSPServer{conn: lsp.NewServer(&bytes.Buffer{}, &ide, nil)}
+	ls.config = &Config{}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	ino := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	change := func(rng lsp.Range, text string) {
+		ls.applyIdeDocumentChanges(logger, &lsp.DidChangeTextDocumentParams{
+			TextDocument:   lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: ino}},
+			ContentChanges: []lsp.TextDocumentContentChangeEvent{{Range: &rng, Text: text}},
+		})
+	}
+
+	// The edited lines are notified to the IDE
+	change(testRange(1, 13, 1, 13), " delay(1);")
+	require.Equal(t, []lineSpan{{1, 1}}, ls.analysisUpdatingLines[ino])
+	require.Contains(t, ide.String(), `"method":"arduino/analysisUpdating"`)
+	require.Contains(t, ide.String(), `"message":"Analysis updating…"`)
+	require.Contains(t, ide.String(), `"ranges":[{"start":{"line":1,"character":0},"end":{"line":2,"character":0}}]`)
+
+	// Nothing is sent if the edited lines are the same
+	ide.Reset()
+	change(testRange(1, 14, 1, 14), " ")
+	require.Empty(t, ide.String())
+
+	// The regions are cleared once clangd publishes the diagnostics
+	ls.clearAnalysisUpdating(logger)
+	require.Empty(t, ls.analysisUpdatingLines)
+	require.Contains(t, ide.String(), `"ranges":[]`)
+	require.Contains(t, ide.String(), ino.String())
+
+	// The regions are not tracked if the diagnostics are not refreshed while editing
+	ide.Reset()
+	ls.config.DisableRealTimeDiagnostics = true
+	change(testRange(0, 0, 0, 0), "\n")
+	require.Empty(t, ls.analysisUpdatingLines)
+	require.Empty(t, ide.String())
+}
@@ -0,0 +1,141 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// arduinoAPIIdentifierRegexp matches, in the headers of a core, the Arduino API identifiers
+// whose availability depends on the platform
+var arduinoAPIIdentifierRegexp = func() *regexp.Regexp {
+	identifiers := []string{`Serial(?:\d|USB)`}
+	for identifier := range arduinoReferencePages {
+		identifiers = append(identifiers, regexp.QuoteMeta(identifier))
+	}
+	sort.Strings(identifiers)
+	return regexp.MustCompile(`\b(` + strings.Join(identifiers, "|") + `)\b`)
+}()
+
+// updateAPIProviders finds which of the installed platforms provide the Arduino API
+// identifiers. The platforms are installed next to the one of the selected board, whose
+// variant folder is taken from the include paths of the given compilation database. The
+// headers are scanned again only if the selected board comes from another packages folder.
+func (ls *INOLanguageServer) updateAPIProviders(logger jsonrpc.FunctionLogger, db *compilationDatabase) {
+	packagesDir := findPackagesFolder(findVariantFolder(db))
+
+	ls.apiProvidersMutex.Lock()
+	defer ls.apiProvidersMutex.Unlock()
+	if packagesDir == nil {
+		ls.apiProvidersDir, ls.apiProviders = nil, nil
+		return
+	}
+	if ls.apiProvidersDir != nil && ls.apiProvidersDir.EquivalentTo(packagesDir) {
+		return
+	}
+	logger.Logf("Loading the Arduino API provided by the platforms installed in %s", packagesDir)
+	ls.apiProvidersDir, ls.apiProviders = packagesDir, loadAPIProviders(packagesDir)
+}
+
+// findPackagesFolder returns the packages folder containing the given variant folder
+// (packages/PACKAGER/hardware/ARCH/VERSION/variants/VARIANT), or nil if the variant is not
+// part of an installed platform.
+func findPackagesFolder(variant *paths.Path) *paths.Path {
+	if variant == nil {
+		return nil
+	}
+	hardware := variant.Parent().Parent().Parent().Parent()
+	if hardware.Base() != "hardware" {
+		return nil
+	}
+	return hardware.Parent().Parent()
+}
+
+// loadAPIProviders scans the core and variant headers of the platforms installed in the
+// given packages folder, and maps each Arduino API identifier found to the (sorted) IDs
+// of the platforms declaring it.
+func loadAPIProviders(packagesDir *paths.Path) map[string][]string {
+	providers := map[string]map[string]bool{}
+	packagers, _ := packagesDir.ReadDir()
+	packagers.FilterDirs()
+	for _, packager := range packagers {
+		archs, _ := packager.Join("hardware").ReadDir()
+		archs.FilterDirs()
+		for _, arch := range archs {
+			platformID := packager.Base() + ":" + arch.Base()
+			versions, _ := arch.ReadDir()
+			versions.FilterDirs()
+			for _, version := range versions {
+				for _, header := range platformAPIHeaders(version) {
+					data, err := header.ReadFile()
+					if err != nil {
+						continue
+					}
+					for _, match := range arduinoAPIIdentifierRegexp.FindAllStringSubmatch(string(data), -1) {
+						if providers[match[1]] == nil {
+							providers[match[1]] = map[string]bool{}
+						}
+						providers[match[1]][platformID] = true
+					}
+				}
+			}
+		}
+	}
+
+	res := map[string][]string{}
+	for identifier, platforms := range providers {
+		for platformID := range platforms {
+			res[identifier] = append(res[identifier], platformID)
+		}
+		sort.Strings(res[identifier])
+	}
+	return res
+}
+
+// platformAPIHeaders returns the headers declaring the API of the given platform: the ones
+// of the cores (including the common ArduinoCore-API, in the "api" subfolder) and of the
+// variants. The other subfolders are not scanned, they may contain whole SDKs.
+func platformAPIHeaders(platformDir *paths.Path) paths.PathList {
+	var res paths.PathList
+	for _, base := range []string{"cores", "variants"} {
+		dirs, _ := platformDir.Join(base).ReadDir()
+		dirs.FilterDirs()
+		for _, dir := range dirs {
+			for _, folder := range []*paths.Path{dir, dir.Join("api")} {
+				headers, err := folder.ReadDir()
+				if err != nil {
+					continue
+				}
+				headers.FilterSuffix(".h")
+				res = append(res, headers...)
+			}
+		}
+	}
+	return res
+}
+
+// apiProvidersOf returns the installed platforms providing the given Arduino API identifier,
+// or nil if unknown
+func (ls *INOLanguageServer) apiProvidersOf(identifier string) []string {
+	ls.apiProvidersMutex.Lock()
+	defer ls.apiProvidersMutex.Unlock()
+	return ls.apiProviders[identifier]
+}
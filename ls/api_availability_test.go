@@ -0,0 +1,56 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadAPIProviders(t *testing.T) {
+	packagesDir := paths.New(t.TempDir()).Join("packages")
+	writeHeader := func(text string, elem ...string) {
+		header := packagesDir.Join(elem...)
+		require.NoError(t, header.Parent().MkdirAll())
+		require.NoError(t, header.WriteFile([]byte(text)))
+	}
+	avr := []string{"arduino", "hardware", "avr", "1.8.6"}
+	samd := []string{"arduino", "hardware", "samd", "1.8.13"}
+	writeHeader("void analogWrite(uint8_t pin, int val);\n#if defined(UBRR1H)\nextern HardwareSerial Serial1;\n#endif\n",
+		append(avr, "cores", "arduino", "Arduino.h")...)
+	writeHeader("#define LED_BUILTIN 13\n", append(avr, "variants", "standard", "pins_arduino.h")...)
+	writeHeader("extern void analogWriteResolution(int res);\n", append(samd, "cores", "arduino", "wiring_analog.h")...)
+	writeHeader("void analogWrite(pin_size_t pinNumber, int value);\n", append(samd, "cores", "arduino", "api", "Common.h")...)
+	writeHeader("extern Uart Serial1;\n#define SERIAL_PORT_USBVIRTUAL SerialUSB\n", append(samd, "variants", "mkr1000", "variant.h")...)
+	// Not part of the API of the platform
+	writeHeader("void analogWriteResolution(int res);\n", append(avr, "libraries", "Servo", "Servo.h")...)
+	writeHeader("void analogWriteResolution(int res);\n", append(avr, "cores", "arduino", "Arduino.cpp")...)
+
+	providers := loadAPIProviders(packagesDir)
+	require.Equal(t, []string{"arduino:avr", "arduino:samd"}, providers["analogWrite"])
+	require.Equal(t, []string{"arduino:samd"}, providers["analogWriteResolution"])
+	require.Equal(t, []string{"arduino:avr", "arduino:samd"}, providers["Serial1"])
+	require.Equal(t, []string{"arduino:samd"}, providers["SerialUSB"])
+	require.Equal(t, []string{"arduino:avr"}, providers["LED_BUILTIN"])
+	require.NotContains(t, providers, "HardwareSerial")
+	require.NotContains(t, providers, "SERIAL_PORT_USBVIRTUAL")
+
+	require.True(t, packagesDir.EquivalentTo(findPackagesFolder(packagesDir.Join(append(avr, "variants", "standard")...))))
+	require.Nil(t, findPackagesFolder(paths.New(t.TempDir()).Join("variants", "standard")))
+	require.Nil(t, findPackagesFolder(nil))
+}
@@ -0,0 +1,85 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// arduinoCLIDaemonClient returns a client for the arduino-cli core service run in the
+// language server or, if it's not running, for the arduino-cli daemon. The underlying gRPC
+// connection is established on the first call and then kept open, so the daemon (and the
+// package and library indexes it has loaded) is reused across rebuilds.
+func (ls *INOLanguageServer) arduinoCLIDaemonClient(ctx context.Context) (rpc.ArduinoCoreServiceClient, error) {
+	if ls.config.cliCore != nil {
+		return ls.config.cliCore, nil
+	}
+
+	ls.cliDaemonConnMutex.Lock()
+	defer ls.cliDaemonConnMutex.Unlock()
+
+	if ls.cliDaemonConn == nil {
+		conn, err := grpc.DialContext(
+			ctx,
+			ls.config.CliDaemonAddress,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithBlock())
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to arduino-cli rpc server: %w", err)
+		}
+		ls.cliDaemonConn = conn
+	}
+	return rpc.NewArduinoCoreServiceClient(ls.cliDaemonConn), nil
+}
+
+// closeArduinoCLIDaemonConnection closes the connection with the arduino-cli daemon (if any)
+func (ls *INOLanguageServer) closeArduinoCLIDaemonConnection() {
+	ls.cliDaemonConnMutex.Lock()
+	defer ls.cliDaemonConnMutex.Unlock()
+
+	if ls.cliDaemonConn != nil {
+		ls.cliDaemonConn.Close()
+		ls.cliDaemonConn = nil
+	}
+}
+
+// runArduinoCLI runs the arduino-cli executable with the given arguments (the configuration
+// file is added automatically) and returns its standard output.
+func (ls *INOLanguageServer) runArduinoCLI(ctx context.Context, logger jsonrpc.FunctionLogger, args ...string) ([]byte, error) {
+	args = append([]string{"--config-file", ls.config.CliConfigPath.String()}, args...)
+	cmd, err := paths.NewProcessFromPath(ls.toolsEnv(), ls.config.CliPath, args...)
+	if err != nil {
+		return nil, fmt.Errorf("running %s: %w", strings.Join(args, " "), err)
+	}
+	cmdOutput := &bytes.Buffer{}
+	cmdErrOutput := &bytes.Buffer{}
+	cmd.RedirectStdoutTo(cmdOutput)
+	cmd.RedirectStderrTo(cmdErrOutput)
+	logger.Logf("running: %s", strings.Join(args, " "))
+	if err := cmd.RunWithinContext(ctx); err != nil {
+		return nil, fmt.Errorf("running %s: %w\n%s", strings.Join(args, " "), err, cmdErrOutput)
+	}
+	return cmdOutput.Bytes(), nil
+}
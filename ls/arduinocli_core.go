@@ -0,0 +1,227 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/arduino/arduino-cli/commands"
+	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"google.golang.org/grpc"
+)
+
+// arduinoCLICoreStartTimeout is the time given to the arduino-cli core to load the package
+// and library indexes.
+const arduinoCLICoreStartTimeout = 2 * time.Minute
+
+// ArduinoCLICore is the arduino-cli core service run inside the language server: the
+// rebuilds and the queries are served by the arduino-cli commands package linked in the
+// language server, without starting a new process, and the package and library managers
+// stay loaded in memory between the rebuilds.
+type ArduinoCLICore struct {
+	server   rpc.ArduinoCoreServiceServer
+	instance *rpc.Instance
+}
+
+// StartArduinoCLICore creates the arduino-cli core service, loads the arduino-cli config
+// file of the given configuration, creates and initializes an instance and updates the
+// configuration to use the core service instead of the arduino-cli executable.
+func StartArduinoCLICore(config *Config) (*ArduinoCLICore, error) {
+	core := &ArduinoCLICore{server: commands.NewArduinoCoreServer()}
+	ctx, cancel := context.WithTimeout(context.Background(), arduinoCLICoreStartTimeout)
+	defer cancel()
+
+	if config.CliConfigPath != nil {
+		settings, err := config.CliConfigPath.ReadFile()
+		if err != nil {
+			return nil, fmt.Errorf("reading arduino-cli config file: %w", err)
+		}
+		resp, err := core.server.ConfigurationOpen(ctx, &rpc.ConfigurationOpenRequest{
+			EncodedSettings: string(settings),
+			SettingsFormat:  "yaml",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("loading arduino-cli config file: %w", err)
+		}
+		for _, warning := range resp.GetWarnings() {
+			log.Printf("arduino-cli config file: %s", warning)
+		}
+	}
+
+	client := &arduinoCLICoreClient{server: core.server}
+	createResp, err := client.Create(ctx, &rpc.CreateRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("error creating arduino-cli instance: %w", err)
+	}
+	core.instance = createResp.GetInstance()
+	if err := runArduinoCLIInit(ctx, client, core.instance); err != nil {
+		core.Close()
+		return nil, err
+	}
+	log.Printf("arduino-cli core started (instance %d)", core.instance.GetId())
+
+	config.CliPath = nil
+	config.CliInstanceNumber = int(core.instance.GetId())
+	config.cliCore = client
+	return core, nil
+}
+
+// Close releases the instance of the core service
+func (c *ArduinoCLICore) Close() {
+	_, _ = c.server.Destroy(context.Background(), &rpc.DestroyRequest{Instance: c.instance})
+}
+
+// runArduinoCLIInit (re)initializes the given instance: the package and library indexes are
+// loaded and the installed platforms and libraries are scanned.
+func runArduinoCLIInit(ctx context.Context, client rpc.ArduinoCoreServiceClient, instance *rpc.Instance) error {
+	initStream, err := client.Init(ctx, &rpc.InitRequest{Instance: instance})
+	if err != nil {
+		return fmt.Errorf("error initializing arduino-cli instance: %w", err)
+	}
+	for {
+		initResp, err := initStream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error initializing arduino-cli instance: %w", err)
+		}
+		if initErr := initResp.GetError(); initErr != nil {
+			// Not fatal: for example a missing index of a third party platform
+			log.Printf("arduino-cli instance initialization: %s", initErr.GetMessage())
+		}
+	}
+}
+
+// arduinoCLICoreClient exposes the core service run in the language server through the
+// same client interface used for an arduino-cli daemon, so that the callers don't need to
+// know where arduino-cli runs. Only the calls made by the language server are forwarded,
+// the other ones are not available.
+type arduinoCLICoreClient struct {
+	rpc.ArduinoCoreServiceClient
+	server rpc.ArduinoCoreServiceServer
+}
+
+func (c *arduinoCLICoreClient) Create(ctx context.Context, req *rpc.CreateRequest, _ ...grpc.CallOption) (*rpc.CreateResponse, error) {
+	return c.server.Create(ctx, req)
+}
+
+func (c *arduinoCLICoreClient) Init(ctx context.Context, req *rpc.InitRequest, _ ...grpc.CallOption) (rpc.ArduinoCoreService_InitClient, error) {
+	return startCoreStream(ctx, func(stream *coreServerStream[rpc.InitResponse]) error {
+		return c.server.Init(req, stream)
+	}), nil
+}
+
+func (c *arduinoCLICoreClient) Compile(ctx context.Context, req *rpc.CompileRequest, _ ...grpc.CallOption) (rpc.ArduinoCoreService_CompileClient, error) {
+	return startCoreStream(ctx, func(stream *coreServerStream[rpc.CompileResponse]) error {
+		return c.server.Compile(req, stream)
+	}), nil
+}
+
+func (c *arduinoCLICoreClient) BoardDetails(ctx context.Context, req *rpc.BoardDetailsRequest, _ ...grpc.CallOption) (*rpc.BoardDetailsResponse, error) {
+	return c.server.BoardDetails(ctx, req)
+}
+
+func (c *arduinoCLICoreClient) BoardList(ctx context.Context, req *rpc.BoardListRequest, _ ...grpc.CallOption) (*rpc.BoardListResponse, error) {
+	return c.server.BoardList(ctx, req)
+}
+
+func (c *arduinoCLICoreClient) BoardListWatch(ctx context.Context, req *rpc.BoardListWatchRequest, _ ...grpc.CallOption) (rpc.ArduinoCoreService_BoardListWatchClient, error) {
+	return startCoreStream(ctx, func(stream *coreServerStream[rpc.BoardListWatchResponse]) error {
+		return c.server.BoardListWatch(req, stream)
+	}), nil
+}
+
+func (c *arduinoCLICoreClient) LibraryList(ctx context.Context, req *rpc.LibraryListRequest, _ ...grpc.CallOption) (*rpc.LibraryListResponse, error) {
+	return c.server.LibraryList(ctx, req)
+}
+
+func (c *arduinoCLICoreClient) SettingsGetValue(ctx context.Context, req *rpc.SettingsGetValueRequest, _ ...grpc.CallOption) (*rpc.SettingsGetValueResponse, error) {
+	return c.server.SettingsGetValue(ctx, req)
+}
+
+// startCoreStream runs a streaming call of the core service in the background and returns
+// the stream the responses are read from, as they are sent.
+func startCoreStream[T any](ctx context.Context, call func(*coreServerStream[T]) error) *coreClientStream[T] {
+	responses := make(chan *T)
+	client := &coreClientStream[T]{responses: responses}
+	go func() {
+		// err is written before closing the channel, Recv reads it after
+		client.err = call(&coreServerStream[T]{ctx: ctx, responses: responses})
+		close(responses)
+	}()
+	return client
+}
+
+// coreServerStream is the stream a streaming call of the core service sends its responses to
+type coreServerStream[T any] struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses chan<- *T
+}
+
+func (s *coreServerStream[T]) Context() context.Context {
+	return s.ctx
+}
+
+func (s *coreServerStream[T]) Send(resp *T) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case s.responses <- resp:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// coreClientStream is the stream the responses of a streaming call of the core service are
+// read from. Recv returns io.EOF when the call ends successfully.
+type coreClientStream[T any] struct {
+	grpc.ClientStream
+	responses <-chan *T
+	err       error
+}
+
+func (s *coreClientStream[T]) Recv() (*T, error) {
+	resp, ok := <-s.responses
+	if !ok {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	return resp, nil
+}
+
+// rescanArduinoCLICore reinitializes the instance of the arduino-cli core run in the language
+// server, to pick up the platforms and libraries installed since it has been started. The
+// package and library managers of the instance are kept in memory across the rebuilds, so
+// they are loaded again only when something is installed.
+func (ls *INOLanguageServer) rescanArduinoCLICore(ctx context.Context, logger jsonrpc.FunctionLogger) error {
+	if ls.config.cliCore == nil {
+		return errors.New("the arduino-cli core is not running in the language server")
+	}
+	logger.Logf("Reinitializing arduino-cli instance %d", ls.config.CliInstanceNumber)
+	return runArduinoCLIInit(ctx, ls.config.cliCore, &rpc.Instance{Id: int32(ls.config.CliInstanceNumber)})
+}
@@ -0,0 +1,100 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// fakeArduinoCLICore records the instances initialized by the language server
+type fakeArduinoCLICore struct {
+	rpc.UnimplementedArduinoCoreServiceServer
+	initialized []int32
+}
+
+func (d *fakeArduinoCLICore) Init(req *rpc.InitRequest, stream rpc.ArduinoCoreService_InitServer) error {
+	d.initialized = append(d.initialized, req.GetInstance().GetId())
+	return stream.Send(&rpc.InitResponse{Message: &rpc.InitResponse_Error{Error: &status.Status{Message: "missing index"}}})
+}
+
+func TestRescanArduinoCLICore(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.config = &Config{CliInstanceNumber: 3}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	require.Error(t, ls.rescanArduinoCLICore(context.Background(), logger), "the core is not running")
+
+	core := &fakeArduinoCLICore{}
+	ls.config.cliCore = &arduinoCLICoreClient{server: core}
+	// The errors reported while loading the indexes are not fatal
+	require.NoError(t, ls.rescanArduinoCLICore(context.Background(), logger))
+	require.Equal(t, []int32{3}, core.initialized)
+}
+
+func (d *fakeArduinoCLICore) Compile(req *rpc.CompileRequest, stream rpc.ArduinoCoreService_CompileServer) error {
+	for _, out := range []string{"first", "second"} {
+		if err := stream.Send(&rpc.CompileResponse{Message: &rpc.CompileResponse_OutStream{OutStream: []byte(out)}}); err != nil {
+			return err
+		}
+	}
+	if req.GetFqbn() == "" {
+		return errors.New("missing fqbn")
+	}
+	return nil
+}
+
+func TestArduinoCLICoreClientStreams(t *testing.T) {
+	client := &arduinoCLICoreClient{server: &fakeArduinoCLICore{}}
+	receive := func(req *rpc.CompileRequest) ([]string, error) {
+		stream, err := client.Compile(context.Background(), req)
+		require.NoError(t, err)
+		outputs := []string{}
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				return outputs, err
+			}
+			outputs = append(outputs, string(resp.GetOutStream()))
+		}
+	}
+
+	outputs, err := receive(&rpc.CompileRequest{Fqbn: "arduino:avr:uno"})
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, []string{"first", "second"}, outputs)
+
+	// The error of the call is returned after the responses sent
+	outputs, err = receive(&rpc.CompileRequest{})
+	require.EqualError(t, err, "missing fqbn")
+	require.Equal(t, []string{"first", "second"}, outputs)
+
+	// The call is stopped if the context is canceled while it's sending
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Compile(ctx, &rpc.CompileRequest{Fqbn: "arduino:avr:uno"})
+	require.NoError(t, err)
+	cancel()
+	_, err = stream.Recv()
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,127 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// variantDefineRegexp matches the object-like macros defined in the variant files
+var variantDefineRegexp = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*define[ \t]+(\w+)[ \t]+(.*?)[ \t]*(?://.*|/\*.*)?$`)
+
+// variantConstRegexp matches the integer constants defined in the variant files, like
+// "static const uint8_t A0 = PIN_A0;"
+var variantConstRegexp = regexp.MustCompile(`(?m)^[ \t]*(?:static[ \t]+)?(?:const|constexpr)[ \t]+\w+[ \t]+(\w+)[ \t]*=[ \t]*([^;]+);`)
+
+// numericValueRegexp matches the integer literals
+var numericValueRegexp = regexp.MustCompile(`^(?:0[xX][0-9a-fA-F]+|[0-9]+)[uUlL]*$`)
+
+// updateBoardDefinitions loads the pin numbers and the other constants defined by the
+// variant of the selected board, the variant folder is taken from the include paths of
+// the given compilation database.
+func (ls *INOLanguageServer) updateBoardDefinitions(logger jsonrpc.FunctionLogger, db *compilationDatabase) {
+	definitions := map[string]string{}
+	if variant := findVariantFolder(db); variant != nil {
+		logger.Logf("Loading board definitions from %s", variant)
+		if headers, err := variant.ReadDir(); err == nil {
+			headers.FilterSuffix(".h")
+			for _, header := range headers {
+				if data, err := header.ReadFile(); err == nil {
+					parseVariantDefinitions(string(data), definitions)
+				}
+			}
+		}
+	}
+
+	ls.boardDefinitionsMutex.Lock()
+	ls.boardDefinitions = definitions
+	ls.boardDefinitionsMutex.Unlock()
+}
+
+// findVariantFolder returns the variant folder of the board in the include paths of the
+// given compilation database, or nil if not found.
+func findVariantFolder(db *compilationDatabase) *paths.Path {
+	for _, cmd := range db.Contents {
+		for _, arg := range cmd.Arguments {
+			if !strings.HasPrefix(arg, "-I") {
+				continue
+			}
+			if include := paths.New(strings.TrimPrefix(arg, "-I")); include != nil && include.Parent().Base() == "variants" {
+				return include
+			}
+		}
+	}
+	return nil
+}
+
+// parseVariantDefinitions adds to definitions the macros and the constants defined in the
+// given variant file, mapped to their (unresolved) values.
+func parseVariantDefinitions(text string, definitions map[string]string) {
+	for _, re := range []*regexp.Regexp{variantDefineRegexp, variantConstRegexp} {
+		for _, match := range re.FindAllStringSubmatch(text, -1) {
+			if _, exists := definitions[match[1]]; !exists {
+				definitions[match[1]] = strings.TrimSpace(match[2])
+			}
+		}
+	}
+}
+
+// resolveBoardDefinition returns the numeric value of the given identifier, following the
+// chain of definitions (for example A0 -> PIN_A0 -> 14).
+func resolveBoardDefinition(definitions map[string]string, identifier string) (string, bool) {
+	value := identifier
+	for i := 0; i < 10; i++ {
+		def, ok := definitions[value]
+		if !ok {
+			return "", false
+		}
+		value = def
+		for strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") {
+			value = strings.TrimSpace(value[1 : len(value)-1])
+		}
+		if numericValueRegexp.MatchString(value) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// addBoardDefinitionToHover appends to the hover the value of the hovered identifier, if it
+// is a pin number or another constant defined by the variant of the selected board.
+func (ls *INOLanguageServer) addBoardDefinitionToHover(hover *lsp.Hover, identifier string) {
+	ls.boardDefinitionsMutex.Lock()
+	value, ok := resolveBoardDefinition(ls.boardDefinitions, identifier)
+	ls.boardDefinitionsMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	board := ls.config.BoardName
+	if board == "" {
+		board = ls.config.Fqbn
+	}
+	if hover.Contents.Kind == lsp.MarkupKindMarkdown {
+		hover.Contents.Value += fmt.Sprintf("\n\n---\n`%s = %s` (on %s)", identifier, value, board)
+	} else {
+		hover.Contents.Value += fmt.Sprintf("\n\n%s = %s (on %s)", identifier, value, board)
+	}
+}
@@ -0,0 +1,110 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+const unoPinsArduinoH = `
+#define NUM_DIGITAL_PINS            20
+#define NUM_ANALOG_INPUTS           6
+#define analogInputToDigitalPin(p)  ((p < 6) ? (p) + 14 : -1)
+
+#define PIN_SPI_SS    (10)
+#define PIN_SPI_MOSI  (11)
+
+static const uint8_t SS   = PIN_SPI_SS;
+static const uint8_t MOSI = PIN_SPI_MOSI;
+
+#define LED_BUILTIN 13 // the on-board LED
+
+#define PIN_A0   (14)
+#define PIN_A1   (15)
+
+static const uint8_t A0 = PIN_A0;
+static const uint8_t A1 = PIN_A1;
+
+#define SERIAL_PORT_MONITOR   Serial
+#define digitalPinHasPWM(p)         ((p) == 3 || (p) == 5)
+`
+
+func TestResolveBoardDefinition(t *testing.T) {
+	definitions := map[string]string{}
+	parseVariantDefinitions(unoPinsArduinoH, definitions)
+
+	for identifier, expected := range map[string]string{
+		"LED_BUILTIN":      "13",
+		"A0":               "14",
+		"A1":               "15",
+		"PIN_A0":           "14",
+		"SS":               "10",
+		"MOSI":             "11",
+		"NUM_DIGITAL_PINS": "20",
+	} {
+		value, ok := resolveBoardDefinition(definitions, identifier)
+		require.True(t, ok, identifier)
+		require.Equal(t, expected, value, identifier)
+	}
+	for _, identifier := range []string{"SERIAL_PORT_MONITOR", "analogInputToDigitalPin", "digitalPinHasPWM", "setup", "A7"} {
+		_, ok := resolveBoardDefinition(definitions, identifier)
+		require.False(t, ok, identifier)
+	}
+
+	// Circular definitions must not loop forever
+	_, ok := resolveBoardDefinition(map[string]string{"A": "B", "B": "A"}, "A")
+	require.False(t, ok)
+}
+
+func TestFindVariantFolder(t *testing.T) {
+	tmp := paths.New(t.TempDir())
+	variant := tmp.Join("hardware", "avr", "1.8.6", "variants", "standard")
+	compileCommands := tmp.Join("compile_commands.json")
+	require.NoError(t, compileCommands.WriteFile([]byte(`[{
+		"directory": "/tmp",
+		"arguments": ["avr-g++", "-c", "-I`+tmp.Join("hardware", "avr", "1.8.6", "cores", "arduino").String()+`", "-I`+variant.String()+`", "sketch.cpp"],
+		"file": "sketch.cpp"
+	}]`)))
+	db, err := loadCompilationDatabase(compileCommands)
+	require.NoError(t, err)
+	require.Equal(t, variant.String(), findVariantFolder(db).String())
+	require.Nil(t, findVariantFolder(&compilationDatabase{}))
+}
+
+func TestAddBoardDefinitionToHover(t *testing.T) {
+	ls := &INOLanguageServer{
+		config:           &Config{Fqbn: "arduino:avr:uno", BoardName: "Arduino Uno"},
+		boardDefinitions: map[string]string{},
+	}
+	parseVariantDefinitions(unoPinsArduinoH, ls.boardDefinitions)
+
+	hover := &lsp.Hover{Contents: lsp.MarkupContent{Kind: lsp.MarkupKindMarkdown, Value: "### macro `LED_BUILTIN`"}}
+	ls.addBoardDefinitionToHover(hover, "LED_BUILTIN")
+	require.Equal(t, "### macro `LED_BUILTIN`\n\n---\n`LED_BUILTIN = 13` (on Arduino Uno)", hover.Contents.Value)
+
+	hover = &lsp.Hover{Contents: lsp.MarkupContent{Kind: lsp.MarkupKindPlainText, Value: "variable A0"}}
+	ls.config.BoardName = ""
+	ls.addBoardDefinitionToHover(hover, "A0")
+	require.Equal(t, "variable A0\n\nA0 = 14 (on arduino:avr:uno)", hover.Contents.Value)
+
+	hover = &lsp.Hover{Contents: lsp.MarkupContent{Kind: lsp.MarkupKindMarkdown, Value: "function setup"}}
+	ls.addBoardDefinitionToHover(hover, "setup")
+	require.Equal(t, "function setup", hover.Contents.Value)
+}
@@ -0,0 +1,117 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/arduino/arduino-language-server/streams"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// selectBoard switches the language server to another board: the diagnostics computed for
+// the previous board are cleared right away and a clean build regenerates the build
+// environment and restarts clangd, that publishes the diagnostics for the new board.
+func (ls *INOLanguageServer) selectBoard(logger jsonrpc.FunctionLogger, fqbn string) {
+	ls.writeLock(logger, true)
+	if ls.config.Fqbn == fqbn {
+		ls.writeUnlock(logger)
+		return
+	}
+	logger.Logf("Board changed from %s to %s", ls.config.Fqbn, fqbn)
+	ls.config.Fqbn = fqbn
+	ls.clearPublishedDiagnostics(logger)
+	ls.writeUnlock(logger)
+
+	ls.cleanBuildInBackground()
+
+	// The platform folder watched depends on the board
+	go func() {
+		defer streams.CatchAndLogPanic()
+		ls.registerEnvironmentWatchedFiles(logger)
+	}()
+}
+
+// currentFqbn returns the FQBN of the selected board
+func (ls *INOLanguageServer) currentFqbn(logger jsonrpc.FunctionLogger) string {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+	return ls.config.Fqbn
+}
+
+// clearPublishedDiagnostics removes from the IDE all the diagnostics published so far,
+// including the ones generated by the language server itself. The caller must hold the
+// write lock.
+func (ls *INOLanguageServer) clearPublishedDiagnostics(logger jsonrpc.FunctionLogger) {
+	cleared := map[lsp.DocumentURI]*lsp.PublishDiagnosticsParams{}
+	for _, docs := range []map[lsp.DocumentURI]bool{ls.ideInoDocsWithDiagnostics, ls.ideDocsWithDiagnostics} {
+		for ideURI := range docs {
+			cleared[ideURI] = &lsp.PublishDiagnosticsParams{URI: ideURI, Diagnostics: []lsp.Diagnostic{}}
+		}
+	}
+	ls.ideInoDocsWithDiagnostics = map[lsp.DocumentURI]bool{}
+	ls.ideDocsWithDiagnostics = map[lsp.DocumentURI]bool{}
+	ls.sketchStructureDiagnostics = nil
+	ls.flashStringDiagnostics = map[lsp.DocumentURI][]lsp.Diagnostic{}
+
+	for _, ideParams := range cleared {
+		logger.Logf("Clearing diagnostics of %s", ideParams.URI)
+		if err := ls.publishIdeDiagnostics(logger, ideParams); err != nil {
+			logger.Logf("Error sending diagnostics to IDE: %s", err)
+			return
+		}
+	}
+	ls.sendDiagnosticsSummary(logger, cleared)
+}
+
+// serialPortObjectRegexp matches the additional serial ports, available only on some boards
+var serialPortObjectRegexp = regexp.MustCompile(`^Serial(\d|USB)$`)
+
+// annotateBoardConditionalDiagnostic explains the errors that depend on the selected
+// board: an Arduino API identifier reported as undeclared is most likely not provided by
+// the platform of the board (for example analogWriteResolution on the AVR boards), rather
+// than misspelled or missing an #include. The installed platforms providing the identifier,
+// returned by providersOf, are listed to tell the user which boards support it.
+func annotateBoardConditionalDiagnostic(diag *lsp.Diagnostic, code, fqbn string, providersOf func(identifier string) []string) {
+	if fqbn == "" || (code != "undeclared_var_use" && code != "undeclared_var_use_suggest") {
+		return
+	}
+	match := undeclaredIdentifierRegexp.FindStringSubmatch(diag.Message)
+	if match == nil {
+		return
+	}
+	identifier := match[1]
+	if _, ok := arduinoReferencePages[identifier]; !ok && !serialPortObjectRegexp.MatchString(identifier) {
+		return
+	}
+	providers := providersOf(identifier)
+	if len(providers) == 0 {
+		diag.Message += fmt.Sprintf(" ('%s' may not be available on the selected board: %s)", identifier, fqbn)
+		return
+	}
+	availability := "is not available"
+	for _, platformID := range providers {
+		if strings.HasPrefix(fqbn, platformID+":") {
+			// Provided only for some boards of the platform (for example Serial1 on AVR)
+			availability = "may not be available"
+		}
+	}
+	diag.Message += fmt.Sprintf(" ('%s' %s on the selected board: %s, it is provided by the installed platforms: %s)",
+		identifier, availability, fqbn, strings.Join(providers, ", "))
+}
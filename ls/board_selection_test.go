@@ -0,0 +1,97 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestClearPublishedDiagnostics(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	var ide bytes.Buffer
+	ls.IDE = &IDELSPServer{conn: lsp.NewServer(&bytes.Buffer{}, &ide, nil)}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	inoURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	helperURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h"))
+	ls.ideInoDocsWithDiagnostics = map[lsp.DocumentURI]bool{inoURI: true}
+	ls.ideDocsWithDiagnostics = map[lsp.DocumentURI]bool{helperURI: true}
+	ls.sketchStructureDiagnostics = []lsp.Diagnostic{{Message: "missing loop"}}
+	ls.publishedDiagnostics = map[lsp.DocumentURI][]lsp.Diagnostic{
+		inoURI:    {{Message: "missing loop"}},
+		helperURI: {{Message: "unused variable"}},
+	}
+
+	ls.clearPublishedDiagnostics(logger)
+	require.Empty(t, ls.ideInoDocsWithDiagnostics)
+	require.Empty(t, ls.ideDocsWithDiagnostics)
+	require.Empty(t, ls.sketchStructureDiagnostics)
+	sent := ide.String()
+	require.Contains(t, sent, `{"uri":"`+inoURI.String()+`","diagnostics":[]}`)
+	require.Contains(t, sent, `{"uri":"`+helperURI.String()+`","diagnostics":[]}`)
+	require.Contains(t, sent, "arduino/diagnosticsSummary")
+}
+
+func TestAnnotateBoardConditionalDiagnostic(t *testing.T) {
+	annotate := func(code, message, fqbn string) string {
+		diag := lsp.Diagnostic{Message: message}
+		annotateBoardConditionalDiagnostic(&diag, code, fqbn, func(string) []string { return nil })
+		return diag.Message
+	}
+	require.Equal(t,
+		"use of undeclared identifier 'analogWriteResolution' ('analogWriteResolution' may not be available on the selected board: arduino:avr:uno)",
+		annotate("undeclared_var_use", "use of undeclared identifier 'analogWriteResolution'", "arduino:avr:uno"))
+	require.Equal(t,
+		"use of undeclared identifier 'Serial1' ('Serial1' may not be available on the selected board: arduino:avr:uno)",
+		annotate("undeclared_var_use", "use of undeclared identifier 'Serial1'", "arduino:avr:uno"))
+
+	// Not an Arduino API identifier
+	require.Equal(t, "use of undeclared identifier 'counter'",
+		annotate("undeclared_var_use", "use of undeclared identifier 'counter'", "arduino:avr:uno"))
+	// Other errors
+	require.Equal(t, "expected ';' after expression",
+		annotate("expected_semi_after_expr", "expected ';' after expression", "arduino:avr:uno"))
+	// No board selected
+	require.Equal(t, "use of undeclared identifier 'Serial1'",
+		annotate("undeclared_var_use", "use of undeclared identifier 'Serial1'", ""))
+}
+
+func TestAnnotateBoardConditionalDiagnosticWithProviders(t *testing.T) {
+	providers := map[string][]string{
+		"analogWriteResolution": {"arduino:mbed_nano", "arduino:samd"},
+		"Serial1":               {"arduino:avr", "arduino:samd"},
+	}
+	annotate := func(message, fqbn string) string {
+		diag := lsp.Diagnostic{Message: message}
+		annotateBoardConditionalDiagnostic(&diag, "undeclared_var_use", fqbn, func(identifier string) []string { return providers[identifier] })
+		return diag.Message
+	}
+	require.Equal(t,
+		"use of undeclared identifier 'analogWriteResolution' ('analogWriteResolution' is not available on the selected board: arduino:avr:uno, it is provided by the installed platforms: arduino:mbed_nano, arduino:samd)",
+		annotate("use of undeclared identifier 'analogWriteResolution'", "arduino:avr:uno"))
+	// Provided only by some boards of the platform
+	require.Equal(t,
+		"use of undeclared identifier 'Serial1' ('Serial1' may not be available on the selected board: arduino:avr:uno, it is provided by the installed platforms: arduino:avr, arduino:samd)",
+		annotate("use of undeclared identifier 'Serial1'", "arduino:avr:uno"))
+	// Not provided by any installed platform
+	require.Equal(t,
+		"use of undeclared identifier 'SerialUSB' ('SerialUSB' may not be available on the selected board: arduino:avr:uno)",
+		annotate("use of undeclared identifier 'SerialUSB'", "arduino:avr:uno"))
+}
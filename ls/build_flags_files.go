@@ -0,0 +1,61 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// buildFlagsFileNames are the files of the sketch folder holding extra compiler flags for the
+// whole build. Some platforms (for example ESP8266 and ESP32) copy them, as saved on disk, in
+// the build path with their prebuild hooks and pass them to the compiler as response files.
+var buildFlagsFileNames = []string{"build_opt.h"}
+
+// isBuildFlagsFile returns true if the given path is a build flags file of the sketch
+func (ls *INOLanguageServer) isBuildFlagsFile(path *paths.Path) bool {
+	if !path.Parent().EquivalentTo(ls.sketchRoot) {
+		return false
+	}
+	for _, name := range buildFlagsFileNames {
+		if path.Base() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sketchBuildFlagsFiles returns the build flags files present in the sketch folder. The
+// caller must hold the read lock.
+func (ls *INOLanguageServer) sketchBuildFlagsFiles() paths.PathList {
+	res := paths.PathList{}
+	for _, name := range buildFlagsFileNames {
+		if file := ls.sketchRoot.Join(name); file.Exist() {
+			res = append(res, file)
+		}
+	}
+	return res
+}
+
+// buildFlagsDiscoveryKey returns the key that, added to the headers included by the sketch,
+// forces a libraries discovery when the content of a build flags file changes: the flags
+// may define the macros selecting the headers, and so the libraries, used by the sketch.
+func buildFlagsDiscoveryKey(rel *paths.Path, text string) string {
+	hash := sha256.Sum256([]byte(text))
+	return rel.String() + "@" + hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,103 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// updateBuildSources maps the folders of the build path, where the core and the libraries
+// are compiled, to the folders of their original sources. The locations reported by clangd
+// in the files copied in the build path are redirected to the original files, that are the
+// ones the user can sensibly read.
+func (ls *INOLanguageServer) updateBuildSources(logger jsonrpc.FunctionLogger, db *compilationDatabase) {
+	folders := findBuildSourceFolders(db)
+
+	ls.buildSourcesMutex.Lock()
+	ls.buildSourceFolders = folders
+	ls.buildSourcesMutex.Unlock()
+}
+
+// findBuildSourceFolders returns the folders of the object files of the given compilation
+// database mapped to the folders of the corresponding source files. The sketch, that is
+// compiled from the build path itself, is not included.
+func findBuildSourceFolders(db *compilationDatabase) map[string]*paths.Path {
+	folders := map[string]*paths.Path{}
+	for _, cmd := range db.Contents {
+		output := ""
+		for i, arg := range cmd.Arguments {
+			if arg == "-o" && i+1 < len(cmd.Arguments) {
+				output = cmd.Arguments[i+1]
+			}
+		}
+		if output == "" || cmd.File == "" {
+			continue
+		}
+		object := paths.New(output)
+		if !object.IsAbs() {
+			object = paths.New(cmd.Directory).JoinPath(object)
+		}
+		object = object.Canonical()
+		source := paths.New(cmd.File).Canonical()
+
+		// arduino-cli compiles "path/file.cpp" into "build/.../path/file.cpp.o"
+		if strings.TrimSuffix(object.Base(), ".o") != source.Base() {
+			continue
+		}
+		if object.Parent().EquivalentTo(source.Parent()) {
+			continue
+		}
+		folders[object.Parent().String()] = source.Parent()
+	}
+	return folders
+}
+
+// buildTreeSourcePath returns the original source of a file copied in the build path
+func (ls *INOLanguageServer) buildTreeSourcePath(file *paths.Path) (*paths.Path, bool) {
+	if ls.buildPath == nil {
+		return nil, false
+	}
+	if inside, err := file.IsInsideDir(ls.buildPath); err != nil || !inside {
+		return nil, false
+	}
+	ls.buildSourcesMutex.Lock()
+	defer ls.buildSourcesMutex.Unlock()
+	return resolveBuildSource(ls.buildSourceFolders, file)
+}
+
+// resolveBuildSource looks for the nearest folder of file that is mapped to a source folder,
+// and returns the file with the same relative path in the source folder, if it exists.
+func resolveBuildSource(folders map[string]*paths.Path, file *paths.Path) (*paths.Path, bool) {
+	for dir := file.Parent(); ; dir = dir.Parent() {
+		if sourceFolder, ok := folders[dir.String()]; ok {
+			rel, err := dir.RelTo(file)
+			if err != nil {
+				return nil, false
+			}
+			source := sourceFolder.JoinPath(rel)
+			if !source.Exist() {
+				return nil, false
+			}
+			return source, true
+		}
+		if dir.Parent().EquivalentTo(dir) {
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveBuildSource(t *testing.T) {
+	tmp := paths.New(t.TempDir()).Canonical()
+	core := tmp.Join("packages", "arduino", "hardware", "avr", "1.8.6", "cores", "arduino")
+	require.NoError(t, core.Join("USB").MkdirAll())
+	require.NoError(t, core.Join("HardwareSerial.cpp").WriteFile([]byte{}))
+	require.NoError(t, core.Join("HardwareSerial.h").WriteFile([]byte{}))
+	require.NoError(t, core.Join("USB", "USBCore.h").WriteFile([]byte{}))
+	build := tmp.Join("build")
+
+	db := &compilationDatabase{Contents: []compileCommand{
+		{
+			Directory: build.String(),
+			Arguments: []string{"g++", "-c", core.Join("HardwareSerial.cpp").String(), "-o", build.Join("core", "HardwareSerial.cpp.o").String()},
+			File:      core.Join("HardwareSerial.cpp").String(),
+		},
+		{
+			// relative output path
+			Directory: build.String(),
+			Arguments: []string{"g++", "-c", "sketch/Sketch.ino.cpp", "-o", "sketch/Sketch.ino.cpp.o"},
+			File:      build.Join("sketch", "Sketch.ino.cpp").String(),
+		},
+	}}
+	folders := findBuildSourceFolders(db)
+	require.Equal(t, map[string]*paths.Path{build.Join("core").String(): core}, folders)
+
+	source, ok := resolveBuildSource(folders, build.Join("core", "HardwareSerial.h"))
+	require.True(t, ok)
+	require.Equal(t, core.Join("HardwareSerial.h"), source)
+
+	source, ok = resolveBuildSource(folders, build.Join("core", "USB", "USBCore.h"))
+	require.True(t, ok)
+	require.Equal(t, core.Join("USB", "USBCore.h"), source)
+
+	// files not available in the sources, or outside the mapped folders
+	_, ok = resolveBuildSource(folders, build.Join("core", "Missing.h"))
+	require.False(t, ok)
+	_, ok = resolveBuildSource(folders, build.Join("sketch", "Sketch.ino.cpp"))
+	require.False(t, ok)
+}
@@ -18,8 +18,14 @@ package ls
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -33,20 +39,50 @@ import (
 	"github.com/vincecity/go-lsp"
 	"github.com/vincecity/go-lsp/jsonrpc"
 	"go.bug.st/json"
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RebuildPolicy defines when the sketch is rebuilt to regenerate the preprocessed sketch
+type RebuildPolicy string
+
+const (
+	// RebuildPolicyAutomatic rebuilds the sketch after every change
+	RebuildPolicyAutomatic RebuildPolicy = "automatic"
+	// RebuildPolicyOnSave rebuilds the sketch only when a file is saved or closed
+	RebuildPolicyOnSave RebuildPolicy = "on-save"
+	// RebuildPolicyManual rebuilds the sketch only when requested with the arduino/rebuild command
+	RebuildPolicyManual RebuildPolicy = "manual"
+)
+
+// Tokens of the progress of the operations of the language server
+const (
+	rebuildProgressToken = "arduinoLanguageServerRebuild"
+	indexProgressToken   = "arduinoLanguageServerIndex"
 )
 
 type sketchRebuilder struct {
 	ls      *INOLanguageServer
-	trigger chan chan<- bool
+	trigger chan struct{}
 	cancel  func()
 	mutex   sync.Mutex
+	// pending are the channels to close when the next rebuild is completed
+	pending []chan<- bool
+	// running is held while a rebuild is running, or while the rebuilder is paused
+	running sync.Mutex
+	// lastManifest describes the content of the sketch at the last successful rebuild
+	lastManifest sketchManifest
+	// lastIncludes are the headers included by the sketch at the last libraries discovery
+	lastIncludes []string
 }
 
+// sketchManifest maps each source file of the sketch to the hash of its content
+type sketchManifest map[string]string
+
 // newSketchBuilder makes a new SketchRebuilder and returns its pointer
 func newSketchBuilder(ls *INOLanguageServer) *sketchRebuilder {
 	res := &sketchRebuilder{
-		trigger: make(chan chan<- bool, 1),
+		trigger: make(chan struct{}, 1),
 		cancel:  func() {},
 		ls:      ls,
 	}
@@ -58,6 +94,7 @@ func newSketchBuilder(ls *INOLanguageServer) *sketchRebuilder {
 }
 
 func (ls *INOLanguageServer) triggerRebuildAndWait(logger jsonrpc.FunctionLogger) {
+	ls.sketchRebuilder.ForgetLastBuild()
 	completed := make(chan bool)
 	ls.sketchRebuilder.TriggerRebuild(completed)
 	ls.writeUnlock(logger)
@@ -69,22 +106,80 @@ func (ls *INOLanguageServer) triggerRebuild() {
 	ls.sketchRebuilder.TriggerRebuild(nil)
 }
 
-// TriggerRebuild schedule a sketch rebuild (it will be executed asynchronously)
+// triggerRebuildOnChange schedules a sketch rebuild after a document change, if allowed by the rebuild
+// policy and the sketch is not too large (see updateReducedFeatures)
+func (ls *INOLanguageServer) triggerRebuildOnChange() {
+	if ls.config.RebuildPolicy == RebuildPolicyAutomatic && !ls.reducedFeatures {
+		ls.triggerRebuild()
+	}
+}
+
+// triggerRebuildOnSave schedules a sketch rebuild after a document save, if allowed by the rebuild policy
+func (ls *INOLanguageServer) triggerRebuildOnSave() {
+	if ls.config.RebuildPolicy != RebuildPolicyManual {
+		ls.triggerRebuild()
+	}
+}
+
+// TriggerRebuild schedule a sketch rebuild (it will be executed asynchronously).
+// A running rebuild is superseded by the new one: it's canceled and completed will
+// be closed when the new one is completed.
 func (r *sketchRebuilder) TriggerRebuild(completed chan<- bool) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
 	r.cancel() // Stop possibly already running builds
+	if completed != nil {
+		r.pending = append(r.pending, completed)
+	}
 	select {
-	case r.trigger <- completed:
+	case r.trigger <- struct{}{}:
 	default:
 	}
 }
 
+// Pause stops the currently running rebuild (if any) and holds the next ones until
+// Resume is called: the rebuilds triggered in the meantime are run after Resume.
+func (r *sketchRebuilder) Pause() {
+	r.CancelRunningRebuild()
+	r.running.Lock()
+}
+
+// Resume allows again the rebuilds held by Pause
+func (r *sketchRebuilder) Resume() {
+	r.running.Unlock()
+}
+
+// ForgetLastBuild forces the next rebuild, even if the content of the sketch is not changed
+func (r *sketchRebuilder) ForgetLastBuild() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lastManifest = nil
+	r.lastIncludes = nil
+}
+
+// SetLastBuild records the fingerprint of a build done outside of the rebuilder
+func (r *sketchRebuilder) SetLastBuild(manifest sketchManifest, includes []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lastManifest = manifest
+	r.lastIncludes = includes
+}
+
+// CancelRunningRebuild stops the currently running rebuild (if any)
+func (r *sketchRebuilder) CancelRunningRebuild() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.cancel()
+}
+
 func (r *sketchRebuilder) rebuilderLoop() {
 	logger := NewLSPFunctionLogger(color.HiMagentaString, "SKETCH REBUILD: ")
 	for {
-		completed := <-r.trigger
+		<-r.trigger
 
 		for {
 			// Concede a 200ms delay to accumulate bursts of changes
@@ -96,34 +191,93 @@ func (r *sketchRebuilder) rebuilderLoop() {
 			break
 		}
 
-		r.ls.progressHandler.Create("arduinoLanguageServerRebuild")
-		r.ls.progressHandler.Begin("arduinoLanguageServerRebuild", &lsp.WorkDoneProgressBegin{Title: "Building sketch"})
-
+		r.running.Lock()
 		ctx, cancel := context.WithCancel(context.Background())
+		r.ls.progressHandler.Create(rebuildProgressToken)
+		r.ls.progressHandler.SetCancel(rebuildProgressToken, cancel)
+		r.ls.progressHandler.Begin(rebuildProgressToken, &lsp.WorkDoneProgressBegin{
+			Title:       "Arduino: rebuilding sketch index",
+			Cancellable: true,
+		})
+
 		r.mutex.Lock()
 		logger.Logf("Sketch rebuild started")
 		r.cancel = cancel
+		// This rebuild includes all the changes triggered until now
+		completed := r.pending
+		r.pending = nil
+		select {
+		case <-r.trigger:
+		default:
+		}
 		r.mutex.Unlock()
 
-		if err := r.doRebuildArduinoPreprocessedSketch(ctx, logger); err != nil {
+		err := r.doRebuildArduinoPreprocessedSketch(ctx, logger)
+		canceled := ctx.Err() != nil
+		if err != nil && !canceled {
 			logger.Logf("Error: %s", err)
+			r.ls.reportBoardConfigurationError(logger, err)
 		}
-
 		cancel()
-		r.ls.progressHandler.End("arduinoLanguageServerRebuild", &lsp.WorkDoneProgressEnd{Message: "done"})
-		if completed != nil {
-			close(completed)
+
+		r.mutex.Lock()
+		if canceled && len(r.trigger) > 0 {
+			// Superseded by a newer rebuild, that will complete the pending requests
+			logger.Logf("Sketch rebuild superseded by a newer one")
+			r.pending = append(completed, r.pending...)
+			completed = nil
+		}
+		r.mutex.Unlock()
+
+		if canceled {
+			r.ls.progressHandler.End(rebuildProgressToken, &lsp.WorkDoneProgressEnd{Message: "canceled"})
+		} else {
+			r.ls.progressHandler.End(rebuildProgressToken, &lsp.WorkDoneProgressEnd{Message: "done"})
+		}
+		r.running.Unlock()
+		for _, c := range completed {
+			close(c)
 		}
 	}
 }
 
-func (r *sketchRebuilder) doRebuildArduinoPreprocessedSketch(ctx context.Context, logger jsonrpc.FunctionLogger) error {
+func (r *sketchRebuilder) doRebuildArduinoPreprocessedSketch(ctx context.Context, logger jsonrpc.FunctionLogger) (err error) {
+	defer recoverClangdUnavailable(&err)
 	ls := r.ls
-	if success, err := ls.generateBuildEnvironment(ctx, !r.ls.config.SkipLibrariesDiscoveryOnRebuild, logger); err != nil {
+	timings := newRebuildTimings("rebuild")
+
+	// Skip the rebuild if the sketch is not changed since the last one
+	manifest, includes, err := ls.computeSketchManifest(logger)
+	if err != nil {
+		logger.Logf("Error computing sketch manifest: %s", err)
+	}
+	librariesDiscovery := !r.ls.config.SkipLibrariesDiscoveryOnRebuild
+	r.mutex.Lock()
+	unchanged := manifest != nil && maps.Equal(manifest, r.lastManifest)
+	if librariesDiscovery && includes != nil && r.lastIncludes != nil && slices.Equal(includes, r.lastIncludes) {
+		// The libraries discovered by the last build are still valid
+		librariesDiscovery = false
+	}
+	r.mutex.Unlock()
+	if unchanged {
+		logger.Logf("Sketch content not changed since the last rebuild, skipping")
+		return nil
+	}
+	if !librariesDiscovery && !r.ls.config.SkipLibrariesDiscoveryOnRebuild {
+		logger.Logf("Included headers not changed since the last libraries discovery, skipping it")
+	}
+
+	ls.progressHandler.Report(rebuildProgressToken, &lsp.WorkDoneProgressReport{Message: "Preprocessing sketch"})
+	if success, err := ls.generateBuildEnvironment(ctx, librariesDiscovery, logger, timings); err != nil {
 		return err
 	} else if !success {
 		return fmt.Errorf("build failed")
 	}
+	if librariesDiscovery {
+		r.mutex.Lock()
+		r.lastIncludes = includes
+		r.mutex.Unlock()
+	}
 
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
@@ -135,16 +289,25 @@ func (r *sketchRebuilder) doRebuildArduinoPreprocessedSketch(ctx context.Context
 	default:
 	}
 
+	ls.progressHandler.Report(rebuildProgressToken, &lsp.WorkDoneProgressReport{Message: "Updating source maps"})
+	preprocessingStart := time.Now()
 	if cppContent, err := ls.buildSketchCpp.ReadFile(); err == nil {
 		oldVersion := ls.sketchMapper.CppText.Version
 		ls.sketchMapper = sourcemapper.CreateInoMapper(cppContent)
 		ls.sketchMapper.CppText.Version = oldVersion + 1
-		ls.sketchMapper.DebugLogAll()
+		ls.responseCache.Clear()
+		ls.updateReducedFeatures(logger, len(cppContent))
+		if !ls.reducedFeatures {
+			ls.sketchMapper.DebugLogAll()
+		}
+		ls.updateSketchDiagnostics(logger)
 	} else {
 		return errors.WithMessage(err, "reading generated cpp file from sketch")
 	}
+	timings.Preprocessing = elapsedMs(preprocessingStart)
 
 	// Send didSave to notify clang that the source cpp is changed
+	clangdResyncStart := time.Now()
 	logger.Logf("Sending 'didSave' notification to Clangd")
 	cppURI := lsp.NewDocumentURIFromPath(ls.buildSketchCpp)
 	didSaveParams := &lsp.DidSaveTextDocumentParams{
@@ -170,11 +333,92 @@ func (r *sketchRebuilder) doRebuildArduinoPreprocessedSketch(ctx context.Context
 		logger.Logf("error reinitializing clangd:", err)
 		return err
 	}
+	timings.ClangdResync = elapsedMs(clangdResyncStart)
 
+	r.mutex.Lock()
+	r.lastManifest = manifest
+	includes = r.lastIncludes
+	r.mutex.Unlock()
+	ls.saveSnapshot(logger, manifest, includes)
+	ls.recordRebuildTimings(logger, timings)
 	return nil
 }
 
-func (ls *INOLanguageServer) generateBuildEnvironment(ctx context.Context, fullBuild bool, logger jsonrpc.FunctionLogger) (bool, error) {
+// computeSketchManifest hashes the current content of the sketch source files (as tracked
+// from the IDE or, for the files not open and the build flags files, as saved on disk)
+// together with the selected board. The sorted list of the headers included by the sketch,
+// and of the build flags files content, is returned too.
+func (ls *INOLanguageServer) computeSketchManifest(logger jsonrpc.FunctionLogger) (sketchManifest, []string, error) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	files, err := ls.sketchSourceFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest := sketchManifest{"fqbn": ls.config.Fqbn}
+	includes := map[string]bool{}
+	addFile := func(rel *paths.Path, text string) {
+		hash := sha256.Sum256([]byte(text))
+		manifest[rel.String()] = hex.EncodeToString(hash[:])
+		for _, include := range findIncludedHeaders(text) {
+			includes[include] = true
+		}
+	}
+	for _, file := range files {
+		rel, err := file.RelFrom(ls.sketchRoot)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ls.isBuildFlagsFile(file) {
+			// The platforms read the build flags files as saved on disk
+			data, err := file.ReadFile()
+			if err != nil {
+				return nil, nil, err
+			}
+			addFile(rel, string(data))
+			includes[buildFlagsDiscoveryKey(rel, string(data))] = true
+			continue
+		}
+		_, text, err := ls.sketchFileContent(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		addFile(rel, text)
+	}
+	// Tracked files may be missing on disk (not saved yet)
+	for path, doc := range ls.trackedIdeDocs {
+		if ls.isBuildFlagsFile(paths.New(path)) {
+			continue
+		}
+		if rel, err := paths.New(path).RelFrom(ls.sketchRoot); err == nil {
+			if _, ok := manifest[rel.String()]; !ok {
+				addFile(rel, doc.Text)
+			}
+		}
+	}
+	sortedIncludes := []string{}
+	for include := range includes {
+		sortedIncludes = append(sortedIncludes, include)
+	}
+	sort.Strings(sortedIncludes)
+	return manifest, sortedIncludes, nil
+}
+
+// includeRegexp matches the #include directives
+var includeRegexp = regexp.MustCompile(`(?m)^\s*#\s*include\s*([<"][^>"]+[>"])`)
+
+// findIncludedHeaders returns the headers included by the given source code, libraries are
+// discovered from the included headers so if they don't change the discovery can be skipped.
+func findIncludedHeaders(text string) []string {
+	res := []string{}
+	for _, match := range includeRegexp.FindAllStringSubmatch(text, -1) {
+		res = append(res, match[1])
+	}
+	return res
+}
+
+func (ls *INOLanguageServer) generateBuildEnvironment(ctx context.Context, fullBuild bool, logger jsonrpc.FunctionLogger, timings *RebuildTimings) (bool, error) {
 	var buildPath *paths.Path
 	if fullBuild {
 		buildPath = ls.fullBuildPath
@@ -185,143 +429,283 @@ func (ls *INOLanguageServer) generateBuildEnvironment(ctx context.Context, fullB
 	// Extract all build information from language server status
 	ls.readLock(logger, false)
 	sketchRoot := ls.sketchRoot
+	libraryRoot := ls.libraryRoot
 	config := ls.config
-	type overridesFile struct {
-		Overrides map[string]string `json:"overrides"`
-	}
-	data := overridesFile{Overrides: map[string]string{}}
+	overrides := map[string]string{}
 	for uri, trackedFile := range ls.trackedIdeDocs {
+		if inside, _ := paths.New(uri).IsInsideDir(sketchRoot); !inside {
+			// Only the sketch files can be overridden (for example the library sources
+			// are compiled as saved on disk)
+			continue
+		}
 		rel, err := paths.New(uri).RelFrom(sketchRoot)
 		if err != nil {
 			ls.readUnlock(logger)
 			return false, errors.WithMessage(err, "dumping tracked files")
 		}
-		data.Overrides[rel.String()] = trackedFile.Text
+		overrides[rel.String()] = trackedFile.Text
 	}
 	ls.readUnlock(logger)
 
 	var success bool
-	if config.CliPath == nil {
-		// Establish a connection with the arduino-cli gRPC server
-		conn, err := grpc.Dial(config.CliDaemonAddress, grpc.WithInsecure(), grpc.WithBlock())
-		if err != nil {
-			return false, fmt.Errorf("error connecting to arduino-cli rpc server: %w", err)
-		}
-		defer conn.Close()
-		client := rpc.NewArduinoCoreServiceClient(conn)
-
-		compileReq := &rpc.CompileRequest{
-			Instance:                      &rpc.Instance{Id: int32(config.CliInstanceNumber)},
-			Fqbn:                          config.Fqbn,
-			SketchPath:                    sketchRoot.String(),
-			SourceOverride:                data.Overrides,
-			BuildPath:                     buildPath.String(),
-			CreateCompilationDatabaseOnly: true,
-			Verbose:                       true,
-			SkipLibrariesDiscovery:        !fullBuild,
+	var usedLibraries []*LibraryDependency
+	cliStart := time.Now()
+	err := ls.runArduinoCLIWithRetries(ctx, logger, func(ctx context.Context) error {
+		var err error
+		if config.CliPath == nil {
+			success, usedLibraries, err = ls.compileWithArduinoCLIDaemon(ctx, logger, sketchRoot, libraryRoot, buildPath, overrides, fullBuild)
+		} else {
+			success, usedLibraries, err = ls.compileWithArduinoCLI(ctx, logger, sketchRoot, libraryRoot, buildPath, overrides, fullBuild)
 		}
-		compileReqJSON, _ := json.MarshalIndent(compileReq, "", "  ")
-		logger.Logf("Running build with: %s", string(compileReqJSON))
+		return err
+	})
+	timings.CliInvocation += elapsedMs(cliStart)
+	if err != nil {
+		return false, err
+	}
+	if success {
+		ls.updateUsedLibraries(logger, usedLibraries, fullBuild)
+	}
 
-		compRespStream, err := client.Compile(context.Background(), compileReq)
-		if err != nil {
-			return false, fmt.Errorf("error running compile: %w", err)
-		}
+	if fullBuild {
+		ls.CopyFullBuildResults(logger, buildPath)
+		return ls.generateBuildEnvironment(ctx, false, logger, timings)
+	}
 
-		// Loop and consume the server stream until all the operations are done.
-		stdout := ""
-		stderr := ""
-		for {
-			compResp, err := compRespStream.Recv()
-			if err == io.EOF {
-				success = true
-				logger.Logf("Compile successful!")
-				break
-			}
-			if err != nil {
-				logger.Logf("build stdout:")
-				logger.Logf(stdout)
-				logger.Logf("build stderr:")
-				logger.Logf(stderr)
-				return false, fmt.Errorf("error running compile: %w", err)
-			}
+	compilationDatabaseStart := time.Now()
+	defer func() { timings.CompilationDatabase += elapsedMs(compilationDatabaseStart) }()
+	ls.progressHandler.Create(indexProgressToken)
+	ls.progressHandler.Begin(indexProgressToken, &lsp.WorkDoneProgressBegin{
+		Title:   "Arduino: updating sketch index",
+		Message: "Writing compile_commands.json for clangd",
+	})
+	if err := writeClangdCompilationDatabase(buildPath); err != nil {
+		ls.progressHandler.End(indexProgressToken, &lsp.WorkDoneProgressEnd{Message: "failed"})
+		return false, fmt.Errorf("writing the compilation database of clangd: %w", err)
+	}
+	ls.progressHandler.Report(indexProgressToken, &lsp.WorkDoneProgressReport{Message: "Loading board definitions and mapping core and library sources"})
+	ls.updateBuildIndexes(logger, buildPath.Join("compile_commands.json"))
+	ls.progressHandler.End(indexProgressToken, &lsp.WorkDoneProgressEnd{Message: "done"})
 
-			if resp := compResp.GetOutStream(); resp != nil {
-				stdout += string(resp)
-			}
-			if resperr := compResp.GetErrStream(); resperr != nil {
-				stderr += string(resperr)
-			}
-		}
+	return success, nil
+}
 
-	} else {
+// updateBuildIndexes loads, from the given compilation database, the board definitions, the
+// Arduino API provided by the installed platforms and the folders of the core and library
+// sources. They are independent and are loaded in parallel.
+func (ls *INOLanguageServer) updateBuildIndexes(logger jsonrpc.FunctionLogger, compileCommandsJSON *paths.Path) {
+	db, err := loadCompilationDatabase(compileCommandsJSON)
+	if err != nil {
+		logger.Logf("Error loading %s: %s", compileCommandsJSON, err)
+		db = &compilationDatabase{File: compileCommandsJSON}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer streams.CatchAndLogPanic()
+		defer wg.Done()
+		ls.updateBoardDefinitions(logger, db)
+	}()
+	go func() {
+		defer streams.CatchAndLogPanic()
+		defer wg.Done()
+		ls.updateAPIProviders(logger, db)
+	}()
+	go func() {
+		defer streams.CatchAndLogPanic()
+		defer wg.Done()
+		ls.updateBuildSources(logger, db)
+	}()
+	wg.Wait()
+}
 
-		// Dump overrides into a temporary json file
-		for filename, override := range data.Overrides {
-			logger.Logf("Dumping %s override:\n%s", filename, override)
+// arduinoCLIContext returns a context for an arduino-cli invocation, with the configured timeout applied.
+func (ls *INOLanguageServer) arduinoCLIContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ls.config.CliTimeout > 0 {
+		return context.WithTimeout(ctx, ls.config.CliTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// runArduinoCLIWithRetries runs the given arduino-cli invocation with the configured timeout.
+// If the invocation times out or the connection with the daemon fails, it is retried up to the
+// configured number of times, unless the parent context has been canceled (for example because
+// a newer rebuild superseded this one). Any other failure (for example a preprocessing error in
+// the sketch) is deterministic and is returned immediately.
+func (ls *INOLanguageServer) runArduinoCLIWithRetries(ctx context.Context, logger jsonrpc.FunctionLogger, run func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; attempt <= ls.config.CliRetries; attempt++ {
+		if attempt > 0 {
+			logger.Logf("Retrying arduino-cli invocation (attempt %d of %d)", attempt, ls.config.CliRetries)
 		}
-		var overridesJSON *paths.Path
-		if jsonBytes, err := json.MarshalIndent(data, "", "  "); err != nil {
-			return false, errors.WithMessage(err, "dumping tracked files")
-		} else if tmp, err := paths.WriteToTempFile(jsonBytes, nil, ""); err != nil {
-			return false, errors.WithMessage(err, "dumping tracked files")
-		} else {
-			overridesJSON = tmp
-			defer tmp.Remove()
+		timedOut := false
+		err = func() error {
+			cliCtx, cancel := ls.arduinoCLIContext(ctx)
+			defer cancel()
+			err := run(cliCtx)
+			if err != nil && errors.Is(cliCtx.Err(), context.DeadlineExceeded) {
+				timedOut = true
+				return fmt.Errorf("arduino-cli timed out after %s: %w", ls.config.CliTimeout, err)
+			}
+			return err
+		}()
+		if err == nil {
+			return nil
 		}
-
-		// Run arduino-cli to perform the build
-		args := []string{
-			"--config-file", config.CliConfigPath.String(),
-			"compile",
-			"--fqbn", config.Fqbn,
-			"--only-compilation-database",
-			"--source-override", overridesJSON.String(),
-			"--build-path", buildPath.String(),
-			"--format", "json",
+		if ctx.Err() != nil {
+			logger.Logf("arduino-cli invocation canceled: %s", err)
+			return ctx.Err()
 		}
-		if !fullBuild {
-			args = append(args, "--skip-libraries-discovery")
+		logger.Logf("arduino-cli invocation failed: %s", err)
+		if !timedOut && !isArduinoCLIConnectionError(err) {
+			return err
 		}
-		args = append(args, sketchRoot.String())
+	}
+	return err
+}
 
-		cmd, err := paths.NewProcessFromPath(nil, config.CliPath, args...)
-		if err != nil {
-			return false, errors.Errorf("running %s: %s", strings.Join(args, " "), err)
+// isArduinoCLIConnectionError returns true if err is caused by a failure of the connection
+// with the arduino-cli daemon, that may succeed if retried.
+func isArduinoCLIConnectionError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+func (ls *INOLanguageServer) compileWithArduinoCLIDaemon(ctx context.Context, logger jsonrpc.FunctionLogger, sketchRoot, libraryRoot, buildPath *paths.Path, overrides map[string]string, fullBuild bool) (bool, []*LibraryDependency, error) {
+	config := ls.config
+
+	client, err := ls.arduinoCLIDaemonClient(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+
+	compileReq := &rpc.CompileRequest{
+		Instance:                      &rpc.Instance{Id: int32(config.CliInstanceNumber)},
+		Fqbn:                          config.Fqbn,
+		SketchPath:                    sketchRoot.String(),
+		SourceOverride:                overrides,
+		BuildPath:                     buildPath.String(),
+		CreateCompilationDatabaseOnly: true,
+		Verbose:                       true,
+		SkipLibrariesDiscovery:        !fullBuild,
+	}
+	if libraryRoot != nil {
+		compileReq.Library = []string{libraryRoot.String()}
+	}
+	compileReqJSON, _ := json.MarshalIndent(compileReq, "", "  ")
+	logger.Logf("Running build with: %s", string(compileReqJSON))
+
+	compRespStream, err := client.Compile(ctx, compileReq)
+	if err != nil {
+		return false, nil, fmt.Errorf("error running compile: %w", err)
+	}
+
+	// Loop and consume the server stream until all the operations are done.
+	stdout := ""
+	stderr := ""
+	usedLibraries := []*LibraryDependency{}
+	for {
+		compResp, err := compRespStream.Recv()
+		if err == io.EOF {
+			logger.Logf("Compile successful!")
+			return true, usedLibraries, nil
 		}
-		cmdOutput := &bytes.Buffer{}
-		cmd.RedirectStdoutTo(cmdOutput)
-		cmd.SetDirFromPath(sketchRoot)
-		logger.Logf("running: %s", strings.Join(args, " "))
-		if err := cmd.RunWithinContext(ctx); err != nil {
-			return false, errors.Errorf("running %s: %s", strings.Join(args, " "), err)
+		if err != nil {
+			logger.Logf("build stdout:")
+			logger.Logf(stdout)
+			logger.Logf("build stderr:")
+			logger.Logf(stderr)
+			return false, nil, fmt.Errorf("error running compile: %w\n%s", err, stderr)
 		}
 
-		// Currently those values are not used, keeping here for future improvements
-		type cmdBuilderRes struct {
-			BuildPath *paths.Path `json:"build_path"`
+		if resp := compResp.GetOutStream(); resp != nil {
+			stdout += string(resp)
 		}
-		type cmdRes struct {
-			CompilerOut   string        `json:"compiler_out"`
-			CompilerErr   string        `json:"compiler_err"`
-			BuilderResult cmdBuilderRes `json:"builder_result"`
-			Success       bool          `json:"success"`
+		if resperr := compResp.GetErrStream(); resperr != nil {
+			stderr += string(resperr)
 		}
-		var res cmdRes
-		if err := json.Unmarshal(cmdOutput.Bytes(), &res); err != nil {
-			return false, errors.Errorf("parsing arduino-cli output: %s", err)
+		for _, lib := range compResp.GetResult().GetUsedLibraries() {
+			usedLibraries = append(usedLibraries, newLibraryDependencyFromRPC(lib))
 		}
-		logger.Logf("arduino-cli output: %s", cmdOutput)
-		success = res.Success
 	}
+}
 
-	if fullBuild {
-		ls.CopyFullBuildResults(logger, buildPath)
-		return ls.generateBuildEnvironment(ctx, false, logger)
+func (ls *INOLanguageServer) compileWithArduinoCLI(ctx context.Context, logger jsonrpc.FunctionLogger, sketchRoot, libraryRoot, buildPath *paths.Path, overrides map[string]string, fullBuild bool) (bool, []*LibraryDependency, error) {
+	config := ls.config
+
+	// Dump overrides into a temporary json file
+	type overridesFile struct {
+		Overrides map[string]string `json:"overrides"`
+	}
+	data := overridesFile{Overrides: overrides}
+	for filename, override := range data.Overrides {
+		logger.Logf("Dumping %s override:\n%s", filename, override)
+	}
+	var overridesJSON *paths.Path
+	if jsonBytes, err := json.MarshalIndent(data, "", "  "); err != nil {
+		return false, nil, errors.WithMessage(err, "dumping tracked files")
+	} else if tmp, err := paths.WriteToTempFile(jsonBytes, nil, ""); err != nil {
+		return false, nil, errors.WithMessage(err, "dumping tracked files")
+	} else {
+		overridesJSON = tmp
+		defer tmp.Remove()
+	}
+
+	// Run arduino-cli to perform the build
+	args := []string{
+		"--config-file", config.CliConfigPath.String(),
+		"compile",
+		"--fqbn", config.Fqbn,
+		"--only-compilation-database",
+		"--source-override", overridesJSON.String(),
+		"--build-path", buildPath.String(),
+		"--format", "json",
+	}
+	if !fullBuild {
+		args = append(args, "--skip-libraries-discovery")
+	}
+	if libraryRoot != nil {
+		args = append(args, "--library", libraryRoot.String())
 	}
+	args = append(args, sketchRoot.String())
 
-	// TODO: do canonicalization directly in `arduino-cli`
-	canonicalizeCompileCommandsJSON(buildPath.Join("compile_commands.json"))
+	cmd, err := paths.NewProcessFromPath(ls.toolsEnv(), config.CliPath, args...)
+	if err != nil {
+		return false, nil, errors.Errorf("running %s: %s", strings.Join(args, " "), err)
+	}
+	cmdOutput := &bytes.Buffer{}
+	cmdErrOutput := &bytes.Buffer{}
+	cmd.RedirectStdoutTo(cmdOutput)
+	cmd.RedirectStderrTo(cmdErrOutput)
+	cmd.SetDirFromPath(sketchRoot)
+	logger.Logf("running: %s", strings.Join(args, " "))
+	if err := cmd.RunWithinContext(ctx); err != nil {
+		// With "--format json" the error is reported on stdout
+		return false, nil, errors.Errorf("running %s: %s\n%s%s", strings.Join(args, " "), err, cmdOutput, cmdErrOutput)
+	}
 
-	return success, nil
+	type cmdBuilderRes struct {
+		BuildPath     *paths.Path       `json:"build_path"`
+		UsedLibraries []*cliUsedLibrary `json:"used_libraries"`
+	}
+	type cmdRes struct {
+		CompilerOut   string        `json:"compiler_out"`
+		CompilerErr   string        `json:"compiler_err"`
+		BuilderResult cmdBuilderRes `json:"builder_result"`
+		Success       bool          `json:"success"`
+	}
+	var res cmdRes
+	if err := json.Unmarshal(cmdOutput.Bytes(), &res); err != nil {
+		return false, nil, errors.Errorf("parsing arduino-cli output: %s\n%s", err, cmdErrOutput)
+	}
+	logger.Logf("arduino-cli output: %s", cmdOutput)
+	usedLibraries := []*LibraryDependency{}
+	for _, lib := range res.BuilderResult.UsedLibraries {
+		usedLibraries = append(usedLibraries, lib.toLibraryDependency())
+	}
+	return res.Success, usedLibraries, nil
 }
@@ -0,0 +1,196 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRunArduinoCLIWithRetries(t *testing.T) {
+	ls := &INOLanguageServer{config: &Config{CliRetries: 2}}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	tests := []struct {
+		name          string
+		err           error
+		expectedCalls int
+	}{
+		{"Success", nil, 1},
+		{"DeterministicFailure", errors.New("exit status 1: sketch.ino:1:1: error: 'foo' was not declared"), 1},
+		{"DaemonUnavailable", status.Error(codes.Unavailable, "connection refused"), 3},
+		{"WrappedDaemonUnavailable", fmt.Errorf("error running compile: %w", status.Error(codes.Unavailable, "connection refused")), 3},
+		{"DaemonInvalidArgument", status.Error(codes.InvalidArgument, "invalid fqbn"), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			err := ls.runArduinoCLIWithRetries(context.Background(), logger, func(ctx context.Context) error {
+				calls++
+				return test.err
+			})
+			require.Equal(t, test.expectedCalls, calls)
+			if test.err == nil {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestComputeSketchManifest(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.config = &Config{Fqbn: "arduino:avr:uno"}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	require.NoError(t, ls.sketchRoot.MkdirAll())
+	require.NoError(t, ls.sketchRoot.Join("Sketch.ino").WriteFile([]byte("void setup() {}\nvoid loop() {}\n")))
+	require.NoError(t, ls.sketchRoot.Join("Helper.h").WriteFile([]byte("#include <Servo.h>\n#define LED 13\n")))
+
+	// Helper.h is not open in the IDE, it's read from disk
+	delete(ls.trackedIdeDocs, ls.sketchRoot.Join("Helper.h").String())
+
+	manifest, includes, err := ls.computeSketchManifest(logger)
+	require.NoError(t, err)
+	require.Len(t, manifest, 3)
+	require.Equal(t, []string{"<Servo.h>"}, includes)
+	again, _, err := ls.computeSketchManifest(logger)
+	require.NoError(t, err)
+	require.Equal(t, manifest, again)
+
+	// The content tracked from the IDE is used instead of the saved one
+	mainIno := ls.sketchRoot.Join("Sketch.ino").String()
+	doc := ls.trackedIdeDocs[mainIno]
+	doc.Text = "#include \"Helper.h\"\n#include <Wire.h>\nvoid setup() {}\nvoid loop() { delay(1); }\n"
+	ls.trackedIdeDocs[mainIno] = doc
+	edited, includes, err := ls.computeSketchManifest(logger)
+	require.NoError(t, err)
+	require.Equal(t, []string{"\"Helper.h\"", "<Servo.h>", "<Wire.h>"}, includes)
+	require.NotEqual(t, manifest["Sketch.ino"], edited["Sketch.ino"])
+	require.Equal(t, manifest["Helper.h"], edited["Helper.h"])
+
+	// Changing the board requires a rebuild too
+	ls.config.Fqbn = "arduino:samd:mkr1000"
+	otherBoard, _, err := ls.computeSketchManifest(logger)
+	require.NoError(t, err)
+	require.NotEqual(t, edited, otherBoard)
+}
+
+func TestComputeSketchManifestWithBuildFlags(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.config = &Config{Fqbn: "esp8266:esp8266:nodemcuv2"}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	require.NoError(t, ls.sketchRoot.MkdirAll())
+	require.NoError(t, ls.sketchRoot.Join("Sketch.ino").WriteFile([]byte("void setup() {}\nvoid loop() {}\n")))
+	require.NoError(t, ls.sketchRoot.Join("Helper.h").WriteFile([]byte("#pragma once\n")))
+	buildOpt := ls.sketchRoot.Join("build_opt.h")
+	require.NoError(t, buildOpt.WriteFile([]byte("-DUSE_DISPLAY=1\n")))
+	require.True(t, ls.isBuildFlagsFile(buildOpt))
+	require.False(t, ls.isBuildFlagsFile(ls.sketchRoot.Join("src", "build_opt.h")))
+	require.Equal(t, paths.PathList{buildOpt}, ls.sketchBuildFlagsFiles())
+
+	manifest, includes, err := ls.computeSketchManifest(logger)
+	require.NoError(t, err)
+	require.Contains(t, manifest, "build_opt.h")
+	require.Len(t, includes, 1)
+
+	// The unsaved changes of the build flags file are ignored, the platform reads it from disk
+	ls.trackedIdeDocs[buildOpt.String()] = lsp.TextDocumentItem{URI: lsp.NewDocumentURIFromPath(buildOpt), Text: "-DUSE_DISPLAY=0\n"}
+	unsaved, unsavedIncludes, err := ls.computeSketchManifest(logger)
+	require.NoError(t, err)
+	require.Equal(t, manifest, unsaved)
+	require.Equal(t, includes, unsavedIncludes)
+
+	// Saving the build flags file changes the manifest and forces a libraries discovery
+	require.NoError(t, buildOpt.WriteFile([]byte("-DUSE_DISPLAY=0\n")))
+	saved, savedIncludes, err := ls.computeSketchManifest(logger)
+	require.NoError(t, err)
+	require.NotEqual(t, manifest["build_opt.h"], saved["build_opt.h"])
+	require.NotEqual(t, includes, savedIncludes)
+}
+
+func TestFindIncludedHeaders(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{"void setup() {}\n", []string{}},
+		{"#include <Servo.h>\n", []string{"<Servo.h>"}},
+		{"  #  include   \"config.h\"\n#include<SPI.h>\n", []string{"\"config.h\"", "<SPI.h>"}},
+		{"// #include <Servo.h> is commented\n", []string{}},
+		{"#define SERVO_INCLUDE <Servo.h>\n", []string{}},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, findIncludedHeaders(test.text), test.text)
+	}
+}
+
+func TestUpdateBuildIndexes(t *testing.T) {
+	tmp := paths.New(t.TempDir()).Canonical()
+	hardware := tmp.Join("packages", "arduino", "hardware", "avr", "1.8.6")
+	core := hardware.Join("cores", "arduino")
+	variant := hardware.Join("variants", "standard")
+	require.NoError(t, core.MkdirAll())
+	require.NoError(t, variant.MkdirAll())
+	require.NoError(t, variant.Join("pins_arduino.h").WriteFile([]byte("#define LED_BUILTIN 13\n")))
+	build := tmp.Join("build")
+	compileCommands := tmp.Join("compile_commands.json")
+	require.NoError(t, compileCommands.WriteFile([]byte(`[{
+		"directory": "`+build.String()+`",
+		"arguments": ["avr-g++", "-c", "-I`+core.String()+`", "-I`+variant.String()+`", "`+core.Join("wiring.c").String()+`", "-o", "`+build.Join("core", "wiring.c.o").String()+`"],
+		"file": "`+core.Join("wiring.c").String()+`"
+	}]`)))
+
+	ls := &INOLanguageServer{}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	ls.updateBuildIndexes(logger, compileCommands)
+	require.Equal(t, map[string]string{"LED_BUILTIN": "13"}, ls.boardDefinitions)
+	require.Equal(t, map[string]*paths.Path{build.Join("core").String(): core}, ls.buildSourceFolders)
+
+	// A missing compilation database clears both
+	ls.updateBuildIndexes(logger, tmp.Join("missing.json"))
+	require.Empty(t, ls.boardDefinitions)
+	require.Empty(t, ls.buildSourceFolders)
+}
+
+func TestTriggerRebuildSupersedesRunningRebuild(t *testing.T) {
+	canceled := 0
+	r := &sketchRebuilder{
+		trigger: make(chan struct{}, 1),
+		cancel:  func() { canceled++ },
+	}
+
+	first := make(chan bool)
+	second := make(chan bool)
+	r.TriggerRebuild(first)
+	r.TriggerRebuild(nil)
+	r.TriggerRebuild(second)
+
+	// The running rebuild is canceled each time and a single rebuild is scheduled,
+	// that completes all the requests
+	require.Equal(t, 3, canceled)
+	require.Len(t, r.trigger, 1)
+	require.Equal(t, []chan<- bool{first, second}, r.pending)
+}
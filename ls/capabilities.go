@@ -0,0 +1,155 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/arduino/arduino-language-server/globals"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// minimumInactiveRegionsClangdVersion is the oldest major version of clangd sending the
+// "textDocument/inactiveRegions" notifications
+const minimumInactiveRegionsClangdVersion = 17
+
+// Capabilities is the response to the custom "arduino/capabilities" request, it reports the
+// optional subsystems of the language server that are active in the session, so that the
+// support requests include the effective configuration.
+type Capabilities struct {
+	// Version is the version of the language server
+	Version string `json:"version"`
+	// ClangdVersion is the version reported by clangd (empty if clangd is not running)
+	ClangdVersion string `json:"clangdVersion,omitempty"`
+	// Subsystems are the optional subsystems of the language server
+	Subsystems []*SubsystemStatus `json:"subsystems"`
+}
+
+// SubsystemStatus is the state of one of the optional subsystems of the language server
+type SubsystemStatus struct {
+	// Name identifies the subsystem: clangd, daemon, backgroundIndex, compileOnSave,
+	// realTimeDiagnostics, inactiveRegions or reducedFeatures
+	Name string `json:"name"`
+	// Active is true if the subsystem is in use
+	Active bool `json:"active"`
+	// Reason explains why the subsystem is not active (why it's active for reducedFeatures,
+	// the mode used for the sketches exceeding the limits)
+	Reason string `json:"reason,omitempty"`
+}
+
+// capabilities computes the state of the optional subsystems. The caller must hold the
+// read lock.
+func (ls *INOLanguageServer) capabilities() *Capabilities {
+	caps := &Capabilities{
+		Version:       globals.VersionInfo.VersionString,
+		ClangdVersion: ls.clangdVersion,
+	}
+	add := func(name string, active bool, reason string) {
+		status := &SubsystemStatus{Name: name, Active: active}
+		if active == (name == "reducedFeatures") {
+			status.Reason = reason
+		}
+		caps.Subsystems = append(caps.Subsystems, status)
+	}
+
+	clangdReason := ls.startupFailure
+	if clangdReason == "" {
+		clangdReason = "clangd has not been started yet"
+	}
+	add("clangd", ls.Clangd != nil, clangdReason)
+
+	add("daemon", ls.config.CliDaemonAddress != "" || ls.config.cliCore != nil, "arduino-cli is run for each command")
+
+	add("backgroundIndex", ls.Clangd != nil, "clangd is not running")
+
+	add("compileOnSave", ls.config.RebuildPolicy != RebuildPolicyManual,
+		"the sketch is rebuilt only on request (-rebuild-policy manual)")
+
+	switch {
+	case ls.config.RebuildPolicy != RebuildPolicyAutomatic:
+		add("realTimeDiagnostics", false, fmt.Sprintf("the sketch is not rebuilt while editing (-rebuild-policy %s)", ls.config.RebuildPolicy))
+	case ls.config.DisableRealTimeDiagnostics:
+		add("realTimeDiagnostics", false, "disabled with -no-real-time-diagnostics")
+	case ls.reducedFeatures:
+		add("realTimeDiagnostics", false, "the sketch exceeds the limits of the language server")
+	default:
+		add("realTimeDiagnostics", true, "")
+	}
+
+	if ls.Clangd == nil {
+		add("inactiveRegions", false, "clangd is not running")
+	} else if major, err := parseClangdMajorVersion(ls.clangdVersion); err != nil {
+		add("inactiveRegions", false, err.Error())
+	} else {
+		add("inactiveRegions", major >= minimumInactiveRegionsClangdVersion,
+			fmt.Sprintf("clangd %d found, version %d or later is required", major, minimumInactiveRegionsClangdVersion))
+	}
+
+	reducedReason := ""
+	if ls.reducedFeatures && ls.sketchMapper != nil {
+		reducedReason = ls.sketchLimitsExceeded(len(ls.sketchMapper.CppText.Text))
+	}
+	add("reducedFeatures", ls.reducedFeatures, reducedReason)
+	return caps
+}
+
+// logCapabilities logs the state of the optional subsystems, the banner of the session
+func (ls *INOLanguageServer) logCapabilities(logger jsonrpc.FunctionLogger) {
+	ls.readLock(logger, false)
+	caps := ls.capabilities()
+	ls.readUnlock(logger)
+
+	logger.Logf("arduino-language-server %s, clangd: %s", caps.Version, caps.ClangdVersion)
+	for _, status := range caps.Subsystems {
+		state := "disabled"
+		if status.Active {
+			state = "enabled"
+		}
+		if status.Reason != "" {
+			logger.Logf("    %s: %s (%s)", status.Name, state, status.Reason)
+		} else {
+			logger.Logf("    %s: %s", status.Name, state)
+		}
+	}
+}
+
+// setStartupFailure records why the language server could not be started, it's reported
+// by the "arduino/capabilities" request.
+func (ls *INOLanguageServer) setStartupFailure(logger jsonrpc.FunctionLogger, reason string) {
+	ls.writeLock(logger, false)
+	ls.startupFailure = reason
+	ls.writeUnlock(logger)
+}
+
+// buildFailureReason describes the failure of the bootstrap build of the sketch
+func buildFailureReason(fqbn string, err error) string {
+	switch boardConfigurationErrorCode(err) {
+	case diagnosticCodeInvalidFqbn:
+		return fmt.Sprintf("the selected board (%s) is not valid", fqbn)
+	case diagnosticCodePlatformNotInstalled:
+		return fmt.Sprintf("the platform of the selected board (%s) is not installed", fqbn)
+	}
+	return fmt.Sprintf("building the sketch: %s", err)
+}
+
+func (ls *INOLanguageServer) capabilitiesReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*Capabilities, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+	caps := ls.capabilities()
+	logger.Logf("<-- capabilities(%d subsystems)", len(caps.Subsystems))
+	return caps, nil
+}
@@ -0,0 +1,69 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestCapabilities(t *testing.T) {
+	statuses := func(caps *Capabilities) map[string]*SubsystemStatus {
+		res := map[string]*SubsystemStatus{}
+		for _, status := range caps.Subsystems {
+			res[status.Name] = status
+		}
+		return res
+	}
+
+	ls := newTestSketchLanguageServer(t)
+	ls.config = &Config{RebuildPolicy: RebuildPolicyAutomatic}
+	ls.startupFailure = buildFailureReason("arduino:avr:uno", errors.New("Platform 'arduino:avr' not found"))
+	caps := statuses(ls.capabilities())
+	require.Equal(t, &SubsystemStatus{Name: "clangd", Reason: "the platform of the selected board (arduino:avr:uno) is not installed"}, caps["clangd"])
+	require.Equal(t, &SubsystemStatus{Name: "daemon", Reason: "arduino-cli is run for each command"}, caps["daemon"])
+	require.Equal(t, &SubsystemStatus{Name: "backgroundIndex", Reason: "clangd is not running"}, caps["backgroundIndex"])
+	require.Equal(t, &SubsystemStatus{Name: "compileOnSave", Active: true}, caps["compileOnSave"])
+	require.Equal(t, &SubsystemStatus{Name: "realTimeDiagnostics", Active: true}, caps["realTimeDiagnostics"])
+	require.Equal(t, &SubsystemStatus{Name: "reducedFeatures"}, caps["reducedFeatures"])
+
+	// clangd 16 is running on a large sketch, with the arduino-cli daemon
+	ls.startupFailure = ""
+	ls.Clangd = &clangdLSPClient{conn: lsp.NewClient(&bytes.Buffer{}, &bytes.Buffer{}, nil)}
+	ls.clangdVersion = "clangd version 16.0.2 (https://github.com/llvm/llvm-project)"
+	ls.config = &Config{RebuildPolicy: RebuildPolicyAutomatic, CliDaemonAddress: "127.0.0.1:50051", MaxGeneratedCppSize: 10}
+	ls.reducedFeatures = true
+	caps = statuses(ls.capabilities())
+	require.Equal(t, &SubsystemStatus{Name: "clangd", Active: true}, caps["clangd"])
+	require.Equal(t, &SubsystemStatus{Name: "daemon", Active: true}, caps["daemon"])
+	require.Equal(t, &SubsystemStatus{Name: "backgroundIndex", Active: true}, caps["backgroundIndex"])
+	require.Equal(t, &SubsystemStatus{Name: "realTimeDiagnostics", Reason: "the sketch exceeds the limits of the language server"}, caps["realTimeDiagnostics"])
+	require.Equal(t, &SubsystemStatus{Name: "inactiveRegions", Reason: "clangd 16 found, version 17 or later is required"}, caps["inactiveRegions"])
+	require.Equal(t, &SubsystemStatus{Name: "reducedFeatures", Active: true, Reason: "the preprocessed sketch is 0 KiB, the limit is 0 KiB"}, caps["reducedFeatures"])
+
+	// The sketch is rebuilt only on request
+	ls.config = &Config{RebuildPolicy: RebuildPolicyManual}
+	ls.reducedFeatures = false
+	ls.clangdVersion = "clangd version 18.1.3"
+	caps = statuses(ls.capabilities())
+	require.Equal(t, &SubsystemStatus{Name: "compileOnSave", Reason: "the sketch is rebuilt only on request (-rebuild-policy manual)"}, caps["compileOnSave"])
+	require.Equal(t, &SubsystemStatus{Name: "realTimeDiagnostics", Reason: "the sketch is not rebuilt while editing (-rebuild-policy manual)"}, caps["realTimeDiagnostics"])
+	require.Equal(t, &SubsystemStatus{Name: "inactiveRegions", Active: true}, caps["inactiveRegions"])
+}
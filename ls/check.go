@@ -0,0 +1,182 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// minimumClangdVersion is the oldest major version of clangd supported, the one
+// bundled with the Arduino IDE 2.
+const minimumClangdVersion = 14
+
+// CheckResult is the outcome of one of the checks run by CheckEnvironment
+type CheckResult struct {
+	// Name identifies the check: arduino-cli, platform, clangd or build
+	Name string `json:"name"`
+	// Success is true if the check passed
+	Success bool `json:"success"`
+	// Message describes the result of the check
+	Message string `json:"message"`
+}
+
+// CheckReport is the result of CheckEnvironment
+type CheckReport struct {
+	// Success is true if all the checks passed
+	Success bool `json:"success"`
+	// Checks are the results of the single checks, in the order they are run
+	Checks []*CheckResult `json:"checks"`
+}
+
+func (r *CheckReport) add(name string, err error, message string) bool {
+	res := &CheckResult{Name: name, Success: err == nil, Message: message}
+	if err != nil {
+		res.Message = err.Error()
+		r.Success = false
+	}
+	r.Checks = append(r.Checks, res)
+	return res.Success
+}
+
+func (r *CheckReport) skip(name, reason string) {
+	r.Checks = append(r.Checks, &CheckResult{Name: name, Message: "skipped: " + reason})
+	r.Success = false
+}
+
+// CheckEnvironment validates, without starting a language server session, the environment
+// required to serve the given sketch with the given configuration: arduino-cli is reachable,
+// the platform of the board is installed, clangd is recent enough and the build environment
+// of the sketch can be generated.
+func CheckEnvironment(config *Config, sketchRoot *paths.Path) *CheckReport {
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "CHECK: ")
+	report := &CheckReport{Success: true}
+
+	tempDir, err := paths.MkTempDir(config.TempRoot().String(), "arduino-language-server-check")
+	if err != nil {
+		report.add("build", fmt.Errorf("could not create temp folder: %w", err), "")
+		return report
+	}
+	defer tempDir.RemoveAll()
+	ls := &INOLanguageServer{
+		config:         config,
+		tempDir:        tempDir,
+		sketchRoot:     sketchRoot,
+		buildPath:      tempDir.Join("build"),
+		fullBuildPath:  tempDir.Join("fullbuild"),
+		trackedIdeDocs: map[string]lsp.TextDocumentItem{},
+	}
+	defer ls.closeArduinoCLIDaemonConnection()
+	if err := ls.buildPath.MkdirAll(); err != nil {
+		report.add("build", fmt.Errorf("could not create build folder: %w", err), "")
+		return report
+	}
+	if err := ls.fullBuildPath.MkdirAll(); err != nil {
+		report.add("build", fmt.Errorf("could not create full-build folder: %w", err), "")
+		return report
+	}
+	ctx := context.Background()
+
+	var dataFolder *paths.Path
+	if config.CliPath == nil && config.CliDaemonAddress == "" && config.cliCore == nil {
+		err = fmt.Errorf("arduino-cli not found")
+	} else if config.CliPath != nil && config.CliConfigPath == nil {
+		err = fmt.Errorf("arduino-cli config file not found")
+	} else {
+		dataFolder, err = ls.extractDataFolderFromArduinoCLI(logger)
+	}
+	cliOk := report.add("arduino-cli", err, fmt.Sprintf("data folder: %s", dataFolder))
+
+	platformOk := false
+	if cliOk {
+		platformOk = report.add("platform", ls.checkBoardDetails(ctx, logger), fmt.Sprintf("board %s installed", config.Fqbn))
+	} else {
+		report.skip("platform", "arduino-cli not reachable")
+	}
+
+	version, err := ls.clangdMajorVersion(ctx, logger)
+	if err == nil && version < minimumClangdVersion {
+		err = fmt.Errorf("clangd %d found, version %d or later is required", version, minimumClangdVersion)
+	}
+	report.add("clangd", err, fmt.Sprintf("clangd %d", version))
+
+	if platformOk {
+		success, err := ls.generateBuildEnvironment(ctx, true, logger, newRebuildTimings("check"))
+		if err == nil && !success {
+			err = fmt.Errorf("build failed")
+		}
+		report.add("build", err, "build environment generated")
+	} else {
+		report.skip("build", "board platform not available")
+	}
+	return report
+}
+
+// checkBoardDetails returns an error if the details of the configured board can't be
+// retrieved, usually because the platform is not installed or the FQBN is not valid.
+func (ls *INOLanguageServer) checkBoardDetails(ctx context.Context, logger jsonrpc.FunctionLogger) error {
+	if ls.config.CliPath == nil {
+		client, err := ls.arduinoCLIDaemonClient(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = client.BoardDetails(ctx, &rpc.BoardDetailsRequest{
+			Instance: &rpc.Instance{Id: int32(ls.config.CliInstanceNumber)},
+			Fqbn:     ls.config.Fqbn,
+		})
+		return err
+	}
+	_, err := ls.runArduinoCLI(ctx, logger, "board", "details", "--fqbn", ls.config.Fqbn, "--format", "json")
+	return err
+}
+
+var clangdVersionRegexp = regexp.MustCompile(`clangd version (\d+)\.`)
+
+// clangdMajorVersion runs "clangd --version" and returns the major version of clangd
+func (ls *INOLanguageServer) clangdMajorVersion(ctx context.Context, logger jsonrpc.FunctionLogger) (int, error) {
+	if ls.config.ClangdPath == nil {
+		return 0, fmt.Errorf("clangd not found")
+	}
+	cmd, err := paths.NewProcessFromPath(ls.toolsEnv(), ls.config.ClangdPath, "--version")
+	if err != nil {
+		return 0, fmt.Errorf("running clangd: %w", err)
+	}
+	cmdOutput := &bytes.Buffer{}
+	cmd.RedirectStdoutTo(cmdOutput)
+	logger.Logf("running: %s --version", ls.config.ClangdPath)
+	if err := cmd.RunWithinContext(ctx); err != nil {
+		return 0, fmt.Errorf("running clangd: %w", err)
+	}
+	return parseClangdMajorVersion(cmdOutput.String())
+}
+
+// parseClangdMajorVersion returns the major version from the output of "clangd --version"
+func parseClangdMajorVersion(output string) (int, error) {
+	match := clangdVersionRegexp.FindStringSubmatch(output)
+	if match == nil {
+		return 0, fmt.Errorf("unknown clangd version: %s", output)
+	}
+	return strconv.Atoi(match[1])
+}
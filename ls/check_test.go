@@ -0,0 +1,86 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClangdMajorVersion(t *testing.T) {
+	version, err := parseClangdMajorVersion("clangd version 14.0.0\nFeatures: linux+grpc\nPlatform: x86_64-unknown-linux-gnu\n")
+	require.NoError(t, err)
+	require.Equal(t, 14, version)
+
+	version, err = parseClangdMajorVersion("Ubuntu clangd version 12.0.1-19ubuntu3\n")
+	require.NoError(t, err)
+	require.Equal(t, 12, version)
+
+	_, err = parseClangdMajorVersion("clang version 14.0.0\n")
+	require.Error(t, err)
+}
+
+// fakeArduinoCLI answers the commands run by CheckEnvironment as arduino-cli would do for a
+// sketch that builds successfully.
+const fakeArduinoCLI = `#!/bin/sh
+case "$*" in
+*"config get directories.data"*)
+	echo '"/tmp/arduino-data"' ;;
+*"board details"*)
+	echo '{}' ;;
+*compile*)
+	while [ "$1" != "--build-path" ]; do shift; done
+	mkdir -p "$2"
+	echo '[]' > "$2/compile_commands.json"
+	echo '{"success":true}' ;;
+*)
+	exit 1 ;;
+esac
+`
+
+func TestCheckEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake arduino-cli is a shell script")
+	}
+	tmp := paths.New(t.TempDir())
+	cli := tmp.Join("arduino-cli")
+	require.NoError(t, cli.WriteFile([]byte(fakeArduinoCLI)))
+	require.NoError(t, cli.Chmod(0755))
+	clangd := tmp.Join("clangd")
+	require.NoError(t, clangd.WriteFile([]byte("#!/bin/sh\necho 'clangd version 14.0.0'\n")))
+	require.NoError(t, clangd.Chmod(0755))
+	cliConfig := tmp.Join("arduino-cli.yaml")
+	require.NoError(t, cliConfig.WriteFile(nil))
+	sketchRoot := tmp.Join("Sketch")
+	require.NoError(t, sketchRoot.MkdirAll())
+	require.NoError(t, sketchRoot.Join("Sketch.ino").WriteFile([]byte("void setup() {}\nvoid loop() {}\n")))
+
+	// The build check runs without an IDE, so without a progress handler
+	report := CheckEnvironment(&Config{
+		CliPath:       cli,
+		CliConfigPath: cliConfig,
+		ClangdPath:    clangd,
+		Fqbn:          "arduino:avr:uno",
+	}, sketchRoot)
+	for _, check := range report.Checks {
+		require.True(t, check.Success, "%s: %s", check.Name, check.Message)
+	}
+	require.True(t, report.Success)
+	require.Len(t, report.Checks, 4)
+}
@@ -0,0 +1,128 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/arduino/arduino-language-server/streams"
+	"github.com/fatih/color"
+)
+
+// ClangdLogLevel is the verbosity of clangd, the minimum level of the log messages it prints
+type ClangdLogLevel string
+
+const (
+	// ClangdLogLevelVerbose keeps all the clangd log messages
+	ClangdLogLevelVerbose ClangdLogLevel = "verbose"
+	// ClangdLogLevelInfo keeps the informational and error messages
+	ClangdLogLevelInfo ClangdLogLevel = "info"
+	// ClangdLogLevelError keeps only the error messages
+	ClangdLogLevelError ClangdLogLevel = "error"
+)
+
+// clangdLogLevel returns the verbosity of clangd: the configured one or, by default,
+// verbose if logging is enabled and error otherwise (verbose logging slows down clangd).
+func (ls *INOLanguageServer) clangdLogLevel() ClangdLogLevel {
+	if ls.config.ClangdLogLevel != "" {
+		return ls.config.ClangdLogLevel
+	}
+	if ls.config.EnableLogging {
+		return ClangdLogLevelVerbose
+	}
+	return ClangdLogLevelError
+}
+
+// severity returns a number that grows with the importance of the level
+func (l ClangdLogLevel) severity() int {
+	switch l {
+	case ClangdLogLevelError:
+		return 2
+	case ClangdLogLevelInfo:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// clangdLogLineLevel returns the level of a clangd log line, in the form
+// "E[12:34:56.789] message". The second result is false if the line has no
+// level prefix (for example the continuation of a multi-line message).
+func clangdLogLineLevel(line string) (ClangdLogLevel, bool) {
+	if len(line) < 2 || line[1] != '[' {
+		return "", false
+	}
+	switch line[0] {
+	case 'E':
+		return ClangdLogLevelError, true
+	case 'I':
+		return ClangdLogLevelInfo, true
+	case 'V', 'D':
+		return ClangdLogLevelVerbose, true
+	}
+	return "", false
+}
+
+// forwardClangdStderr copies the clangd log messages, with at least the clangd log level,
+// to the language server log (if ClangdStderrToLog is set) or to the clangd log file (if
+// logging is enabled) or to the language server stderr.
+func (ls *INOLanguageServer) forwardClangdStderr(clangdStderr io.Reader) {
+	minLevel := ls.clangdLogLevel()
+	var output func(level ClangdLogLevel, line string)
+	if ls.config.ClangdStderrToLog {
+		loggers := map[ClangdLogLevel]*FunctionLogger{
+			ClangdLogLevelError:   NewLSPFunctionLogger(color.HiRedString, "CLANGD E"),
+			ClangdLogLevelInfo:    NewLSPFunctionLogger(color.WhiteString, "CLANGD I"),
+			ClangdLogLevelVerbose: NewLSPFunctionLogger(color.HiBlackString, "CLANGD V"),
+		}
+		output = func(level ClangdLogLevel, line string) {
+			loggers[level].Logf("%s", line)
+		}
+	} else {
+		var out io.Writer = os.Stderr
+		if ls.config.EnableLogging {
+			out = streams.OpenLogFileAs("inols-clangd-err.log")
+		}
+		output = func(level ClangdLogLevel, line string) {
+			fmt.Fprintln(out, line)
+		}
+	}
+
+	filterClangdLog(clangdStderr, minLevel, output)
+	// Drain the remaining output to not block clangd
+	_, _ = io.Copy(io.Discard, clangdStderr)
+}
+
+// filterClangdLog reads the clangd log lines and sends to output the ones with at least
+// the given level. The lines without a level prefix (the continuation of multi-line
+// messages) take the level of the message they belong to.
+func filterClangdLog(clangdStderr io.Reader, minLevel ClangdLogLevel, output func(level ClangdLogLevel, line string)) {
+	scanner := bufio.NewScanner(clangdStderr)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	level := ClangdLogLevelVerbose
+	for scanner.Scan() {
+		line := scanner.Text()
+		if lineLevel, ok := clangdLogLineLevel(line); ok {
+			level = lineLevel
+		}
+		if level.severity() >= minLevel.severity() {
+			output(level, line)
+		}
+	}
+}
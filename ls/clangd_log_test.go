@@ -0,0 +1,94 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClangdLogLineLevel(t *testing.T) {
+	tests := []struct {
+		line     string
+		level    ClangdLogLevel
+		hasLevel bool
+	}{
+		{"E[12:34:56.789] Failed to prepare a compiler instance", ClangdLogLevelError, true},
+		{"I[12:34:56.789] --> textDocument/hover(3)", ClangdLogLevelInfo, true},
+		{"V[12:34:56.789] <<< {\"id\":3}", ClangdLogLevelVerbose, true},
+		{"D[12:34:56.789] debug message", ClangdLogLevelVerbose, true},
+		{"W[12:34:56.789] unknown level", "", false},
+		{"  \"jsonrpc\": \"2.0\",", "", false},
+		{"clangd version 14.0.0", "", false},
+		{"E", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		level, ok := clangdLogLineLevel(test.line)
+		require.Equal(t, test.hasLevel, ok, test.line)
+		require.Equal(t, test.level, level, test.line)
+	}
+}
+
+func TestFilterClangdLog(t *testing.T) {
+	clangdLog := strings.Join([]string{
+		"clangd version 14.0.0",
+		"I[12:34:56.789] <-- textDocument/hover(3)",
+		"V[12:34:56.790] >>> {",
+		"  \"id\": 3",
+		"}",
+		"E[12:34:56.791] Failed to prepare a compiler instance:",
+		"  unknown argument '-mmcu=atmega328p'",
+		"I[12:34:56.792] --> reply:textDocument/hover(3)",
+	}, "\n")
+
+	tests := []struct {
+		minLevel ClangdLogLevel
+		expected []string
+	}{
+		{ClangdLogLevelVerbose, []string{
+			"V clangd version 14.0.0",
+			"I I[12:34:56.789] <-- textDocument/hover(3)",
+			"V V[12:34:56.790] >>> {",
+			"V   \"id\": 3",
+			"V }",
+			"E E[12:34:56.791] Failed to prepare a compiler instance:",
+			"E   unknown argument '-mmcu=atmega328p'",
+			"I I[12:34:56.792] --> reply:textDocument/hover(3)",
+		}},
+		{ClangdLogLevelInfo, []string{
+			"I I[12:34:56.789] <-- textDocument/hover(3)",
+			"E E[12:34:56.791] Failed to prepare a compiler instance:",
+			"E   unknown argument '-mmcu=atmega328p'",
+			"I I[12:34:56.792] --> reply:textDocument/hover(3)",
+		}},
+		{ClangdLogLevelError, []string{
+			"E E[12:34:56.791] Failed to prepare a compiler instance:",
+			"E   unknown argument '-mmcu=atmega328p'",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.minLevel), func(t *testing.T) {
+			var res []string
+			filterClangdLog(strings.NewReader(clangdLog), test.minLevel, func(level ClangdLogLevel, line string) {
+				res = append(res, strings.ToUpper(string(level[0]))+" "+line)
+			})
+			require.Equal(t, test.expected, res)
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"strings"
+
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// sendClangdRequest runs a request to clangd about the given document. If clangd
+// lost track of the document (it answers with a "non-added document" error) the
+// document is opened again in clangd and the request is retried once; if it still
+// fails clangd is restarted in background with a clean build.
+// The caller must hold a clangd slot (see acquireClangdSlot) and the read-lock.
+func (ls *INOLanguageServer) sendClangdRequest(logger jsonrpc.FunctionLogger, clangURI lsp.DocumentURI, request func() (*jsonrpc.ResponseError, error)) (*jsonrpc.ResponseError, error) {
+	clangErr, err := request()
+	if err != nil || !isNonAddedDocumentError(clangErr) {
+		return clangErr, err
+	}
+
+	logger.Logf("clangd lost track of %s, sending it again", clangURI)
+	if err := ls.resyncClangdDocument(logger, clangURI); err != nil {
+		logger.Logf("Error sending %s again, restarting clangd: %s", clangURI, err)
+		ls.cleanBuildInBackground()
+		return responseError(err), nil
+	}
+
+	clangErr, err = request()
+	if err == nil && isNonAddedDocumentError(clangErr) {
+		logger.Logf("clangd could not resync %s, restarting clangd", clangURI)
+		ls.cleanBuildInBackground()
+	}
+	return clangErr, err
+}
+
+// acquireClangdSlot waits for a free slot to send a request to clangd and returns the
+// function to release it. It must be called before taking the read-lock, otherwise the
+// writers would be blocked while waiting. If the IDE cancels the request while waiting,
+// the RequestCancelled error to reply to the IDE is returned.
+func (ls *INOLanguageServer) acquireClangdSlot(ctx context.Context, logger jsonrpc.FunctionLogger) (func(), *jsonrpc.ResponseError) {
+	release, err := ls.clangdRequests.Acquire(ctx)
+	if err != nil {
+		logger.Logf("Request canceled while waiting for clangd: %s", err)
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesRequestCancelled, Message: err.Error()}
+	}
+	return release, nil
+}
+
+// isNonAddedDocumentError returns true if clangd does not know the document of the request,
+// clangd replies with an InvalidParams error like "trying to get AST for non-added document".
+func isNonAddedDocumentError(clangErr *jsonrpc.ResponseError) bool {
+	return clangErr != nil && clangErr.Code == jsonrpc.ErrorCodesInvalidParams && strings.Contains(clangErr.Message, "non-added")
+}
+
+// resyncClangdDocument opens again in clangd the given document, with the content
+// currently tracked by the language server.
+func (ls *INOLanguageServer) resyncClangdDocument(logger jsonrpc.FunctionLogger, clangURI lsp.DocumentURI) error {
+	if ls.clangURIRefersToIno(clangURI) {
+		// The content of the preprocessed sketch is taken from the mapper
+		return ls.clangdDidOpen(logger, clangURI, lsp.TextDocumentItem{})
+	}
+
+	ideURI, err := ls.clang2IdeDocumentURI(logger, clangURI)
+	if err != nil {
+		return err
+	}
+	ideDoc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]
+	if !ok {
+		return &UnknownURIError{ideURI}
+	}
+	return ls.Clangd.conn.TextDocumentDidOpen(&lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{
+			URI:        clangURI,
+			LanguageID: ideDoc.LanguageID,
+			Version:    ideDoc.Version,
+			Text:       ideDoc.Text,
+		},
+	})
+}
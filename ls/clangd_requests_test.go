@@ -0,0 +1,44 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+func TestIsNonAddedDocumentError(t *testing.T) {
+	tests := []struct {
+		name     string
+		clangErr *jsonrpc.ResponseError
+		expected bool
+	}{
+		// The messages sent by clangd when a request refers to a document not opened
+		{"AST", &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: "trying to get AST for non-added document"}, true},
+		{"Preamble", &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: "trying to get preamble for non-added document"}, true},
+		{"CodeAction", &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: "onCodeAction called for non-added file"}, true},
+		{"OtherCode", &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: "trying to get AST for non-added document"}, false},
+		{"OtherMessage", &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: "invalid position"}, false},
+		{"NoError", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, isNonAddedDocumentError(test.clangErr))
+		})
+	}
+}
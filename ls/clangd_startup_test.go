@@ -0,0 +1,55 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestStartClangdTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake clangd is a shell script")
+	}
+	ls := newTestSketchLanguageServer(t)
+	require.NoError(t, ls.buildPath.MkdirAll())
+
+	// The fake clangd never replies to the initialize request
+	starts := ls.buildPath.Join("starts")
+	clangd := ls.buildPath.Join("clangd")
+	require.NoError(t, clangd.WriteFile([]byte("#!/bin/sh\necho started >> "+starts.String()+"\nexec cat > /dev/null\n")))
+	require.NoError(t, clangd.Chmod(0755))
+	ls.config = &Config{ClangdPath: clangd, ClangdInitTimeout: 100 * time.Millisecond}
+	ls.ideInitializeParams = &lsp.InitializeParams{}
+
+	start := time.Now()
+	err := ls.startClangd(NewLSPFunctionLogger(color.HiWhiteString, "TEST"), paths.New("data"))
+	require.Error(t, err)
+	require.Less(t, time.Since(start), defaultClangdInitTimeout)
+	require.Nil(t, ls.Clangd)
+
+	// The initialization has been retried once, with another clangd process
+	data, err := starts.ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(data), "started"))
+}
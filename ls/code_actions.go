@@ -0,0 +1,205 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// arduinoAPIIdentifiers are the identifiers of the Arduino core API that are
+// suggested as replacement for misspelled identifiers.
+var arduinoAPIIdentifiers = []string{
+	// Digital and analog I/O
+	"pinMode", "digitalWrite", "digitalRead",
+	"analogRead", "analogWrite", "analogReference", "analogReadResolution", "analogWriteResolution",
+	// Advanced I/O
+	"tone", "noTone", "pulseIn", "pulseInLong", "shiftIn", "shiftOut",
+	// Time
+	"delay", "delayMicroseconds", "millis", "micros",
+	// Math
+	"abs", "constrain", "map", "max", "min", "pow", "sq", "sqrt",
+	// Random numbers
+	"random", "randomSeed",
+	// Bits and bytes
+	"bit", "bitClear", "bitRead", "bitSet", "bitWrite", "highByte", "lowByte",
+	// Interrupts
+	"attachInterrupt", "detachInterrupt", "digitalPinToInterrupt", "interrupts", "noInterrupts",
+	// Characters
+	"isAlpha", "isAlphaNumeric", "isAscii", "isControl", "isDigit", "isGraph", "isHexadecimalDigit",
+	"isLowerCase", "isPrintable", "isPunct", "isSpace", "isUpperCase", "isWhitespace",
+	// Constants
+	"HIGH", "LOW", "INPUT", "INPUT_PULLUP", "OUTPUT", "LED_BUILTIN",
+	// Communication
+	"Serial",
+}
+
+var undeclaredIdentifierRegexp = regexp.MustCompile(`use of undeclared identifier '([^']+)'`)
+
+// arduinoQuickFixes returns the quick-fixes synthesized by the language server for the
+// given IDE diagnostics, in addition to the code actions provided by clangd.
+func (ls *INOLanguageServer) arduinoQuickFixes(logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI, ideDiagnostics []lsp.Diagnostic) []lsp.CommandOrCodeAction {
+	res := []lsp.CommandOrCodeAction{}
+	for _, ideDiag := range ideDiagnostics {
+		var code string
+		_ = json.Unmarshal(ideDiag.Code, &code)
+		if code == diagnosticCodeMissingSetup || code == diagnosticCodeMissingLoop {
+			if codeAction, ok := ls.insertSketchSkeletonQuickFix(logger, ideURI, ideDiag, code); ok {
+				item := lsp.CommandOrCodeAction{}
+				item.Set(codeAction)
+				res = append(res, item)
+			}
+			continue
+		}
+		if code == diagnosticCodeMisnamedMainFile {
+			item := lsp.CommandOrCodeAction{}
+			item.Set(ls.renameMainFileQuickFix(ideURI, ideDiag))
+			res = append(res, item)
+			continue
+		}
+		if code == diagnosticCodeFlashString {
+			item := lsp.CommandOrCodeAction{}
+			item.Set(wrapWithFlashStringQuickFix(ideURI, ideDiag))
+			res = append(res, item)
+			continue
+		}
+		if code != "undeclared_var_use" && code != "undeclared_var_use_suggest" {
+			continue
+		}
+		match := undeclaredIdentifierRegexp.FindStringSubmatch(ideDiag.Message)
+		if match == nil {
+			continue
+		}
+		suggestion, ok := closestArduinoAPIIdentifier(match[1])
+		if !ok {
+			continue
+		}
+		logger.Logf("        > Arduino quick-fix: %s -> %s", match[1], suggestion)
+
+		codeAction := lsp.CodeAction{
+			Title:       fmt.Sprintf("Change '%s' to '%s'", match[1], suggestion),
+			Kind:        lsp.CodeActionKindQuickFix,
+			Diagnostics: []lsp.Diagnostic{ideDiag},
+			Edit: &lsp.WorkspaceEdit{
+				Changes: map[lsp.DocumentURI][]lsp.TextEdit{
+					ideURI: {{Range: ideDiag.Range, NewText: suggestion}},
+				},
+			},
+		}
+		item := lsp.CommandOrCodeAction{}
+		item.Set(codeAction)
+		res = append(res, item)
+	}
+	return res
+}
+
+// insertSketchSkeletonQuickFix returns a code action that appends the missing setup()
+// or loop() function at the end of the given .ino file.
+func (ls *INOLanguageServer) insertSketchSkeletonQuickFix(logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI, ideDiag lsp.Diagnostic, code string) (lsp.CodeAction, bool) {
+	var text string
+	if doc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]; ok {
+		text = doc.Text
+	} else if data, err := ideURI.AsPath().ReadFile(); err == nil {
+		text = textutils.StripBOM(string(data))
+	} else {
+		logger.Logf("Error reading %s: %s", ideURI, err)
+		return lsp.CodeAction{}, false
+	}
+
+	var title, skeleton string
+	if code == diagnosticCodeMissingSetup {
+		title = "Add setup() function"
+		skeleton = "void setup() {\n  // put your setup code here, to run once:\n\n}\n"
+	} else {
+		title = "Add loop() function"
+		skeleton = "void loop() {\n  // put your main code here, to run repeatedly:\n\n}\n"
+	}
+
+	// Append the skeleton after the last line of the file
+	lines := textutils.SplitLines(text)
+	lastLine := len(lines) - 1
+	lastLineText := lines[lastLine]
+	end := lsp.Position{Line: lastLine, Character: len(utf16.Encode([]rune(lastLineText)))}
+	if lastLineText != "" {
+		skeleton = "\n\n" + skeleton
+	} else {
+		skeleton = "\n" + skeleton
+	}
+
+	return lsp.CodeAction{
+		Title:       title,
+		Kind:        lsp.CodeActionKindQuickFix,
+		Diagnostics: []lsp.Diagnostic{ideDiag},
+		Edit: &lsp.WorkspaceEdit{
+			Changes: map[lsp.DocumentURI][]lsp.TextEdit{
+				ideURI: {{Range: lsp.Range{Start: end, End: end}, NewText: skeleton}},
+			},
+		},
+	}, true
+}
+
+// closestArduinoAPIIdentifier returns the Arduino API identifier that is the closest match
+// to the given (misspelled) identifier, if any is close enough.
+func closestArduinoAPIIdentifier(identifier string) (string, bool) {
+	// Allow one typo every four characters, at most two
+	maxDistance := len(identifier) / 4
+	if maxDistance > 2 {
+		maxDistance = 2
+	}
+
+	best, bestDistance := "", maxDistance+1
+	for _, candidate := range arduinoAPIIdentifiers {
+		if candidate == identifier {
+			// The identifier is correct, the problem is elsewhere (e.g. a missing include)
+			return "", false
+		}
+		if strings.EqualFold(candidate, identifier) {
+			return candidate, true
+		}
+		if d := editDistance(candidate, identifier); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best, best != ""
+}
+
+// editDistance computes the Levenshtein distance between the two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,76 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"delay", "delay", 0},
+		{"delay", "dealy", 2},
+		{"millis", "milis", 1},
+		{"digitalWrite", "digitalWrit", 1},
+		{"digitalWrite", "digitalRead", 5},
+		{"kitten", "sitting", 3},
+	}
+	for _, test := range tests {
+		t.Run(test.a+"/"+test.b, func(t *testing.T) {
+			require.Equal(t, test.expected, editDistance(test.a, test.b))
+			require.Equal(t, test.expected, editDistance(test.b, test.a))
+		})
+	}
+}
+
+func TestClosestArduinoAPIIdentifier(t *testing.T) {
+	tests := []struct {
+		identifier string
+		expected   string
+	}{
+		// Misspellings within the allowed distance
+		{"digitalWrit", "digitalWrite"},
+		{"digitalwrite", "digitalWrite"},
+		{"pinmode", "pinMode"},
+		{"milis", "millis"},
+		{"Seral", "Serial"},
+		{"delayMicrosecond", "delayMicroseconds"},
+		// Correct identifiers are not replaced
+		{"digitalWrite", ""},
+		{"Serial", ""},
+		// Short identifiers only match ignoring the case
+		{"Map", "map"},
+		{"mpa", ""},
+		// Too far from any Arduino API identifier
+		{"myCounter", ""},
+		{"dgtlWrt", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.identifier, func(t *testing.T) {
+			suggestion, ok := closestArduinoAPIIdentifier(test.identifier)
+			require.Equal(t, test.expected, suggestion)
+			require.Equal(t, test.expected != "", ok)
+		})
+	}
+}
@@ -0,0 +1,367 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/arduino/arduino-language-server/streams"
+	"github.com/fatih/color"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// The commands implemented by the language server itself (the other commands are
+// provided by clangd).
+const (
+	cleanBuildCommand           = "arduino/cleanBuild"
+	rebuildCommand              = "arduino/rebuild"
+	openLibraryExampleCommand   = "arduino/openLibraryExample"
+	showSketchSizeCommand       = "arduino/showSketchSize"
+	removeStaleTempFilesCommand = "arduino/removeStaleTempFiles"
+	reloadSettingsCommand       = "arduino/reloadSettings"
+	getSketchSettingsCommand    = "arduino/getSketchSettings"
+	updateSketchSettingsCommand = "arduino/updateSketchSettings"
+	listCompileTargetsCommand   = "arduino/listCompileTargets"
+	selectCompileTargetCommand  = "arduino/selectCompileTarget"
+	exportReproBundleCommand    = "arduino/exportReproBundle"
+	exportDiagnosticsCommand    = "arduino/exportDiagnostics"
+	setLogLevelCommand          = "arduino/setLogLevel"
+	renameMainFileCommand       = "arduino/renameMainFile"
+	clangdApplyTweakCommand     = "clangd.applyTweak"
+)
+
+// serverCommands is the list of commands advertised through the ExecuteCommandProvider capability
+var serverCommands = []string{
+	clangdApplyTweakCommand,
+	cleanBuildCommand,
+	rebuildCommand,
+	openLibraryExampleCommand,
+	showSketchSizeCommand,
+	removeStaleTempFilesCommand,
+	reloadSettingsCommand,
+	getSketchSettingsCommand,
+	updateSketchSettingsCommand,
+	listCompileTargetsCommand,
+	selectCompileTargetCommand,
+	exportReproBundleCommand,
+	exportDiagnosticsCommand,
+	setLogLevelCommand,
+	renameMainFileCommand,
+}
+
+func (ls *INOLanguageServer) workspaceExecuteCommandReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.ExecuteCommandParams) (json.RawMessage, *jsonrpc.ResponseError) {
+	logger.Logf("--> executeCommand(%s)", ideParams.Command)
+	switch ideParams.Command {
+	case cleanBuildCommand:
+		// The clean build takes a while: it runs in background and reports its progress
+		ls.cleanBuildInBackground()
+		return nil, nil
+	case rebuildCommand:
+		ls.sketchRebuilder.ForgetLastBuild()
+		ls.triggerRebuild()
+		return nil, nil
+	case openLibraryExampleCommand:
+		res, err := ls.openLibraryExample(ctx, logger, ideParams.Arguments)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+		return res, nil
+	case showSketchSizeCommand:
+		if err := ls.showSketchSize(logger); err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, responseError(err)
+		}
+		return nil, nil
+	case removeStaleTempFilesCommand:
+		res, err := ls.removeStaleTempFiles(logger)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, responseError(err)
+		}
+		return res, nil
+	case reloadSettingsCommand:
+		res, err := ls.reloadSettings(logger)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, responseError(err)
+		}
+		return lsp.EncodeMessage(res), nil
+	case getSketchSettingsCommand:
+		return lsp.EncodeMessage(ls.getSketchSettings(logger)), nil
+	case updateSketchSettingsCommand:
+		update, err := parseSketchSettingsUpdate(ideParams.Arguments)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+		res, err := ls.updateSketchSettings(logger, update)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, responseError(err)
+		}
+		return lsp.EncodeMessage(res), nil
+	case listCompileTargetsCommand:
+		return lsp.EncodeMessage(ls.listCompileTargets(logger)), nil
+	case selectCompileTargetCommand:
+		if err := ls.selectCompileTarget(logger, ideParams.Arguments); err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+		return nil, nil
+	case exportReproBundleCommand:
+		output, err := parseReproBundleOutput(ideParams.Arguments)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+		if err := ls.exportReproBundle(logger, output); err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, responseError(err)
+		}
+		return lsp.EncodeMessage(output.String()), nil
+	case exportDiagnosticsCommand:
+		output, err := parseExportDiagnosticsOutput(ideParams.Arguments)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+		report, err := ls.exportDiagnostics(logger, output)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, responseError(err)
+		}
+		return lsp.EncodeMessage(report), nil
+	case setLogLevelCommand:
+		previous, err := ls.setLogLevel(logger, ideParams.Arguments)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+		return lsp.EncodeMessage(previous), nil
+	case renameMainFileCommand:
+		mainFileURI, err := ls.renameMainFile(logger, ideParams.Arguments)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+		return lsp.EncodeMessage(mainFileURI), nil
+	case clangdApplyTweakCommand:
+		clangParams, err := ls.ide2ClangApplyTweakParams(logger, ideParams)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+		// clangd applies the tweak by sending back a workspace/applyEdit request, that is
+		// forwarded to the IDE: the command must not block the processing of the IDE messages.
+		go func() {
+			defer streams.CatchAndLogPanic()
+			logger := NewLSPFunctionLogger(color.HiRedString, "APPLY TWEAK --- ")
+			ls.readLock(logger, false)
+			clangd := ls.Clangd
+			ls.readUnlock(logger)
+			if clangd == nil {
+				logger.Logf("Error: clangd is not running")
+				return
+			}
+			if _, clangErr, err := clangd.conn.WorkspaceExecuteCommand(context.Background(), clangParams); err != nil {
+				logger.Logf("Error: %s", err)
+			} else if clangErr != nil {
+				logger.Logf("clangd error: %s", clangErr.AsError())
+			}
+		}()
+		return nil, nil
+	default:
+		err := fmt.Errorf("unsupported command: %s", ideParams.Command)
+		logger.Logf("Error: %s", err)
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+}
+
+// ide2ClangApplyTweakParams converts the arguments of a clangd.applyTweak command, previously
+// converted by clang2IdeCommand, back to the preprocessed sketch.
+func (ls *INOLanguageServer) ide2ClangApplyTweakParams(logger jsonrpc.FunctionLogger, ideParams *lsp.ExecuteCommandParams) (*lsp.ExecuteCommandParams, error) {
+	ls.readLock(logger, true)
+	defer ls.readUnlock(logger)
+
+	clangArguments := []interface{}{}
+	for _, ideArgument := range ideParams.Arguments {
+		data, err := json.Marshal(ideArgument)
+		if err != nil {
+			return nil, err
+		}
+		var tweak struct {
+			TweakID   string          `json:"tweakID"`
+			File      lsp.DocumentURI `json:"file"`
+			Selection lsp.Range       `json:"selection"`
+		}
+		if err := json.Unmarshal(data, &tweak); err != nil {
+			return nil, fmt.Errorf("invalid tweak argument: %w", err)
+		}
+		if tweak.File.Ext() == ".ino" {
+			clangSelection, ok := ls.sketchMapper.InoToCppLSPRangeOk(tweak.File, tweak.Selection)
+			if !ok {
+				return nil, fmt.Errorf("invalid tweak selection %s:%s", tweak.File, tweak.Selection)
+			}
+			tweak.File = lsp.NewDocumentURIFromPath(ls.buildSketchCpp)
+			tweak.Selection = clangSelection
+		} else if inside, _ := tweak.File.AsPath().IsInsideDir(ls.buildSketchRoot); !inside {
+			clangURI, _, err := ls.ide2ClangDocumentURI(logger, tweak.File)
+			if err != nil {
+				return nil, err
+			}
+			tweak.File = clangURI
+		}
+		clangArguments = append(clangArguments, tweak)
+	}
+	return &lsp.ExecuteCommandParams{
+		Command:   ideParams.Command,
+		Arguments: clangArguments,
+	}, nil
+}
+
+// cleanBuildInBackground runs a clean build in background, unless one is already running.
+// If the board is changed while the clean build is running, it's run again for the new board.
+func (ls *INOLanguageServer) cleanBuildInBackground() {
+	if !ls.cleanBuildRunning.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer streams.CatchAndLogPanic()
+		logger := NewLSPFunctionLogger(color.HiCyanString, "CLEAN BUILD --- ")
+		for {
+			fqbn := ls.currentFqbn(logger)
+			if err := ls.cleanBuild(logger); err != nil {
+				logger.Logf("Error: %s", err)
+			}
+			ls.cleanBuildRunning.Store(false)
+			// The check is done after releasing the flag, so a board change can't get lost
+			if ls.currentFqbn(logger) == fqbn || !ls.cleanBuildRunning.CompareAndSwap(false, true) {
+				return
+			}
+			logger.Logf("The board has been changed during the clean build, running it again")
+		}
+	}()
+}
+
+// cleanBuild wipes the build environment, regenerates it from scratch and restarts clangd.
+// If the build environment or the new clangd cannot be created the previous clangd is kept
+// running and the error is reported to the user.
+func (ls *INOLanguageServer) cleanBuild(logger jsonrpc.FunctionLogger) (err error) {
+	progressToken := "arduinoLanguageServerCleanBuild"
+	ls.progressHandler.Create(progressToken)
+	ls.progressHandler.Begin(progressToken, &lsp.WorkDoneProgressBegin{Title: "Clean build"})
+	defer func() {
+		if err != nil {
+			ls.progressHandler.End(progressToken, &lsp.WorkDoneProgressEnd{Message: "failed"})
+			if err := ls.IDE.conn.WindowShowMessage(&lsp.ShowMessageParams{
+				Type:    lsp.MessageTypeError,
+				Message: "Clean build failed: " + err.Error(),
+			}); err != nil {
+				logger.Logf("Error sending message to the IDE: %s", err)
+			}
+			return
+		}
+		ls.progressHandler.End(progressToken, &lsp.WorkDoneProgressEnd{Message: "done"})
+	}()
+	defer recoverClangdUnavailable(&err)
+
+	timings := newRebuildTimings("cleanBuild")
+
+	// Stop any running rebuild, and hold the next ones: they would write in the
+	// folders we are going to remove
+	ls.sketchRebuilder.Pause()
+	defer ls.sketchRebuilder.Resume()
+
+	ls.progressHandler.Report(progressToken, &lsp.WorkDoneProgressReport{Message: "Removing build folders"})
+	ls.writeLock(logger, true)
+	if err := ls.prepareBuildFolders(logger); err != nil {
+		ls.writeUnlock(logger)
+		return err
+	}
+	ls.writeUnlock(logger)
+
+	ls.progressHandler.Report(progressToken, &lsp.WorkDoneProgressReport{Message: "Generating build environment"})
+	if success, err := ls.generateBuildEnvironment(context.Background(), true, logger, timings); err != nil {
+		return err
+	} else if !success {
+		return fmt.Errorf("build failed")
+	}
+
+	// arduino-cli is queried before taking the lock, to not stall the IDE requests
+	dataFolder, err := ls.extractDataFolderFromArduinoCLI(logger)
+	if err != nil {
+		return fmt.Errorf("retrieving data folder from arduino-cli: %w", err)
+	}
+
+	ls.writeLock(logger, true)
+	defer ls.writeUnlock(logger)
+
+	cppContent, err := ls.buildSketchCpp.ReadFile()
+	if err != nil {
+		return fmt.Errorf("reading generated cpp file from sketch: %w", err)
+	}
+
+	ls.progressHandler.Report(progressToken, &lsp.WorkDoneProgressReport{Message: "Restarting clangd"})
+	clangdStart := time.Now()
+	oldClangd := ls.Clangd
+	if err := ls.startClangd(logger, dataFolder); err != nil {
+		return err
+	}
+	oldClangd.Close()
+	timings.ClangdResync = elapsedMs(clangdStart)
+
+	// The version keeps growing, as in the rebuilds, so the diagnostics computed by
+	// the old clangd are recognized as stale
+	version := 1
+	if ls.sketchMapper != nil {
+		version = ls.sketchMapper.CppText.Version + 1
+	}
+	preprocessingStart := time.Now()
+	ls.sketchMapper = sourcemapper.CreateInoMapper(cppContent)
+	ls.sketchMapper.CppText.Version = version
+	ls.responseCache.Clear()
+	ls.updateSketchDiagnostics(logger)
+	timings.Preprocessing = elapsedMs(preprocessingStart)
+
+	// Reopen in the new clangd all the documents currently opened in the IDE
+	reopenStart := time.Now()
+	inoOpened := false
+	for _, ideDoc := range ls.trackedIdeDocs {
+		if ideDoc.URI.Ext() == ".ino" {
+			if inoOpened {
+				continue
+			}
+			inoOpened = true
+		}
+		clangURI, _, err := ls.ide2ClangDocumentURI(logger, ideDoc.URI)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			continue
+		}
+		if err := ls.clangdDidOpen(logger, clangURI, ideDoc); err != nil {
+			return fmt.Errorf("sending didOpen notification to clangd: %w", err)
+		}
+	}
+	timings.ClangdResync += elapsedMs(reopenStart)
+	ls.recordRebuildTimings(logger, timings)
+	return nil
+}
@@ -16,6 +16,7 @@
 package ls
 
 import (
+	"fmt"
 	"runtime"
 	"strings"
 
@@ -47,30 +48,130 @@ func loadCompilationDatabase(file *paths.Path) (*compilationDatabase, error) {
 		File:     file,
 		Contents: []compileCommand{},
 	}
-	return res, json.Unmarshal(f, &res.Contents)
+	if err := json.Unmarshal(f, &res.Contents); err != nil {
+		return res, err
+	}
+	for i := range res.Contents {
+		res.Contents[i].normalize()
+	}
+	return res, nil
+}
+
+// maxResponseFilesDepth is the maximum nesting of the response files
+const maxResponseFilesDepth = 10
+
+// normalize turns the command in the "arguments" form, used by the language server and
+// by clangd: the builders may emit the command line as a single "command" string instead,
+// and may move the arguments to response files (passed as @file).
+func (cmd *compileCommand) normalize() {
+	if len(cmd.Arguments) == 0 && cmd.Command != "" {
+		cmd.Arguments = splitCommandLine(cmd.Command, runtime.GOOS == "windows")
+		cmd.Command = ""
+	}
+	cmd.Arguments = expandResponseFiles(cmd.Arguments, paths.New(cmd.Directory), maxResponseFilesDepth)
+}
+
+// splitCommandLine splits a command line in its arguments, with the quoting rules of the
+// POSIX shells or, if windows is true, of the Windows command line (where the backslashes
+// are path separators and escape only the quotes).
+func splitCommandLine(commandLine string, windows bool) []string {
+	args := []string{}
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	runes := []rune(commandLine)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\\' && i+1 < len(runes) && quote != '\'' && (!windows || runes[i+1] == '"'):
+			i++
+			arg.WriteRune(runes[i])
+			inArg = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '"' || (c == '\'' && !windows):
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// expandResponseFiles replaces the @file arguments with the arguments contained in the
+// file, relative to the given directory. The response files that can't be read are left
+// as they are: the compiler will report them.
+func expandResponseFiles(args []string, dir *paths.Path, depth int) []string {
+	res := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") || len(arg) == 1 || depth == 0 {
+			res = append(res, arg)
+			continue
+		}
+		file := paths.New(arg[1:])
+		if !file.IsAbs() && dir != nil {
+			file = dir.JoinPath(file)
+		}
+		data, err := file.ReadFile()
+		if err != nil {
+			res = append(res, arg)
+			continue
+		}
+		fileArgs := splitCommandLine(string(data), runtime.GOOS == "windows")
+		res = append(res, expandResponseFiles(fileArgs, dir, depth-1)...)
+	}
+	return res
 }
 
-// SaveToFile save the CompilationDatabase to file as a clangd-compatible compile_commands.json,
-// see https://clang.llvm.org/docs/JSONCompilationDatabase.html
+// save writes the compilationDatabase to its file as a clangd-compatible compile_commands.json,
+// see https://clang.llvm.org/docs/JSONCompilationDatabase.html. The file is written to a
+// temporary file first and then renamed, so that clangd never reads a truncated database.
 func (db *compilationDatabase) save() error {
-	if jsonContents, err := json.MarshalIndent(db.Contents, "", " "); err != nil {
+	jsonContents, err := json.MarshalIndent(db.Contents, "", " ")
+	if err != nil {
 		return err
-	} else if err := db.File.WriteFile(jsonContents); err != nil {
+	}
+	tmp := db.File.Parent().Join(db.File.Base() + ".tmp")
+	if err := tmp.WriteFile(jsonContents); err != nil {
 		return err
 	}
-	return nil
+	return tmp.Rename(db.File)
 }
 
-func canonicalizeCompileCommandsJSON(compileCommandsJSONPath *paths.Path) {
-	// TODO: do canonicalization directly in `arduino-cli`
+// clangdCompilationDatabaseDir returns the folder, in the given build path, of the
+// compilation database read by clangd
+func clangdCompilationDatabaseDir(buildPath *paths.Path) *paths.Path {
+	return buildPath.Join("clangd")
+}
 
-	compileCommands, err := loadCompilationDatabase(compileCommandsJSONPath)
+// writeClangdCompilationDatabase writes in clangdCompilationDatabaseDir the compile_commands.json
+// generated by arduino-cli in the given build path, with the paths of the compilers rewritten
+// as required by clangd. The database generated by arduino-cli is left untouched: it's
+// overwritten by each rebuild, while clangd may be reading its own copy.
+func writeClangdCompilationDatabase(buildPath *paths.Path) error {
+	// TODO: do canonicalization directly in `arduino-cli`
+	db, err := loadCompilationDatabase(buildPath.Join("compile_commands.json"))
 	if err != nil {
-		panic("could not find compile_commands.json")
+		return fmt.Errorf("loading compile_commands.json: %w", err)
 	}
-	for i, cmd := range compileCommands.Contents {
+	for i, cmd := range db.Contents {
 		if len(cmd.Arguments) == 0 {
-			panic("invalid empty argument field in compile_commands.json")
+			return fmt.Errorf("invalid compile_commands.json: %s has neither arguments nor command", cmd.File)
 		}
 
 		// clangd requires full path to compiler (including extension .exe on Windows!)
@@ -79,9 +180,14 @@ func canonicalizeCompileCommandsJSON(compileCommandsJSONPath *paths.Path) {
 		if runtime.GOOS == "windows" && strings.ToLower(compilerPath.Ext()) != ".exe" {
 			compiler += ".exe"
 		}
-		compileCommands.Contents[i].Arguments[0] = compiler
+		db.Contents[i].Arguments[0] = compiler
 	}
 
-	// Save back compile_commands.json with OS native file separator and extension
-	compileCommands.save()
+	dir := clangdCompilationDatabaseDir(buildPath)
+	if err := dir.MkdirAll(); err != nil {
+		return err
+	}
+	// Saved with OS native file separator and extension
+	db.File = dir.Join("compile_commands.json")
+	return db.save()
 }
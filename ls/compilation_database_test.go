@@ -0,0 +1,99 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteClangdCompilationDatabase(t *testing.T) {
+	buildPath := paths.New(t.TempDir()).Canonical()
+	compiler := buildPath.Join("tools", "avr-g++")
+	require.NoError(t, compiler.Parent().MkdirAll())
+	require.NoError(t, compiler.WriteFile(nil))
+	original := `[
+ {
+  "directory": "` + buildPath.String() + `",
+  "arguments": ["` + buildPath.Join("tools", "..", "tools", "avr-g++").String() + `", "-c", "-mmcu=atmega328p", "Sketch.ino.cpp"],
+  "file": "Sketch.ino.cpp"
+ }
+]`
+	require.NoError(t, buildPath.Join("compile_commands.json").WriteFile([]byte(original)))
+
+	require.NoError(t, writeClangdCompilationDatabase(buildPath))
+
+	// The database generated by arduino-cli is left untouched
+	data, err := buildPath.Join("compile_commands.json").ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, original, string(data))
+
+	db, err := loadCompilationDatabase(clangdCompilationDatabaseDir(buildPath).Join("compile_commands.json"))
+	require.NoError(t, err)
+	require.Len(t, db.Contents, 1)
+	expectedCompiler := compiler.String()
+	if runtime.GOOS == "windows" {
+		expectedCompiler += ".exe"
+	}
+	require.Equal(t, []string{expectedCompiler, "-c", "-mmcu=atmega328p", "Sketch.ino.cpp"}, db.Contents[0].Arguments)
+	require.Equal(t, "Sketch.ino.cpp", db.Contents[0].File)
+
+	// Invalid database
+	require.NoError(t, buildPath.Join("compile_commands.json").WriteFile([]byte(`[{"directory": "/", "file": "a.cpp"}]`)))
+	require.Error(t, writeClangdCompilationDatabase(buildPath))
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	require.Equal(t,
+		[]string{"/usr/bin/g++", "-DNAME=\"Uno R3\"", "-I/path with spaces/include", "it's", "a b", "Sketch.ino.cpp"},
+		splitCommandLine(`/usr/bin/g++  -DNAME=\"Uno\ R3\" "-I/path with spaces/include" it\'s 'a b'	Sketch.ino.cpp`, false))
+	require.Equal(t,
+		[]string{`C:\tools\g++.exe`, `-IC:\path with spaces\include`, `-DNAME="Uno"`, `it's`},
+		splitCommandLine(`C:\tools\g++.exe "-IC:\path with spaces\include" -DNAME=\"Uno\" it's`, true))
+	require.Empty(t, splitCommandLine("  \n", false))
+}
+
+func TestLoadCompilationDatabaseCommandAndResponseFiles(t *testing.T) {
+	dir := paths.New(t.TempDir())
+	require.NoError(t, dir.Join("includes.rsp").WriteFile([]byte("-I/core\n-I/variant @defines.rsp\n")))
+	require.NoError(t, dir.Join("defines.rsp").WriteFile([]byte("-DF_CPU=16000000L -DARDUINO=10607")))
+	require.NoError(t, dir.Join("loop.rsp").WriteFile([]byte("-O2 @loop.rsp")))
+	file := dir.Join("compile_commands.json")
+	require.NoError(t, file.WriteFile([]byte(`[
+ {"directory": "`+filepathToJSON(dir)+`", "command": "gcc -c @includes.rsp @missing.rsp @loop.rsp a.c", "file": "a.c"},
+ {"directory": "`+filepathToJSON(dir)+`", "arguments": ["gcc", "-c", "@defines.rsp", "b.c"], "file": "b.c"}
+]`)))
+
+	db, err := loadCompilationDatabase(file)
+	require.NoError(t, err)
+	require.Len(t, db.Contents, 2)
+	require.Equal(t, "", db.Contents[0].Command)
+	args := db.Contents[0].Arguments
+	require.Equal(t, []string{"gcc", "-c", "-I/core", "-I/variant", "-DF_CPU=16000000L", "-DARDUINO=10607", "@missing.rsp"}, args[:7])
+	// Recursive response files are expanded up to a limit
+	require.Contains(t, args, "@loop.rsp")
+	require.Equal(t, "a.c", args[len(args)-1])
+	require.Equal(t, []string{"gcc", "-c", "-DF_CPU=16000000L", "-DARDUINO=10607", "b.c"}, db.Contents[1].Arguments)
+}
+
+// filepathToJSON returns the given path as a JSON string content
+func filepathToJSON(p *paths.Path) string {
+	return strings.ReplaceAll(p.String(), `\`, `\\`)
+}
@@ -0,0 +1,124 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// CompileTargets is the result of the "arduino/listCompileTargets" command
+type CompileTargets struct {
+	// Targets are the boards the sketch is meant to be compiled for
+	Targets []string `json:"targets"`
+	// Active is the board driving the diagnostics
+	Active string `json:"active"`
+}
+
+// compileTargets returns the boards the sketch is meant to be compiled for, set with the
+// -compile-target flags or, if none is given, in the sketch settings. The caller must hold
+// the read lock.
+func (ls *INOLanguageServer) compileTargets() []string {
+	if len(ls.config.CompileTargets) > 0 {
+		return ls.config.CompileTargets
+	}
+	return ls.sketchSettings.CompileTargets
+}
+
+// isCompileTarget returns true if the given board is one of the compile targets of the
+// sketch. The caller must hold the read lock.
+func (ls *INOLanguageServer) isCompileTarget(fqbn string) bool {
+	return fqbn != "" && slices.Contains(ls.compileTargets(), fqbn)
+}
+
+// listCompileTargets returns the compile targets of the sketch and the selected one
+func (ls *INOLanguageServer) listCompileTargets(logger jsonrpc.FunctionLogger) *CompileTargets {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+	return &CompileTargets{
+		Targets: append([]string{}, ls.compileTargets()...),
+		Active:  ls.config.Fqbn,
+	}
+}
+
+// selectCompileTarget switches the diagnostics to another compile target of the sketch. The
+// argument of the "arduino/selectCompileTarget" command is the FQBN of the target.
+func (ls *INOLanguageServer) selectCompileTarget(logger jsonrpc.FunctionLogger, arguments []interface{}) error {
+	if len(arguments) != 1 {
+		return fmt.Errorf("expected 1 argument (fqbn), got %d", len(arguments))
+	}
+	fqbn, ok := arguments[0].(string)
+	if !ok {
+		return fmt.Errorf("invalid fqbn: %v", arguments[0])
+	}
+	ls.readLock(logger, false)
+	isTarget := ls.isCompileTarget(fqbn)
+	ls.readUnlock(logger)
+	if !isTarget {
+		return fmt.Errorf("%s is not a compile target of the sketch", fqbn)
+	}
+	ls.selectBoard(logger, fqbn)
+	return nil
+}
+
+// compileTargetFolder returns the folder where the build environment of the given compile
+// target is kept while another target is selected
+func (ls *INOLanguageServer) compileTargetFolder(fqbn string) *paths.Path {
+	hash := sha256.Sum256([]byte(fqbn))
+	return ls.tempDir.Join("targets", hex.EncodeToString(hash[:8]))
+}
+
+// prepareBuildFolders empties the build folders before a clean build. When switching between
+// two compile targets the build folders of the previous target are kept aside, and the ones
+// of the new target are restored if they have been generated before: arduino-cli rebuilds
+// only what changed in the meantime, so switching back and forth is quick. The caller must
+// hold the write lock.
+func (ls *INOLanguageServer) prepareBuildFolders(logger jsonrpc.FunctionLogger) error {
+	switchTargets := ls.buildFqbn != ls.config.Fqbn && ls.isCompileTarget(ls.buildFqbn) && ls.isCompileTarget(ls.config.Fqbn)
+	for _, dir := range []*paths.Path{ls.buildPath, ls.fullBuildPath} {
+		if switchTargets {
+			stash := ls.compileTargetFolder(ls.buildFqbn).Join(dir.Base())
+			if err := stash.RemoveAll(); err != nil {
+				return fmt.Errorf("removing build folder %s: %w", stash, err)
+			}
+			if err := stash.Parent().MkdirAll(); err != nil {
+				return fmt.Errorf("creating build folder %s: %w", stash.Parent(), err)
+			}
+			if err := dir.Rename(stash); err != nil {
+				return fmt.Errorf("saving build folder of %s: %w", ls.buildFqbn, err)
+			}
+			if saved := ls.compileTargetFolder(ls.config.Fqbn).Join(dir.Base()); saved.IsDir() {
+				logger.Logf("Restoring build folder %s of %s", dir, ls.config.Fqbn)
+				if err := saved.Rename(dir); err != nil {
+					return fmt.Errorf("restoring build folder of %s: %w", ls.config.Fqbn, err)
+				}
+				continue
+			}
+		} else if err := dir.RemoveAll(); err != nil {
+			return fmt.Errorf("removing build folder %s: %w", dir, err)
+		}
+		if err := dir.MkdirAll(); err != nil {
+			return fmt.Errorf("creating build folder %s: %w", dir, err)
+		}
+	}
+	ls.buildFqbn = ls.config.Fqbn
+	return nil
+}
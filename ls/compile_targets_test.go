@@ -0,0 +1,87 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepareBuildFoldersSwitchingTargets(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.tempDir = ls.buildPath.Parent()
+	ls.fullBuildPath = ls.tempDir.Join("fullbuild")
+	ls.config = &Config{Fqbn: "arduino:avr:uno", CompileTargets: []string{"arduino:avr:uno", "esp32:esp32:esp32"}}
+	ls.buildFqbn = "arduino:avr:uno"
+	require.NoError(t, ls.buildSketchRoot.MkdirAll())
+	require.NoError(t, ls.fullBuildPath.MkdirAll())
+	require.NoError(t, ls.buildSketchCpp.WriteFile([]byte("// uno")))
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	// The build folders of the first target are kept aside
+	ls.config.Fqbn = "esp32:esp32:esp32"
+	require.NoError(t, ls.prepareBuildFolders(logger))
+	require.Equal(t, "esp32:esp32:esp32", ls.buildFqbn)
+	require.True(t, ls.buildPath.IsDir())
+	require.True(t, ls.fullBuildPath.IsDir())
+	require.True(t, ls.buildSketchCpp.NotExist())
+	require.NoError(t, ls.buildSketchCpp.Parent().MkdirAll())
+	require.NoError(t, ls.buildSketchCpp.WriteFile([]byte("// esp32")))
+
+	// ...and restored when the target is selected again
+	ls.config.Fqbn = "arduino:avr:uno"
+	require.NoError(t, ls.prepareBuildFolders(logger))
+	cpp, err := ls.buildSketchCpp.ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, "// uno", string(cpp))
+
+	ls.config.Fqbn = "esp32:esp32:esp32"
+	require.NoError(t, ls.prepareBuildFolders(logger))
+	cpp, err = ls.buildSketchCpp.ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, "// esp32", string(cpp))
+
+	// A clean build of the same target, or of a board that is not a target, wipes the folders
+	require.NoError(t, ls.prepareBuildFolders(logger))
+	require.True(t, ls.buildSketchCpp.NotExist())
+	require.NoError(t, ls.buildSketchCpp.Parent().MkdirAll())
+	require.NoError(t, ls.buildSketchCpp.WriteFile([]byte("// esp32")))
+	ls.config.Fqbn = "arduino:samd:mkr1000"
+	require.NoError(t, ls.prepareBuildFolders(logger))
+	require.True(t, ls.buildSketchCpp.NotExist())
+}
+
+func TestSelectCompileTarget(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.config = &Config{Fqbn: "arduino:avr:uno"}
+	ls.sketchSettings.CompileTargets = []string{"arduino:avr:uno", "arduino:samd:mkr1000"}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	require.Equal(t, &CompileTargets{
+		Targets: []string{"arduino:avr:uno", "arduino:samd:mkr1000"},
+		Active:  "arduino:avr:uno",
+	}, ls.listCompileTargets(logger))
+
+	require.Error(t, ls.selectCompileTarget(logger, []interface{}{}))
+	require.Error(t, ls.selectCompileTarget(logger, []interface{}{42}))
+	require.Error(t, ls.selectCompileTarget(logger, []interface{}{"esp32:esp32:esp32"}))
+
+	// The flags take precedence over the sketch settings
+	ls.config.CompileTargets = []string{"esp32:esp32:esp32"}
+	require.Equal(t, []string{"esp32:esp32:esp32"}, ls.listCompileTargets(logger).Targets)
+}
@@ -0,0 +1,90 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/vincecity/go-lsp"
+)
+
+// completionRank is the group of a completion item in the ranking of the language server,
+// the lower groups are listed first
+type completionRank int
+
+const (
+	// completionRankSketch are the symbols of the sketch
+	completionRankSketch completionRank = iota
+	// completionRankArduinoAPI are the identifiers of the Arduino API
+	completionRankArduinoAPI
+	// completionRankOther are the other symbols, from the core and library internals
+	completionRankOther
+)
+
+// completionLabelIdentifierRegexp matches the identifier at the beginning of the label of
+// a completion item (clangd may prefix the labels with a space or a bullet)
+var completionLabelIdentifierRegexp = regexp.MustCompile(`[A-Za-z_]\w*`)
+
+// completionItemIdentifier returns the identifier completed by the item
+func completionItemIdentifier(item *lsp.CompletionItem) string {
+	if item.FilterText != "" {
+		return item.FilterText
+	}
+	return completionLabelIdentifierRegexp.FindString(item.Label)
+}
+
+// rankCompletionItems boosts the symbols of the sketch (the identifiers found in the sketch
+// sources) and the Arduino API above the other ones, usually internals of the core and of
+// the libraries: the sortText of each item is prefixed with its group, clangd's order is
+// kept within each group.
+func rankCompletionItems(items []lsp.CompletionItem, sketchIdentifiers map[string]bool) {
+	for i := range items {
+		item := &items[i]
+		identifier := completionItemIdentifier(item)
+		rank := completionRankOther
+		if sketchIdentifiers[identifier] {
+			rank = completionRankSketch
+		} else if _, ok := arduinoReferencePages[identifier]; ok || serialPortObjectRegexp.MatchString(identifier) {
+			rank = completionRankArduinoAPI
+		}
+		sortText := item.SortText
+		if sortText == "" {
+			sortText = item.Label
+		}
+		item.SortText = string(rune('0'+rank)) + sortText
+	}
+}
+
+// sketchIdentifiers returns the identifiers found in the sources of the sketch: the
+// preprocessed .ino tabs and the .cpp/.h files open in the IDE. The caller must hold the
+// read lock.
+func (ls *INOLanguageServer) sketchIdentifiers() map[string]bool {
+	sources := []string{}
+	if ls.sketchMapper != nil {
+		sources = append(sources, ls.sketchMapper.CppText.Text)
+	}
+	for _, doc := range ls.trackedIdeDocs {
+		if doc.URI.Ext() != ".ino" && ls.ideURIIsPartOfTheSketch(doc.URI) {
+			sources = append(sources, doc.Text)
+		}
+	}
+	res := map[string]bool{}
+	for _, identifier := range completionLabelIdentifierRegexp.FindAllString(strings.Join(sources, "\n"), -1) {
+		res[identifier] = true
+	}
+	return res
+}
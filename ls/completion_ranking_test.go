@@ -0,0 +1,55 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestRankCompletionItems(t *testing.T) {
+	items := []lsp.CompletionItem{
+		{Label: " __builtin_avr_delay_cycles(unsigned long)", SortText: "3f"},
+		{Label: "•digitalWrite(uint8_t pin, uint8_t val)", SortText: "40"},
+		{Label: " ledPin", SortText: "42"},
+		{Label: " Serial1", SortText: "41"},
+		{Label: " blinkLed()", FilterText: "blinkLed"},
+		{Label: " TIMSK1"},
+	}
+	rankCompletionItems(items, map[string]bool{"ledPin": true, "blinkLed": true, "setup": true})
+
+	require.Equal(t, "23f", items[0].SortText)
+	require.Equal(t, "140", items[1].SortText)
+	require.Equal(t, "042", items[2].SortText)
+	require.Equal(t, "141", items[3].SortText)
+	// Without sortText the items are sorted by label
+	require.Equal(t, "0 blinkLed()", items[4].SortText)
+	require.Equal(t, "2 TIMSK1", items[5].SortText)
+}
+
+func TestSketchIdentifiers(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	identifiers := ls.sketchIdentifiers()
+	// .ino tabs, from the preprocessed sketch
+	require.True(t, identifiers["setup"])
+	require.True(t, identifiers["loop"])
+	// .h files open in the IDE
+	require.True(t, identifiers["helper"])
+	require.True(t, identifiers["counter"])
+	require.False(t, identifiers["digitalWrite"])
+}
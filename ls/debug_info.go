@@ -0,0 +1,56 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+
+	"github.com/arduino/arduino-language-server/globals"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// DebugInfo is the response to the custom "arduino/getDebugInfo" request, it describes
+// the tools used by the language server to help troubleshooting.
+type DebugInfo struct {
+	// Version is the version of the language server
+	Version string `json:"version"`
+	// ClangdPath is the path of the clangd executable
+	ClangdPath string `json:"clangdPath"`
+	// CliPath is the path of the arduino-cli executable (empty if the daemon is used)
+	CliPath string `json:"cliPath,omitempty"`
+	// CliConfigPath is the path of the arduino-cli config file (empty if the daemon is used)
+	CliConfigPath string `json:"cliConfigPath,omitempty"`
+	// CliDaemonAddress is the address of the arduino-cli daemon (empty if arduino-cli is run)
+	CliDaemonAddress string `json:"cliDaemonAddress,omitempty"`
+}
+
+func (ls *INOLanguageServer) getDebugInfoReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*DebugInfo, *jsonrpc.ResponseError) {
+	info := &DebugInfo{
+		Version:          globals.VersionInfo.VersionString,
+		CliDaemonAddress: ls.config.CliDaemonAddress,
+	}
+	if ls.config.ClangdPath != nil {
+		info.ClangdPath = ls.config.ClangdPath.String()
+	}
+	if ls.config.CliPath != nil {
+		info.CliPath = ls.config.CliPath.String()
+	}
+	if ls.config.CliConfigPath != nil {
+		info.CliConfigPath = ls.config.CliConfigPath.String()
+	}
+	logger.Logf("<-- getDebugInfo(clangd: %s, arduino-cli: %s)", info.ClangdPath, info.CliPath)
+	return info, nil
+}
@@ -0,0 +1,173 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// rangeConverter moves a range from a document to another one, for example from the
+// preprocessed sketch to a .ino tab
+type rangeConverter func(uri lsp.DocumentURI, rng lsp.Range) (lsp.DocumentURI, lsp.Range, error)
+
+// clang2IdeDiagnosticData converts the ranges and the URIs embedded in the data payload of a
+// diagnostic published by clangd. The IDE sends the payload back unchanged in the context of
+// the codeAction requests, where it's converted back with ide2ClangDiagnosticData.
+func (ls *INOLanguageServer) clang2IdeDiagnosticData(logger jsonrpc.FunctionLogger, clangURI lsp.DocumentURI, data json.RawMessage) json.RawMessage {
+	return convertDiagnosticData(logger, data, clangURI, func(clangURI lsp.DocumentURI, clangRange lsp.Range) (lsp.DocumentURI, lsp.Range, error) {
+		ideURI, ideRange, inPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, clangURI, clangRange)
+		if err == nil && inPreprocessed {
+			// Leave the range as is: it can't be edited in the IDE anyway
+			return clangURI, clangRange, nil
+		}
+		return ideURI, ideRange, err
+	})
+}
+
+// ide2ClangDiagnosticData converts back the payload converted by clang2IdeDiagnosticData
+func (ls *INOLanguageServer) ide2ClangDiagnosticData(logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI, data json.RawMessage) json.RawMessage {
+	return convertDiagnosticData(logger, data, ideURI, func(ideURI lsp.DocumentURI, ideRange lsp.Range) (lsp.DocumentURI, lsp.Range, error) {
+		return ls.ide2ClangRange(logger, ideURI, ideRange)
+	})
+}
+
+// convertDiagnosticData converts with the given converter the ranges found in a diagnostic
+// data payload, whose structure is not specified by LSP. Each "range" object is converted in
+// the document given by the "uri" field of the same object, if any, or in the document of
+// the diagnostic. The keys of the "changes" of a WorkspaceEdit are converted together with
+// the ranges of their TextEdits. The parts that can't be converted are left unchanged.
+func convertDiagnosticData(logger jsonrpc.FunctionLogger, data json.RawMessage, uri lsp.DocumentURI, convert rangeConverter) json.RawMessage {
+	if len(data) == 0 {
+		return data
+	}
+	var payload interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		logger.Logf("Invalid diagnostic data: %s", err)
+		return data
+	}
+	res, err := json.Marshal(convertDiagnosticDataValue(logger, payload, uri, convert))
+	if err != nil {
+		logger.Logf("Error converting diagnostic data: %s", err)
+		return data
+	}
+	return res
+}
+
+func convertDiagnosticDataValue(logger jsonrpc.FunctionLogger, value interface{}, uri lsp.DocumentURI, convert rangeConverter) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = convertDiagnosticDataValue(logger, v[i], uri, convert)
+		}
+		return v
+	case map[string]interface{}:
+		// The URI of the object applies to its range and to the nested objects
+		uriField, hasURI := v["uri"].(string)
+		if hasURI {
+			if parsed, err := lsp.NewDocumentURIFromURL(uriField); err == nil {
+				uri = parsed
+			} else {
+				hasURI = false
+			}
+		}
+		for key, field := range v {
+			switch key {
+			case "uri":
+			case "range":
+				rng, ok := decodeDiagnosticDataRange(field)
+				if !ok {
+					continue
+				}
+				newURI, newRange, err := convert(uri, rng)
+				if err != nil {
+					logger.Logf("Error converting diagnostic data range: %s", err)
+					continue
+				}
+				v["range"] = newRange
+				if hasURI {
+					v["uri"] = newURI
+				}
+			case "changes":
+				if changes, ok := field.(map[string]interface{}); ok {
+					v["changes"] = convertDiagnosticDataChanges(logger, changes, convert)
+				}
+			default:
+				v[key] = convertDiagnosticDataValue(logger, field, uri, convert)
+			}
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// convertDiagnosticDataChanges converts the "changes" of a WorkspaceEdit: the edits may be
+// moved to another document (for example from the preprocessed sketch to each .ino tab).
+func convertDiagnosticDataChanges(logger jsonrpc.FunctionLogger, changes map[string]interface{}, convert rangeConverter) map[string]interface{} {
+	res := map[string]interface{}{}
+	add := func(uri string, edit interface{}) {
+		edits, _ := res[uri].([]interface{})
+		res[uri] = append(edits, edit)
+	}
+	for uriField, field := range changes {
+		uri, err := lsp.NewDocumentURIFromURL(uriField)
+		edits, ok := field.([]interface{})
+		if err != nil || !ok {
+			res[uriField] = field
+			continue
+		}
+		for _, edit := range edits {
+			editFields, ok := edit.(map[string]interface{})
+			if !ok {
+				add(uriField, edit)
+				continue
+			}
+			rng, ok := decodeDiagnosticDataRange(editFields["range"])
+			if !ok {
+				add(uriField, edit)
+				continue
+			}
+			newURI, newRange, err := convert(uri, rng)
+			if err != nil {
+				logger.Logf("Error converting diagnostic data edit: %s", err)
+				add(uriField, edit)
+				continue
+			}
+			editFields["range"] = newRange
+			add(newURI.String(), editFields)
+		}
+	}
+	return res
+}
+
+// decodeDiagnosticDataRange decodes a range, it returns false if the value is not a range
+func decodeDiagnosticDataRange(value interface{}) (lsp.Range, bool) {
+	fields, ok := value.(map[string]interface{})
+	if !ok || fields["start"] == nil || fields["end"] == nil {
+		return lsp.Range{}, false
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return lsp.Range{}, false
+	}
+	var rng lsp.Range
+	if err := json.Unmarshal(data, &rng); err != nil {
+		return lsp.Range{}, false
+	}
+	return rng, true
+}
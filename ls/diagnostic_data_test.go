@@ -0,0 +1,57 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestDiagnosticDataConversion(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	clangInoURI := lsp.NewDocumentURIFromPath(ls.buildSketchCpp)
+	clangHelperURI := lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Helper.h"))
+	ideInoURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	ideHelperURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h"))
+
+	payload := func(inoURI, helperURI lsp.DocumentURI, inoLine, helperLine int) string {
+		return fmt.Sprintf(`{
+			"fixes": [{
+				"title": "insert ';'",
+				"edit": {"changes": {"%s": [{"range": {"start": {"line": %d, "character": 14}, "end": {"line": %d, "character": 14}}, "newText": ";"}]}}
+			}],
+			"declaration": {"uri": "%s", "range": {"start": {"line": %d, "character": 0}, "end": {"line": %d, "character": 4}}},
+			"token": {"range": {"start": {"line": %d, "character": 5}, "end": {"line": %d, "character": 9}}},
+			"kind": "missing-semicolon"
+		}`, inoURI, inoLine, inoLine, helperURI, helperLine, helperLine, inoLine, inoLine)
+	}
+	clangData := []byte(payload(clangInoURI, clangHelperURI, 3, 4))
+	ideData := []byte(payload(ideInoURI, ideHelperURI, 1, 3))
+
+	// The ranges without a URI are in the document of the diagnostic
+	require.JSONEq(t, string(ideData), string(ls.clang2IdeDiagnosticData(logger, clangInoURI, clangData)))
+	// The IDE sends the payload back with the codeAction requests
+	require.JSONEq(t, string(clangData), string(ls.ide2ClangDiagnosticData(logger, ideInoURI, ideData)))
+
+	// The payloads that are not JSON objects are left as they are
+	require.Equal(t, `"opaque"`, string(ls.clang2IdeDiagnosticData(logger, clangInoURI, []byte(`"opaque"`))))
+	require.Nil(t, ls.clang2IdeDiagnosticData(logger, clangInoURI, nil))
+}
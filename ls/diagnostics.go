@@ -0,0 +1,362 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// Codes of the diagnostics generated by the language server itself
+const (
+	diagnosticCodeMissingSetup         = "arduino_missing_setup"
+	diagnosticCodeMissingLoop          = "arduino_missing_loop"
+	diagnosticCodeFlashString          = "arduino_flash_string"
+	diagnosticCodeInvalidFqbn          = "arduino_invalid_fqbn"
+	diagnosticCodePlatformNotInstalled = "arduino_platform_not_installed"
+	diagnosticCodeMisnamedMainFile     = "arduino_misnamed_main_file"
+)
+
+// diagnosticCodeDescriptions maps the diagnostic codes to a page explaining the
+// error, it's used to populate the Diagnostic.CodeDescription field.
+var diagnosticCodeDescriptions = map[string]string{
+	// Sketch structure
+	diagnosticCodeMissingSetup: "https://www.arduino.cc/reference/en/language/structure/sketch/setup/",
+	diagnosticCodeMissingLoop:  "https://www.arduino.cc/reference/en/language/structure/sketch/loop/",
+
+	// Strings in RAM on AVR boards
+	diagnosticCodeFlashString: "https://www.arduino.cc/reference/en/language/variables/utilities/progmem/",
+
+	// Wrong board selection: invalid FQBN or platform not installed
+	diagnosticCodeInvalidFqbn:          "https://docs.arduino.cc/software/ide-v2/tutorials/getting-started/ide-v2-uploading-a-sketch/",
+	diagnosticCodePlatformNotInstalled: "https://docs.arduino.cc/software/ide-v2/tutorials/ide-v2-board-manager/",
+
+	// Main file not named as the sketch folder
+	diagnosticCodeMisnamedMainFile: "https://arduino.github.io/arduino-cli/latest/sketch-specification/#primary-sketch-file",
+
+	// Missing library: "'Servo.h' file not found"
+	"pp_file_not_found": "https://docs.arduino.cc/software/ide-v2/tutorials/ide-v2-installing-a-library",
+
+	// Common syntax errors
+	"expected_semi_after_expr": "https://support.arduino.cc/hc/en-us/articles/4403365313810-If-your-sketch-doesn-t-compile",
+	"expected_semi_after_stmt": "https://support.arduino.cc/hc/en-us/articles/4403365313810-If-your-sketch-doesn-t-compile",
+	"expected_semi_decl_list":  "https://support.arduino.cc/hc/en-us/articles/4403365313810-If-your-sketch-doesn-t-compile",
+	"expected_rbrace":          "https://support.arduino.cc/hc/en-us/articles/4403365313810-If-your-sketch-doesn-t-compile",
+	"expected_expression":      "https://support.arduino.cc/hc/en-us/articles/4403365313810-If-your-sketch-doesn-t-compile",
+}
+
+// arduinoReferencePages maps the Arduino API identifiers to their page in the
+// language reference (relative to arduinoReferenceURL).
+var arduinoReferencePages = map[string]string{
+	"pinMode":               "functions/digital-io/pinmode/",
+	"digitalWrite":          "functions/digital-io/digitalwrite/",
+	"digitalRead":           "functions/digital-io/digitalread/",
+	"analogRead":            "functions/analog-io/analogread/",
+	"analogWrite":           "functions/analog-io/analogwrite/",
+	"analogReference":       "functions/analog-io/analogreference/",
+	"analogReadResolution":  "functions/zero-due-mkr-family/analogreadresolution/",
+	"analogWriteResolution": "functions/zero-due-mkr-family/analogwriteresolution/",
+	"tone":                  "functions/advanced-io/tone/",
+	"noTone":                "functions/advanced-io/notone/",
+	"pulseIn":               "functions/advanced-io/pulsein/",
+	"pulseInLong":           "functions/advanced-io/pulseinlong/",
+	"shiftIn":               "functions/advanced-io/shiftin/",
+	"shiftOut":              "functions/advanced-io/shiftout/",
+	"delay":                 "functions/time/delay/",
+	"delayMicroseconds":     "functions/time/delaymicroseconds/",
+	"millis":                "functions/time/millis/",
+	"micros":                "functions/time/micros/",
+	"abs":                   "functions/math/abs/",
+	"constrain":             "functions/math/constrain/",
+	"map":                   "functions/math/map/",
+	"max":                   "functions/math/max/",
+	"min":                   "functions/math/min/",
+	"pow":                   "functions/math/pow/",
+	"sq":                    "functions/math/sq/",
+	"sqrt":                  "functions/math/sqrt/",
+	"random":                "functions/random-numbers/random/",
+	"randomSeed":            "functions/random-numbers/randomseed/",
+	"bit":                   "functions/bits-and-bytes/bit/",
+	"bitClear":              "functions/bits-and-bytes/bitclear/",
+	"bitRead":               "functions/bits-and-bytes/bitread/",
+	"bitSet":                "functions/bits-and-bytes/bitset/",
+	"bitWrite":              "functions/bits-and-bytes/bitwrite/",
+	"highByte":              "functions/bits-and-bytes/highbyte/",
+	"lowByte":               "functions/bits-and-bytes/lowbyte/",
+	"attachInterrupt":       "functions/external-interrupts/attachinterrupt/",
+	"detachInterrupt":       "functions/external-interrupts/detachinterrupt/",
+	"digitalPinToInterrupt": "functions/external-interrupts/digitalpintointerrupt/",
+	"interrupts":            "functions/interrupts/interrupts/",
+	"noInterrupts":          "functions/interrupts/nointerrupts/",
+	"isAlpha":               "functions/characters/isalpha/",
+	"isAlphaNumeric":        "functions/characters/isalphanumeric/",
+	"isAscii":               "functions/characters/isascii/",
+	"isControl":             "functions/characters/iscontrol/",
+	"isDigit":               "functions/characters/isdigit/",
+	"isGraph":               "functions/characters/isgraph/",
+	"isHexadecimalDigit":    "functions/characters/ishexadecimaldigit/",
+	"isLowerCase":           "functions/characters/islowercase/",
+	"isPrintable":           "functions/characters/isprintable/",
+	"isPunct":               "functions/characters/ispunct/",
+	"isSpace":               "functions/characters/isspace/",
+	"isUpperCase":           "functions/characters/isuppercase/",
+	"isWhitespace":          "functions/characters/iswhitespace/",
+	"HIGH":                  "variables/constants/highlow/",
+	"LOW":                   "variables/constants/highlow/",
+	"INPUT":                 "variables/constants/inputoutputpullup/",
+	"INPUT_PULLUP":          "variables/constants/inputoutputpullup/",
+	"OUTPUT":                "variables/constants/inputoutputpullup/",
+	"LED_BUILTIN":           "variables/constants/ledbuiltin/",
+	"Serial":                "functions/communication/serial/",
+}
+
+const arduinoReferenceURL = "https://www.arduino.cc/reference/en/language/"
+
+// addDiagnosticCodeDescription links the diagnostic to the page explaining its
+// error code (if known and if the diagnostic doesn't already have one).
+// Undeclared identifiers are linked to the reference of the Arduino API identifier
+// they refer to (or that they misspell), if any.
+func addDiagnosticCodeDescription(diag *lsp.Diagnostic, code string) {
+	if diag.CodeDescription != nil {
+		return
+	}
+	if code == "undeclared_var_use" || code == "undeclared_var_use_suggest" {
+		if page, ok := arduinoReferencePageForUndeclaredIdentifier(diag.Message); ok {
+			diag.CodeDescription = &lsp.CodeDescription{Href: lsp.URI(arduinoReferenceURL + page)}
+		}
+		return
+	}
+	if href, ok := diagnosticCodeDescriptions[code]; ok {
+		diag.CodeDescription = &lsp.CodeDescription{Href: lsp.URI(href)}
+	}
+}
+
+// arduinoReferencePageForUndeclaredIdentifier returns the reference page of the Arduino
+// API identifier reported as undeclared in the given diagnostic message (for example
+// because of a missing #include), or of the one it most likely misspells.
+func arduinoReferencePageForUndeclaredIdentifier(message string) (string, bool) {
+	match := undeclaredIdentifierRegexp.FindStringSubmatch(message)
+	if match == nil {
+		return "", false
+	}
+	if page, ok := arduinoReferencePages[match[1]]; ok {
+		return page, true
+	}
+	if suggestion, ok := closestArduinoAPIIdentifier(match[1]); ok {
+		page, ok := arduinoReferencePages[suggestion]
+		return page, ok
+	}
+	return "", false
+}
+
+// boardConfigurationErrorCode returns the code of the diagnostic reporting the given
+// build error, if it's caused by the board configuration (an invalid FQBN or a board
+// whose platform is not installed), or an empty string otherwise.
+func boardConfigurationErrorCode(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "Invalid FQBN"), strings.Contains(msg, "Unknown FQBN"), strings.Contains(msg, "Missing FQBN"):
+		return diagnosticCodeInvalidFqbn
+	case strings.Contains(msg, "Platform '") && strings.Contains(msg, "' not found"):
+		return diagnosticCodePlatformNotInstalled
+	}
+	return ""
+}
+
+// reportBoardConfigurationError publishes a diagnostic on the main .ino file of the sketch
+// when the build failed because of the board configuration, so that the IDE user can click
+// through to an explanation. The diagnostic is kept until the next successful build.
+func (ls *INOLanguageServer) reportBoardConfigurationError(logger jsonrpc.FunctionLogger, buildErr error) {
+	code := boardConfigurationErrorCode(buildErr)
+	if code == "" {
+		return
+	}
+
+	ls.writeLock(logger, false)
+	var message string
+	if code == diagnosticCodeInvalidFqbn {
+		message = fmt.Sprintf("The selected board (%s) is not valid, select the board again", ls.config.Fqbn)
+	} else {
+		message = fmt.Sprintf("The platform of the selected board (%s) is not installed, install it with the Boards Manager", ls.config.Fqbn)
+	}
+	mainInoURI := ls.sketchMainInoURI()
+	diag := newSketchDiagnostic(code, lsp.DiagnosticSeverityError, lsp.Range{}, message)
+	addDiagnosticCodeDescription(&diag, code)
+	ls.sketchStructureDiagnostics = []lsp.Diagnostic{diag}
+	ls.flashStringDiagnostics = map[lsp.DocumentURI][]lsp.Diagnostic{}
+	ls.ideInoDocsWithDiagnostics[mainInoURI] = true
+	ls.writeUnlock(logger)
+
+	logger.Logf("Board configuration error: %s", message)
+	if err := ls.publishIdeDiagnostics(logger, &lsp.PublishDiagnosticsParams{
+		URI:         mainInoURI,
+		Diagnostics: []lsp.Diagnostic{diag},
+	}); err != nil {
+		logger.Logf("Error sending diagnostics to IDE: %s", err)
+	}
+}
+
+var setupPrototypeRegexp = regexp.MustCompile(`^\s*void\s+setup\s*\(\s*(void)?\s*\)\s*;`)
+var loopPrototypeRegexp = regexp.MustCompile(`^\s*void\s+loop\s*\(\s*(void)?\s*\)\s*;`)
+
+// updateSketchDiagnostics regenerates the diagnostics produced by the language server
+// itself on the sketch .ino files, they are merged with the diagnostics from clangd.
+func (ls *INOLanguageServer) updateSketchDiagnostics(logger jsonrpc.FunctionLogger) {
+	ls.sketchStructureDiagnostics = nil
+	ls.flashStringDiagnostics = map[lsp.DocumentURI][]lsp.Diagnostic{}
+	if ls.sketchMapper == nil {
+		return
+	}
+	ls.checkSketchStructure(logger)
+	if ls.flashStringHintsEnabled() {
+		ls.checkFlashStrings(logger)
+	}
+}
+
+// checkSketchStructure looks for setup() and loop() among the prototypes generated by the
+// Arduino preprocessor for the functions defined in the .ino files, their absence is reported
+// as a diagnostic on the main .ino file before the full compile fails at link time.
+func (ls *INOLanguageServer) checkSketchStructure(logger jsonrpc.FunctionLogger) {
+	if len(ls.sketchMapper.PreprocessedCppLines()) == 0 {
+		// Either the sketch defines no functions or the preprocessor failed to parse it,
+		// in both cases the compiler will report a better error.
+		logger.Logf("No function prototypes generated for the sketch")
+		return
+	}
+
+	if !ls.sketchDeclaresFunction(setupPrototypeRegexp) {
+		logger.Logf("The sketch has no setup() function")
+		ls.sketchStructureDiagnostics = append(ls.sketchStructureDiagnostics,
+			newSketchDiagnostic(diagnosticCodeMissingSetup, lsp.DiagnosticSeverityError, lsp.Range{}, "The sketch has no setup() function"))
+	}
+	if !ls.sketchDeclaresFunction(loopPrototypeRegexp) {
+		logger.Logf("The sketch has no loop() function")
+		ls.sketchStructureDiagnostics = append(ls.sketchStructureDiagnostics,
+			newSketchDiagnostic(diagnosticCodeMissingLoop, lsp.DiagnosticSeverityError, lsp.Range{}, "The sketch has no loop() function"))
+	}
+}
+
+// sketchFunctionDefinition returns the .ino file and line where the function, whose prototype
+// generated by the preprocessor matches the given regexp, is defined.
+func (ls *INOLanguageServer) sketchFunctionDefinition(prototypeRegexp *regexp.Regexp) (string, int, bool) {
+	cppLines := textutils.SplitLines(ls.sketchMapper.CppText.Text)
+	for _, cppLine := range ls.sketchMapper.PreprocessedCppLines() {
+		if cppLine < len(cppLines) && prototypeRegexp.MatchString(cppLines[cppLine]) {
+			return ls.sketchMapper.CppToInoLineOk(cppLine)
+		}
+	}
+	return "", 0, false
+}
+
+// sketchDeclaresFunction returns true if the function matching the given prototype regexp
+// is defined in the sketch. The preprocessor doesn't generate the prototypes already
+// declared in the .ino files, so these are checked too.
+func (ls *INOLanguageServer) sketchDeclaresFunction(prototypeRegexp *regexp.Regexp) bool {
+	if _, _, ok := ls.sketchFunctionDefinition(prototypeRegexp); ok {
+		return true
+	}
+	for cppLine, text := range textutils.SplitLines(ls.sketchMapper.CppText.Text) {
+		if file, _, ok := ls.sketchMapper.CppToInoLineOk(cppLine); ok && file != sourcemapper.NotIno.File && prototypeRegexp.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+func newSketchDiagnostic(code string, severity lsp.DiagnosticSeverity, r lsp.Range, message string) lsp.Diagnostic {
+	rawCode, _ := json.Marshal(code)
+	return lsp.Diagnostic{
+		Range:    r,
+		Severity: severity,
+		Code:     rawCode,
+		Source:   "arduino-language-server",
+		Message:  message,
+	}
+}
+
+// sketchMainInoURI returns the IDE URI of the main .ino file of the sketch
+func (ls *INOLanguageServer) sketchMainInoURI() lsp.DocumentURI {
+	mainIno := ls.sketchRoot.Join(ls.sketchName + ".ino")
+	if doc, ok := ls.trackedIdeDocs[mainIno.String()]; ok {
+		return doc.URI
+	}
+	return lsp.NewDocumentURIFromPath(mainIno)
+}
+
+// DiagnosticsSummary is sent to the IDE as an "arduino/diagnosticsSummary" event after each
+// publication of the diagnostics of the sketch, it allows the IDE to badge the tabs.
+type DiagnosticsSummary struct {
+	Tabs []TabDiagnosticsSummary `json:"tabs"`
+}
+
+// TabDiagnosticsSummary is the number of errors and warnings published for a .ino tab
+type TabDiagnosticsSummary struct {
+	URI      lsp.DocumentURI `json:"uri"`
+	Errors   int             `json:"errors"`
+	Warnings int             `json:"warnings"`
+}
+
+// summarizeDiagnostics counts the errors and warnings of the given .ino tabs, the tabs
+// without published diagnostics are reported with zero counts.
+func summarizeDiagnostics(inoURIs []lsp.DocumentURI, allIdeParams map[lsp.DocumentURI]*lsp.PublishDiagnosticsParams) DiagnosticsSummary {
+	summary := DiagnosticsSummary{Tabs: []TabDiagnosticsSummary{}}
+	for _, inoURI := range inoURIs {
+		tab := TabDiagnosticsSummary{URI: inoURI}
+		if ideParams, ok := allIdeParams[inoURI]; ok {
+			for _, diag := range ideParams.Diagnostics {
+				switch diag.Severity {
+				case lsp.DiagnosticSeverityError:
+					tab.Errors++
+				case lsp.DiagnosticSeverityWarning:
+					tab.Warnings++
+				}
+			}
+		}
+		summary.Tabs = append(summary.Tabs, tab)
+	}
+	sort.Slice(summary.Tabs, func(i, j int) bool { return summary.Tabs[i].URI.String() < summary.Tabs[j].URI.String() })
+	return summary
+}
+
+// sendDiagnosticsSummary sends to the IDE the summary of the diagnostics just published
+// on the .ino tabs.
+func (ls *INOLanguageServer) sendDiagnosticsSummary(logger jsonrpc.FunctionLogger, allIdeParams map[lsp.DocumentURI]*lsp.PublishDiagnosticsParams) {
+	inoURIs := []lsp.DocumentURI{}
+	seen := map[lsp.DocumentURI]bool{}
+	addTab := func(uri lsp.DocumentURI) {
+		if !seen[uri] && uri.Ext() == ".ino" {
+			seen[uri] = true
+			inoURIs = append(inoURIs, uri)
+		}
+	}
+	for _, doc := range ls.trackedIdeDocs {
+		addTab(doc.URI)
+	}
+	for ideURI := range allIdeParams {
+		addTab(ideURI)
+	}
+
+	summary := summarizeDiagnostics(inoURIs, allIdeParams)
+	ls.IDE.sendCustomNotification(logger, "arduino/diagnosticsSummary", summary)
+}
@@ -0,0 +1,143 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"go.bug.st/json"
+)
+
+func TestAddDiagnosticCodeDescription(t *testing.T) {
+	tests := []struct {
+		code     string
+		message  string
+		expected string
+	}{
+		{diagnosticCodeMissingSetup, "The sketch has no setup() function", "https://www.arduino.cc/reference/en/language/structure/sketch/setup/"},
+		{diagnosticCodeInvalidFqbn, "The selected board (arduino:avr:unoo) is not valid, select the board again", "https://docs.arduino.cc/software/ide-v2/tutorials/getting-started/ide-v2-uploading-a-sketch/"},
+		{diagnosticCodePlatformNotInstalled, "The platform of the selected board (arduino:samd:mkr1000) is not installed", "https://docs.arduino.cc/software/ide-v2/tutorials/ide-v2-board-manager/"},
+		{"pp_file_not_found", "'Servo.h' file not found", "https://docs.arduino.cc/software/ide-v2/tutorials/ide-v2-installing-a-library"},
+		// Misspelled Arduino API identifiers link to the reference of the right one
+		{"undeclared_var_use", "use of undeclared identifier 'digitalWrit'", "https://www.arduino.cc/reference/en/language/functions/digital-io/digitalwrite/"},
+		{"undeclared_var_use_suggest", "use of undeclared identifier 'pinmode'; did you mean 'pinMode'?", "https://www.arduino.cc/reference/en/language/functions/digital-io/pinmode/"},
+		{"undeclared_var_use", "use of undeclared identifier 'LED_BUILTIN'", "https://www.arduino.cc/reference/en/language/variables/constants/ledbuiltin/"},
+		// Other undeclared identifiers are not linked
+		{"undeclared_var_use", "use of undeclared identifier 'myCounter'", ""},
+		{"unknown_code", "some error", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.code+" "+test.message, func(t *testing.T) {
+			diag := lsp.Diagnostic{Message: test.message}
+			addDiagnosticCodeDescription(&diag, test.code)
+			if test.expected == "" {
+				require.Nil(t, diag.CodeDescription)
+			} else {
+				require.NotNil(t, diag.CodeDescription)
+				require.Equal(t, lsp.URI(test.expected), diag.CodeDescription.Href)
+			}
+		})
+	}
+
+	// An existing description is kept
+	diag := lsp.Diagnostic{CodeDescription: &lsp.CodeDescription{Href: "https://example.com"}}
+	addDiagnosticCodeDescription(&diag, diagnosticCodeMissingLoop)
+	require.Equal(t, lsp.URI("https://example.com"), diag.CodeDescription.Href)
+}
+
+func TestBoardConfigurationErrorCode(t *testing.T) {
+	require.Equal(t, diagnosticCodeInvalidFqbn, boardConfigurationErrorCode(errors.New("error running compile: rpc error: code = InvalidArgument desc = Invalid FQBN: not an FQBN: arduino")))
+	require.Equal(t, diagnosticCodeInvalidFqbn, boardConfigurationErrorCode(errors.New("running arduino-cli compile: exit status 1\n{\"error\": \"Error during build: Unknown FQBN: board arduino:avr:unoo not found\"}")))
+	require.Equal(t, diagnosticCodePlatformNotInstalled, boardConfigurationErrorCode(errors.New("Error during build: Platform 'arduino:samd' not found: platform not installed")))
+	require.Equal(t, "", boardConfigurationErrorCode(errors.New("build failed")))
+}
+
+func TestCheckSketchStructure(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	ino := ls.sketchRoot.Join("Sketch.ino").String()
+	line := func(n int) string { return "#line " + strconv.Itoa(n) + " \"" + ino + "\"\n" }
+
+	tests := []struct {
+		name     string
+		cpp      string
+		expected []string
+	}{
+		{"SetupAndLoop",
+			"#include <Arduino.h>\n" + line(1) + line(1) + "void setup();\n" + line(3) + "void loop();\n" +
+				line(1) + "void setup() {\n}\n\nvoid loop() {\n}\n",
+			nil},
+		{"MissingSetup",
+			"#include <Arduino.h>\n" + line(1) + "// void setup() {}\n" + line(2) + "void loop();\n" +
+				line(2) + "void loop() {\n}\n",
+			[]string{diagnosticCodeMissingSetup}},
+		{"MissingLoop",
+			"#include <Arduino.h>\n" + line(1) + line(1) + "void setup();\n" +
+				line(1) + "void setup() {\n}\n",
+			[]string{diagnosticCodeMissingLoop}},
+		{"SetupDeclaredInTheSketch",
+			"#include <Arduino.h>\n" + line(1) + "void setup();\n" + line(2) + "void loop();\n" +
+				line(2) + "void loop() {\n}\nvoid setup() {\n}\n",
+			nil},
+		{"NoPrototypes",
+			"#include <Arduino.h>\n" + line(1) + "int x;\n",
+			nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ls.sketchMapper = sourcemapper.CreateInoMapper([]byte(test.cpp))
+			ls.sketchStructureDiagnostics = nil
+			ls.checkSketchStructure(logger)
+
+			var codes []string
+			for _, diag := range ls.sketchStructureDiagnostics {
+				var code string
+				require.NoError(t, json.Unmarshal(diag.Code, &code))
+				codes = append(codes, code)
+			}
+			require.Equal(t, test.expected, codes)
+		})
+	}
+}
+
+func TestSummarizeDiagnostics(t *testing.T) {
+	mainIno := lsp.NewDocumentURI("/sketch/Sketch.ino")
+	otherTab := lsp.NewDocumentURI("/sketch/Other.ino")
+	cleanTab := lsp.NewDocumentURI("/sketch/Clean.ino")
+	allIdeParams := map[lsp.DocumentURI]*lsp.PublishDiagnosticsParams{
+		mainIno: {URI: mainIno, Diagnostics: []lsp.Diagnostic{
+			{Severity: lsp.DiagnosticSeverityError},
+			{Severity: lsp.DiagnosticSeverityError},
+			{Severity: lsp.DiagnosticSeverityWarning},
+			{Severity: lsp.DiagnosticSeverityHint},
+		}},
+		otherTab: {URI: otherTab, Diagnostics: []lsp.Diagnostic{
+			{Severity: lsp.DiagnosticSeverityWarning},
+		}},
+	}
+	summary := summarizeDiagnostics([]lsp.DocumentURI{mainIno, otherTab, cleanTab}, allIdeParams)
+	require.Equal(t, []TabDiagnosticsSummary{
+		{URI: cleanTab},
+		{URI: otherTab, Warnings: 1},
+		{URI: mainIno, Errors: 2, Warnings: 1},
+	}, summary.Tabs)
+}
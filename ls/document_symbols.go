@@ -0,0 +1,70 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"github.com/vincecity/go-lsp"
+)
+
+// documentSymbolsLabel is shown by the IDEs supporting multiple outlines for the same document
+const documentSymbolsLabel = "Arduino"
+
+// ideSupportsHierarchicalDocumentSymbols returns true if the IDE accepts the document symbols
+// in the hierarchical form (DocumentSymbol) rather than in the flat one (SymbolInformation)
+func ideSupportsHierarchicalDocumentSymbols(ideParams *lsp.InitializeParams) bool {
+	if ideParams == nil || ideParams.Capabilities.TextDocument == nil {
+		return false
+	}
+	documentSymbol := ideParams.Capabilities.TextDocument.DocumentSymbol
+	return documentSymbol != nil && documentSymbol.HierarchicalDocumentSymbolSupport
+}
+
+// withHierarchicalDocumentSymbols returns a copy of the capabilities of the IDE requesting
+// the hierarchical document symbols: they carry the ranges of the containers, needed to
+// keep only the symbols of the requested tab when they are converted, and are flattened
+// afterwards for the IDEs accepting only the flat form.
+func withHierarchicalDocumentSymbols(capabilities lsp.ClientCapabilities) lsp.ClientCapabilities {
+	textDocument := lsp.TextDocumentClientCapabilities{}
+	if capabilities.TextDocument != nil {
+		textDocument = *capabilities.TextDocument
+	}
+	documentSymbol := lsp.DocumentSymbolClientCapabilities{}
+	if textDocument.DocumentSymbol != nil {
+		documentSymbol = *textDocument.DocumentSymbol
+	}
+	documentSymbol.HierarchicalDocumentSymbolSupport = true
+	textDocument.DocumentSymbol = &documentSymbol
+	capabilities.TextDocument = &textDocument
+	return capabilities
+}
+
+// flattenDocumentSymbols converts the document symbols of the given document into the flat
+// form, naming the container of each symbol after its parent
+func flattenDocumentSymbols(symbols []lsp.DocumentSymbol, uri lsp.DocumentURI, containerName string) []lsp.SymbolInformation {
+	res := []lsp.SymbolInformation{}
+	for _, symbol := range symbols {
+		res = append(res, lsp.SymbolInformation{
+			Name:          symbol.Name,
+			Kind:          symbol.Kind,
+			Tags:          symbol.Tags,
+			Deprecated:    symbol.Deprecated,
+			Location:      lsp.Location{URI: uri, Range: symbol.Range},
+			ContainerName: containerName,
+		})
+		res = append(res, flattenDocumentSymbols(symbol.Children, uri, symbol.Name)...)
+	}
+	return res
+}
@@ -0,0 +1,84 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestDeprecatedSymbolTags(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	cppURI := lsp.NewDocumentURIFromPath(ls.buildSketchCpp)
+	inoURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+
+	require.Nil(t, ls.clang2IdeSymbolTags(logger, nil, false))
+	require.Equal(t, []lsp.SymbolTag{lsp.SymbolTagDeprecated}, ls.clang2IdeSymbolTags(logger, nil, true))
+	require.Equal(t, []lsp.SymbolTag{lsp.SymbolTagDeprecated}, ls.clang2IdeSymbolTags(logger, []lsp.SymbolTag{lsp.SymbolTagDeprecated}, true))
+
+	// The deprecation reported by clangd is kept on the .ino symbols
+	ideSymbols, err := ls.clang2IdeDocumentSymbols(logger, []lsp.DocumentSymbol{
+		{Name: "setup", Kind: lsp.SymbolKindFunction, Range: testRange(2, 0, 2, 15), SelectionRange: testRange(2, 5, 2, 10), Deprecated: true},
+		{Name: "loop", Kind: lsp.SymbolKindFunction, Range: testRange(3, 0, 3, 14), SelectionRange: testRange(3, 5, 3, 9)},
+	}, cppURI, inoURI)
+	require.NoError(t, err)
+	require.Len(t, ideSymbols, 2)
+	require.True(t, ideSymbols[0].Deprecated)
+	require.Equal(t, []lsp.SymbolTag{lsp.SymbolTagDeprecated}, ideSymbols[0].Tags)
+	require.Empty(t, ideSymbols[1].Tags)
+
+	ideSymbolsInformation := ls.clang2IdeSymbolsInformation(logger, []lsp.SymbolInformation{
+		{Name: "setup", Location: lsp.Location{URI: cppURI, Range: testRange(2, 0, 2, 15)}, Deprecated: true},
+	})
+	require.Equal(t, []lsp.SymbolTag{lsp.SymbolTagDeprecated}, ideSymbolsInformation[0].Tags)
+}
+
+func TestFlattenDocumentSymbols(t *testing.T) {
+	uri := lsp.NewDocumentURI("/Sketch/Sketch.ino")
+	symbols := []lsp.DocumentSymbol{
+		{
+			Name: "Led", Kind: lsp.SymbolKindClass, Range: testRange(0, 0, 4, 2),
+			Children: []lsp.DocumentSymbol{
+				{Name: "on", Kind: lsp.SymbolKindMethod, Range: testRange(1, 2, 1, 12), Tags: []lsp.SymbolTag{lsp.SymbolTagDeprecated}, Deprecated: true},
+			},
+		},
+		{Name: "setup", Kind: lsp.SymbolKindFunction, Range: testRange(5, 0, 5, 15)},
+	}
+	require.Equal(t, []lsp.SymbolInformation{
+		{Name: "Led", Kind: lsp.SymbolKindClass, Location: lsp.Location{URI: uri, Range: testRange(0, 0, 4, 2)}},
+		{Name: "on", Kind: lsp.SymbolKindMethod, Location: lsp.Location{URI: uri, Range: testRange(1, 2, 1, 12)}, Tags: []lsp.SymbolTag{lsp.SymbolTagDeprecated}, Deprecated: true, ContainerName: "Led"},
+		{Name: "setup", Kind: lsp.SymbolKindFunction, Location: lsp.Location{URI: uri, Range: testRange(5, 0, 5, 15)}},
+	}, flattenDocumentSymbols(symbols, uri, ""))
+}
+
+func TestHierarchicalDocumentSymbolsCapability(t *testing.T) {
+	require.False(t, ideSupportsHierarchicalDocumentSymbols(nil))
+	require.False(t, ideSupportsHierarchicalDocumentSymbols(&lsp.InitializeParams{}))
+
+	// clangd is always asked for the hierarchical form, the capabilities of the IDE are not changed
+	ideParams := &lsp.InitializeParams{Capabilities: lsp.ClientCapabilities{
+		TextDocument: &lsp.TextDocumentClientCapabilities{DocumentSymbol: &lsp.DocumentSymbolClientCapabilities{DynamicRegistration: true}},
+	}}
+	clangCapabilities := withHierarchicalDocumentSymbols(ideParams.Capabilities)
+	require.True(t, clangCapabilities.TextDocument.DocumentSymbol.HierarchicalDocumentSymbolSupport)
+	require.True(t, clangCapabilities.TextDocument.DocumentSymbol.DynamicRegistration)
+	require.False(t, ideSupportsHierarchicalDocumentSymbols(ideParams))
+	require.True(t, withHierarchicalDocumentSymbols(lsp.ClientCapabilities{}).TextDocument.DocumentSymbol.HierarchicalDocumentSymbolSupport)
+}
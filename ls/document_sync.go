@@ -0,0 +1,128 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// resyncSavedDocument compares the content of a document saved in the IDE (included in the
+// save notification or read from the saved file) with the content tracked by the language
+// server. If they differ, for example because a change has been lost, the tracked content
+// is replaced with the saved one, as a change of the whole document: the sketch mapper and
+// clangd are updated too. The caller must hold the write-lock.
+func (ls *INOLanguageServer) resyncSavedDocument(logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI, savedText string) bool {
+	doc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]
+	if !ok || doc.Text == savedText {
+		return false
+	}
+	logger.Logf("The tracked content of %s (version %d) differs from the saved one: resynchronizing", ideURI, doc.Version)
+	wholeDocument := fullDocumentRange(doc.Text)
+	ls.applyIdeDocumentChanges(logger, &lsp.DidChangeTextDocumentParams{
+		TextDocument: lsp.VersionedTextDocumentIdentifier{
+			TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: doc.URI},
+			Version:                doc.Version,
+		},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{Range: &wholeDocument, Text: savedText}},
+	})
+	return true
+}
+
+// fullDocumentRange returns the range covering the whole given text
+func fullDocumentRange(text string) lsp.Range {
+	lines := textutils.SplitLines(text)
+	lastLine := len(lines) - 1
+	return lsp.Range{
+		End: lsp.Position{Line: lastLine, Character: len(utf16.Encode([]rune(lines[lastLine])))},
+	}
+}
+
+// DocumentChecksumParams are the parameters of the "arduino/documentChecksum" notification,
+// sent by the IDE to check that the content of a document tracked by the language server
+// is the same as the one in the editor
+type DocumentChecksumParams struct {
+	TextDocument lsp.VersionedTextDocumentIdentifier `json:"textDocument"`
+	// SHA256 is the hex encoded SHA-256 hash of the (UTF-8) text of the document
+	SHA256 string `json:"sha256"`
+}
+
+// DocumentOutOfSyncParams are the parameters of the "arduino/documentOutOfSync" notification,
+// sent to the IDE to ask for the full content of a document that can't be trusted anymore:
+// the IDE should close and reopen the document.
+type DocumentOutOfSyncParams struct {
+	TextDocument lsp.VersionedTextDocumentIdentifier `json:"textDocument"`
+}
+
+// documentChecksum returns the hex encoded SHA-256 hash of the given text
+func documentChecksum(text string) string {
+	hash := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(hash[:])
+}
+
+func (ls *INOLanguageServer) documentChecksumNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *DocumentChecksumParams) {
+	ls.writeLock(logger, true)
+	defer ls.writeUnlock(logger)
+	ls.verifyDocumentChecksum(logger, ideParams)
+}
+
+// verifyDocumentChecksum compares the checksum of a document computed by the IDE with the
+// one of the content tracked by the language server, after all the changes received so
+// far. A mismatch means that the ranges converted in the document (and the sketch mapper,
+// for the .ino tabs) are wrong: the IDE is asked for the full content of the document, and
+// the sketch is rebuilt when it's reopened (see checkOutOfSyncDoc). The checksums of other
+// versions of the document can't be compared and are ignored. It returns true if the
+// document is out of sync. The caller must hold the write lock.
+func (ls *INOLanguageServer) verifyDocumentChecksum(logger jsonrpc.FunctionLogger, ideParams *DocumentChecksumParams) bool {
+	ideURI := ideParams.TextDocument.URI
+	doc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]
+	if !ok {
+		logger.Logf("Checksum of untracked document: %s", ideURI)
+		return false
+	}
+	if doc.Version != ideParams.TextDocument.Version {
+		logger.Logf("Checksum of %s version %d ignored: tracked version is %d", ideURI, ideParams.TextDocument.Version, doc.Version)
+		return false
+	}
+	if strings.EqualFold(documentChecksum(doc.Text), ideParams.SHA256) {
+		return false
+	}
+	logger.Logf("The tracked content of %s (version %d) differs from the one in the IDE: requesting a refresh", ideURI, doc.Version)
+	ls.outOfSyncIdeDocs[doc.URI] = true
+	ls.IDE.sendCustomNotification(logger, "arduino/documentOutOfSync", &DocumentOutOfSyncParams{
+		TextDocument: ideParams.TextDocument,
+	})
+	return true
+}
+
+// checkOutOfSyncDoc rebuilds the sketch when a document found out of sync is reopened by
+// the IDE: the preprocessed sketch, and its mapper, are generated again from the refreshed
+// content. The caller must hold the write lock.
+func (ls *INOLanguageServer) checkOutOfSyncDoc(logger jsonrpc.FunctionLogger, doc lsp.TextDocumentItem) {
+	if !ls.outOfSyncIdeDocs[doc.URI] {
+		return
+	}
+	delete(ls.outOfSyncIdeDocs, doc.URI)
+	logger.Logf("%s has been refreshed by the IDE", doc.URI)
+	ls.sketchRebuilder.ForgetLastBuild()
+	ls.triggerRebuild()
+}
@@ -0,0 +1,103 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestResyncSavedDocument(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	var clangd bytes.Buffer
+	ls.Clangd = &clangdLSPClient{conn: lsp.NewClient(&bytes.Buffer{}, &clangd, nil)}
+	ls.IDE = &IDELSPServer{conn: lsp.NewServer(&bytes.Buffer{}, &bytes.Buffer{}, nil)}
+	ls.config = &Config{}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	ino := ls.sketchRoot.Join("Sketch.ino")
+	helper := ls.sketchRoot.Join("Helper.h")
+
+	// Nothing to do if the tracked content matches the saved one
+	require.False(t, ls.resyncSavedDocument(logger, lsp.NewDocumentURIFromPath(helper), "#pragma once\n\nvoid helper();\nint counter;\n"))
+	require.Empty(t, clangd.String())
+
+	// The whole document is replaced in clangd
+	saved := "#pragma once\n\nvoid helper();\nint counter = 1;\n"
+	require.True(t, ls.resyncSavedDocument(logger, lsp.NewDocumentURIFromPath(helper), saved))
+	require.Equal(t, saved, ls.trackedIdeDocs[helper.String()].Text)
+	require.Contains(t, clangd.String(), `"method":"textDocument/didChange"`)
+	require.Contains(t, clangd.String(), ls.buildSketchRoot.Join("Helper.h").String())
+	require.Contains(t, clangd.String(), `int counter = 1;`)
+
+	// The .ino tabs are replaced in the preprocessed sketch
+	clangd.Reset()
+	saved = "void setup() {}\nvoid loop() { delay(1); }\n"
+	require.True(t, ls.resyncSavedDocument(logger, lsp.NewDocumentURIFromPath(ino), saved))
+	require.Equal(t, saved, ls.trackedIdeDocs[ino.String()].Text)
+	require.Contains(t, ls.sketchMapper.CppText.Text, "void loop() { delay(1); }")
+	require.NotContains(t, ls.sketchMapper.CppText.Text, "void loop() {}")
+	require.Contains(t, clangd.String(), ls.buildSketchCpp.String())
+
+	// The documents not tracked are ignored
+	require.False(t, ls.resyncSavedDocument(logger, lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Other.cpp")), "int x;\n"))
+}
+
+func TestFullDocumentRange(t *testing.T) {
+	require.Equal(t, testRange(0, 0, 0, 0), fullDocumentRange(""))
+	require.Equal(t, testRange(0, 0, 2, 0), fullDocumentRange("a\nb\n"))
+	require.Equal(t, testRange(0, 0, 2, 0), fullDocumentRange("a\r\nb\r\n"))
+	require.Equal(t, testRange(0, 0, 1, 3), fullDocumentRange("a\r\nbcd"))
+	require.Equal(t, testRange(0, 0, 1, 2), fullDocumentRange("a\n€x"))
+}
+
+func TestVerifyDocumentChecksum(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	var ide bytes.Buffer
+	ls.IDE = &IDELSPServer{conn: lsp.NewServer(&bytes.Buffer{}, &ide, nil)}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	helper := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h"))
+	checksum := func(uri lsp.DocumentURI, version int, sha string) *DocumentChecksumParams {
+		return &DocumentChecksumParams{
+			TextDocument: lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: uri}, Version: version},
+			SHA256:       sha,
+		}
+	}
+
+	// The checksum matches the tracked content
+	require.False(t, ls.verifyDocumentChecksum(logger, checksum(helper, 0, documentChecksum("#pragma once\n\nvoid helper();\nint counter;\n"))))
+	require.False(t, ls.verifyDocumentChecksum(logger, checksum(helper, 0, strings.ToUpper(documentChecksum("#pragma once\n\nvoid helper();\nint counter;\n")))))
+	require.Empty(t, ide.String())
+
+	// Other versions and untracked documents can't be compared
+	require.False(t, ls.verifyDocumentChecksum(logger, checksum(helper, 1, documentChecksum("int x;\n"))))
+	require.False(t, ls.verifyDocumentChecksum(logger, checksum(lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Other.cpp")), 0, documentChecksum("int x;\n"))))
+	require.Empty(t, ide.String())
+
+	// The IDE is asked to refresh the document
+	require.True(t, ls.verifyDocumentChecksum(logger, checksum(helper, 0, documentChecksum("int x;\n"))))
+	require.True(t, ls.outOfSyncIdeDocs[helper])
+	require.Contains(t, ide.String(), `"method":"arduino/documentOutOfSync"`)
+	require.Contains(t, ide.String(), helper.String())
+}
+
+func TestDocumentChecksum(t *testing.T) {
+	require.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", documentChecksum(""))
+}
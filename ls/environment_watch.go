@@ -0,0 +1,149 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// environmentWatchedFilesRegistrationID identifies the registration of the watchers on the
+// libraries and platform folders, separated from the one of the sketch files since it's
+// replaced when the board is changed.
+const environmentWatchedFilesRegistrationID = "arduino/environmentWatchedFiles"
+
+// environmentWatchedFolders returns the folders that, when changed, require the build
+// environment to be refreshed: the user's libraries and the folders of the platform of
+// the board (installed by the boards manager or manually in the sketchbook).
+func environmentWatchedFolders(dataFolder, userFolder *paths.Path, fqbn string) paths.PathList {
+	res := paths.PathList{}
+	if userFolder != nil {
+		res.Add(userFolder.Join("libraries"))
+	}
+	fqbnParts := strings.Split(fqbn, ":")
+	if len(fqbnParts) < 3 {
+		return res
+	}
+	vendor, arch := fqbnParts[0], fqbnParts[1]
+	if dataFolder != nil {
+		res.Add(dataFolder.Join("packages", vendor, "hardware", arch))
+	}
+	if userFolder != nil {
+		res.Add(userFolder.Join("hardware", vendor, arch))
+	}
+	return res
+}
+
+// environmentWatchersOptions returns the registration options of the watchers on the
+// given folders. The glob patterns are absolute, since the folders are outside of the
+// workspace.
+func environmentWatchersOptions(folders paths.PathList) (json.RawMessage, error) {
+	type watcher struct {
+		GlobPattern string `json:"globPattern"`
+	}
+	watchers := []watcher{}
+	for _, folder := range folders {
+		watchers = append(watchers, watcher{GlobPattern: filepath.ToSlash(folder.String()) + "/**"})
+	}
+	return json.Marshal(map[string]interface{}{"watchers": watchers})
+}
+
+// registerEnvironmentWatchedFiles asks the IDE to notify the changes in the libraries and
+// platform folders, so the build environment is refreshed when libraries or platforms are
+// installed, updated or removed outside of the IDE, even without a connection to the
+// arduino-cli daemon. The watchers of the previous board (if any) are replaced.
+func (ls *INOLanguageServer) registerEnvironmentWatchedFiles(logger jsonrpc.FunctionLogger) {
+	if !ideSupportsWatchedFilesRegistration(ls.ideInitializeParams) {
+		logger.Logf("IDE does not support dynamic registration of watched files")
+		return
+	}
+
+	// arduino-cli is queried before taking the lock, to not stall the IDE requests
+	dataFolder, err := ls.extractDataFolderFromArduinoCLI(logger)
+	if err != nil {
+		logger.Logf("Error retrieving data folder from arduino-cli: %s", err)
+	}
+	userFolder, err := ls.extractUserFolderFromArduinoCLI(logger)
+	if err != nil {
+		logger.Logf("Error retrieving user folder from arduino-cli: %s", err)
+	}
+	folders := environmentWatchedFolders(dataFolder, userFolder, ls.currentFqbn(logger))
+
+	ls.writeLock(logger, false)
+	defer ls.writeUnlock(logger)
+	if ls.environmentWatchedFolders != nil && slices.EqualFunc(folders, ls.environmentWatchedFolders, (*paths.Path).EquivalentTo) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if ls.environmentWatchedFolders != nil {
+		if respErr, err := ls.IDE.conn.ClientUnregisterCapability(ctx, &lsp.UnregistrationParams{
+			Unregisterations: []lsp.Unregistration{{
+				ID:     environmentWatchedFilesRegistrationID,
+				Method: "workspace/didChangeWatchedFiles",
+			}},
+		}); err != nil {
+			logger.Logf("Error unregistering libraries and platform watched files: %s", err)
+		} else if respErr != nil {
+			logger.Logf("IDE refused libraries and platform watched files unregistration: %s", respErr.AsError())
+		}
+		ls.environmentWatchedFolders = nil
+	}
+	if len(folders) == 0 {
+		return
+	}
+
+	options, err := environmentWatchersOptions(folders)
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return
+	}
+	if respErr, err := ls.IDE.conn.ClientRegisterCapability(ctx, &lsp.RegistrationParams{
+		Registrations: []lsp.Registration{{
+			ID:              environmentWatchedFilesRegistrationID,
+			Method:          "workspace/didChangeWatchedFiles",
+			RegisterOptions: options,
+		}},
+	}); err != nil {
+		logger.Logf("Error registering libraries and platform watched files: %s", err)
+		return
+	} else if respErr != nil {
+		logger.Logf("IDE refused libraries and platform watched files registration: %s", respErr.AsError())
+		return
+	}
+	logger.Logf("Watching libraries and platform folders: %s", folders)
+	ls.environmentWatchedFolders = folders
+}
+
+// isEnvironmentPath returns true if the given path is inside one of the libraries or
+// platform folders watched. The caller must hold the lock.
+func (ls *INOLanguageServer) isEnvironmentPath(path *paths.Path) bool {
+	for _, folder := range ls.environmentWatchedFolders {
+		if inside, _ := path.IsInsideDir(folder); inside || path.EquivalentTo(folder) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestEnvironmentWatchedFolders(t *testing.T) {
+	data := paths.New("/data")
+	user := paths.New("/user")
+	require.Equal(t, paths.PathList{
+		paths.New("/user/libraries"),
+		paths.New("/data/packages/arduino/hardware/avr"),
+		paths.New("/user/hardware/arduino/avr"),
+	}, environmentWatchedFolders(data, user, "arduino:avr:uno"))
+	require.Equal(t, paths.PathList{paths.New("/user/libraries")}, environmentWatchedFolders(data, user, ""))
+	require.Equal(t, paths.PathList{paths.New("/data/packages/esp32/hardware/esp32")}, environmentWatchedFolders(data, nil, "esp32:esp32:esp32"))
+
+	options, err := environmentWatchersOptions(paths.PathList{paths.New("/user/libraries")})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"watchers":[{"globPattern":"/user/libraries/**"}]}`, string(options))
+}
+
+func TestEnvironmentChangedOnDisk(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.sketchRebuilder = &sketchRebuilder{ls: ls, trigger: make(chan struct{}, 1), cancel: func() {}}
+	ls.config = &Config{RebuildPolicy: RebuildPolicyOnSave}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	libraries := paths.New(t.TempDir()).Join("libraries")
+	ls.environmentWatchedFolders = paths.PathList{libraries}
+	changed := func(path *paths.Path) {
+		ls.workspaceDidChangeWatchedFilesNotifFromIDE(logger, &lsp.DidChangeWatchedFilesParams{
+			Changes: []lsp.FileEvent{{URI: lsp.NewDocumentURIFromPath(path), Type: 1}},
+		})
+	}
+
+	// Files outside of the sketch and of the watched folders are ignored
+	changed(paths.New(t.TempDir()).Join("Other", "Other.h"))
+	require.Empty(t, ls.sketchRebuilder.trigger)
+
+	// A library installed refreshes the build environment
+	ls.sketchRebuilder.lastIncludes = []string{"Servo.h"}
+	changed(libraries.Join("Servo", "library.properties"))
+	require.Len(t, ls.sketchRebuilder.trigger, 1)
+	require.Nil(t, ls.sketchRebuilder.lastIncludes)
+}
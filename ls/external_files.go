@@ -0,0 +1,172 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// ExternalFilesPolicy defines how the files opened in the IDE from outside of the sketch
+// (for example the sources of an installed library) are analyzed
+type ExternalFilesPolicy string
+
+const (
+	// ExternalFilesSketchFlags compiles the external source files with the flags of the sketch,
+	// unless they are already compiled with the sketch (like the libraries it uses)
+	ExternalFilesSketchFlags ExternalFilesPolicy = "sketch-flags"
+	// ExternalFilesStandalone compiles the external source files on their own, in their folder,
+	// without the flags of the sketch
+	ExternalFilesStandalone ExternalFilesPolicy = "standalone"
+	// ExternalFilesDecline doesn't analyze the external files: the requests on them are declined
+	ExternalFilesDecline ExternalFilesPolicy = "decline"
+)
+
+// ExternalFileDeclinedError is returned for the requests on the files outside of the sketch,
+// when their analysis is disabled with the "decline" external files policy
+type ExternalFileDeclinedError struct {
+	URI lsp.DocumentURI
+}
+
+func (e *ExternalFileDeclinedError) Error() string {
+	return "Files outside of the sketch are not analyzed: " + e.URI.String()
+}
+
+// externalFilesPolicy returns the configured policy for the external files
+func (ls *INOLanguageServer) externalFilesPolicy() ExternalFilesPolicy {
+	if ls.config.ExternalFiles != "" {
+		return ls.config.ExternalFiles
+	}
+	return ExternalFilesSketchFlags
+}
+
+// isExternalFile returns true if the given file is neither in the sketch, nor in the library
+// being developed, nor in the build folder
+func (ls *INOLanguageServer) isExternalFile(path *paths.Path) bool {
+	for _, root := range []*paths.Path{ls.sketchRoot, ls.libraryRoot, ls.buildPath} {
+		if root == nil {
+			continue
+		}
+		if inside, _ := path.IsInsideDir(root); inside {
+			return false
+		}
+	}
+	return true
+}
+
+// externalFileCompileCommand returns the compile command of an external source file built
+// from a command of the sketch compiling the same language: the .ino.cpp one for the C++
+// files, the first C or assembly file (usually a core source) for the others.
+func externalFileCompileCommand(db *compilationDatabase, sketchCpp, file *paths.Path) (*compileCommand, bool) {
+	var template *compileCommand
+	for i, cmd := range db.Contents {
+		cmdFile := paths.New(cmd.File)
+		switch file.Ext() {
+		case ".c", ".S":
+			if cmdFile.Ext() == file.Ext() && template == nil {
+				template = &db.Contents[i]
+			}
+		default:
+			if cmdFile.EquivalentTo(sketchCpp) {
+				template = &db.Contents[i]
+			}
+		}
+	}
+	if template == nil || len(template.Arguments) == 0 {
+		return nil, false
+	}
+
+	args := []string{}
+	for i := 0; i < len(template.Arguments); i++ {
+		arg := template.Arguments[i]
+		switch {
+		case arg == "-o":
+			i++ // Skip the object file
+		case arg == template.File:
+			args = append(args, file.String())
+		default:
+			args = append(args, arg)
+		}
+	}
+	return &compileCommand{Directory: template.Directory, Arguments: args, File: file.String()}, true
+}
+
+// standaloneCompileCommand returns the compile command of an external source file compiled
+// on its own in its folder
+func standaloneCompileCommand(file *paths.Path) *compileCommand {
+	compiler := "clang++"
+	if file.Ext() == ".c" {
+		compiler = "clang"
+	}
+	folder := file.Parent()
+	return &compileCommand{
+		Directory: folder.String(),
+		Arguments: []string{compiler, "-I" + folder.String(), "-c", file.String()},
+		File:      file.String(),
+	}
+}
+
+// setExternalFileCompileCommand tells clangd how to compile the external source file, opened
+// in the IDE, according to the external files policy. The headers are left to clangd, that
+// infers their flags from the files including them. The caller must hold the lock.
+func (ls *INOLanguageServer) setExternalFileCompileCommand(logger jsonrpc.FunctionLogger, file *paths.Path) error {
+	if isHeaderFile(file) || !isSketchSourceFile(file) {
+		return nil
+	}
+
+	var cmd *compileCommand
+	switch ls.externalFilesPolicy() {
+	case ExternalFilesStandalone:
+		cmd = standaloneCompileCommand(file)
+	case ExternalFilesSketchFlags:
+		db, err := loadCompilationDatabase(clangdCompilationDatabaseDir(ls.buildPath).Join("compile_commands.json"))
+		if err != nil {
+			return fmt.Errorf("loading compile_commands.json: %w", err)
+		}
+		for _, compiled := range db.Contents {
+			if paths.New(compiled.File).EquivalentTo(file) {
+				logger.Logf("%s is compiled with the sketch", file)
+				return nil
+			}
+		}
+		res, ok := externalFileCompileCommand(db, ls.buildSketchCpp, file)
+		if !ok {
+			return fmt.Errorf("no compile command of the sketch for %s", file)
+		}
+		cmd = res
+	default:
+		return nil
+	}
+
+	logger.Logf("Compile command of %s: %s", file, cmd.Arguments)
+	type compileCommandChange struct {
+		WorkingDirectory   string   `json:"workingDirectory"`
+		CompilationCommand []string `json:"compilationCommand"`
+	}
+	settings, err := json.Marshal(map[string]interface{}{
+		"compilationDatabaseChanges": map[string]compileCommandChange{
+			file.String(): {WorkingDirectory: cmd.Directory, CompilationCommand: cmd.Arguments},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return ls.Clangd.conn.WorkspaceDidChangeConfiguration(&lsp.DidChangeConfigurationParams{Settings: settings})
+}
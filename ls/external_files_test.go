@@ -0,0 +1,109 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+func TestExternalFileCompileCommand(t *testing.T) {
+	sketchCpp := paths.New("/build/sketch/Sketch.ino.cpp")
+	db := &compilationDatabase{Contents: []compileCommand{
+		{Directory: "/build", File: "/core/wiring.c", Arguments: []string{"gcc", "-std=gnu11", "-c", "/core/wiring.c", "-o", "/build/core/wiring.c.o"}},
+		{Directory: "/build", File: "/build/sketch/Sketch.ino.cpp", Arguments: []string{"g++", "-std=gnu++11", "-DARDUINO=10607", "-c", "/build/sketch/Sketch.ino.cpp", "-o", "/build/sketch/Sketch.ino.cpp.o"}},
+	}}
+
+	cmd, ok := externalFileCompileCommand(db, sketchCpp, paths.New("/libraries/Servo/src/Servo.cpp"))
+	require.True(t, ok)
+	require.Equal(t, &compileCommand{
+		Directory: "/build",
+		File:      "/libraries/Servo/src/Servo.cpp",
+		Arguments: []string{"g++", "-std=gnu++11", "-DARDUINO=10607", "-c", "/libraries/Servo/src/Servo.cpp"},
+	}, cmd)
+
+	cmd, ok = externalFileCompileCommand(db, sketchCpp, paths.New("/libraries/Servo/src/avr.c"))
+	require.True(t, ok)
+	require.Equal(t, []string{"gcc", "-std=gnu11", "-c", "/libraries/Servo/src/avr.c"}, cmd.Arguments)
+
+	// No assembly file is compiled by the sketch
+	_, ok = externalFileCompileCommand(db, sketchCpp, paths.New("/libraries/Servo/src/avr.S"))
+	require.False(t, ok)
+
+	require.Equal(t, &compileCommand{
+		Directory: "/libraries/Servo/src",
+		File:      "/libraries/Servo/src/avr.c",
+		Arguments: []string{"clang", "-I/libraries/Servo/src", "-c", "/libraries/Servo/src/avr.c"},
+	}, standaloneCompileCommand(paths.New("/libraries/Servo/src/avr.c")))
+}
+
+func TestExternalFiles(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	var clangd bytes.Buffer
+	ls.Clangd = &clangdLSPClient{conn: lsp.NewClient(&bytes.Buffer{}, &clangd, nil)}
+	ls.config = &Config{}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	library := paths.New(t.TempDir()).Join("Servo")
+	servo := library.Join("Servo.cpp")
+
+	require.False(t, ls.isExternalFile(ls.sketchRoot.Join("Helper.h")))
+	require.False(t, ls.isExternalFile(ls.buildSketchCpp))
+	require.True(t, ls.isExternalFile(servo))
+
+	// The external sources get the flags of the sketch
+	clangdDir := clangdCompilationDatabaseDir(ls.buildPath)
+	require.NoError(t, clangdDir.MkdirAll())
+	db := &compilationDatabase{File: clangdDir.Join("compile_commands.json"), Contents: []compileCommand{
+		{Directory: ls.buildPath.String(), File: ls.buildSketchCpp.String(), Arguments: []string{"g++", "-DARDUINO=10607", "-c", ls.buildSketchCpp.String()}},
+	}}
+	require.NoError(t, db.save())
+	require.NoError(t, ls.setExternalFileCompileCommand(logger, servo))
+	require.Contains(t, clangd.String(), `"method":"workspace/didChangeConfiguration"`)
+	require.Contains(t, clangd.String(), `"compilationDatabaseChanges"`)
+	require.Contains(t, clangd.String(), `"-DARDUINO=10607"`)
+
+	// ...unless they are already compiled with the sketch
+	clangd.Reset()
+	db.Contents = append(db.Contents, compileCommand{Directory: ls.buildPath.String(), File: servo.String(), Arguments: []string{"g++", "-c", servo.String()}})
+	require.NoError(t, db.save())
+	require.NoError(t, ls.setExternalFileCompileCommand(logger, servo))
+	require.Empty(t, clangd.String())
+
+	// The headers are left to clangd
+	require.NoError(t, ls.setExternalFileCompileCommand(logger, library.Join("Servo.h")))
+	require.Empty(t, clangd.String())
+
+	// Compiled on their own
+	ls.config.ExternalFiles = ExternalFilesStandalone
+	require.NoError(t, ls.setExternalFileCompileCommand(logger, servo))
+	require.Contains(t, clangd.String(), `"workingDirectory":"`+library.String()+`"`)
+	require.NotContains(t, clangd.String(), `"-DARDUINO=10607"`)
+
+	// Declined
+	ls.config.ExternalFiles = ExternalFilesDecline
+	_, _, err := ls.ide2ClangDocumentURI(logger, lsp.NewDocumentURIFromPath(servo))
+	require.Equal(t, &ExternalFileDeclinedError{lsp.NewDocumentURIFromPath(servo)}, err)
+	require.Equal(t, jsonrpc.ErrorCodesInvalidParams, responseError(err).Code)
+	_, inSketch, err := ls.ide2ClangDocumentURI(logger, lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h")))
+	require.NoError(t, err)
+	require.True(t, inSketch)
+}
@@ -0,0 +1,647 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// fileOperationsMethods are the workspace file operations the language server
+// registers for, once the IDE has completed the initialization.
+var fileOperationsMethods = []string{
+	"workspace/willRenameFiles",
+	"workspace/didRenameFiles",
+	"workspace/didCreateFiles",
+	"workspace/didDeleteFiles",
+}
+
+// fileOperationsRegistrationOptions restricts the file operations to the sketch
+// source files and to the folders (that may contain source files).
+var fileOperationsRegistrationOptions = json.RawMessage(`{"filters":[` +
+	`{"scheme":"file","pattern":{"glob":"**/*.{ino,pde,h,hh,hpp,hxx,c,cc,cpp,cxx,S}","matches":"file"}},` +
+	`{"scheme":"file","pattern":{"glob":"**/*","matches":"folder"}}]}`)
+
+// watchedFilesRegistrationOptions asks the IDE to notify the changes on disk of the sketch
+// source files and of the ignore files.
+var watchedFilesRegistrationOptions = json.RawMessage(`{"watchers":[` +
+	`{"globPattern":"**/*.{ino,pde,h,hh,hpp,hxx,c,cc,cpp,cxx,S}"},` +
+	`{"globPattern":"**/{.gitignore,.arduinoignore}"}]}`)
+
+var includeDirectiveRegexp = regexp.MustCompile(`^\s*#\s*include\s*"([^"]+)"`)
+
+func isHeaderFile(path *paths.Path) bool {
+	switch path.Ext() {
+	case ".h", ".hh", ".hpp", ".hxx":
+		return true
+	}
+	return false
+}
+
+func isSketchSourceFile(path *paths.Path) bool {
+	switch path.Ext() {
+	case ".ino", ".pde", ".c", ".cc", ".cpp", ".cxx", ".S":
+		return true
+	}
+	return isHeaderFile(path)
+}
+
+// isCompiledSketchPath returns true if the given path is compiled with the sketch: arduino-cli
+// compiles the files in the sketch folder and, recursively, the files in its src subfolder
+// (the other subfolders are ignored).
+func (ls *INOLanguageServer) isCompiledSketchPath(path *paths.Path) bool {
+	if path.Parent().EquivalentTo(ls.sketchRoot) {
+		return true
+	}
+	inside, _ := path.IsInsideDir(ls.sketchRoot.Join("src"))
+	return inside
+}
+
+// registerFileOperations asks the IDE to send the workspace file operations
+// notifications, so the language server can follow the sketch files being
+// created, renamed or deleted.
+func (ls *INOLanguageServer) registerFileOperations(logger jsonrpc.FunctionLogger) {
+	if !ideSupportsFileOperationsRegistration(ls.ideInitializeParams) {
+		logger.Logf("IDE does not support dynamic registration of file operations")
+		return
+	}
+	registrations := []lsp.Registration{}
+	for _, method := range fileOperationsMethods {
+		registrations = append(registrations, lsp.Registration{
+			ID:              method,
+			Method:          method,
+			RegisterOptions: fileOperationsRegistrationOptions,
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if respErr, err := ls.IDE.conn.ClientRegisterCapability(ctx, &lsp.RegistrationParams{Registrations: registrations}); err != nil {
+		logger.Logf("Error registering file operations: %s", err)
+	} else if respErr != nil {
+		logger.Logf("IDE refused file operations registration: %s", respErr.AsError())
+	}
+}
+
+// ideSupportsFileOperationsRegistration returns true if the IDE declared support for the
+// dynamic registration of the workspace file operations.
+func ideSupportsFileOperationsRegistration(ideParams *lsp.InitializeParams) bool {
+	if ideParams == nil || ideParams.Capabilities.Workspace == nil {
+		return false
+	}
+	fileOperations := ideParams.Capabilities.Workspace.FileOperations
+	return fileOperations != nil && fileOperations.DynamicRegistration
+}
+
+// registerWatchedFiles asks the IDE to send the workspace/didChangeWatchedFiles notifications,
+// so the language server can follow the sketch files changed outside of the IDE.
+func (ls *INOLanguageServer) registerWatchedFiles(logger jsonrpc.FunctionLogger) {
+	if !ideSupportsWatchedFilesRegistration(ls.ideInitializeParams) {
+		logger.Logf("IDE does not support dynamic registration of watched files")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if respErr, err := ls.IDE.conn.ClientRegisterCapability(ctx, &lsp.RegistrationParams{
+		Registrations: []lsp.Registration{{
+			ID:              "workspace/didChangeWatchedFiles",
+			Method:          "workspace/didChangeWatchedFiles",
+			RegisterOptions: watchedFilesRegistrationOptions,
+		}},
+	}); err != nil {
+		logger.Logf("Error registering watched files: %s", err)
+	} else if respErr != nil {
+		logger.Logf("IDE refused watched files registration: %s", respErr.AsError())
+	}
+}
+
+// ideSupportsWatchedFilesRegistration returns true if the IDE declared support for the
+// dynamic registration of the watched files.
+func ideSupportsWatchedFilesRegistration(ideParams *lsp.InitializeParams) bool {
+	if ideParams == nil || ideParams.Capabilities.Workspace == nil {
+		return false
+	}
+	watchedFiles := ideParams.Capabilities.Workspace.DidChangeWatchedFiles
+	return watchedFiles != nil && watchedFiles.DynamicRegistration
+}
+
+// parseFileOperationURI converts the URI of a workspace file operation (sent by the IDE
+// as a plain string) into a DocumentURI.
+func parseFileOperationURI(uri string) (lsp.DocumentURI, error) {
+	res, err := lsp.NewDocumentURIFromURL(uri)
+	if err != nil {
+		return lsp.NilURI, fmt.Errorf("invalid URI %s: %w", uri, err)
+	}
+	return res, nil
+}
+
+// sketchSourceFiles returns the source files compiled with the sketch: the files in the sketch
+// folder and, recursively, the files in its src subfolder.
+func (ls *INOLanguageServer) sketchSourceFiles() (paths.PathList, error) {
+	files, err := ls.sketchRoot.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+	if srcFolder := ls.sketchRoot.Join("src"); srcFolder.IsDir() {
+		srcFiles, err := srcFolder.ReadDirRecursive()
+		if err != nil {
+			return nil, err
+		}
+		files.AddAll(srcFiles)
+	}
+	files.FilterOutDirs()
+	res := paths.PathList{}
+	for _, file := range files {
+		if isSketchSourceFile(file) {
+			res = append(res, file)
+		}
+	}
+	return res, nil
+}
+
+func (ls *INOLanguageServer) workspaceWillRenameFilesReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.RenameFilesParams) (*lsp.WorkspaceEdit, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	sourceFiles, err := ls.sketchSourceFiles()
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, responseError(err)
+	}
+
+	ideChanges := map[lsp.DocumentURI][]lsp.TextEdit{}
+	for _, rename := range ideParams.Files {
+		oldURI, err := parseFileOperationURI(rename.OldURI)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+		newURI, err := parseFileOperationURI(rename.NewURI)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+		oldPath := oldURI.AsPath()
+		newPath := newURI.AsPath()
+		if !isHeaderFile(oldPath) || !ls.ideURIIsPartOfTheSketch(oldURI) {
+			continue
+		}
+		logger.Logf("Fixing includes of %s renamed to %s", oldPath, newPath)
+
+		for _, sourceFile := range sourceFiles {
+			var text string
+			if doc, tracked := ls.trackedIdeDocs[sourceFile.String()]; tracked {
+				text = doc.Text
+			} else if data, err := sourceFile.ReadFile(); err == nil {
+				text = textutils.StripBOM(string(data))
+			} else {
+				logger.Logf("Error reading %s: %s", sourceFile, err)
+				continue
+			}
+			edits := renameIncludeDirectives(text, sourceFile.Parent(), oldPath, newPath)
+			if len(edits) == 0 {
+				continue
+			}
+			ideURI := lsp.NewDocumentURIFromPath(sourceFile)
+			ideChanges[ideURI] = append(ideChanges[ideURI], edits...)
+			logger.Logf("  > %d include(s) fixed in %s", len(edits), sourceFile)
+		}
+	}
+	return &lsp.WorkspaceEdit{Changes: ideChanges}, nil
+}
+
+// renameIncludeDirectives returns the edits needed to update all the `#include "..."`
+// directives in text (a source file in dir) that refer to oldHeader, so that they
+// refer to newHeader.
+func renameIncludeDirectives(text string, dir, oldHeader, newHeader *paths.Path) []lsp.TextEdit {
+	edits := []lsp.TextEdit{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for line := 0; scanner.Scan(); line++ {
+		lineText := scanner.Text()
+		match := includeDirectiveRegexp.FindStringSubmatchIndex(lineText)
+		if match == nil {
+			continue
+		}
+		included := lineText[match[2]:match[3]]
+		if !dir.Join(filepath.FromSlash(included)).EquivalentTo(oldHeader) {
+			continue
+		}
+		newIncluded := newHeader.Base()
+		if rel, err := newHeader.RelFrom(dir); err == nil {
+			newIncluded = filepath.ToSlash(rel.String())
+		}
+		start := len(utf16.Encode([]rune(lineText[:match[2]])))
+		end := start + len(utf16.Encode([]rune(included)))
+		edits = append(edits, lsp.TextEdit{
+			Range: lsp.Range{
+				Start: lsp.Position{Line: line, Character: start},
+				End:   lsp.Position{Line: line, Character: end},
+			},
+			NewText: newIncluded,
+		})
+	}
+	return edits
+}
+
+func (ls *INOLanguageServer) workspaceDidRenameFilesNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *lsp.RenameFilesParams) {
+	ls.writeLock(logger, true)
+
+	sketchRootRenamed := false
+	rebuild := false
+	renamedDocs := []lsp.TextDocumentItem{}
+	for _, rename := range ideParams.Files {
+		oldURI, err := parseFileOperationURI(rename.OldURI)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			continue
+		}
+		newURI, err := parseFileOperationURI(rename.NewURI)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			continue
+		}
+		oldPath := oldURI.AsPath()
+		newPath := newURI.AsPath()
+		logger.Logf("Renamed %s -> %s", oldPath, newPath)
+		rootRenamed := oldPath.EquivalentTo(ls.sketchRoot)
+		if rootRenamed {
+			sketchRootRenamed = true
+		} else if !ls.ideURIIsPartOfTheSketch(oldURI) {
+			continue
+		} else if !ls.ignoreRules.ignored(oldPath) || !ls.ignoreRules.ignored(newPath) {
+			rebuild = true
+		}
+
+		// Move all the tracked documents affected by the rename (the renamed file
+		// itself, or all the files inside the renamed folder).
+		for trackedPath, doc := range ls.trackedIdeDocs {
+			docPath := paths.New(trackedPath)
+			var newDocPath *paths.Path
+			if docPath.EquivalentTo(oldPath) {
+				newDocPath = newPath
+			} else if inside, _ := docPath.IsInsideDir(oldPath); inside {
+				rel, err := oldPath.RelTo(docPath)
+				if err != nil {
+					logger.Logf("Error: %s", err)
+					continue
+				}
+				newDocPath = newPath.JoinPath(rel)
+			} else {
+				continue
+			}
+
+			if !rootRenamed && docPath.Ext() != ".ino" {
+				// The copy in the build folder is going to be replaced by the rebuild
+				if clangURI, _, err := ls.ide2ClangDocumentURI(logger, doc.URI); err != nil {
+					logger.Logf("Error: %s", err)
+				} else {
+					if err := ls.Clangd.conn.TextDocumentDidClose(&lsp.DidCloseTextDocumentParams{
+						TextDocument: lsp.TextDocumentIdentifier{URI: clangURI},
+					}); err != nil {
+						logger.Logf("Error sending didClose to clangd: %s", err)
+					}
+					_ = clangURI.AsPath().Remove()
+				}
+			}
+
+			renamedDocs = append(renamedDocs, ls.moveTrackedDoc(logger, trackedPath, newDocPath))
+		}
+
+		if rootRenamed {
+			ls.setSketchRoot(newPath)
+		}
+	}
+
+	if sketchRootRenamed {
+		// The whole build environment refers to the old sketch: start over.
+		ls.writeUnlock(logger)
+		ls.cleanBuildInBackground()
+		return
+	}
+	defer ls.writeUnlock(logger)
+
+	if !rebuild && len(renamedDocs) == 0 {
+		// Nothing renamed in the sketch, or only ignored files not open in the IDE
+		return
+	}
+	ls.triggerRebuildAndWait(logger)
+
+	// Reopen in clangd the renamed documents that are not part of the preprocessed sketch
+	for _, doc := range renamedDocs {
+		if doc.URI.Ext() == ".ino" {
+			continue
+		}
+		clangURI, _, err := ls.ide2ClangDocumentURI(logger, doc.URI)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			continue
+		}
+		if err := ls.clangdDidOpen(logger, clangURI, doc); err != nil {
+			logger.Logf("Error sending didOpen to clangd: %s", err)
+		}
+	}
+}
+
+// moveTrackedDoc moves the tracked document at trackedPath to newDocPath, after a rename
+// or a move done by the IDE, and returns it.
+func (ls *INOLanguageServer) moveTrackedDoc(logger jsonrpc.FunctionLogger, trackedPath string, newDocPath *paths.Path) lsp.TextDocumentItem {
+	doc := ls.trackedIdeDocs[trackedPath]
+	if ls.ideInoDocsWithDiagnostics[doc.URI] {
+		ls.clearIdeDiagnostics(logger, doc.URI)
+	}
+	if doc.URI.Ext() == ".ino" && ls.sketchMapper != nil {
+		ls.sketchMapper.RenameInoFile(trackedPath, newDocPath.String())
+	}
+
+	delete(ls.trackedIdeDocs, trackedPath)
+	doc.URI = lsp.NewDocumentURIFromPath(newDocPath)
+	ls.trackedIdeDocs[newDocPath.String()] = doc
+	logger.Logf("  > tracked document moved to %s", newDocPath)
+	return doc
+}
+
+// setSketchRoot changes the sketch folder, and the name of the preprocessed sketch that
+// follows the name of the folder.
+func (ls *INOLanguageServer) setSketchRoot(sketchRoot *paths.Path) {
+	ls.sketchRoot = sketchRoot
+	ls.sketchName = sketchRoot.Base()
+	ls.buildSketchCpp = ls.buildSketchRoot.Join(ls.sketchName + ".ino.cpp")
+	ls.ignoreRules = loadIgnoreRules(sketchRoot)
+}
+
+// registerWorkspaceFolders asks the IDE to send the workspace/didChangeWorkspaceFolders
+// notifications, so the language server can follow the sketch folder being moved.
+func (ls *INOLanguageServer) registerWorkspaceFolders(logger jsonrpc.FunctionLogger) {
+	if ls.ideInitializeParams == nil || ls.ideInitializeParams.Capabilities.Workspace == nil ||
+		!ls.ideInitializeParams.Capabilities.Workspace.WorkspaceFolders {
+		logger.Logf("IDE does not support workspace folders")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if respErr, err := ls.IDE.conn.ClientRegisterCapability(ctx, &lsp.RegistrationParams{
+		Registrations: []lsp.Registration{{
+			ID:     "workspace/didChangeWorkspaceFolders",
+			Method: "workspace/didChangeWorkspaceFolders",
+		}},
+	}); err != nil {
+		logger.Logf("Error registering workspace folders: %s", err)
+	} else if respErr != nil {
+		logger.Logf("IDE refused workspace folders registration: %s", respErr.AsError())
+	}
+}
+
+// workspaceDidChangeWorkspaceFoldersNotifFromIDE follows the workspace folder being replaced
+// by another one, as the IDEs do when the sketch (or the library) folder is renamed or
+// moved while open: the tracked documents are moved to the new folder and the build
+// environment is regenerated from scratch, since it refers to the old name of the sketch.
+// Any other change of the workspace folders is ignored.
+func (ls *INOLanguageServer) workspaceDidChangeWorkspaceFoldersNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *lsp.DidChangeWorkspaceFoldersParams) {
+	ls.writeLock(logger, true)
+
+	oldRoot := ls.sketchRoot
+	if ls.libraryRoot != nil {
+		oldRoot = ls.libraryRoot
+	}
+	removed := false
+	for _, folder := range ideParams.Event.Eemoved {
+		removed = removed || folder.URI.AsPath().EquivalentTo(oldRoot)
+	}
+	if !removed || len(ideParams.Event.Added) != 1 {
+		logger.Logf("The sketch folder has not been moved, workspace folders change ignored")
+		ls.writeUnlock(logger)
+		return
+	}
+	newRoot := ideParams.Event.Added[0].URI.AsPath()
+	logger.Logf("Workspace folder moved %s -> %s", oldRoot, newRoot)
+	movedDocs := map[string]*paths.Path{}
+	for trackedPath := range ls.trackedIdeDocs {
+		docPath := paths.New(trackedPath)
+		if inside, _ := docPath.IsInsideDir(oldRoot); !inside {
+			continue
+		}
+		if rel, err := oldRoot.RelTo(docPath); err == nil {
+			movedDocs[trackedPath] = newRoot.JoinPath(rel)
+		}
+	}
+	for trackedPath, newDocPath := range movedDocs {
+		ls.moveTrackedDoc(logger, trackedPath, newDocPath)
+	}
+	if ls.libraryRoot != nil {
+		// The library development sketch is either an example of the library, or a
+		// sketch generated in the temp folder that doesn't need to be moved
+		if inside, _ := ls.sketchRoot.IsInsideDir(ls.libraryRoot); inside {
+			if rel, err := ls.libraryRoot.RelTo(ls.sketchRoot); err == nil {
+				ls.setSketchRoot(newRoot.JoinPath(rel))
+			}
+		}
+		ls.libraryRoot = newRoot
+	} else {
+		ls.setSketchRoot(newRoot)
+	}
+	ls.writeUnlock(logger)
+
+	ls.cleanBuildInBackground()
+}
+
+func (ls *INOLanguageServer) workspaceDidCreateFilesNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *lsp.CreateFilesParams) {
+	ls.writeLock(logger, true)
+	defer ls.writeUnlock(logger)
+
+	rebuild := false
+	for _, create := range ideParams.Files {
+		createdURI, err := parseFileOperationURI(create.URI)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			continue
+		}
+		if !ls.ideURIIsPartOfTheSketch(createdURI) || ls.ignoreRules.ignored(createdURI.AsPath()) {
+			continue
+		}
+		logger.Logf("Created %s", createdURI)
+		rebuild = true
+		ls.registerCreatedSketchFile(logger, createdURI)
+	}
+
+	// The new files must be copied in the build folder (and the new .ino tabs
+	// must be merged in the preprocessed sketch).
+	if rebuild {
+		ls.triggerRebuild()
+	}
+}
+
+func (ls *INOLanguageServer) workspaceDidDeleteFilesNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *lsp.DeleteFilesParams) {
+	ls.writeLock(logger, true)
+	defer ls.writeUnlock(logger)
+
+	rebuild := false
+	for _, deleted := range ideParams.Files {
+		deletedURI, err := parseFileOperationURI(deleted.URI)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			continue
+		}
+		if !ls.ideURIIsPartOfTheSketch(deletedURI) {
+			continue
+		}
+		deletedPath := deletedURI.AsPath()
+		logger.Logf("Deleted %s", deletedPath)
+		rebuild = rebuild || !ls.ignoreRules.ignored(deletedPath)
+
+		// Forget all the tracked documents affected by the deletion (the deleted
+		// file itself, or all the files inside the deleted folder).
+		for trackedPath, doc := range ls.trackedIdeDocs {
+			docPath := paths.New(trackedPath)
+			if inside, _ := docPath.IsInsideDir(deletedPath); !inside && !docPath.EquivalentTo(deletedPath) {
+				continue
+			}
+			delete(ls.trackedIdeDocs, trackedPath)
+			logger.Logf("  > stopped tracking %s", docPath)
+
+			if doc.URI.Ext() == ".ino" {
+				// The preprocessed sketch will be regenerated by the rebuild
+				ls.sketchTrackedFilesCount--
+				logger.Logf("decreasing .ino tracked files count: %d", ls.sketchTrackedFilesCount)
+				if ls.sketchTrackedFilesCount == 0 {
+					// No more .ino open in the IDE: close the preprocessed sketch in clangd
+					clangURI := lsp.NewDocumentURIFromPath(ls.buildSketchCpp)
+					if err := ls.Clangd.conn.TextDocumentDidClose(&lsp.DidCloseTextDocumentParams{
+						TextDocument: lsp.TextDocumentIdentifier{URI: clangURI},
+					}); err != nil {
+						logger.Logf("Error sending didClose to clangd: %s", err)
+					}
+				}
+			} else if clangURI, _, err := ls.ide2ClangDocumentURI(logger, doc.URI); err != nil {
+				logger.Logf("Error: %s", err)
+			} else {
+				if err := ls.Clangd.conn.TextDocumentDidClose(&lsp.DidCloseTextDocumentParams{
+					TextDocument: lsp.TextDocumentIdentifier{URI: clangURI},
+				}); err != nil {
+					logger.Logf("Error sending didClose to clangd: %s", err)
+				}
+				_ = clangURI.AsPath().Remove()
+			}
+		}
+
+		// Clear the diagnostics of the deleted files
+		for ideURI := range ls.ideInoDocsWithDiagnostics {
+			docPath := ideURI.AsPath()
+			if inside, _ := docPath.IsInsideDir(deletedPath); inside || docPath.EquivalentTo(deletedPath) {
+				ls.clearIdeDiagnostics(logger, ideURI)
+			}
+		}
+
+		// Remove the stale copy from the build folder
+		if rel, err := ls.sketchRoot.RelTo(deletedPath); err == nil {
+			_ = ls.buildSketchRoot.JoinPath(rel).RemoveAll()
+		}
+	}
+
+	if rebuild {
+		ls.triggerRebuild()
+	}
+}
+
+// workspaceDidChangeWatchedFilesNotifFromIDE rebuilds the sketch when one of its source files
+// is changed on disk outside of the IDE (for example by a git checkout). The files open in the
+// IDE are ignored: their content is tracked through the didChange notifications. The changes
+// in the libraries and platform folders refresh the build environment, running the libraries
+// discovery again.
+func (ls *INOLanguageServer) workspaceDidChangeWatchedFilesNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *lsp.DidChangeWatchedFilesParams) {
+	ls.writeLock(logger, false)
+	defer ls.writeUnlock(logger)
+
+	rebuild := false
+	for _, change := range ideParams.Changes {
+		changedPath := change.URI.AsPath()
+		if ls.isEnvironmentPath(changedPath) {
+			logger.Logf("Changed libraries or platform %s", changedPath)
+			ls.sketchRebuilder.ForgetLastBuild()
+			rebuild = true
+			continue
+		}
+		if slices.Contains(ignoreFileNames, changedPath.Base()) {
+			logger.Logf("Changed ignore file %s", changedPath)
+			ls.ignoreRules = loadIgnoreRules(ls.sketchRoot)
+			continue
+		}
+		if !isSketchSourceFile(changedPath) || !ls.ideURIIsPartOfTheSketch(change.URI) || !ls.isCompiledSketchPath(changedPath) {
+			continue
+		}
+		if ls.ignoreRules.ignored(changedPath) {
+			logger.Logf("Changed on disk %s (ignored)", changedPath)
+			continue
+		}
+		if _, tracked := ls.trackedIdeDocs[changedPath.String()]; tracked {
+			continue
+		}
+		logger.Logf("Changed on disk %s", changedPath)
+		rebuild = true
+	}
+
+	if rebuild {
+		ls.triggerRebuildOnSave()
+	}
+}
+
+// registerCreatedSketchFile makes a source file just created in the sketch immediately
+// available to clangd (for example to resolve the includes) by copying it in the build
+// folder, without waiting for the rebuild. The .ino files are merged into the
+// preprocessed sketch by the rebuild.
+func (ls *INOLanguageServer) registerCreatedSketchFile(logger jsonrpc.FunctionLogger, createdURI lsp.DocumentURI) {
+	createdPath := createdURI.AsPath()
+	if !isSketchSourceFile(createdPath) || createdURI.Ext() == ".ino" || createdURI.Ext() == ".pde" {
+		return
+	}
+	rel, err := ls.sketchRoot.RelTo(createdPath)
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return
+	}
+	buildPath := ls.buildSketchRoot.JoinPath(rel)
+	if err := buildPath.Parent().MkdirAll(); err != nil {
+		logger.Logf("Error: %s", err)
+		return
+	}
+	if err := createdPath.CopyTo(buildPath); err != nil {
+		logger.Logf("Error copying %s to the build folder: %s", createdPath, err)
+		return
+	}
+	logger.Logf("  > copied to %s", buildPath)
+}
+
+// clearIdeDiagnostics removes all the diagnostics previously published for the given document.
+func (ls *INOLanguageServer) clearIdeDiagnostics(logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI) {
+	delete(ls.ideInoDocsWithDiagnostics, ideURI)
+	if err := ls.publishIdeDiagnostics(logger, &lsp.PublishDiagnosticsParams{
+		URI:         ideURI,
+		Diagnostics: []lsp.Diagnostic{},
+	}); err != nil {
+		logger.Logf("Error sending diagnostics to IDE: %s", err)
+	}
+}
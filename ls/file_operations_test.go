@@ -0,0 +1,150 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"go.bug.st/json"
+)
+
+func TestRenameIncludeDirectives(t *testing.T) {
+	sketch := paths.New("/tmp/Sketch")
+	oldHeader := sketch.Join("src", "Old.h")
+	newHeader := sketch.Join("src", "New.h")
+
+	text := "#include <Arduino.h>\n" +
+		"#include \"src/Old.h\"\n" +
+		"  #  include \"src/Old.h\" // comment\n" +
+		"#include \"Old.h\"\n" +
+		"// àè #include \"src/Old.h\"\n" +
+		"const char *s = \"à\"; #include \"src/Old.h\"\n"
+	require.Equal(t, []lsp.TextEdit{
+		{Range: lsp.Range{Start: lsp.Position{Line: 1, Character: 10}, End: lsp.Position{Line: 1, Character: 19}}, NewText: "src/New.h"},
+		{Range: lsp.Range{Start: lsp.Position{Line: 2, Character: 14}, End: lsp.Position{Line: 2, Character: 23}}, NewText: "src/New.h"},
+	}, renameIncludeDirectives(text, sketch, oldHeader, newHeader))
+
+	// Included from a file in the same folder of the header
+	require.Equal(t, []lsp.TextEdit{
+		{Range: lsp.Range{Start: lsp.Position{Line: 0, Character: 10}, End: lsp.Position{Line: 0, Character: 15}}, NewText: "New.h"},
+	}, renameIncludeDirectives("#include \"Old.h\"\n", sketch.Join("src"), oldHeader, newHeader))
+
+	// Header moved to another folder
+	require.Equal(t, []lsp.TextEdit{
+		{Range: lsp.Range{Start: lsp.Position{Line: 0, Character: 10}, End: lsp.Position{Line: 0, Character: 19}}, NewText: "lib/New.h"},
+	}, renameIncludeDirectives("#include \"src/Old.h\"", sketch, oldHeader, sketch.Join("lib", "New.h")))
+
+	require.Empty(t, renameIncludeDirectives("#include \"Other.h\"\n", sketch, oldHeader, newHeader))
+}
+
+func TestIdeSupportsFileOperationsRegistration(t *testing.T) {
+	require.False(t, ideSupportsFileOperationsRegistration(nil))
+	require.False(t, ideSupportsFileOperationsRegistration(&lsp.InitializeParams{}))
+
+	var params lsp.InitializeParams
+	require.NoError(t, json.Unmarshal([]byte(`{"workspace":{"fileOperations":{"dynamicRegistration":false,"didRename":true}}}`), &params.Capabilities))
+	require.False(t, ideSupportsFileOperationsRegistration(&params))
+	require.NoError(t, json.Unmarshal([]byte(`{"workspace":{"fileOperations":{"dynamicRegistration":true,"didRename":true}}}`), &params.Capabilities))
+	require.True(t, ideSupportsFileOperationsRegistration(&params))
+}
+
+func TestIdeSupportsWatchedFilesRegistration(t *testing.T) {
+	require.False(t, ideSupportsWatchedFilesRegistration(nil))
+	require.False(t, ideSupportsWatchedFilesRegistration(&lsp.InitializeParams{}))
+
+	var params lsp.InitializeParams
+	require.NoError(t, json.Unmarshal([]byte(`{"workspace":{"didChangeWatchedFiles":{"dynamicRegistration":true}}}`), &params.Capabilities))
+	require.True(t, ideSupportsWatchedFilesRegistration(&params))
+}
+
+func TestSketchSourceFilesInSrcFolder(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	for _, file := range []*paths.Path{
+		ls.sketchRoot.Join("Sketch.ino"),
+		ls.sketchRoot.Join("src", "lib", "Driver.cpp"),
+		ls.sketchRoot.Join("src", "lib", "Driver.h"),
+		ls.sketchRoot.Join("extras", "Example.cpp"),
+	} {
+		require.NoError(t, file.Parent().MkdirAll())
+		require.NoError(t, file.WriteFile([]byte{}))
+	}
+
+	// Only the sketch folder and the src subfolder are compiled
+	files, err := ls.sketchSourceFiles()
+	require.NoError(t, err)
+	files.Sort()
+	require.Equal(t, paths.PathList{
+		ls.sketchRoot.Join("Sketch.ino"),
+		ls.sketchRoot.Join("src", "lib", "Driver.cpp"),
+		ls.sketchRoot.Join("src", "lib", "Driver.h"),
+	}, files)
+
+	// The src files are mapped 1:1 in the build folder
+	driverURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("src", "lib", "Driver.cpp"))
+	clangURI, inSketch, err := ls.ide2ClangDocumentURI(logger, driverURI)
+	require.NoError(t, err)
+	require.True(t, inSketch)
+	require.Equal(t, lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("src", "lib", "Driver.cpp")), clangURI)
+
+	// The other subfolders are left as they are
+	exampleURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("extras", "Example.cpp"))
+	clangURI, inSketch, err = ls.ide2ClangDocumentURI(logger, exampleURI)
+	require.NoError(t, err)
+	require.False(t, inSketch)
+	require.Equal(t, exampleURI, clangURI)
+}
+
+func TestWorkspaceFolderMoved(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.Clangd = &clangdLSPClient{}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	// Keep the clean build from running
+	ls.cleanBuildRunning.Store(true)
+	oldRoot := ls.sketchRoot
+	newRoot := oldRoot.Parent().Join("Renamed")
+
+	// Unrelated change
+	ls.workspaceDidChangeWorkspaceFoldersNotifFromIDE(logger, &lsp.DidChangeWorkspaceFoldersParams{
+		Event: lsp.WorkspaceFoldersChangeEvent{Added: []lsp.WorkspaceFolder{{URI: lsp.NewDocumentURIFromPath(newRoot)}}},
+	})
+	require.Equal(t, oldRoot, ls.sketchRoot)
+
+	ls.workspaceDidChangeWorkspaceFoldersNotifFromIDE(logger, &lsp.DidChangeWorkspaceFoldersParams{
+		Event: lsp.WorkspaceFoldersChangeEvent{
+			Added:   []lsp.WorkspaceFolder{{URI: lsp.NewDocumentURIFromPath(newRoot)}},
+			Eemoved: []lsp.WorkspaceFolder{{URI: lsp.NewDocumentURIFromPath(oldRoot)}},
+		},
+	})
+	require.Equal(t, newRoot, ls.sketchRoot)
+	require.Equal(t, "Renamed", ls.sketchName)
+	require.Equal(t, ls.buildSketchRoot.Join("Renamed.ino.cpp"), ls.buildSketchCpp)
+	require.Len(t, ls.trackedIdeDocs, 2)
+	for _, name := range []string{"Sketch.ino", "Helper.h"} {
+		doc, ok := ls.trackedIdeDocs[newRoot.Join(name).String()]
+		require.True(t, ok, name)
+		require.Equal(t, lsp.NewDocumentURIFromPath(newRoot.Join(name)), doc.URI)
+	}
+	// The preprocessed sketch refers to the moved .ino
+	file, line, ok := ls.sketchMapper.CppToInoLineOk(2)
+	require.True(t, ok)
+	require.Equal(t, newRoot.Join("Sketch.ino").String(), file)
+	require.Equal(t, 0, line)
+}
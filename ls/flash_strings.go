@@ -0,0 +1,128 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bufio"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// flashStringMinLength is the minimum length of a string literal to suggest moving it to flash
+const flashStringMinLength = 12
+
+// serialPrintLiteralRegexp matches Serial.print("...") and Serial.println("...") calls
+// (on any serial port) with a plain string literal argument.
+var serialPrintLiteralRegexp = regexp.MustCompile(`\bSerial\w*\s*\.\s*print(?:ln)?\s*\(\s*("(?:[^"\\]|\\.)*")\s*\)`)
+
+// isAVRBoard returns true if the selected board has an AVR architecture
+func (ls *INOLanguageServer) isAVRBoard() bool {
+	fqbn := strings.Split(ls.config.Fqbn, ":")
+	return len(fqbn) >= 3 && (fqbn[1] == "avr" || fqbn[1] == "megaavr")
+}
+
+// flashStringHintsEnabled returns true if the F() hints must be generated for the sketch
+func (ls *INOLanguageServer) flashStringHintsEnabled() bool {
+	return ls.config.FlashStringHints && ls.isAVRBoard() && !ls.reducedFeatures
+}
+
+// checkFlashStrings flags the long string literals printed on the serial port: on AVR
+// boards they are copied in the (very limited) RAM, unless wrapped with the F() macro.
+func (ls *INOLanguageServer) checkFlashStrings(logger jsonrpc.FunctionLogger) {
+	inoFiles, err := ls.sketchRoot.ReadDir()
+	if err != nil {
+		logger.Logf("Error reading sketch folder: %s", err)
+		return
+	}
+	inoFiles.FilterSuffix(".ino")
+	for _, inoFile := range inoFiles {
+		ideURI, text, err := ls.sketchFileContent(inoFile)
+		if err != nil {
+			logger.Logf("Error reading %s: %s", inoFile, err)
+			continue
+		}
+		ls.updateFlashStringDiagnostics(ideURI, text)
+	}
+}
+
+// updateFlashStringDiagnostics regenerates the F() hints for the given content of a .ino file
+func (ls *INOLanguageServer) updateFlashStringDiagnostics(ideURI lsp.DocumentURI, text string) {
+	diags := []lsp.Diagnostic{}
+	for _, r := range findFlashStringCandidates(text) {
+		diags = append(diags, newSketchDiagnostic(diagnosticCodeFlashString, lsp.DiagnosticSeverityHint, r,
+			"Wrap the string with F() to keep it in flash memory and save RAM"))
+	}
+	ls.flashStringDiagnostics[ideURI] = diags
+}
+
+// sketchFileContent returns the IDE URI and the current content of the given sketch file,
+// the content tracked from the IDE is preferred to the one saved on disk.
+func (ls *INOLanguageServer) sketchFileContent(file *paths.Path) (lsp.DocumentURI, string, error) {
+	if doc, ok := ls.trackedIdeDocs[file.String()]; ok {
+		return doc.URI, doc.Text, nil
+	}
+	data, err := file.ReadFile()
+	if err != nil {
+		return lsp.NilURI, "", err
+	}
+	return lsp.NewDocumentURIFromPath(file), textutils.StripBOM(string(data)), nil
+}
+
+// findFlashStringCandidates returns the ranges of the string literals that should be wrapped with F()
+func findFlashStringCandidates(text string) []lsp.Range {
+	res := []lsp.Range{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for line := 0; scanner.Scan(); line++ {
+		lineText := scanner.Text()
+		for _, match := range serialPrintLiteralRegexp.FindAllStringSubmatchIndex(lineText, -1) {
+			literal := lineText[match[2]:match[3]]
+			if len(literal)-2 < flashStringMinLength {
+				continue
+			}
+			start := len(utf16.Encode([]rune(lineText[:match[2]])))
+			end := start + len(utf16.Encode([]rune(literal)))
+			res = append(res, lsp.Range{
+				Start: lsp.Position{Line: line, Character: start},
+				End:   lsp.Position{Line: line, Character: end},
+			})
+		}
+	}
+	return res
+}
+
+// wrapWithFlashStringQuickFix returns a code action that wraps the string literal flagged
+// by the given diagnostic with the F() macro.
+func wrapWithFlashStringQuickFix(ideURI lsp.DocumentURI, ideDiag lsp.Diagnostic) lsp.CodeAction {
+	return lsp.CodeAction{
+		Title:       "Wrap with F()",
+		Kind:        lsp.CodeActionKindQuickFix,
+		Diagnostics: []lsp.Diagnostic{ideDiag},
+		Edit: &lsp.WorkspaceEdit{
+			Changes: map[lsp.DocumentURI][]lsp.TextEdit{
+				ideURI: {
+					{Range: lsp.Range{Start: ideDiag.Range.Start, End: ideDiag.Range.Start}, NewText: "F("},
+					{Range: lsp.Range{Start: ideDiag.Range.End, End: ideDiag.Range.End}, NewText: ")"},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,64 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestFindFlashStringCandidates(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected []lsp.Range
+	}{
+		{"ShortLiteral", `Serial.println("hello");`, []lsp.Range{}},
+		{"Println", `  Serial.println("Hello, world!");`, []lsp.Range{testRange(0, 17, 0, 32)}},
+		{"Print", `Serial.print("Temperature: ");`, []lsp.Range{testRange(0, 13, 0, 28)}},
+		{"OtherSerialPort", `Serial1 . println ( "Hello, world!" );`, []lsp.Range{testRange(0, 20, 0, 35)}},
+		{"AlreadyWrapped", `Serial.println(F("Hello, world!"));`, []lsp.Range{}},
+		{"NotALiteral", `Serial.println(message);`, []lsp.Range{}},
+		{"EscapedQuotes", `Serial.println("say \"hello\" now");`, []lsp.Range{testRange(0, 15, 0, 34)}},
+		{"UTF16Columns", `/* è */ Serial.println("Hello, world!");`, []lsp.Range{testRange(0, 23, 0, 38)}},
+		{"UTF16Literal", `Serial.println("Temperatura: 20°C");`, []lsp.Range{testRange(0, 15, 0, 34)}},
+		{"MultipleLines", "void setup() {\n  Serial.println(\"Hello, world!\");\n  Serial.print(\"Goodbye, world!\");\n}\n",
+			[]lsp.Range{testRange(1, 17, 1, 32), testRange(2, 15, 2, 32)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, findFlashStringCandidates(test.text))
+		})
+	}
+}
+
+func TestIsAVRBoard(t *testing.T) {
+	ls := &INOLanguageServer{config: &Config{}}
+	for fqbn, expected := range map[string]bool{
+		"arduino:avr:uno":                 true,
+		"arduino:avr:mega:cpu=atmega2560": true,
+		"arduino:megaavr:nona4809":        true,
+		"arduino:samd:mkr1000":            false,
+		"esp32:esp32:esp32":               false,
+		"arduino:avr":                     false,
+		"":                                false,
+	} {
+		ls.config.Fqbn = fqbn
+		require.Equal(t, expected, ls.isAVRBoard(), fqbn)
+	}
+}
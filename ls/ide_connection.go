@@ -0,0 +1,74 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// clangdExitTimeout is the time given to clangd to exit after the connection with the
+// IDE is lost, before killing it
+const clangdExitTimeout = 5 * time.Second
+
+// ideOutputWriter is the writer of the messages sent to the IDE, it detects when the
+// connection is broken: the reads from the IDE may not fail in that case (for example if
+// only the IDE's end of the output pipe has been closed).
+type ideOutputWriter struct {
+	out       io.Writer
+	onError   func(err error)
+	errorOnce sync.Once
+}
+
+func (w *ideOutputWriter) Write(data []byte) (int, error) {
+	n, err := w.out.Write(data)
+	if err != nil {
+		w.errorOnce.Do(func() { w.onError(err) })
+	}
+	return n, err
+}
+
+// ideConnectionClosed is called when the connection with the IDE is closed. If the IDE
+// didn't shut down the language server before, the connection has been lost (the IDE
+// crashed or has been killed): clangd is terminated and the build environment is removed
+// before closing the language server, then the process exits (or, when serving multiple
+// sessions, keeps waiting for new connections).
+func (ls *INOLanguageServer) ideConnectionClosed(logger jsonrpc.FunctionLogger, reason string) {
+	ls.ideConnectionClosedOnce.Do(func() {
+		if ls.ideShutdown.Load() {
+			logger.Logf("Connection with IDE closed")
+			ls.Close()
+			return
+		}
+
+		logger.Logf("Lost connection with IDE: %s", reason)
+		ls.closeMux.Lock()
+		clangd := ls.Clangd
+		ls.Clangd = nil
+		ls.closeMux.Unlock()
+		if clangd != nil {
+			logger.Logf("Terminating clangd")
+			if err := clangd.Terminate(clangdExitTimeout); err != nil {
+				logger.Logf("Error terminating clangd: %s", err)
+			}
+		}
+		ls.removeTemporaryFilesNow(logger)
+		ls.Close()
+	})
+}
@@ -0,0 +1,92 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+type brokenWriter struct{}
+
+func (brokenWriter) Write(data []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestIDEOutputWriter(t *testing.T) {
+	errs := []error{}
+	w := &ideOutputWriter{out: brokenWriter{}, onError: func(err error) { errs = append(errs, err) }}
+	_, err := w.Write([]byte("Content-Length: 2\r\n\r\n"))
+	require.EqualError(t, err, "broken pipe")
+	_, err = w.Write([]byte("{}"))
+	require.Error(t, err)
+	require.Len(t, errs, 1)
+
+	w = &ideOutputWriter{out: io.Discard, onError: func(err error) { errs = append(errs, err) }}
+	n, err := w.Write([]byte("{}"))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Len(t, errs, 1)
+}
+
+func TestIDEConnectionClosed(t *testing.T) {
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	tempDir := paths.New(t.TempDir(), "arduino-language-server-session")
+	require.NoError(t, tempDir.Join("build").MkdirAll())
+	ls := &INOLanguageServer{closing: make(chan bool), config: &Config{}, tempDir: tempDir, buildPath: tempDir.Join("build")}
+	closeNotify := ls.CloseNotify()
+	ls.ideConnectionClosed(logger, "end of input")
+	require.Nil(t, ls.CloseNotify())
+	require.False(t, tempDir.Exist())
+	require.Nil(t, ls.buildPath)
+	_, open := <-closeNotify
+	require.False(t, open)
+	// Further notifications of the disconnection are ignored
+	ls.ideConnectionClosed(logger, "error sending data")
+
+	ls = &INOLanguageServer{closing: make(chan bool)}
+	ls.ideShutdown.Store(true)
+	ls.ideConnectionClosed(logger, "end of input")
+	require.Nil(t, ls.CloseNotify())
+}
+
+func TestTerminateClangd(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not available")
+	}
+	// A process that ignores the exit notification
+	process, err := paths.NewProcess(nil, sleep, "30")
+	require.NoError(t, err)
+	require.NoError(t, process.Start())
+	client := &clangdLSPClient{process: process, diagnostics: newOrderedQueue()}
+	client.conn = lsp.NewClient(strings.NewReader(""), io.Discard, client)
+
+	start := time.Now()
+	require.NoError(t, client.Terminate(200*time.Millisecond))
+	require.True(t, client.IsClosing())
+	require.Less(t, time.Since(start), 10*time.Second)
+}
@@ -0,0 +1,199 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+
+	"github.com/arduino/arduino-language-server/streams"
+	"go.bug.st/json"
+)
+
+// ideInboxSize is the max number of messages read from the IDE and not handled yet: when
+// the inbox is full the IDE messages are not read anymore until a message is handled.
+const ideInboxSize = 256
+
+// ideInbox reads the messages sent by the IDE as soon as they arrive, and queues them for
+// the jsonrpc connection of the IDE. The connection handles the messages one at a time,
+// in the same goroutine that reads them, so it would not see a cancellation (or the
+// shutdown) until the request being handled is completed: the inbox sees the control
+// messages right away and cancels the context of the request (see requestContext).
+type ideInbox struct {
+	messages chan *ideMessage
+	readErr  error
+
+	// pending is the part of the current message not read yet by the connection
+	pending []byte
+
+	mutex         sync.Mutex
+	current       *ideMessage
+	currentCtx    context.Context
+	currentCancel context.CancelFunc
+	// queued are the requests not handled yet, true if canceled
+	queued map[string]bool
+}
+
+// ideMessage is a message received from the IDE
+type ideMessage struct {
+	frame  []byte
+	id     string
+	method string
+}
+
+// isRequest returns true if the message is a request, the other messages are notifications
+// and responses
+func (msg *ideMessage) isRequest() bool {
+	return msg != nil && msg.id != "" && msg.method != ""
+}
+
+// ideMessageFields are the fields of the IDE messages used by the inbox
+type ideMessageFields struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+func newIDEInbox(in io.Reader, size int) *ideInbox {
+	inbox := &ideInbox{
+		messages: make(chan *ideMessage, size),
+		queued:   map[string]bool{},
+	}
+	go func() {
+		defer streams.CatchAndLogPanic()
+		defer close(inbox.messages)
+		inbox.readErr = inbox.receive(in)
+	}()
+	return inbox
+}
+
+// receive reads the IDE messages until the end of the stream
+func (inbox *ideInbox) receive(in io.Reader) error {
+	reader := textproto.NewReader(bufio.NewReader(in))
+	for {
+		header, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return err
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			return fmt.Errorf("invalid Content-Length: %w", err)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader.R, body); err != nil {
+			return err
+		}
+
+		msg := &ideMessage{frame: append([]byte(fmt.Sprintf("Content-Length: %d\r\n\r\n", length)), body...)}
+		var fields ideMessageFields
+		if err := json.Unmarshal(body, &fields); err == nil {
+			msg.id, msg.method = string(fields.ID), fields.Method
+			if msg.isRequest() {
+				inbox.mutex.Lock()
+				inbox.queued[msg.id] = false
+				inbox.mutex.Unlock()
+			}
+			switch fields.Method {
+			case "$/cancelRequest":
+				var params ideMessageFields
+				if err := json.Unmarshal(fields.Params, &params); err == nil {
+					inbox.cancel(string(params.ID))
+				}
+			case "shutdown", "exit":
+				// The request being handled is not going to be useful anymore
+				inbox.cancel("")
+			}
+		}
+		// The connection receives all the messages, including the control ones
+		inbox.messages <- msg
+	}
+}
+
+// cancel cancels the given request, if it's being handled, or marks it as canceled if it
+// is still queued. An empty id cancels the request being handled, if any.
+func (inbox *ideInbox) cancel(id string) {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+	if inbox.current.isRequest() && (id == "" || inbox.current.id == id) {
+		inbox.currentCancel()
+		return
+	}
+	if _, ok := inbox.queued[id]; ok {
+		inbox.queued[id] = true
+	}
+}
+
+// Read implements io.Reader for the jsonrpc connection. A read never spans over two
+// messages: when the connection reads the next message it's done with the previous one.
+func (inbox *ideInbox) Read(p []byte) (int, error) {
+	if len(inbox.pending) == 0 {
+		msg, ok := <-inbox.messages
+		inbox.handling(msg)
+		if !ok {
+			if inbox.readErr != nil {
+				return 0, inbox.readErr
+			}
+			return 0, io.EOF
+		}
+		inbox.pending = msg.frame
+	}
+	n := copy(p, inbox.pending)
+	inbox.pending = inbox.pending[n:]
+	return n, nil
+}
+
+// handling records the message the connection is going to handle, nil if none
+func (inbox *ideInbox) handling(msg *ideMessage) {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+	if inbox.currentCancel != nil {
+		inbox.currentCancel()
+	}
+	inbox.current, inbox.currentCtx, inbox.currentCancel = msg, nil, nil
+	if !msg.isRequest() {
+		return
+	}
+	inbox.currentCtx, inbox.currentCancel = context.WithCancel(context.Background())
+	if inbox.queued[msg.id] {
+		inbox.currentCancel()
+	}
+	delete(inbox.queued, msg.id)
+}
+
+// requestContext returns the context of the request being handled by the connection: the
+// given context, created by the connection, that is also canceled when the inbox receives
+// the cancellation of the request.
+func (inbox *ideInbox) requestContext(ctx context.Context) context.Context {
+	inbox.mutex.Lock()
+	current := inbox.currentCtx
+	inbox.mutex.Unlock()
+	if current == nil {
+		return ctx
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if current.Err() != nil {
+		// Canceled while queued
+		cancel()
+	} else {
+		context.AfterFunc(current, cancel)
+	}
+	return ctx
+}
@@ -0,0 +1,95 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ideFrame(body string) string {
+	return fmt.Sprintf("Content-Length: %d\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\n\r\n%s", len(body), body)
+}
+
+// readIDEMessage reads a message from the inbox, as the jsonrpc connection does
+func readIDEMessage(t *testing.T, inbox *ideInbox, body string) {
+	frame := fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+	data := make([]byte, len(frame))
+	_, err := io.ReadFull(inbox, data)
+	require.NoError(t, err)
+	require.Equal(t, frame, string(data))
+}
+
+func TestIDEInboxCancelRequestBeingHandled(t *testing.T) {
+	in, ide := io.Pipe()
+	inbox := newIDEInbox(in, ideInboxSize)
+
+	request := `{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{}}`
+	cancel := `{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":1}}`
+	go io.WriteString(ide, ideFrame(request))
+	readIDEMessage(t, inbox, request)
+	ctx := inbox.requestContext(context.Background())
+	require.NoError(t, ctx.Err())
+
+	// The cancellation is received while the request is being handled
+	go io.WriteString(ide, ideFrame(cancel))
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "request not canceled")
+	}
+
+	// The connection receives the cancellation too
+	readIDEMessage(t, inbox, cancel)
+	require.NoError(t, inbox.requestContext(context.Background()).Err())
+
+	ide.Close()
+	_, err := inbox.Read(make([]byte, 10))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestIDEInboxCancelQueuedRequest(t *testing.T) {
+	in, ide := io.Pipe()
+	inbox := newIDEInbox(in, ideInboxSize)
+
+	first := `{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{}}`
+	second := `{"jsonrpc":"2.0","id":"2","method":"textDocument/definition","params":{}}`
+	cancel := `{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":"2"}}`
+	shutdown := `{"jsonrpc":"2.0","id":3,"method":"shutdown"}`
+	go io.WriteString(ide, ideFrame(first))
+	readIDEMessage(t, inbox, first)
+	firstCtx := inbox.requestContext(context.Background())
+
+	go io.WriteString(ide, ideFrame(second)+ideFrame(cancel)+ideFrame(shutdown))
+	// The shutdown cancels the request being handled
+	select {
+	case <-firstCtx.Done():
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "request not canceled by the shutdown")
+	}
+
+	// The second request has been canceled while queued
+	readIDEMessage(t, inbox, second)
+	require.Error(t, inbox.requestContext(context.Background()).Err())
+	readIDEMessage(t, inbox, cancel)
+	readIDEMessage(t, inbox, shutdown)
+	require.NoError(t, inbox.requestContext(context.Background()).Err())
+}
@@ -0,0 +1,224 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// ignoreFileNames are the files listing the paths of the sketch to be ignored by the language
+// server, with the .gitignore syntax: .arduinoignore is for the paths that must be ignored
+// only by the language server.
+var ignoreFileNames = []string{".gitignore", ".arduinoignore"}
+
+// ignorePattern is a line of an ignore file
+type ignorePattern struct {
+	regexp  *regexp.Regexp
+	negated bool
+	dirOnly bool
+}
+
+// ignoreFile are the patterns of an ignore file, they apply to the paths inside its folder
+type ignoreFile struct {
+	dir      *paths.Path
+	patterns []ignorePattern
+}
+
+// ignoreRules are the ignore files that apply to the sketch, sorted from the outermost folder
+// to the innermost one: the last matching pattern wins, as in git.
+type ignoreRules struct {
+	sketchRoot *paths.Path
+	files      []*ignoreFile
+}
+
+// loadIgnoreRules reads the ignore files of the sketch: the ones in the sketch folder and in
+// its subfolders (the ignored subfolders are not visited) and, if the sketch is part of a
+// bigger git repository, the .gitignore files of the enclosing folders up to the root of the
+// repository. The .git folder is always ignored.
+func loadIgnoreRules(sketchRoot *paths.Path) *ignoreRules {
+	rules := &ignoreRules{sketchRoot: sketchRoot}
+
+	enclosingDirs := paths.PathList{}
+	for dir := sketchRoot.Parent(); ; dir = dir.Parent() {
+		enclosingDirs = append(paths.PathList{dir}, enclosingDirs...)
+		if dir.Join(".git").Exist() {
+			break
+		}
+		if dir.Parent().EquivalentTo(dir) {
+			// Not in a git repository
+			enclosingDirs = nil
+			break
+		}
+	}
+	for _, dir := range enclosingDirs {
+		rules.addIgnoreFile(dir, ".gitignore")
+	}
+	rules.loadIgnoreFilesRecursive(sketchRoot)
+	return rules
+}
+
+func (r *ignoreRules) loadIgnoreFilesRecursive(dir *paths.Path) {
+	for _, name := range ignoreFileNames {
+		r.addIgnoreFile(dir, name)
+	}
+	subDirs, err := dir.ReadDir()
+	if err != nil {
+		return
+	}
+	subDirs.FilterDirs()
+	for _, subDir := range subDirs {
+		if !r.ignored(subDir) {
+			r.loadIgnoreFilesRecursive(subDir)
+		}
+	}
+}
+
+func (r *ignoreRules) addIgnoreFile(dir *paths.Path, name string) {
+	data, err := dir.Join(name).ReadFile()
+	if err != nil {
+		return
+	}
+	if file := parseIgnoreFile(dir, string(data)); len(file.patterns) > 0 {
+		r.files = append(r.files, file)
+	}
+}
+
+// parseIgnoreFile parses the content of an ignore file in the given folder. The invalid
+// patterns are skipped.
+func parseIgnoreFile(dir *paths.Path, content string) *ignoreFile {
+	file := &ignoreFile{dir: dir}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			pattern.negated = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		re, err := ignorePatternRegexp(line)
+		if err != nil {
+			continue
+		}
+		pattern.regexp = re
+		file.patterns = append(file.patterns, pattern)
+	}
+	return file
+}
+
+// ignorePatternRegexp converts a .gitignore pattern (without the leading "!" and the trailing
+// "/") to a regexp matching the slash-separated paths relative to the folder of the ignore
+// file. A pattern containing a slash is anchored to the folder, otherwise it matches at any
+// depth.
+func ignorePatternRegexp(pattern string) (*regexp.Regexp, error) {
+	res := "^(?:.*/)?"
+	if strings.Contains(pattern, "/") {
+		res = "^"
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+	for i := 0; i < len(pattern); i++ {
+		rest := pattern[i:]
+		switch {
+		case strings.HasPrefix(rest, "**/"):
+			res += "(?:.*/)?"
+			i += 2
+		case rest == "**":
+			res += ".*"
+			i++
+		case rest[0] == '*':
+			res += "[^/]*"
+		case rest[0] == '?':
+			res += "[^/]"
+		case rest[0] == '[' && strings.Contains(rest[1:], "]"):
+			end := strings.Index(rest[1:], "]") + 1
+			class := rest[1:end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			res += "[" + strings.ReplaceAll(class, `\`, `\\`) + "]"
+			i += end
+		case rest[0] == '\\' && len(rest) > 1:
+			res += regexp.QuoteMeta(rest[1:2])
+			i++
+		default:
+			res += regexp.QuoteMeta(rest[:1])
+		}
+	}
+	return regexp.Compile(res + "$")
+}
+
+// ignored returns true if the given path, inside the sketch, is ignored by the ignore files
+// or is inside an ignored folder. The paths outside of the sketch are never ignored.
+func (r *ignoreRules) ignored(path *paths.Path) bool {
+	if r == nil {
+		return false
+	}
+	rel, err := path.RelFrom(r.sketchRoot)
+	if err != nil {
+		return false
+	}
+	components := strings.Split(filepath.ToSlash(rel.String()), "/")
+	if len(components) == 0 || components[0] == "." || components[0] == ".." {
+		return false
+	}
+	dir := r.sketchRoot
+	for i, component := range components {
+		dir = dir.Join(component)
+		if component == ".git" {
+			return true
+		}
+		isDir := i < len(components)-1 || dir.IsDir()
+		if r.matches(dir, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the given path is ignored by the last pattern matching it
+func (r *ignoreRules) matches(path *paths.Path, isDir bool) bool {
+	ignored := false
+	for _, file := range r.files {
+		rel, err := path.RelFrom(file.dir)
+		if err != nil || strings.HasPrefix(rel.String(), "..") {
+			continue
+		}
+		slashRel := filepath.ToSlash(rel.String())
+		for _, pattern := range file.patterns {
+			if pattern.dirOnly && !isDir {
+				continue
+			}
+			if pattern.regexp.MatchString(slashRel) {
+				ignored = !pattern.negated
+			}
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,104 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnorePatternRegexp(t *testing.T) {
+	for pattern, cases := range map[string]map[string]bool{
+		"build":            {"build": true, "src/build": true, "builder": false},
+		"/build":           {"build": true, "src/build": false},
+		"*.o":              {"main.o": true, "src/lib/main.o": true, "main.cpp": false},
+		"src/gen*":         {"src/generated": true, "other/src/generated": false, "src/lib/generated": false},
+		"**/cache":         {"cache": true, "a/b/cache": true, "cached": false},
+		"docs/**":          {"docs/a.md": true, "docs/a/b.md": true, "docs": false},
+		"a/**/b":           {"a/b": true, "a/x/y/b": true, "x/a/b": false},
+		"file?.txt":        {"file1.txt": true, "file10.txt": false},
+		"[!a]*.log":        {"b.log": true, "a.log": false},
+		`\#notes`:          {"#notes": true},
+		"node_modules":     {"node_modules": true, "web/node_modules": true},
+		"config.[ch]":      {"config.c": true, "config.h": true, "config.o": false},
+		"dir/sub/file.ino": {"dir/sub/file.ino": true, "file.ino": false},
+	} {
+		re, err := ignorePatternRegexp(pattern)
+		require.NoError(t, err, pattern)
+		for path, match := range cases {
+			require.Equal(t, match, re.MatchString(path), "%s ~ %s", pattern, path)
+		}
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	repo := paths.New(t.TempDir())
+	sketchRoot := repo.Join("firmware", "Sketch")
+	for file, content := range map[string]string{
+		".git/HEAD":                          "ref: refs/heads/main\n",
+		".gitignore":                         "# Repository\nnode_modules/\n*.log\n",
+		"firmware/Sketch/Sketch.ino":         "",
+		"firmware/Sketch/.gitignore":         "/build/\n!keep.log\n",
+		"firmware/Sketch/.arduinoignore":     "extras\n",
+		"firmware/Sketch/build/Sketch.o":     "",
+		"firmware/Sketch/keep.log":           "",
+		"firmware/Sketch/debug.log":          "",
+		"firmware/Sketch/extras/Example.cpp": "",
+		"firmware/Sketch/node_modules/x.h":   "",
+		"firmware/Sketch/src/build/gen.h":    "",
+		"firmware/Sketch/src/lib/.gitignore": "*.tmp\n",
+		"firmware/Sketch/src/lib/driver.tmp": "",
+		"firmware/Sketch/src/lib/driver.cpp": "",
+		"firmware/Sketch/.git/config":        "",
+	} {
+		path := repo.Join(file)
+		require.NoError(t, path.Parent().MkdirAll())
+		require.NoError(t, path.WriteFile([]byte(content)))
+	}
+
+	rules := loadIgnoreRules(sketchRoot)
+	for file, ignored := range map[string]bool{
+		"Sketch.ino":         false,
+		"build":              true,
+		"build/Sketch.o":     true,
+		"src/build/gen.h":    false,
+		"keep.log":           false,
+		"debug.log":          true,
+		"extras/Example.cpp": true,
+		"node_modules/x.h":   true,
+		"src/lib/driver.tmp": true,
+		"src/lib/driver.cpp": false,
+		".git/config":        true,
+	} {
+		require.Equal(t, ignored, rules.ignored(sketchRoot.Join(file)), file)
+	}
+
+	// The paths outside of the sketch are never ignored, not even the sketch itself
+	require.False(t, rules.ignored(sketchRoot))
+	require.False(t, rules.ignored(repo.Join("debug.log")))
+
+	// The .gitignore files outside of a git repository don't apply
+	require.NoError(t, repo.Join(".git").RemoveAll())
+	rules = loadIgnoreRules(sketchRoot)
+	require.False(t, rules.ignored(sketchRoot.Join("node_modules", "x.h")))
+	require.True(t, rules.ignored(sketchRoot.Join("build", "Sketch.o")))
+
+	// Without rules nothing is ignored
+	rules = nil
+	require.False(t, rules.ignored(sketchRoot.Join(".git", "config")))
+}
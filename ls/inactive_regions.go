@@ -0,0 +1,201 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// InactiveRegionsParams are the parameters of the "textDocument/inactiveRegions" notification,
+// a clangd extension (clangd 17 or later) listing the code disabled by the preprocessor
+// conditionals (#if/#ifdef) in a document. The same notification, with the regions moved
+// to the IDE documents, is sent to the IDE as a "textDocument/inactiveRegions" event.
+type InactiveRegionsParams struct {
+	TextDocument lsp.VersionedTextDocumentIdentifier `json:"textDocument"`
+	Regions      []lsp.Range                         `json:"regions"`
+}
+
+// TextDocumentInactiveRegions handles the "textDocument/inactiveRegions" notifications from clangd
+func (client *clangdLSPClient) TextDocumentInactiveRegions(logger jsonrpc.FunctionLogger, raw json.RawMessage) {
+	var params InactiveRegionsParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		logger.Logf("ERROR decoding InactiveRegionsParams: %s", err)
+		return
+	}
+	// Processed in order with the diagnostics, they are both published after each parse
+	client.diagnostics.Push(func() {
+		client.ls.inactiveRegionsNotifFromClangd(logger, &params)
+	})
+}
+
+func (ls *INOLanguageServer) inactiveRegionsNotifFromClangd(logger jsonrpc.FunctionLogger, clangParams *InactiveRegionsParams) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	for _, ideParams := range ls.clang2IdeInactiveRegions(logger, clangParams) {
+		logger.Logf("%s: %d inactive regions", ideParams.TextDocument.URI, len(ideParams.Regions))
+		ls.IDE.sendCustomNotification(logger, "textDocument/inactiveRegions", ideParams)
+	}
+}
+
+// clang2IdeInactiveRegions moves the inactive regions of a clangd document to the IDE
+// documents. The regions of the preprocessed sketch are split among the .ino tabs: each
+// tracked tab receives its list of regions, possibly empty to clear the previous ones.
+// The regions computed on an older version of the preprocessed sketch, or falling in its
+// generated parts, are dropped. The caller must hold the read lock.
+func (ls *INOLanguageServer) clang2IdeInactiveRegions(logger jsonrpc.FunctionLogger, clangParams *InactiveRegionsParams) []*InactiveRegionsParams {
+	clangURI := clangParams.TextDocument.URI
+	isIno := ls.clangURIRefersToIno(clangURI)
+	if isIno && clangParams.TextDocument.Version != 0 && ls.sketchMapper != nil {
+		if cppVersion := ls.sketchMapper.CppText.Version; clangParams.TextDocument.Version != cppVersion {
+			logger.Logf("Dropped inactive regions for version %d of the sketch (current version is %d)", clangParams.TextDocument.Version, cppVersion)
+			return nil
+		}
+	}
+
+	allIdeParams := map[lsp.DocumentURI]*InactiveRegionsParams{}
+	ideParamsOf := func(ideURI lsp.DocumentURI) *InactiveRegionsParams {
+		ideParams, ok := allIdeParams[ideURI]
+		if !ok {
+			ideParams = &InactiveRegionsParams{Regions: []lsp.Range{}}
+			ideParams.TextDocument.URI = ideURI
+			if doc, tracked := ls.trackedIdeDocs[ideURI.AsPath().String()]; tracked {
+				ideParams.TextDocument.Version = doc.Version
+			}
+			allIdeParams[ideURI] = ideParams
+		}
+		return ideParams
+	}
+	if isIno {
+		for _, doc := range ls.trackedIdeDocs {
+			if doc.URI.Ext() == ".ino" {
+				ideParamsOf(doc.URI)
+			}
+		}
+	} else if ideURI, err := ls.clang2IdeDocumentURI(logger, clangURI); err == nil {
+		ideParamsOf(ideURI)
+	}
+
+	for _, clangRegion := range clangParams.Regions {
+		ideURI, ideRegion, inPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, clangURI, clangRegion)
+		if err != nil {
+			logger.Logf("Dropped inactive region %s: %s", clangRegion, err)
+			continue
+		}
+		if inPreprocessed {
+			continue
+		}
+		ideParams := ideParamsOf(ideURI)
+		ideParams.Regions = append(ideParams.Regions, ideRegion)
+	}
+
+	res := []*InactiveRegionsParams{}
+	for _, ideParams := range allIdeParams {
+		res = append(res, ideParams)
+	}
+	return res
+}
+
+// initializeCapabilitiesWriter adds to the initialize request sent to clangd the client
+// capabilities that can't be represented in lsp.InitializeParams: the inactive regions
+// extension. The initialize request is the first message sent to clangd, the following
+// ones are written unchanged.
+type initializeCapabilitiesWriter struct {
+	out     io.WriteCloser
+	buf     []byte
+	patched bool
+}
+
+func newInitializeCapabilitiesWriter(out io.WriteCloser) *initializeCapabilitiesWriter {
+	return &initializeCapabilitiesWriter{out: out}
+}
+
+// Write implements io.Writer, the first message is buffered until complete
+func (w *initializeCapabilitiesWriter) Write(p []byte) (int, error) {
+	if w.patched {
+		return w.out.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	headerEnd := bytes.Index(w.buf, []byte("\r\n\r\n"))
+	if headerEnd == -1 {
+		return len(p), nil
+	}
+	length, err := contentLength(string(w.buf[:headerEnd]))
+	if err != nil {
+		return 0, err
+	}
+	bodyStart := headerEnd + 4
+	if len(w.buf) < bodyStart+length {
+		return len(p), nil
+	}
+	body := addInactiveRegionsCapability(w.buf[bodyStart : bodyStart+length])
+	msg := append([]byte(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body))), body...)
+	msg = append(msg, w.buf[bodyStart+length:]...)
+	w.buf = nil
+	w.patched = true
+	if _, err := w.out.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close implements io.Closer
+func (w *initializeCapabilitiesWriter) Close() error {
+	return w.out.Close()
+}
+
+// contentLength returns the value of the Content-Length field of a message header
+func contentLength(header string) (int, error) {
+	for _, field := range strings.Split(header, "\r\n") {
+		name, value, ok := strings.Cut(field, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			return strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+	return 0, fmt.Errorf("missing Content-Length in message header")
+}
+
+// addInactiveRegionsCapability adds the inactive regions capability to an initialize request,
+// the other messages (and the requests that can't be decoded) are returned unchanged
+func addInactiveRegionsCapability(body []byte) []byte {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(body, &msg); err != nil || msg["method"] != "initialize" {
+		return body
+	}
+	field := func(parent map[string]interface{}, name string) map[string]interface{} {
+		child, ok := parent[name].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			parent[name] = child
+		}
+		return child
+	}
+	textDocument := field(field(field(msg, "params"), "capabilities"), "textDocument")
+	textDocument["inactiveRegionsCapabilities"] = map[string]interface{}{"inactiveRegions": true}
+	res, err := json.Marshal(msg)
+	if err != nil {
+		return body
+	}
+	return res
+}
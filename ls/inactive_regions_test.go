@@ -0,0 +1,111 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"go.bug.st/json"
+)
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestInitializeCapabilitiesWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := newInitializeCapabilitiesWriter(nopWriteCloser{&out})
+
+	// The header and the body are written separately by the jsonrpc connection
+	initialize := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"capabilities":{"textDocument":{"hover":{}}}}}`
+	for _, chunk := range []string{fmt.Sprintf("Content-Length: %d\r\n\r\n", len(initialize)), initialize[:10], initialize[10:]} {
+		n, err := w.Write([]byte(chunk))
+		require.NoError(t, err)
+		require.Equal(t, len(chunk), n)
+	}
+	header, body, ok := bytes.Cut(out.Bytes(), []byte("\r\n\r\n"))
+	require.True(t, ok)
+	require.Equal(t, fmt.Sprintf("Content-Length: %d", len(body)), string(header))
+	var msg struct {
+		ID     int `json:"id"`
+		Params struct {
+			Capabilities struct {
+				TextDocument map[string]json.RawMessage `json:"textDocument"`
+			} `json:"capabilities"`
+		} `json:"params"`
+	}
+	require.NoError(t, json.Unmarshal(body, &msg))
+	require.Equal(t, 1, msg.ID)
+	require.Contains(t, msg.Params.Capabilities.TextDocument, "hover")
+	require.JSONEq(t, `{"inactiveRegions":true}`, string(msg.Params.Capabilities.TextDocument["inactiveRegionsCapabilities"]))
+
+	// The following messages are not changed
+	out.Reset()
+	initialized := "Content-Length: 52\r\n\r\n" + `{"jsonrpc":"2.0","method":"initialized","params":{}}`
+	_, err := w.Write([]byte(initialized))
+	require.NoError(t, err)
+	require.Equal(t, initialized, out.String())
+}
+
+func TestAddInactiveRegionsCapability(t *testing.T) {
+	require.JSONEq(t,
+		`{"id":1,"method":"initialize","params":{"capabilities":{"textDocument":{"inactiveRegionsCapabilities":{"inactiveRegions":true}}}}}`,
+		string(addInactiveRegionsCapability([]byte(`{"id":1,"method":"initialize","params":{}}`))))
+	require.Equal(t, `{"method":"shutdown"}`, string(addInactiveRegionsCapability([]byte(`{"method":"shutdown"}`))))
+	require.Equal(t, `not json`, string(addInactiveRegionsCapability([]byte(`not json`))))
+}
+
+func TestClang2IdeInactiveRegions(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	ino := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	helper := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h"))
+	params := func(uri lsp.DocumentURI, version int, regions ...lsp.Range) *InactiveRegionsParams {
+		res := &InactiveRegionsParams{Regions: regions}
+		res.TextDocument.URI = uri
+		res.TextDocument.Version = version
+		return res
+	}
+
+	// The regions of the preprocessed sketch are moved to the .ino tabs
+	res := ls.clang2IdeInactiveRegions(logger, params(lsp.NewDocumentURIFromPath(ls.buildSketchCpp), 0, testRange(3, 0, 3, 14)))
+	require.Len(t, res, 1)
+	require.Equal(t, ino, res[0].TextDocument.URI)
+	require.Equal(t, []lsp.Range{testRange(1, 0, 1, 14)}, res[0].Regions)
+
+	// The .ino tabs without inactive regions are cleared
+	res = ls.clang2IdeInactiveRegions(logger, params(lsp.NewDocumentURIFromPath(ls.buildSketchCpp), 0))
+	require.Len(t, res, 1)
+	require.Equal(t, ino, res[0].TextDocument.URI)
+	require.Empty(t, res[0].Regions)
+
+	// The regions computed on another version of the preprocessed sketch are dropped
+	ls.sketchMapper.CppText.Version = 2
+	require.Empty(t, ls.clang2IdeInactiveRegions(logger, params(lsp.NewDocumentURIFromPath(ls.buildSketchCpp), 1, testRange(3, 0, 3, 14))))
+
+	// .cpp/.h files of the sketch
+	res = ls.clang2IdeInactiveRegions(logger, params(lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Helper.h")), 0, testRange(3, 0, 4, 0)))
+	require.Len(t, res, 1)
+	require.Equal(t, helper, res[0].TextDocument.URI)
+	require.Equal(t, []lsp.Range{testRange(2, 0, 3, 0)}, res[0].Regions)
+}
@@ -0,0 +1,142 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"time"
+
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// InlineValueParams are the parameters of the "textDocument/inlineValue" request (LSP 3.17,
+// not available in go-lsp)
+type InlineValueParams struct {
+	TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+	// Range is the document range for which inline values should be computed
+	Range   lsp.Range          `json:"range"`
+	Context InlineValueContext `json:"context"`
+}
+
+// InlineValueContext describes the debug session stopped in the document
+type InlineValueContext struct {
+	// FrameID is the id of the stack frame where the execution has stopped
+	FrameID int `json:"frameId"`
+	// StoppedLocation is the range where the execution has stopped, usually the current line
+	StoppedLocation lsp.Range `json:"stoppedLocation"`
+}
+
+// InlineValueVariableLookup asks the IDE to show the value of a variable, looked up by name
+// in the debug session
+type InlineValueVariableLookup struct {
+	Range               lsp.Range `json:"range"`
+	VariableName        string    `json:"variableName,omitempty"`
+	CaseSensitiveLookup bool      `json:"caseSensitiveLookup"`
+}
+
+// registerInlineValues asks the IDE to send the textDocument/inlineValue requests. The
+// capability can't be advertised in the initialize response (go-lsp doesn't know about
+// it) so it's registered dynamically: IDEs without support for it will refuse.
+func (ls *INOLanguageServer) registerInlineValues(logger jsonrpc.FunctionLogger) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if respErr, err := ls.IDE.conn.ClientRegisterCapability(ctx, &lsp.RegistrationParams{
+		Registrations: []lsp.Registration{{
+			ID:     "textDocument/inlineValue",
+			Method: "textDocument/inlineValue",
+			RegisterOptions: lsp.EncodeMessage(map[string]interface{}{
+				"documentSelector": []map[string]string{
+					{"scheme": "file", "pattern": "**/*.{ino,cpp,c,h,hpp}"},
+				},
+			}),
+		}},
+	}); err != nil {
+		logger.Logf("Error registering inline values: %s", err)
+	} else if respErr != nil {
+		logger.Logf("IDE refused inline values registration: %s", respErr.AsError())
+	}
+}
+
+func (ls *INOLanguageServer) textDocumentInlineValueReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *InlineValueParams) ([]InlineValueVariableLookup, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/inlineValue") {
+		return nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
+	ls.readLock(logger, true)
+	defer ls.readUnlock(logger)
+
+	if ls.clangdTokensLegend == nil {
+		logger.Logf("clangd does not provide semantic tokens")
+		return nil, nil
+	}
+	if ls.reducedFeatures {
+		logger.Logf("Inline values disabled: the sketch is too large")
+		return nil, nil
+	}
+
+	// The variables are found through the semantic tokens of clangd, that are already
+	// resolved on the AST: macros, types and functions with the same names are excluded.
+	tokens, _, respErr := ls.clangdSemanticTokens(ctx, logger, &lsp.SemanticTokensParams{TextDocument: ideParams.TextDocument})
+	if tokens == nil {
+		return nil, respErr
+	}
+	doc, ok := ls.trackedIdeDocs[ideParams.TextDocument.URI.AsPath().String()]
+	if !ok {
+		logger.Logf("Document not tracked: %s", ideParams.TextDocument.URI)
+		return nil, nil
+	}
+	return inlineValueLookups(tokens, textutils.SplitLines(doc.Text), ideParams.Range, ideParams.Context.StoppedLocation), nil
+}
+
+// inlineValueLookups returns the lookups of the variables and parameters in the given range,
+// up to the line where the execution has stopped: the values of the following lines are
+// not computed yet.
+func inlineValueLookups(tokens []semanticToken, lines []string, rng, stoppedLocation lsp.Range) []InlineValueVariableLookup {
+	lastLine := rng.End.Line
+	if stoppedLocation.End.Line < lastLine {
+		lastLine = stoppedLocation.End.Line
+	}
+	res := []InlineValueVariableLookup{}
+	for _, tok := range tokens {
+		if tok.Type != "variable" && tok.Type != "parameter" {
+			continue
+		}
+		if tok.Line < rng.Start.Line || tok.Line > lastLine {
+			continue
+		}
+		name := semanticTokenText(lines, tok)
+		if name == "" {
+			continue
+		}
+		res = append(res, InlineValueVariableLookup{
+			Range: lsp.Range{
+				Start: lsp.Position{Line: tok.Line, Character: tok.Char},
+				End:   lsp.Position{Line: tok.Line, Character: tok.Char + tok.Length},
+			},
+			VariableName:        name,
+			CaseSensitiveLookup: true,
+		})
+	}
+	return res
+}
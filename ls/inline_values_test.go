@@ -0,0 +1,72 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestInlineValueLookups(t *testing.T) {
+	lines := strings.Split(
+		"int count = 0;\n"+
+			"void loop() {\n"+
+			"  int value = analogRead(A0);\n"+
+			"  count += value;\n"+
+			"  Serial.println(count);\n"+
+			"}\n", "\n")
+	tokens := []semanticToken{
+		{Line: 0, Char: 4, Length: 5, Type: "variable"},
+		{Line: 1, Char: 5, Length: 4, Type: "function"},
+		{Line: 2, Char: 6, Length: 5, Type: "variable"},
+		{Line: 2, Char: 14, Length: 10, Type: "function"},
+		{Line: 2, Char: 25, Length: 2, Type: "macro"},
+		{Line: 3, Char: 2, Length: 5, Type: "variable"},
+		{Line: 3, Char: 11, Length: 5, Type: "variable"},
+		{Line: 4, Char: 17, Length: 5, Type: "variable"},
+	}
+	lookup := func(line, char int, name string) InlineValueVariableLookup {
+		return InlineValueVariableLookup{
+			Range: lsp.Range{
+				Start: lsp.Position{Line: line, Character: char},
+				End:   lsp.Position{Line: line, Character: char + len(name)},
+			},
+			VariableName:        name,
+			CaseSensitiveLookup: true,
+		}
+	}
+	visible := lsp.Range{Start: lsp.Position{Line: 1}, End: lsp.Position{Line: 5}}
+
+	// Stopped on the 4th line: the variables of the following lines are not computed yet
+	stopped := lsp.Range{Start: lsp.Position{Line: 3}, End: lsp.Position{Line: 3, Character: 16}}
+	require.Equal(t, []InlineValueVariableLookup{
+		lookup(2, 6, "value"),
+		lookup(3, 2, "count"),
+		lookup(3, 11, "value"),
+	}, inlineValueLookups(tokens, lines, visible, stopped))
+
+	// Only the visible range is considered
+	stopped = lsp.Range{Start: lsp.Position{Line: 10}, End: lsp.Position{Line: 10}}
+	require.Equal(t, []InlineValueVariableLookup{
+		lookup(2, 6, "value"),
+		lookup(3, 2, "count"),
+		lookup(3, 11, "value"),
+		lookup(4, 17, "count"),
+	}, inlineValueLookups(tokens, lines, visible, stopped))
+}
@@ -0,0 +1,113 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+
+	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// LibraryDependencies is the result of the "arduino/getLibraryDependencies" request
+type LibraryDependencies struct {
+	// Fqbn is the board selected for the sketch
+	Fqbn string `json:"fqbn"`
+	// Libraries are the libraries resolved by the last build with libraries discovery
+	Libraries []*LibraryDependency `json:"libraries"`
+}
+
+// LibraryDependency is a library used by the sketch build
+type LibraryDependency struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	// Provider tells where the library is installed, with the values used by arduino-cli:
+	// "user", "ide", "platform", "ref-platform" or "unmanaged"
+	Provider string `json:"provider"`
+	// Platform is the platform containing the library, for the platform libraries
+	Platform    string      `json:"platform,omitempty"`
+	InstallDir  *paths.Path `json:"installDir"`
+	IncludePath *paths.Path `json:"includePath"`
+}
+
+// libraryProviders are the names given by arduino-cli to the library locations
+var libraryProviders = map[rpc.LibraryLocation]string{
+	rpc.LibraryLocation_LIBRARY_LOCATION_BUILTIN:                     "ide",
+	rpc.LibraryLocation_LIBRARY_LOCATION_USER:                        "user",
+	rpc.LibraryLocation_LIBRARY_LOCATION_PLATFORM_BUILTIN:            "platform",
+	rpc.LibraryLocation_LIBRARY_LOCATION_REFERENCED_PLATFORM_BUILTIN: "ref-platform",
+	rpc.LibraryLocation_LIBRARY_LOCATION_UNMANAGED:                   "unmanaged",
+}
+
+// newLibraryDependencyFromRPC converts a library used by a build of the arduino-cli daemon
+func newLibraryDependencyFromRPC(lib *rpc.Library) *LibraryDependency {
+	return &LibraryDependency{
+		Name:        lib.GetName(),
+		Version:     lib.GetVersion(),
+		Provider:    libraryProviders[lib.GetLocation()],
+		Platform:    lib.GetContainerPlatform(),
+		InstallDir:  paths.New(lib.GetInstallDir()),
+		IncludePath: paths.New(lib.GetSourceDir()),
+	}
+}
+
+// cliUsedLibrary is a library used by the build in the JSON output of "arduino-cli compile"
+type cliUsedLibrary struct {
+	Name              string `json:"name"`
+	Version           string `json:"version"`
+	Location          string `json:"location"`
+	ContainerPlatform string `json:"container_platform"`
+	InstallDir        string `json:"install_dir"`
+	SourceDir         string `json:"source_dir"`
+}
+
+func (lib *cliUsedLibrary) toLibraryDependency() *LibraryDependency {
+	return &LibraryDependency{
+		Name:        lib.Name,
+		Version:     lib.Version,
+		Provider:    lib.Location,
+		Platform:    lib.ContainerPlatform,
+		InstallDir:  paths.New(lib.InstallDir),
+		IncludePath: paths.New(lib.SourceDir),
+	}
+}
+
+// updateUsedLibraries stores the libraries used by a build. The builds without libraries
+// discovery may not report them, in that case the libraries of the last discovery are kept.
+func (ls *INOLanguageServer) updateUsedLibraries(logger jsonrpc.FunctionLogger, libraries []*LibraryDependency, librariesDiscovery bool) {
+	if len(libraries) == 0 && !librariesDiscovery {
+		return
+	}
+	ls.writeLock(logger, false)
+	defer ls.writeUnlock(logger)
+	ls.usedLibraries = libraries
+	for _, lib := range libraries {
+		logger.Logf("Used library: %s %s (%s) in %s", lib.Name, lib.Version, lib.Provider, lib.InstallDir)
+	}
+}
+
+func (ls *INOLanguageServer) getLibraryDependenciesReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*LibraryDependencies, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	res := &LibraryDependencies{
+		Fqbn:      ls.config.Fqbn,
+		Libraries: append([]*LibraryDependency{}, ls.usedLibraries...),
+	}
+	logger.Logf("<-- getLibraryDependencies(%d libraries)", len(res.Libraries))
+	return res, nil
+}
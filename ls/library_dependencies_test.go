@@ -0,0 +1,101 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeArduinoCLICompileWithLibraries answers "arduino-cli compile" reporting the used libraries
+const fakeArduinoCLICompileWithLibraries = `#!/bin/sh
+echo '{"success":true,"builder_result":{"used_libraries":[
+  {"name":"Servo","version":"1.2.1","location":"user","install_dir":"/sketchbook/libraries/Servo","source_dir":"/sketchbook/libraries/Servo/src"},
+  {"name":"SPI","version":"1.0","location":"platform","container_platform":"arduino:avr","install_dir":"/data/packages/arduino/hardware/avr/1.8.6/libraries/SPI","source_dir":"/data/packages/arduino/hardware/avr/1.8.6/libraries/SPI/src"}
+]}}'
+`
+
+func TestLibraryDependencies(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake arduino-cli is a shell script")
+	}
+	ls := newTestSketchLanguageServer(t)
+	tmp := paths.New(t.TempDir())
+	cli := tmp.Join("arduino-cli")
+	require.NoError(t, cli.WriteFile([]byte(fakeArduinoCLICompileWithLibraries)))
+	require.NoError(t, cli.Chmod(0755))
+	ls.config = &Config{CliPath: cli, CliConfigPath: tmp.Join("arduino-cli.yaml"), Fqbn: "arduino:avr:uno"}
+	require.NoError(t, ls.sketchRoot.MkdirAll())
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	success, libraries, err := ls.compileWithArduinoCLI(context.Background(), logger, ls.sketchRoot, nil, ls.buildPath, map[string]string{}, true)
+	require.NoError(t, err)
+	require.True(t, success)
+	servo := &LibraryDependency{
+		Name:        "Servo",
+		Version:     "1.2.1",
+		Provider:    "user",
+		InstallDir:  paths.New("/sketchbook/libraries/Servo"),
+		IncludePath: paths.New("/sketchbook/libraries/Servo/src"),
+	}
+	spi := &LibraryDependency{
+		Name:        "SPI",
+		Version:     "1.0",
+		Provider:    "platform",
+		Platform:    "arduino:avr",
+		InstallDir:  paths.New("/data/packages/arduino/hardware/avr/1.8.6/libraries/SPI"),
+		IncludePath: paths.New("/data/packages/arduino/hardware/avr/1.8.6/libraries/SPI/src"),
+	}
+	require.Equal(t, []*LibraryDependency{servo, spi}, libraries)
+
+	// A build without libraries discovery that doesn't report the libraries keeps the last ones
+	ls.updateUsedLibraries(logger, libraries, true)
+	ls.updateUsedLibraries(logger, []*LibraryDependency{}, false)
+	res, respErr := ls.getLibraryDependenciesReqFromIDE(context.Background(), logger)
+	require.Nil(t, respErr)
+	require.Equal(t, &LibraryDependencies{Fqbn: "arduino:avr:uno", Libraries: []*LibraryDependency{servo, spi}}, res)
+
+	// A libraries discovery finding no libraries clears them
+	ls.updateUsedLibraries(logger, []*LibraryDependency{}, true)
+	res, respErr = ls.getLibraryDependenciesReqFromIDE(context.Background(), logger)
+	require.Nil(t, respErr)
+	require.Empty(t, res.Libraries)
+}
+
+func TestNewLibraryDependencyFromRPC(t *testing.T) {
+	lib := newLibraryDependencyFromRPC(&rpc.Library{
+		Name:              "Wire",
+		Version:           "1.0",
+		Location:          rpc.LibraryLocation_LIBRARY_LOCATION_REFERENCED_PLATFORM_BUILTIN,
+		ContainerPlatform: "arduino:avr",
+		InstallDir:        "/data/libraries/Wire",
+		SourceDir:         "/data/libraries/Wire/src",
+	})
+	require.Equal(t, &LibraryDependency{
+		Name:        "Wire",
+		Version:     "1.0",
+		Provider:    "ref-platform",
+		Platform:    "arduino:avr",
+		InstallDir:  paths.New("/data/libraries/Wire"),
+		IncludePath: paths.New("/data/libraries/Wire/src"),
+	}, lib)
+}
@@ -0,0 +1,131 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	properties "github.com/arduino/go-properties-orderedmap"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// librarySketchName is the name of the sketch generated to develop a library without examples
+const librarySketchName = "LibrarySketch"
+
+// isLibraryFolder returns true if the given folder is the root of an Arduino library
+func isLibraryFolder(folder *paths.Path) bool {
+	return folder.Join("library.properties").Exist()
+}
+
+// librarySourceFolder returns the folder of the library sources: src for the libraries
+// with the recursive layout, the library root for the ones with the flat layout.
+func librarySourceFolder(libraryRoot *paths.Path) *paths.Path {
+	if src := libraryRoot.Join("src"); src.IsDir() {
+		return src
+	}
+	return libraryRoot
+}
+
+// findLibraryExampleSketch returns the first example sketch of the library (in alphabetical
+// order), or nil if the library has no examples.
+func findLibraryExampleSketch(libraryRoot *paths.Path) *paths.Path {
+	examples := libraryRoot.Join("examples")
+	if !examples.IsDir() {
+		return nil
+	}
+	files, err := examples.ReadDirRecursive()
+	if err != nil {
+		return nil
+	}
+	files.Sort()
+	for _, file := range files {
+		if file.Ext() == ".ino" && file.Base() == file.Parent().Base()+".ino" {
+			return file.Parent()
+		}
+	}
+	return nil
+}
+
+// libraryIncludes returns the headers to include to use the library: the ones listed in the
+// includes property of library.properties or, if not specified, all the headers in the
+// library source folder.
+func libraryIncludes(libraryRoot *paths.Path) ([]string, error) {
+	props, err := properties.LoadFromPath(libraryRoot.Join("library.properties"))
+	if err != nil {
+		return nil, fmt.Errorf("reading library.properties: %w", err)
+	}
+	res := []string{}
+	if includes := props.Get("includes"); includes != "" {
+		for _, include := range strings.Split(includes, ",") {
+			if include = strings.TrimSpace(include); include != "" {
+				res = append(res, include)
+			}
+		}
+		return res, nil
+	}
+	files, err := librarySourceFolder(libraryRoot).ReadDir()
+	if err != nil {
+		return nil, err
+	}
+	files.FilterOutDirs()
+	files.Sort()
+	for _, file := range files {
+		if isHeaderFile(file) {
+			res = append(res, file.Base())
+		}
+	}
+	return res, nil
+}
+
+// createLibrarySketch writes in the given folder a sketch that includes the headers of the
+// library, and returns its root.
+func createLibrarySketch(folder *paths.Path, includes []string) (*paths.Path, error) {
+	sketchRoot := folder.Join(librarySketchName)
+	if err := sketchRoot.MkdirAll(); err != nil {
+		return nil, err
+	}
+	text := ""
+	for _, include := range includes {
+		text += "#include <" + include + ">\n"
+	}
+	text += "\nvoid setup() {}\n\nvoid loop() {}\n"
+	if err := sketchRoot.Join(librarySketchName + ".ino").WriteFile([]byte(text)); err != nil {
+		return nil, err
+	}
+	return sketchRoot, nil
+}
+
+// libraryDevelopmentSketch returns the sketch used to build the library being developed:
+// the first example of the library or, if it has no examples, a sketch generated in the
+// temp folder of the language server that includes the library.
+func (ls *INOLanguageServer) libraryDevelopmentSketch(logger jsonrpc.FunctionLogger, libraryRoot *paths.Path) (*paths.Path, error) {
+	if example := findLibraryExampleSketch(libraryRoot); example != nil {
+		logger.Logf("Library development: using example %s", example)
+		return example, nil
+	}
+	includes, err := libraryIncludes(libraryRoot)
+	if err != nil {
+		return nil, err
+	}
+	sketchRoot, err := createLibrarySketch(ls.tempDir.Join("library"), includes)
+	if err != nil {
+		return nil, err
+	}
+	logger.Logf("Library development: using generated sketch %s including %s", sketchRoot, strings.Join(includes, ", "))
+	return sketchRoot, nil
+}
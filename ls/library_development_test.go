@@ -0,0 +1,63 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibraryDevelopmentSketch(t *testing.T) {
+	library := paths.New(t.TempDir()).Join("MyLibrary")
+	require.NoError(t, library.Join("src").MkdirAll())
+	require.False(t, isLibraryFolder(library))
+	require.NoError(t, library.Join("library.properties").WriteFile([]byte("name=MyLibrary\nversion=1.0.0\n")))
+	require.True(t, isLibraryFolder(library))
+	require.NoError(t, library.Join("src", "MyLibrary.h").WriteFile([]byte{}))
+	require.NoError(t, library.Join("src", "MyLibrary.cpp").WriteFile([]byte{}))
+	require.NoError(t, library.Join("src", "utility", "Internal.h").Parent().MkdirAll())
+	require.NoError(t, library.Join("src", "utility", "Internal.h").WriteFile([]byte{}))
+
+	ls := newTestSketchLanguageServer(t)
+	ls.tempDir = paths.New(t.TempDir())
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	// Without examples a sketch including the library headers is generated
+	sketchRoot, err := ls.libraryDevelopmentSketch(logger, library)
+	require.NoError(t, err)
+	require.Equal(t, ls.tempDir.Join("library", librarySketchName), sketchRoot)
+	text, err := sketchRoot.Join(librarySketchName + ".ino").ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, "#include <MyLibrary.h>\n\nvoid setup() {}\n\nvoid loop() {}\n", string(text))
+
+	// The headers listed in library.properties are preferred
+	require.NoError(t, library.Join("library.properties").WriteFile([]byte("name=MyLibrary\nincludes=MyLibrary.h, utility/Internal.h\n")))
+	includes, err := libraryIncludes(library)
+	require.NoError(t, err)
+	require.Equal(t, []string{"MyLibrary.h", "utility/Internal.h"}, includes)
+
+	// The first example is used if available
+	for _, example := range []string{"Basic", "Advanced"} {
+		require.NoError(t, library.Join("examples", example).MkdirAll())
+		require.NoError(t, library.Join("examples", example, example+".ino").WriteFile([]byte{}))
+	}
+	sketchRoot, err = ls.libraryDevelopmentSketch(logger, library)
+	require.NoError(t, err)
+	require.Equal(t, library.Join("examples", "Advanced"), sketchRoot)
+}
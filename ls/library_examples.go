@@ -0,0 +1,217 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"fmt"
+
+	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// LibraryExamples is an element of the response to the custom "arduino/listLibraryExamples" request
+type LibraryExamples struct {
+	Library  string           `json:"library"`
+	Examples []LibraryExample `json:"examples"`
+}
+
+// LibraryExample is an example sketch bundled with a library
+type LibraryExample struct {
+	Name string `json:"name"`
+	// URI is the main .ino file of the example
+	URI lsp.DocumentURI `json:"uri"`
+}
+
+// installedLibrary is a library installed in the arduino-cli data or user folders
+type installedLibrary struct {
+	Name       string
+	InstallDir *paths.Path
+	Examples   paths.PathList
+}
+
+func newLibraryExamples(lib *installedLibrary) LibraryExamples {
+	res := LibraryExamples{Library: lib.Name, Examples: []LibraryExample{}}
+	for _, example := range lib.Examples {
+		res.Examples = append(res.Examples, LibraryExample{
+			Name: example.Base(),
+			URI:  lsp.NewDocumentURIFromPath(example.Join(example.Base() + ".ino")),
+		})
+	}
+	return res
+}
+
+func (ls *INOLanguageServer) listLibraryExamplesReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) ([]LibraryExamples, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	librariesCache := ls.buildPath.Join("libraries.cache")
+	ls.readUnlock(logger)
+
+	// The include folders resolved by the last libraries discovery of the sketch
+	var includeFolders paths.PathList
+	if data, err := librariesCache.ReadFile(); err != nil {
+		logger.Logf("Error reading %s: %s", librariesCache, err)
+	} else if err := json.Unmarshal(data, &includeFolders); err != nil {
+		logger.Logf("Error parsing %s: %s", librariesCache, err)
+	}
+
+	libs, err := ls.installedLibraries(ctx, logger, "")
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, responseError(err)
+	}
+
+	res := []LibraryExamples{}
+	for _, lib := range libs {
+		if len(lib.Examples) == 0 || !isLibraryReferenced(lib, includeFolders) {
+			continue
+		}
+		res = append(res, newLibraryExamples(lib))
+	}
+	logger.Logf("<-- listLibraryExamples(%d libraries)", len(res))
+	return res, nil
+}
+
+// isLibraryReferenced returns true if one of the include folders belongs to the given library
+func isLibraryReferenced(lib *installedLibrary, includeFolders paths.PathList) bool {
+	for _, folder := range includeFolders {
+		if folder.EquivalentTo(lib.InstallDir) {
+			return true
+		}
+		if inside, err := folder.IsInsideDir(lib.InstallDir); err == nil && inside {
+			return true
+		}
+	}
+	return false
+}
+
+// openLibraryExample resolves the path of the given library example and returns the
+// URI of its main .ino file.
+func (ls *INOLanguageServer) openLibraryExample(ctx context.Context, logger jsonrpc.FunctionLogger, arguments []interface{}) (json.RawMessage, error) {
+	if len(arguments) != 2 {
+		return nil, fmt.Errorf("expected 2 arguments (library, example), got %d", len(arguments))
+	}
+	libraryName, ok := arguments[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid library name: %v", arguments[0])
+	}
+	exampleName, ok := arguments[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid example name: %v", arguments[1])
+	}
+
+	libs, err := ls.installedLibraries(ctx, logger, libraryName)
+	if err != nil {
+		return nil, err
+	}
+	for _, lib := range libs {
+		if lib.Name != libraryName {
+			continue
+		}
+		for _, example := range newLibraryExamples(lib).Examples {
+			if example.Name == exampleName {
+				return json.Marshal(example.URI)
+			}
+		}
+		return nil, fmt.Errorf("example %s not found in library %s", exampleName, libraryName)
+	}
+	return nil, fmt.Errorf("library %s is not installed", libraryName)
+}
+
+// installedLibraries returns the libraries available for the selected board, optionally
+// filtered by name.
+func (ls *INOLanguageServer) installedLibraries(ctx context.Context, logger jsonrpc.FunctionLogger, name string) ([]*installedLibrary, error) {
+	var libs []*installedLibrary
+	err := ls.runArduinoCLIWithRetries(ctx, logger, func(ctx context.Context) error {
+		var err error
+		if ls.config.CliPath == nil {
+			libs, err = ls.installedLibrariesWithArduinoCLIDaemon(ctx, name)
+		} else {
+			libs, err = ls.installedLibrariesWithArduinoCLI(ctx, logger, name)
+		}
+		return err
+	})
+	return libs, err
+}
+
+func (ls *INOLanguageServer) installedLibrariesWithArduinoCLIDaemon(ctx context.Context, name string) ([]*installedLibrary, error) {
+	client, err := ls.arduinoCLIDaemonClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.LibraryList(ctx, &rpc.LibraryListRequest{
+		Instance: &rpc.Instance{Id: int32(ls.config.CliInstanceNumber)},
+		All:      true,
+		Name:     name,
+		Fqbn:     ls.config.Fqbn,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing installed libraries: %w", err)
+	}
+	libs := []*installedLibrary{}
+	for _, installed := range resp.GetInstalledLibraries() {
+		lib := installed.GetLibrary()
+		if lib == nil {
+			continue
+		}
+		libs = append(libs, &installedLibrary{
+			Name:       lib.GetName(),
+			InstallDir: paths.New(lib.GetInstallDir()),
+			Examples:   paths.NewPathList(lib.GetExamples()...),
+		})
+	}
+	return libs, nil
+}
+
+func (ls *INOLanguageServer) installedLibrariesWithArduinoCLI(ctx context.Context, logger jsonrpc.FunctionLogger, name string) ([]*installedLibrary, error) {
+	args := []string{"lib", "list", "--all", "--format", "json"}
+	if ls.config.Fqbn != "" {
+		args = append(args, "--fqbn", ls.config.Fqbn)
+	}
+	if name != "" {
+		args = append(args, name)
+	}
+	cmdOutput, err := ls.runArduinoCLI(ctx, logger, args...)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		InstalledLibraries []struct {
+			Library *struct {
+				Name       string   `json:"name"`
+				InstallDir string   `json:"install_dir"`
+				Examples   []string `json:"examples"`
+			} `json:"library"`
+		} `json:"installed_libraries"`
+	}
+	if err := json.Unmarshal(cmdOutput, &res); err != nil {
+		return nil, fmt.Errorf("parsing arduino-cli output: %w", err)
+	}
+	libs := []*installedLibrary{}
+	for _, installed := range res.InstalledLibraries {
+		if installed.Library == nil {
+			continue
+		}
+		libs = append(libs, &installedLibrary{
+			Name:       installed.Library.Name,
+			InstallDir: paths.New(installed.Library.InstallDir),
+			Examples:   paths.NewPathList(installed.Library.Examples...),
+		})
+	}
+	return libs, nil
+}
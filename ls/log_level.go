@@ -0,0 +1,61 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// LogLevel is the verbosity of the language server log, set with the "arduino/setLogLevel"
+// command
+type LogLevel string
+
+const (
+	// LogLevelInfo logs the method of the messages exchanged with the IDE and clangd, and
+	// how each message is processed
+	LogLevelInfo LogLevel = "info"
+	// LogLevelDebug also logs the content of the messages
+	LogLevelDebug LogLevel = "debug"
+)
+
+// logLevel returns the current verbosity of the log
+func (ls *INOLanguageServer) logLevel() LogLevel {
+	if ls.verboseLogging.Load() {
+		return LogLevelDebug
+	}
+	return LogLevelInfo
+}
+
+// setLogLevel changes the verbosity of the log, without restarting the language server: the
+// argument of the "arduino/setLogLevel" command is the new level. The previous level is
+// returned, so that the IDE can restore it once the problem has been reproduced.
+func (ls *INOLanguageServer) setLogLevel(logger jsonrpc.FunctionLogger, arguments []interface{}) (LogLevel, error) {
+	if len(arguments) != 1 {
+		return "", fmt.Errorf("expected 1 argument (level), got %d", len(arguments))
+	}
+	level, _ := arguments[0].(string)
+	switch LogLevel(level) {
+	case LogLevelInfo, LogLevelDebug:
+	default:
+		return "", fmt.Errorf("invalid log level: %v (valid levels: %s, %s)", arguments[0], LogLevelInfo, LogLevelDebug)
+	}
+	previous := ls.logLevel()
+	ls.verboseLogging.Store(LogLevel(level) == LogLevelDebug)
+	logger.Logf("Log level changed from %s to %s", previous, level)
+	return previous, nil
+}
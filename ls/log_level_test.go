@@ -0,0 +1,85 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	require.Equal(t, LogLevelInfo, ls.logLevel())
+
+	setLogLevel := func(arguments ...interface{}) (string, *jsonrpc.ResponseError) {
+		res, respErr := ls.workspaceExecuteCommandReqFromIDE(context.Background(), logger, &lsp.ExecuteCommandParams{
+			Command:   setLogLevelCommand,
+			Arguments: arguments,
+		})
+		return string(res), respErr
+	}
+	previous, respErr := setLogLevel("debug")
+	require.Nil(t, respErr)
+	require.Equal(t, `"info"`, previous)
+	require.Equal(t, LogLevelDebug, ls.logLevel())
+
+	_, respErr = setLogLevel("trace")
+	require.NotNil(t, respErr)
+	require.Equal(t, jsonrpc.ErrorCodesInvalidParams, respErr.Code)
+	_, respErr = setLogLevel()
+	require.NotNil(t, respErr)
+	require.Equal(t, LogLevelDebug, ls.logLevel())
+
+	previous, respErr = setLogLevel("info")
+	require.Nil(t, respErr)
+	require.Equal(t, `"debug"`, previous)
+	require.Equal(t, LogLevelInfo, ls.logLevel())
+}
+
+func TestLogMessagesContent(t *testing.T) {
+	var out bytes.Buffer
+	defaultOutput := log.Writer()
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(defaultOutput) })
+
+	ls := newTestSketchLanguageServer(t)
+	logger := &Logger{
+		IncomingPrefix: "IDE --> LS",
+		OutgoingPrefix: "IDE <-- LS",
+		HiColor:        color.HiGreenString,
+		LoColor:        color.GreenString,
+		ErrorColor:     color.HiMagentaString,
+		verbose:        &ls.verboseLogging,
+	}
+
+	logger.LogIncomingNotification("textDocument/didSave", []byte(`{"textDocument":{"uri":"file:///Sketch.ino"}}`))
+	require.Contains(t, out.String(), "textDocument/didSave")
+	require.NotContains(t, out.String(), "file:///Sketch.ino")
+
+	ls.verboseLogging.Store(true)
+	logger.LogIncomingNotification("textDocument/didSave", []byte(`{"textDocument":{"uri":"file:///Sketch.ino"}}`))
+	logger.LogOutgoingResponse("1", "textDocument/hover", []byte(`{"contents":"void setup()"}`), nil)
+	require.Contains(t, out.String(), `{"textDocument":{"uri":"file:///Sketch.ino"}}`)
+	require.Contains(t, out.String(), `{"contents":"void setup()"}`)
+}
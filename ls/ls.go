@@ -20,27 +20,26 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
 	"github.com/arduino/arduino-language-server/globals"
 	"github.com/arduino/arduino-language-server/sourcemapper"
 	"github.com/arduino/arduino-language-server/streams"
+	"github.com/arduino/arduino-language-server/textutils"
 	"github.com/arduino/go-paths-helper"
 	"github.com/fatih/color"
 	"github.com/pkg/errors"
 	"github.com/vincecity/go-lsp"
 	"github.com/vincecity/go-lsp/jsonrpc"
-	"github.com/vincecity/go-lsp/textedits"
 	"go.bug.st/json"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 // INOLanguageServer is a JSON-RPC handler that delegates messages to clangd.
@@ -49,38 +48,121 @@ type INOLanguageServer struct {
 	IDE    *IDELSPServer
 	Clangd *clangdLSPClient
 
-	progressHandler           *progressProxyHandler
-	closing                   chan bool
-	removeTempMutex           sync.Mutex
-	clangdStarted             *sync.Cond
-	dataMux                   sync.RWMutex
-	tempDir                   *paths.Path
-	buildPath                 *paths.Path
-	buildSketchRoot           *paths.Path
-	buildSketchCpp            *paths.Path
-	fullBuildPath             *paths.Path
-	sketchRoot                *paths.Path
-	sketchName                string
-	sketchMapper              *sourcemapper.SketchMapper
-	sketchTrackedFilesCount   int
-	trackedIdeDocs            map[string]lsp.TextDocumentItem
-	ideInoDocsWithDiagnostics map[lsp.DocumentURI]bool
-	sketchRebuilder           *sketchRebuilder
+	progressHandler            *progressProxyHandler
+	closing                    chan bool
+	closeMux                   sync.Mutex
+	removeTempMutex            sync.Mutex
+	clangdStarted              *sync.Cond
+	dataMux                    sync.RWMutex
+	tempDir                    *paths.Path
+	buildPath                  *paths.Path
+	buildSketchRoot            *paths.Path
+	buildSketchCpp             *paths.Path
+	fullBuildPath              *paths.Path
+	buildFqbn                  string
+	sketchRoot                 *paths.Path
+	sketchName                 string
+	libraryRoot                *paths.Path
+	sketchSettings             *SketchSettings
+	usedLibraries              []*LibraryDependency
+	sketchMapper               *sourcemapper.SketchMapper
+	sketchTrackedFilesCount    int
+	trackedIdeDocs             map[string]lsp.TextDocumentItem
+	recoveredDocHashes         map[lsp.DocumentURI]string
+	outOfSyncIdeDocs           map[lsp.DocumentURI]bool
+	ideInoDocsWithDiagnostics  map[lsp.DocumentURI]bool
+	ideDocsWithDiagnostics     map[lsp.DocumentURI]bool
+	sketchStructureDiagnostics []lsp.Diagnostic
+	flashStringDiagnostics     map[lsp.DocumentURI][]lsp.Diagnostic
+	publishedDiagnosticsMutex  sync.Mutex
+	publishedDiagnostics       map[lsp.DocumentURI][]lsp.Diagnostic
+	analysisUpdatingLines      map[lsp.DocumentURI][]lineSpan
+	environmentWatchedFolders  paths.PathList
+	sketchSize                 *sketchSize
+	sketchRebuilder            *sketchRebuilder
+	ideInitializeParams        *lsp.InitializeParams
+	cliDaemonConnMutex         sync.Mutex
+	cliDaemonConn              *grpc.ClientConn
+	serialPortsWatchMutex      sync.Mutex
+	serialPortsWatchCancel     context.CancelFunc
+	clangdRequests             *requestLimiter
+	responseCache              *responseCache
+	cleanBuildRunning          atomic.Bool
+	clangdFailed               bool
+	boardDefinitionsMutex      sync.Mutex
+	boardDefinitions           map[string]string
+	builtInMacrosMutex         sync.Mutex
+	builtInMacrosKey           string
+	builtInMacrosCache         []Macro
+	apiProvidersMutex          sync.Mutex
+	apiProvidersDir            *paths.Path
+	apiProviders               map[string][]string
+	clangdTokensLegend         *lsp.SemanticTokensLegend
+	clangdMonikerProvider      bool
+	clangdVersion              string
+	startupFailure             string
+	misnamedMainFiles          paths.PathList
+	ignoreRules                *ignoreRules
+	clangdDataFolder           *paths.Path
+	buildSourcesMutex          sync.Mutex
+	buildSourceFolders         map[string]*paths.Path
+	methodFilterMutex          sync.Mutex
+	methodFilter               MethodFilter
+	workspaceSymbolsFromCore   atomic.Bool
+	lastRebuildTimings         atomic.Pointer[RebuildTimings]
+	ideMessages                *messageHistory
+	verboseLogging             atomic.Bool
+	ideDisconnected            chan struct{}
+	ideShutdown                atomic.Bool
+	ideConnectionClosedOnce    sync.Once
+	reducedFeatures            bool
 }
 
 // Config describes the language server configuration.
 type Config struct {
 	Fqbn                            string
+	CompileTargets                  []string
+	BoardName                       string
 	CliPath                         *paths.Path
 	CliConfigPath                   *paths.Path
 	ClangdPath                      *paths.Path
 	CliDaemonAddress                string
 	CliInstanceNumber               int
 	FormatterConf                   *paths.Path
+	TempDir                         *paths.Path
 	EnableLogging                   bool
 	SkipLibrariesDiscoveryOnRebuild bool
 	DisableRealTimeDiagnostics      bool
 	Jobs                            int
+	ExtraEnv                        []string
+	CliTimeout                      time.Duration
+	CliRetries                      int
+	ClangdInitTimeout               time.Duration
+	ProgressMaxRate                 int
+	MultiSession                    bool
+	FlashStringHints                bool
+	CompletionRanking               bool
+	WorkspaceSymbolsFromCore        bool
+	ClangdLimitResults              int
+	RebuildPolicy                   RebuildPolicy
+	ClangdMaxConcurrentRequests     int
+	ClangdLogLevel                  ClangdLogLevel
+	ClangdStderrToLog               bool
+	MethodFilter                    MethodFilter
+	SnapshotDir                     *paths.Path
+	MaxGeneratedCppSize             int
+	MaxTabs                         int
+	Offline                         bool
+	DiagnosticsFile                 string
+	FormatOrganizeIncludes          bool
+	ExternalFiles                   ExternalFilesPolicy
+
+	// clangdRequests is the limiter shared by all the sessions of a SessionManager
+	clangdRequests *requestLimiter
+	// cliCore is the client of the arduino-cli core service run in the language server, if
+	// it has been started (its instance can be reinitialized, while the instance of a daemon
+	// of the IDE is managed by the IDE itself)
+	cliCore rpc.ArduinoCoreServiceClient
 }
 
 var yellow = color.New(color.FgHiYellow)
@@ -89,20 +171,62 @@ func (ls *INOLanguageServer) writeLock(logger jsonrpc.FunctionLogger, requireCla
 	ls.dataMux.Lock()
 	logger.Logf(yellow.Sprintf("write-locked"))
 	if requireClangd && ls.Clangd == nil {
+		if ls.ideInitializeParams == nil {
+			// clangd is started only after the initialize request
+			ls.writeUnlock(logger)
+			panic(errServerNotInitialized)
+		}
+
 		// if clangd is not started...
-		logger.Logf("(throttled: waiting for clangd)")
-		logger.Logf(yellow.Sprintf("unlocked (waiting clangd)"))
-		ls.clangdStarted.Wait()
-		logger.Logf(yellow.Sprintf("locked (waiting clangd)"))
+		ls.failIfMisnamedMainFile(logger)
+		if !ls.clangdFailed {
+			logger.Logf("(throttled: waiting for clangd)")
+			logger.Logf(yellow.Sprintf("unlocked (waiting clangd)"))
+			ls.clangdStarted.Wait()
+			logger.Logf(yellow.Sprintf("locked (waiting clangd)"))
+		}
 
 		if ls.Clangd == nil {
-			logger.Logf("clangd startup failed: quitting Language server")
-			ls.Close()
-			os.Exit(2)
+			ls.failIfMisnamedMainFile(logger)
+			ls.clangdStartupFailed(logger)
 		}
 	}
 }
 
+// errClangdStartupFailed is the error returned to the IDE when its session is closed
+// because clangd could not be started.
+var errClangdStartupFailed = errors.New("clangd startup failed: the language server session has been closed")
+
+// clangdStartupFailed terminates the language server when clangd could not be started.
+// When running multiple sessions only the current session is closed: the lock is released
+// and the handler of the IDE message is unwound with errClangdStartupFailed, that is turned
+// into an error response by replyClangdStartupFailure.
+func (ls *INOLanguageServer) clangdStartupFailed(logger jsonrpc.FunctionLogger) {
+	logger.Logf("clangd startup failed: quitting Language server")
+	ls.clangdFailed = true
+	ls.Close()
+	if !ls.config.MultiSession {
+		os.Exit(2)
+	}
+	ls.writeUnlock(logger)
+	panic(errClangdStartupFailed)
+}
+
+// recoverClangdUnavailable must be deferred by the code running in background that needs
+// clangd: the unwinding done by writeLock when clangd is not available, meant for the
+// handlers of the IDE messages (see replyClangdStartupFailure), is stopped and returned in
+// err instead of crashing the whole language server.
+func recoverClangdUnavailable(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if r != errClangdStartupFailed && r != errServerNotInitialized && r != errMisnamedMainFile {
+		panic(r)
+	}
+	*err = r.(error)
+}
+
 func (ls *INOLanguageServer) writeUnlock(logger jsonrpc.FunctionLogger) {
 	logger.Logf(yellow.Sprintf("write-unlocked"))
 	ls.dataMux.Unlock()
@@ -134,30 +258,48 @@ func (ls *INOLanguageServer) readUnlock(logger jsonrpc.FunctionLogger) {
 }
 
 // NewINOLanguageServer creates and configures an Arduino Language Server.
-func NewINOLanguageServer(stdin io.Reader, stdout io.Writer, config *Config) *INOLanguageServer {
+func NewINOLanguageServer(stdin io.Reader, stdout io.Writer, config *Config) (*INOLanguageServer, error) {
 	logger := NewLSPFunctionLogger(color.HiWhiteString, "LS: ")
 	ls := &INOLanguageServer{
 		trackedIdeDocs:            map[string]lsp.TextDocumentItem{},
+		outOfSyncIdeDocs:          map[lsp.DocumentURI]bool{},
+		sketchSettings:            &SketchSettings{},
 		ideInoDocsWithDiagnostics: map[lsp.DocumentURI]bool{},
+		ideDocsWithDiagnostics:    map[lsp.DocumentURI]bool{},
+		flashStringDiagnostics:    map[lsp.DocumentURI][]lsp.Diagnostic{},
 		closing:                   make(chan bool),
+		ideDisconnected:           make(chan struct{}),
 		config:                    config,
+		clangdRequests:            config.clangdRequests,
+		responseCache:             newResponseCache(responseCacheSize),
+		methodFilter:              config.MethodFilter,
+		ideMessages:               newMessageHistory(ideMessagesHistorySize),
+	}
+	if ls.clangdRequests == nil {
+		ls.clangdRequests = newRequestLimiter(config.ClangdMaxConcurrentRequests)
 	}
+	ls.workspaceSymbolsFromCore.Store(config.WorkspaceSymbolsFromCore)
 	ls.clangdStarted = sync.NewCond(&ls.dataMux)
 	ls.sketchRebuilder = newSketchBuilder(ls)
 
-	if tmp, err := paths.MkTempDir("", "arduino-language-server"); err != nil {
-		log.Fatalf("Could not create temp folder: %s", err)
+	if tmp, err := paths.MkTempDir(config.TempRoot().String(), tempDirPrefix); err != nil {
+		return nil, fmt.Errorf("could not create temp folder: %w", err)
 	} else {
 		ls.tempDir = tmp.Canonical()
 	}
+	if err := writeSessionPID(ls.tempDir); err != nil {
+		logger.Logf("Error marking the temp folder as in use: %s", err)
+	}
 	ls.buildPath = ls.tempDir.Join("build")
 	ls.buildSketchRoot = ls.buildPath.Join("sketch")
 	if err := ls.buildPath.MkdirAll(); err != nil {
-		log.Fatalf("Could not create temp folder: %s", err)
+		ls.tempDir.RemoveAll()
+		return nil, fmt.Errorf("could not create temp folder: %w", err)
 	}
 	ls.fullBuildPath = ls.tempDir.Join("fullbuild")
 	if err := ls.fullBuildPath.MkdirAll(); err != nil {
-		log.Fatalf("Could not create temp folder: %s", err)
+		ls.tempDir.RemoveAll()
+		return nil, fmt.Errorf("could not create temp folder: %w", err)
 	}
 
 	logger.Logf("Initial board configuration: %s", ls.config.Fqbn)
@@ -167,89 +309,44 @@ func NewINOLanguageServer(stdin io.Reader, stdout io.Writer, config *Config) *IN
 	logger.Logf("Language server build sketch root: %s", ls.buildSketchRoot)
 	logger.Logf("Language server FULL build path: %s", ls.fullBuildPath)
 
-	ls.IDE = NewIDELSPServer(logger, stdin, stdout, ls)
-	ls.progressHandler = newProgressProxy(ls.IDE.conn)
+	ideOutput := &ideOutputWriter{out: stdout}
+	ideOutput.onError = func(err error) {
+		// The message is being sent while holding the locks of the caller
+		go ls.ideConnectionClosed(logger, "error sending data: "+err.Error())
+	}
+	ls.IDE = NewIDELSPServer(logger, stdin, ideOutput, ls)
+	ls.progressHandler = newProgressProxy(ls.IDE.conn, progressReportInterval(config.ProgressMaxRate))
 	go func() {
 		defer streams.CatchAndLogPanic()
+		defer close(ls.ideDisconnected)
 		ls.IDE.Run()
-		logger.Logf("Lost connection with IDE!")
-		ls.Close()
+		ls.ideConnectionClosed(logger, "end of input")
 	}()
 
-	return ls
+	return ls, nil
 }
 
 func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.InitializeParams) (*lsp.InitializeResult, *jsonrpc.ResponseError) {
 	ls.writeLock(logger, false)
 	ls.sketchRoot = ideParams.RootURI.AsPath()
+	if isLibraryFolder(ls.sketchRoot) {
+		// Library development: the library is built with one of its examples
+		if sketchRoot, err := ls.libraryDevelopmentSketch(logger, ls.sketchRoot); err != nil {
+			logger.Logf("Error preparing the library development sketch: %s", err)
+		} else {
+			ls.libraryRoot = ls.sketchRoot
+			ls.sketchRoot = sketchRoot
+		}
+	}
 	ls.sketchName = ls.sketchRoot.Base()
 	ls.buildSketchCpp = ls.buildSketchRoot.Join(ls.sketchName + ".ino.cpp")
+	ls.ignoreRules = loadIgnoreRules(ls.sketchRoot)
+	ls.readSketchSettings(logger)
+	ls.buildFqbn = ls.config.Fqbn
+	ls.ideInitializeParams = ideParams
 	ls.writeUnlock(logger)
 
-	go func() {
-		defer streams.CatchAndLogPanic()
-
-		// Unlock goroutines waiting for clangd at the end of the initialization.
-		defer ls.clangdStarted.Broadcast()
-
-		logger := NewLSPFunctionLogger(color.HiCyanString, "INIT --- ")
-		logger.Logf("initializing workbench: %s", ideParams.RootURI)
-
-		if success, err := ls.generateBuildEnvironment(context.Background(), true, logger); err != nil {
-			logger.Logf("error starting clang: %s", err)
-			return
-		} else if !success {
-			logger.Logf("bootstrap build failed!")
-			return
-		}
-
-		if inoCppContent, err := ls.buildSketchCpp.ReadFile(); err == nil {
-			ls.sketchMapper = sourcemapper.CreateInoMapper(inoCppContent)
-			ls.sketchMapper.CppText.Version = 1
-		} else {
-			logger.Logf("error starting clang: reading generated cpp file from sketch: %s", err)
-			return
-		}
-
-		// Retrieve data folder
-		dataFolder, err := ls.extractDataFolderFromArduinoCLI(logger)
-		if err != nil {
-			logger.Logf("error retrieving data folder from arduino-cli: %s", err)
-			return
-		}
-
-		// Start clangd
-		ls.Clangd = newClangdLSPClient(logger, dataFolder, ls)
-		go func() {
-			defer streams.CatchAndLogPanic()
-			ls.Clangd.Run()
-			logger.Logf("Lost connection with clangd!")
-			ls.Close()
-		}()
-
-		// Send initialization command to clangd (1 sec. timeout)
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		clangInitializeParams := *ideParams
-		clangInitializeParams.RootPath = ls.buildSketchRoot.String()
-		clangInitializeParams.RootURI = lsp.NewDocumentURIFromPath(ls.buildSketchRoot)
-		if clangInitializeResult, clangErr, err := ls.Clangd.conn.Initialize(ctx, &clangInitializeParams); err != nil {
-			logger.Logf("error initializing clangd: %v", err)
-			return
-		} else if clangErr != nil {
-			logger.Logf("error initializing clangd: %v", clangErr.AsError())
-			return
-		} else {
-			logger.Logf("clangd successfully started: %s", string(lsp.EncodeMessage(clangInitializeResult)))
-		}
-
-		if err := ls.Clangd.conn.Initialized(&lsp.InitializedParams{}); err != nil {
-			logger.Logf("error sending initialized notification to clangd: %v", err)
-			return
-		}
-
-		logger.Logf("Done initializing workbench")
-	}()
+	go ls.initializeWorkbench(ideParams)
 	/*
 		Clang 12 capabilities:
 
@@ -334,18 +431,21 @@ func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger js
 				TriggerCharacters: []string{"(", ","},
 			},
 			// DeclarationProvider:             &lsp.DeclarationRegistrationOptions{},
-			DefinitionProvider: &lsp.DefinitionOptions{},
-			// ImplementationProvider:          &lsp.ImplementationRegistrationOptions{},
+			DefinitionProvider:     &lsp.DefinitionOptions{},
+			TypeDefinitionProvider: &lsp.TypeDefinitionOptions{},
+			ImplementationProvider: &lsp.ImplementationOptions{},
 			// ReferencesProvider:              &lsp.ReferenceOptions{},
 			DocumentHighlightProvider: &lsp.DocumentHighlightOptions{},
-			DocumentSymbolProvider:    &lsp.DocumentSymbolOptions{},
+			DocumentSymbolProvider:    &lsp.DocumentSymbolOptions{Label: documentSymbolsLabel},
 			CodeActionProvider: &lsp.CodeActionOptions{
 				CodeActionKinds: []lsp.CodeActionKind{
 					lsp.CodeActionKindQuickFix,
 					lsp.CodeActionKindRefactor,
+					lsp.CodeActionKindSourceOrganizeImports,
 					"info",
 				},
 			},
+			CodeLensProvider: &lsp.CodeLensOptions{},
 			// DocumentLinkProvider:            &lsp.DocumentLinkOptions{ResolveProvider: false},
 			DocumentFormattingProvider:      &lsp.DocumentFormattingOptions{},
 			DocumentRangeFormattingProvider: &lsp.DocumentRangeFormattingOptions{},
@@ -357,26 +457,17 @@ func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger js
 				// PrepareProvider: true,
 			},
 			ExecuteCommandProvider: &lsp.ExecuteCommandOptions{
-				Commands: []string{"clangd.applyFix", "clangd.applyTweak"},
+				Commands: serverCommands,
 			},
 			// SelectionRangeProvider: &lsp.SelectionRangeOptions{},
 			// CallHierarchyProvider: &lsp.CallHierarchyOptions{},
-			// SemanticTokensProvider: &lsp.SemanticTokensOptions{
-			// 	Legend: lsp.SemanticTokensLegend{
-			// 		TokenTypes: []string{
-			// 			"variable", "variable", "parameter", "function", "method",
-			// 			"function", "property", "variable", "class", "enum",
-			// 			"enumMember", "type", "dependent", "dependent", "namespace",
-			// 			"typeParameter", "concept", "type", "macro", "comment",
-			// 		},
-			// 		TokenModifiers: []string{},
-			// 	},
-			// 	Range: false,
-			// 	Full: &lsp.SemanticTokenFullOptions{
-			// 		Delta: true,
-			// 	},
-			// },
+			SemanticTokensProvider: &lsp.SemanticTokensOptions{
+				Legend: semanticTokensLegend,
+				Range:  false,
+				Full:   &lsp.SemanticTokenFullOptions{},
+			},
 			WorkspaceSymbolProvider: &lsp.WorkspaceSymbolOptions{},
+			MonikerProvider:         &lsp.MonikerOptions{},
 		},
 		ServerInfo: &lsp.InitializeResultServerInfo{
 			Name:    "arduino-language-server",
@@ -387,7 +478,190 @@ func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger js
 	return resp, nil
 }
 
+// initializeWorkbench runs the bootstrap build of the sketch and starts clangd, the goroutines
+// waiting for clangd are unlocked at the end, even if the startup failed.
+func (ls *INOLanguageServer) initializeWorkbench(ideParams *lsp.InitializeParams) {
+	defer streams.CatchAndLogPanic()
+
+	// Unlock goroutines waiting for clangd at the end of the initialization.
+	defer ls.clangdStarted.Broadcast()
+
+	logger := NewLSPFunctionLogger(color.HiCyanString, "INIT --- ")
+	logger.Logf("initializing workbench: %s", ideParams.RootURI)
+	defer ls.logCapabilities(logger)
+	removeLeftoverFormatterConfigs(logger, ideParams.RootURI.AsPath())
+
+	if mainFiles := misnamedMainFiles(ls.sketchRoot, ls.sketchName); mainFiles != nil {
+		ls.reportMisnamedMainFile(logger, mainFiles)
+		return
+	}
+
+	if ls.config.Offline {
+		if err := ls.checkOfflineData(logger); err != nil {
+			logger.Logf("error starting clang: %s", err)
+			ls.setStartupFailure(logger, err.Error())
+			ls.showMessage(logger, lsp.MessageTypeError, "Could not start editor support.\n"+err.Error())
+			return
+		}
+	}
+
+	timings := newRebuildTimings("bootstrap")
+	if ls.recoverFromSnapshot(logger) {
+		logger.Logf("bootstrap build skipped")
+	} else {
+		// The fingerprint is taken before the build, changes made in the meantime
+		// will trigger a rebuild
+		manifest, includes, err := ls.computeSketchManifest(logger)
+		if err != nil {
+			logger.Logf("Error computing sketch manifest: %s", err)
+		}
+		if success, err := ls.generateBuildEnvironment(context.Background(), true, logger, timings); err != nil {
+			logger.Logf("error starting clang: %s", err)
+			ls.setStartupFailure(logger, buildFailureReason(ls.config.Fqbn, err))
+			ls.reportBoardConfigurationError(logger, err)
+			return
+		} else if !success {
+			logger.Logf("bootstrap build failed!")
+			ls.setStartupFailure(logger, "the bootstrap build of the sketch failed")
+			return
+		}
+		if manifest != nil {
+			ls.sketchRebuilder.SetLastBuild(manifest, includes)
+			ls.readLock(logger, false)
+			ls.saveSnapshot(logger, manifest, includes)
+			ls.readUnlock(logger)
+		}
+	}
+
+	preprocessingStart := time.Now()
+	if inoCppContent, err := ls.buildSketchCpp.ReadFile(); err == nil {
+		ls.sketchMapper = sourcemapper.CreateInoMapper(inoCppContent)
+		ls.sketchMapper.CppText.Version = 1
+		ls.updateReducedFeatures(logger, len(inoCppContent))
+		ls.updateSketchDiagnostics(logger)
+	} else {
+		logger.Logf("error starting clang: reading generated cpp file from sketch: %s", err)
+		ls.setStartupFailure(logger, fmt.Sprintf("reading the preprocessed sketch: %s", err))
+		return
+	}
+	timings.Preprocessing = elapsedMs(preprocessingStart)
+
+	dataFolder, err := ls.extractDataFolderFromArduinoCLI(logger)
+	if err != nil {
+		logger.Logf("error starting clangd: retrieving data folder from arduino-cli: %s", err)
+		ls.setStartupFailure(logger, fmt.Sprintf("retrieving the data folder from arduino-cli: %s", err))
+		return
+	}
+	clangdStart := time.Now()
+	if err := ls.startClangd(logger, dataFolder); err != nil {
+		logger.Logf("error starting clangd: %s", err)
+		ls.setStartupFailure(logger, err.Error())
+		return
+	}
+	timings.ClangdResync = elapsedMs(clangdStart)
+	ls.recordRebuildTimings(logger, timings)
+
+	logger.Logf("Done initializing workbench")
+}
+
+// defaultClangdInitTimeout is the time given to clangd to reply to the initialize request,
+// when not set in the Config: a fresh clangd binary may be slowed down by the antivirus.
+const defaultClangdInitTimeout = 30 * time.Second
+
+// startClangd starts a new clangd process and initializes it on the sketch build path.
+// ls.Clangd is replaced only if the new clangd has been successfully initialized. If the
+// initialization fails, another clangd process is started and initialized once again.
+func (ls *INOLanguageServer) startClangd(logger jsonrpc.FunctionLogger, dataFolder *paths.Path) error {
+	clangd, clangInitializeResult, err := ls.initializeClangd(logger, dataFolder)
+	if err != nil {
+		logger.Logf("%s, retrying", err)
+		clangd, clangInitializeResult, err = ls.initializeClangd(logger, dataFolder)
+		if err != nil {
+			return err
+		}
+	}
+	logger.Logf("clangd successfully started: %s", string(lsp.EncodeMessage(clangInitializeResult)))
+	ls.clangdTokensLegend = nil
+	if provider := clangInitializeResult.Capabilities.SemanticTokensProvider; provider != nil {
+		ls.clangdTokensLegend = &provider.Legend
+	}
+	ls.clangdMonikerProvider = clangInitializeResult.Capabilities.MonikerProvider != nil
+	ls.clangdVersion = ""
+	if info := clangInitializeResult.ServerInfo; info != nil {
+		ls.clangdVersion = info.Version
+	}
+
+	if err := clangd.conn.Initialized(&lsp.InitializedParams{}); err != nil {
+		clangd.Close()
+		return fmt.Errorf("sending initialized notification to clangd: %w", err)
+	}
+	ls.Clangd = clangd
+	ls.clangdDataFolder = dataFolder
+	return nil
+}
+
+// initializeClangd starts a new clangd process and sends it the initialize request, the
+// process is closed if the request fails, and killed if clangd doesn't reply within
+// Config.ClangdInitTimeout.
+func (ls *INOLanguageServer) initializeClangd(logger jsonrpc.FunctionLogger, dataFolder *paths.Path) (*clangdLSPClient, *lsp.InitializeResult, error) {
+	clangd := newClangdLSPClient(logger, dataFolder, ls)
+	go func() {
+		defer streams.CatchAndLogPanic()
+		clangd.Run()
+		if clangd.IsClosing() {
+			logger.Logf("clangd terminated")
+			return
+		}
+		logger.Logf("Lost connection with clangd!")
+		ls.Close()
+	}()
+
+	timeout := ls.config.ClangdInitTimeout
+	if timeout <= 0 {
+		timeout = defaultClangdInitTimeout
+	}
+	clangInitializeParams := *ls.ideInitializeParams
+	clangInitializeParams.RootPath = ls.buildSketchRoot.String()
+	clangInitializeParams.RootURI = lsp.NewDocumentURIFromPath(ls.buildSketchRoot)
+	clangInitializeParams.Capabilities = withHierarchicalDocumentSymbols(clangInitializeParams.Capabilities)
+
+	// The request is not abandoned when its context expires (the response is awaited even
+	// after sending the cancelation), so the timeout is enforced here
+	type initializeResponse struct {
+		result  *lsp.InitializeResult
+		respErr *jsonrpc.ResponseError
+		err     error
+	}
+	responses := make(chan initializeResponse, 1)
+	go func() {
+		defer streams.CatchAndLogPanic()
+		var resp initializeResponse
+		resp.result, resp.respErr, resp.err = clangd.conn.Initialize(context.Background(), &clangInitializeParams)
+		responses <- resp
+	}()
+
+	var clangInitializeResult *lsp.InitializeResult
+	select {
+	case resp := <-responses:
+		if resp.err != nil {
+			clangd.Close()
+			return nil, nil, fmt.Errorf("initializing clangd: %w", resp.err)
+		} else if resp.respErr != nil {
+			clangd.Close()
+			return nil, nil, fmt.Errorf("initializing clangd: %w", resp.respErr.AsError())
+		}
+		clangInitializeResult = resp.result
+	case <-time.After(timeout):
+		if err := clangd.Kill(); err != nil {
+			logger.Logf("Error killing clangd: %s", err)
+		}
+		return nil, nil, fmt.Errorf("initializing clangd: no response within %s", timeout)
+	}
+	return clangd, clangInitializeResult, nil
+}
+
 func (ls *INOLanguageServer) shutdownReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) *jsonrpc.ResponseError {
+	ls.ideShutdown.Store(true)
 	done := make(chan bool)
 	go func() {
 		ls.progressHandler.Shutdown()
@@ -400,13 +674,23 @@ func (ls *INOLanguageServer) shutdownReqFromIDE(ctx context.Context, logger json
 }
 
 func (ls *INOLanguageServer) textDocumentCompletionReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.CompletionParams) (*lsp.CompletionList, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/completion") {
+		return nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
 
 	clangTextDocPositionParams, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 
 	clangParams := &lsp.CompletionParams{
@@ -416,15 +700,19 @@ func (ls *INOLanguageServer) textDocumentCompletionReqFromIDE(ctx context.Contex
 		PartialResultParams:        ideParams.PartialResultParams,
 	}
 
-	clangCompletionList, clangErr, err := ls.Clangd.conn.TextDocumentCompletion(ctx, clangParams)
+	var clangCompletionList *lsp.CompletionList
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangCompletionList, clangErr, err = ls.Clangd.conn.TextDocumentCompletion(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd connection error: %v", err)
 		ls.Close()
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	ideCompletionList := &lsp.CompletionList{
@@ -440,11 +728,11 @@ func (ls *INOLanguageServer) textDocumentCompletionReqFromIDE(ctx context.Contex
 		if clangItem.TextEdit != nil {
 			if ideURI, _ideTextEdit, isPreprocessed, err := ls.cpp2inoTextEdit(logger, clangParams.TextDocument.URI, *clangItem.TextEdit); err != nil {
 				logger.Logf("Error converting textedit: %s", err)
-				return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+				return nil, responseError(err)
 			} else if ideURI != ideParams.TextDocument.URI || isPreprocessed {
 				err := fmt.Errorf("text edit is in preprocessed section or is mapped to another file")
 				logger.Logf("Error converting textedit: %s", err)
-				return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+				return nil, responseError(err)
 			} else {
 				ideTextEdit = &_ideTextEdit
 			}
@@ -454,7 +742,7 @@ func (ls *INOLanguageServer) textDocumentCompletionReqFromIDE(ctx context.Contex
 			_ideAdditionalTextEdits, err := ls.cland2IdeTextEdits(logger, clangParams.TextDocument.URI, clangItem.AdditionalTextEdits)
 			if err != nil {
 				logger.Logf("Error converting textedit: %s", err)
-				return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+				return nil, responseError(err)
 			}
 			ideAdditionalTextEdits = _ideAdditionalTextEdits[ideParams.TextDocument.URI]
 		}
@@ -489,33 +777,62 @@ func (ls *INOLanguageServer) textDocumentCompletionReqFromIDE(ctx context.Contex
 			AdditionalTextEdits: ideAdditionalTextEdits,
 		})
 	}
+	if ls.config.CompletionRanking {
+		rankCompletionItems(ideCompletionList.Items, ls.sketchIdentifiers())
+	}
 	logger.Logf("<-- completion(%d items)", len(ideCompletionList.Items))
 	return ideCompletionList, nil
 }
 
-func (ls *INOLanguageServer) textDocumentHoverReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.HoverParams) (*lsp.Hover, *jsonrpc.ResponseError) {
+func (ls *INOLanguageServer) textDocumentHoverReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.HoverParams) (res *lsp.Hover, respErr *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/hover") {
+		return nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
 
+	if cacheKey, cacheable := ls.responseCacheKey("textDocument/hover", ideParams.TextDocument.URI, ideParams.Position); cacheable {
+		if cached, ok := ls.responseCache.Get(cacheKey); ok {
+			logger.Logf("Cached response")
+			return cached.(*lsp.Hover), nil
+		}
+		defer func() {
+			if respErr == nil {
+				ls.responseCache.Put(cacheKey, res)
+			}
+		}()
+	}
+
 	clangTextDocPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 
 	clangParams := &lsp.HoverParams{
 		TextDocumentPositionParams: clangTextDocPosition,
 		WorkDoneProgressParams:     ideParams.WorkDoneProgressParams,
 	}
-	clangResp, clangErr, err := ls.Clangd.conn.TextDocumentHover(ctx, clangParams)
+	var clangResp *lsp.Hover
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangResp, clangErr, err = ls.Clangd.conn.TextDocumentHover(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd communication error: %v", err)
 		ls.Close()
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	if clangResp == nil {
@@ -529,7 +846,7 @@ func (ls *INOLanguageServer) textDocumentHoverReqFromIDE(ctx context.Context, lo
 		if err != nil {
 			logger.Logf("error during range conversion: %v", err)
 			ls.Close()
-			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+			return nil, responseError(err)
 		}
 		if inPreprocessed {
 			return nil, nil
@@ -540,18 +857,36 @@ func (ls *INOLanguageServer) textDocumentHoverReqFromIDE(ctx context.Context, lo
 		Contents: clangResp.Contents,
 		Range:    ideRange,
 	}
+	if ideRange != nil {
+		// Show the value of the pins and the other constants defined by the board
+		if doc, ok := ls.trackedIdeDocs[ideParams.TextDocument.URI.AsPath().String()]; ok {
+			if identifier, err := textutils.ExtractRange(doc.Text, *ideRange); err == nil {
+				ls.addBoardDefinitionToHover(&ideResp, identifier)
+			}
+		}
+	}
 	logger.Logf("Hover content: %s", strconv.Quote(ideResp.Contents.Value))
 	return &ideResp, nil
 }
 
 func (ls *INOLanguageServer) textDocumentSignatureHelpReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.SignatureHelpParams) (*lsp.SignatureHelp, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/signatureHelp") {
+		return nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
 
 	clangTextDocumentPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 
 	clangParams := &lsp.SignatureHelpParams{
@@ -559,15 +894,19 @@ func (ls *INOLanguageServer) textDocumentSignatureHelpReqFromIDE(ctx context.Con
 		WorkDoneProgressParams:     ideParams.WorkDoneProgressParams,
 		Context:                    ideParams.Context,
 	}
-	clangSignatureHelp, clangErr, err := ls.Clangd.conn.TextDocumentSignatureHelp(ctx, clangParams)
+	var clangSignatureHelp *lsp.SignatureHelp
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangSignatureHelp, clangErr, err = ls.Clangd.conn.TextDocumentSignatureHelp(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd communication error: %v", err)
 		ls.Close()
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	// No need to convert back to inoSignatureHelp
@@ -576,13 +915,23 @@ func (ls *INOLanguageServer) textDocumentSignatureHelpReqFromIDE(ctx context.Con
 }
 
 func (ls *INOLanguageServer) textDocumentDefinitionReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DefinitionParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/definition") {
+		return nil, nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
 
 	clangTextDocPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, nil, responseError(err)
 	}
 
 	clangParams := &lsp.DefinitionParams{
@@ -590,15 +939,20 @@ func (ls *INOLanguageServer) textDocumentDefinitionReqFromIDE(ctx context.Contex
 		WorkDoneProgressParams:     ideParams.WorkDoneProgressParams,
 		PartialResultParams:        ideParams.PartialResultParams,
 	}
-	clangLocations, clangLocationLinks, clangErr, err := ls.Clangd.conn.TextDocumentDefinition(ctx, clangParams)
+	var clangLocations []lsp.Location
+	var clangLocationLinks []lsp.LocationLink
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangLocations, clangLocationLinks, clangErr, err = ls.Clangd.conn.TextDocumentDefinition(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd communication error: %v", err)
 		ls.Close()
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	var ideLocations []lsp.Location
@@ -607,28 +961,41 @@ func (ls *INOLanguageServer) textDocumentDefinitionReqFromIDE(ctx context.Contex
 		if err != nil {
 			logger.Logf("Error: %v", err)
 			ls.Close()
-			return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+			return nil, nil, responseError(err)
 		}
 	}
 
 	var ideLocationLinks []lsp.LocationLink
 	if clangLocationLinks != nil {
-		panic("unimplemented")
+		ideLocationLinks, err = ls.clang2IdeLocationLinksArray(logger, clangParams.TextDocument.URI, clangLocationLinks)
+		if err != nil {
+			logger.Logf("Error: %v", err)
+			ls.Close()
+			return nil, nil, responseError(err)
+		}
 	}
 
 	return ideLocations, ideLocationLinks, nil
 }
 
 func (ls *INOLanguageServer) textDocumentTypeDefinitionReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.TypeDefinitionParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError) {
-	// XXX: This capability is not advertised in the initialization message (clangd
-	// does not advertise it either, so maybe we should just not implement it)
+	if !ls.methodForwarded(logger, "textDocument/typeDefinition") {
+		return nil, nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
 
 	cppTextDocumentPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, nil, responseError(err)
 	}
 
 	clangParams := &lsp.TypeDefinitionParams{
@@ -636,15 +1003,20 @@ func (ls *INOLanguageServer) textDocumentTypeDefinitionReqFromIDE(ctx context.Co
 		WorkDoneProgressParams:     ideParams.WorkDoneProgressParams,
 		PartialResultParams:        ideParams.PartialResultParams,
 	}
-	clangLocations, clangLocationLinks, clangErr, err := ls.Clangd.conn.TextDocumentTypeDefinition(ctx, clangParams)
+	var clangLocations []lsp.Location
+	var clangLocationLinks []lsp.LocationLink
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangLocations, clangLocationLinks, clangErr, err = ls.Clangd.conn.TextDocumentTypeDefinition(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd communication error: %v", err)
 		ls.Close()
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	var ideLocations []lsp.Location
@@ -653,26 +1025,41 @@ func (ls *INOLanguageServer) textDocumentTypeDefinitionReqFromIDE(ctx context.Co
 		if err != nil {
 			logger.Logf("Error: %v", err)
 			ls.Close()
-			return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+			return nil, nil, responseError(err)
 		}
 	}
 
 	var ideLocationLinks []lsp.LocationLink
 	if clangLocationLinks != nil {
-		panic("unimplemented")
+		ideLocationLinks, err = ls.clang2IdeLocationLinksArray(logger, clangParams.TextDocument.URI, clangLocationLinks)
+		if err != nil {
+			logger.Logf("Error: %v", err)
+			ls.Close()
+			return nil, nil, responseError(err)
+		}
 	}
 
 	return ideLocations, ideLocationLinks, nil
 }
 
 func (ls *INOLanguageServer) textDocumentImplementationReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.ImplementationParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/implementation") {
+		return nil, nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
 
 	clangTextDocumentPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, nil, responseError(err)
 	}
 
 	clangParams := &lsp.ImplementationParams{
@@ -680,15 +1067,20 @@ func (ls *INOLanguageServer) textDocumentImplementationReqFromIDE(ctx context.Co
 		WorkDoneProgressParams:     ideParams.WorkDoneProgressParams,
 		PartialResultParams:        ideParams.PartialResultParams,
 	}
-	clangLocations, clangLocationLinks, clangErr, err := ls.Clangd.conn.TextDocumentImplementation(ctx, clangParams)
+	var clangLocations []lsp.Location
+	var clangLocationLinks []lsp.LocationLink
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangLocations, clangLocationLinks, clangErr, err = ls.Clangd.conn.TextDocumentImplementation(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd communication error: %v", err)
 		ls.Close()
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	var ideLocations []lsp.Location
@@ -697,26 +1089,91 @@ func (ls *INOLanguageServer) textDocumentImplementationReqFromIDE(ctx context.Co
 		if err != nil {
 			logger.Logf("Error: %v", err)
 			ls.Close()
-			return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+			return nil, nil, responseError(err)
 		}
 	}
 
 	var inoLocationLinks []lsp.LocationLink
 	if clangLocationLinks != nil {
-		panic("unimplemented")
+		inoLocationLinks, err = ls.clang2IdeLocationLinksArray(logger, clangParams.TextDocument.URI, clangLocationLinks)
+		if err != nil {
+			logger.Logf("Error: %v", err)
+			ls.Close()
+			return nil, nil, responseError(err)
+		}
 	}
 
 	return ideLocations, inoLocationLinks, nil
 }
 
+func (ls *INOLanguageServer) textDocumentMonikerReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.MonikerParams) ([]lsp.Moniker, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/moniker") {
+		return nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
+	ls.readLock(logger, true)
+	defer ls.readUnlock(logger)
+
+	if !ls.clangdMonikerProvider {
+		logger.Logf("clangd does not provide monikers")
+		return nil, nil
+	}
+
+	clangTextDocumentPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, responseError(err)
+	}
+
+	clangParams := &lsp.MonikerParams{
+		TextDocumentPositionParams: clangTextDocumentPosition,
+		WorkDoneProgressParams:     ideParams.WorkDoneProgressParams,
+		PartialResultParams:        ideParams.PartialResultParams,
+	}
+	var clangMonikers []lsp.Moniker
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangMonikers, clangErr, err = ls.Clangd.conn.TextDocumentMoniker(ctx, clangParams)
+		return
+	})
+	if err != nil {
+		logger.Logf("clangd communication error: %v", err)
+		ls.Close()
+		return nil, responseError(err)
+	}
+	if clangErr != nil {
+		logger.Logf("clangd response error: %v", clangErr.AsError())
+		return nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
+	}
+
+	// The monikers identify the symbols independently of the documents: they don't
+	// contain positions nor URIs to convert back to the sketch.
+	return clangMonikers, nil
+}
+
 func (ls *INOLanguageServer) textDocumentDocumentHighlightReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DocumentHighlightParams) ([]lsp.DocumentHighlight, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/documentHighlight") {
+		return nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
 
 	clangTextDocumentPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
 		logger.Logf("ERROR: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	clangURI := clangTextDocumentPosition.TextDocument.URI
 
@@ -725,15 +1182,19 @@ func (ls *INOLanguageServer) textDocumentDocumentHighlightReqFromIDE(ctx context
 		WorkDoneProgressParams:     ideParams.WorkDoneProgressParams,
 		PartialResultParams:        ideParams.PartialResultParams,
 	}
-	clangHighlights, clangErr, err := ls.Clangd.conn.TextDocumentDocumentHighlight(ctx, clangParams)
+	var clangHighlights []lsp.DocumentHighlight
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangHighlights, clangErr, err = ls.Clangd.conn.TextDocumentDocumentHighlight(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd communication ERROR: %v", err)
 		ls.Close()
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response ERROR: %v", clangErr.AsError())
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	if clangHighlights == nil {
@@ -741,6 +1202,12 @@ func (ls *INOLanguageServer) textDocumentDocumentHighlightReqFromIDE(ctx context
 		return nil, nil
 	}
 
+	if inside, _ := clangURI.AsPath().IsInsideDir(ls.buildSketchRoot); !inside {
+		// The document is not part of the sketch (for example a library header opened
+		// in the IDE): the highlights do not need any conversion.
+		return clangHighlights, nil
+	}
+
 	ideHighlights := []lsp.DocumentHighlight{}
 	for _, clangHighlight := range clangHighlights {
 		ideHighlight, inPreprocessed, err := ls.clang2IdeDocumentHighlight(logger, clangHighlight, clangURI)
@@ -749,22 +1216,45 @@ func (ls *INOLanguageServer) textDocumentDocumentHighlightReqFromIDE(ctx context
 		}
 		if err != nil {
 			logger.Logf("ERROR converting highlight %s:%s: %s", clangURI, clangHighlight.Range, err)
-			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+			return nil, responseError(err)
 		}
 		ideHighlights = append(ideHighlights, ideHighlight)
 	}
 	return ideHighlights, nil
 }
 
-func (ls *INOLanguageServer) textDocumentDocumentSymbolReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DocumentSymbolParams) ([]lsp.DocumentSymbol, []lsp.SymbolInformation, *jsonrpc.ResponseError) {
+func (ls *INOLanguageServer) textDocumentDocumentSymbolReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DocumentSymbolParams) (symbols []lsp.DocumentSymbol, symbolsInformation []lsp.SymbolInformation, respErr *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/documentSymbol") {
+		return nil, nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
 
+	if cacheKey, cacheable := ls.responseCacheKey("textDocument/documentSymbol", ideParams.TextDocument.URI, lsp.Position{}); cacheable {
+		if cached, ok := ls.responseCache.Get(cacheKey); ok {
+			logger.Logf("Cached response")
+			cachedSymbols := cached.(*cachedDocumentSymbols)
+			return cachedSymbols.symbols, cachedSymbols.symbolsInformation, nil
+		}
+		defer func() {
+			if respErr == nil {
+				ls.responseCache.Put(cacheKey, &cachedDocumentSymbols{symbols: symbols, symbolsInformation: symbolsInformation})
+			}
+		}()
+	}
+
 	// Convert request for clang
 	clangTextDocument, err := ls.ide2ClangTextDocumentIdentifier(logger, ideParams.TextDocument)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, nil, responseError(err)
 	}
 
 	// Send request to clang
@@ -773,15 +1263,20 @@ func (ls *INOLanguageServer) textDocumentDocumentSymbolReqFromIDE(ctx context.Co
 		WorkDoneProgressParams: ideParams.WorkDoneProgressParams,
 		PartialResultParams:    ideParams.PartialResultParams,
 	}
-	clangDocSymbols, clangSymbolsInformation, clangErr, err := ls.Clangd.conn.TextDocumentDocumentSymbol(ctx, clangParams)
+	var clangDocSymbols []lsp.DocumentSymbol
+	var clangSymbolsInformation []lsp.SymbolInformation
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangDocSymbols, clangSymbolsInformation, clangErr, err = ls.Clangd.conn.TextDocumentDocumentSymbol(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd communication error: %v", err)
 		ls.Close()
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	// Convert response for IDE
@@ -791,7 +1286,7 @@ func (ls *INOLanguageServer) textDocumentDocumentSymbolReqFromIDE(ctx context.Co
 		if err != nil {
 			logger.Logf("Error: %s", err)
 			ls.Close()
-			return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+			return nil, nil, responseError(err)
 		}
 		ideDocSymbols = s
 	}
@@ -799,10 +1294,33 @@ func (ls *INOLanguageServer) textDocumentDocumentSymbolReqFromIDE(ctx context.Co
 	if clangSymbolsInformation != nil {
 		ideSymbolsInformation = ls.clang2IdeSymbolsInformation(logger, clangSymbolsInformation)
 	}
+	if ideDocSymbols != nil && !ideSupportsHierarchicalDocumentSymbols(ls.ideInitializeParams) {
+		// The IDE accepts only the flat form
+		return nil, flattenDocumentSymbols(ideDocSymbols, ideParams.TextDocument.URI, ""), nil
+	}
 	return ideDocSymbols, ideSymbolsInformation, nil
 }
 
 func (ls *INOLanguageServer) textDocumentCodeActionReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.CodeActionParams) ([]lsp.CommandOrCodeAction, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/codeAction") {
+		return nil, nil
+	}
+
+	// Without clangd only the quick-fixes of the language server are available
+	ls.readLock(logger, false)
+	if ls.misnamedMainFiles != nil {
+		defer ls.readUnlock(logger)
+		logger.Logf("--> codeAction(%s:%s) without clangd", ideParams.TextDocument, ideParams.Range.Start)
+		return ls.arduinoQuickFixes(logger, ideParams.TextDocument.URI, ideParams.Context.Diagnostics), nil
+	}
+	ls.readUnlock(logger)
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
 
@@ -813,13 +1331,13 @@ func (ls *INOLanguageServer) textDocumentCodeActionReqFromIDE(ctx context.Contex
 	clangURI, clangRange, err := ls.ide2ClangRange(logger, ideURI, ideParams.Range)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 
 	clangContext, err := ls.ide2ClangCodeActionContext(logger, ideURI, ideParams.Context)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	clangParams := &lsp.CodeActionParams{
 		WorkDoneProgressParams: ideParams.WorkDoneProgressParams,
@@ -830,22 +1348,23 @@ func (ls *INOLanguageServer) textDocumentCodeActionReqFromIDE(ctx context.Contex
 	}
 	logger.Logf("    --> codeAction(%s:%s)", clangParams.TextDocument, ideParams.Range.Start)
 
-	clangCommandsOrCodeActions, clangErr, err := ls.Clangd.conn.TextDocumentCodeAction(ctx, clangParams)
+	var clangCommandsOrCodeActions []lsp.CommandOrCodeAction
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangCommandsOrCodeActions, clangErr, err = ls.Clangd.conn.TextDocumentCodeAction(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd communication error: %v", err)
 		ls.Close()
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	// TODO: Create a function for this one?
 	ideCommandsOrCodeActions := []lsp.CommandOrCodeAction{}
-	if clangCommandsOrCodeActions != nil {
-		return ideCommandsOrCodeActions, nil
-	}
 	logger.Logf("    <-- codeAction(%d elements)", len(clangCommandsOrCodeActions))
 	for _, clangItem := range clangCommandsOrCodeActions {
 		ideItem := lsp.CommandOrCodeAction{}
@@ -867,11 +1386,25 @@ func (ls *INOLanguageServer) textDocumentCodeActionReqFromIDE(ctx context.Contex
 		}
 		ideCommandsOrCodeActions = append(ideCommandsOrCodeActions, ideItem)
 	}
+
+	// Add the quick-fixes synthesized by the language server
+	ideCommandsOrCodeActions = append(ideCommandsOrCodeActions, ls.arduinoQuickFixes(logger, ideURI, ideParams.Context.Diagnostics)...)
+	ideCommandsOrCodeActions = append(ideCommandsOrCodeActions, ls.organizeIncludesCodeAction(logger, ideURI, ideParams.Context.Only)...)
 	logger.Logf("<-- codeAction(%d elements)", len(ideCommandsOrCodeActions))
 	return ideCommandsOrCodeActions, nil
 }
 
 func (ls *INOLanguageServer) textDocumentFormattingReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DocumentFormattingParams) ([]lsp.TextEdit, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/formatting") {
+		return nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
 
@@ -881,14 +1414,19 @@ func (ls *INOLanguageServer) textDocumentFormattingReqFromIDE(ctx context.Contex
 	clangTextDocument, err := ls.ide2ClangTextDocumentIdentifier(logger, ideTextDocument)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	clangURI := clangTextDocument.URI
 
-	cleanup, err := ls.createClangdFormatterConfig(logger, clangURI)
-	if err != nil {
+	cleanup, err := ls.createClangdFormatterConfig(ctx, logger, clangURI, ideParams.Options)
+	if ctx.Err() != nil {
+		if cleanup != nil {
+			cleanup()
+		}
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesRequestCancelled, Message: ctx.Err().Error()}
+	} else if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	defer cleanup()
 
@@ -897,15 +1435,19 @@ func (ls *INOLanguageServer) textDocumentFormattingReqFromIDE(ctx context.Contex
 		Options:                ideParams.Options,
 		TextDocument:           clangTextDocument,
 	}
-	clangEdits, clangErr, err := ls.Clangd.conn.TextDocumentFormatting(ctx, clangParams)
+	var clangEdits []lsp.TextEdit
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangEdits, clangErr, err = ls.Clangd.conn.TextDocumentFormatting(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd communication error: %v", err)
 		ls.Close()
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	if clangEdits == nil {
@@ -915,18 +1457,34 @@ func (ls *INOLanguageServer) textDocumentFormattingReqFromIDE(ctx context.Contex
 	ideEdits, err := ls.cland2IdeTextEdits(logger, clangURI, clangEdits)
 	if err != nil {
 		logger.Logf("ERROR converting textEdits: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 
 	// Edits may span over multiple .ino files, filter only the edits relative to the currently displayed file
 	inoEdits, ok := ideEdits[ideURI]
 	if !ok {
-		return []lsp.TextEdit{}, nil
+		inoEdits = []lsp.TextEdit{}
+	}
+	if ls.config.FormatOrganizeIncludes {
+		if inoEdits, err = ls.organizeFormattedIncludes(ideURI, inoEdits); err != nil {
+			logger.Logf("ERROR organizing includes: %s", err)
+			return nil, responseError(err)
+		}
 	}
 	return inoEdits, nil
 }
 
 func (ls *INOLanguageServer) textDocumentRangeFormattingReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DocumentRangeFormattingParams) ([]lsp.TextEdit, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/rangeFormatting") {
+		return nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
 
@@ -934,7 +1492,7 @@ func (ls *INOLanguageServer) textDocumentRangeFormattingReqFromIDE(ctx context.C
 	clangURI, clangRange, err := ls.ide2ClangRange(logger, ideURI, ideParams.Range)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	clangParams := &lsp.DocumentRangeFormattingParams{
 		WorkDoneProgressParams: ideParams.WorkDoneProgressParams,
@@ -943,22 +1501,31 @@ func (ls *INOLanguageServer) textDocumentRangeFormattingReqFromIDE(ctx context.C
 		Range:                  clangRange,
 	}
 
-	cleanup, e := ls.createClangdFormatterConfig(logger, clangURI)
-	if e != nil {
+	cleanup, err := ls.createClangdFormatterConfig(ctx, logger, clangURI, ideParams.Options)
+	if ctx.Err() != nil {
+		if cleanup != nil {
+			cleanup()
+		}
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesRequestCancelled, Message: ctx.Err().Error()}
+	} else if err != nil {
 		logger.Logf("cannot create formatter config file: %v", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	defer cleanup()
 
-	clangEdits, clangErr, err := ls.Clangd.conn.TextDocumentRangeFormatting(ctx, clangParams)
+	var clangEdits []lsp.TextEdit
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangEdits, clangErr, err = ls.Clangd.conn.TextDocumentRangeFormatting(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd communication error: %v", err)
 		ls.Close()
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	if clangEdits == nil {
@@ -968,7 +1535,7 @@ func (ls *INOLanguageServer) textDocumentRangeFormattingReqFromIDE(ctx context.C
 	sketchEdits, err := ls.cland2IdeTextEdits(logger, clangURI, clangEdits)
 	if err != nil {
 		logger.Logf("ERROR converting textEdits: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 
 	// Edits may span over multiple .ino files, filter only the edits relative to the currently displayed file
@@ -981,21 +1548,46 @@ func (ls *INOLanguageServer) textDocumentRangeFormattingReqFromIDE(ctx context.C
 
 func (ls *INOLanguageServer) initializedNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *lsp.InitializedParams) {
 	logger.Logf("Notification is not propagated to clangd")
+
+	// Dynamic registrations must be requested after the initialization is completed,
+	// the request is sent asynchronously to avoid blocking the notifications handler.
+	go func() {
+		defer streams.CatchAndLogPanic()
+		ls.registerFileOperations(logger)
+		ls.registerWatchedFiles(logger)
+		ls.registerEnvironmentWatchedFiles(logger)
+		ls.registerWorkspaceFolders(logger)
+		ls.registerInlineValues(logger)
+	}()
 }
 
 func (ls *INOLanguageServer) exitNotifFromIDE(logger jsonrpc.FunctionLogger) {
+	ls.ideShutdown.Store(true)
 	ls.Clangd.conn.Exit()
 	logger.Logf("Arduino Language Server is exiting.")
 	ls.Close()
 }
 
 func (ls *INOLanguageServer) textDocumentDidOpenNotifFromIDE(logger jsonrpc.FunctionLogger, ideParam *lsp.DidOpenTextDocumentParams) {
+	if isPreviewGeneratedSketchURI(ideParam.TextDocument.URI) {
+		// The preprocessed sketch preview is read-only and its content is provided
+		// through the arduino/previewGeneratedSketch request: nothing to track here.
+		logger.Logf("Opened read-only preview %s", ideParam.TextDocument.URI)
+		return
+	}
+
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
 
 	ideTextDocItem := ideParam.TextDocument
+	ideTextDocItem.Text = textutils.StripBOM(ideTextDocItem.Text)
 	clangURI, _, err := ls.ide2ClangDocumentURI(logger, ideTextDocItem.URI)
-	if err != nil {
+	var declined *ExternalFileDeclinedError
+	if errors.As(err, &declined) {
+		logger.Logf("%s", err)
+		ls.showMessage(logger, lsp.MessageTypeInfo, fmt.Sprintf("%s is outside of the sketch: code analysis is disabled for this file.", ideTextDocItem.URI.AsPath().Base()))
+		return
+	} else if err != nil {
 		logger.Logf("Error: %s", err)
 		return
 	}
@@ -1008,6 +1600,10 @@ func (ls *INOLanguageServer) textDocumentDidOpenNotifFromIDE(logger jsonrpc.Func
 
 	// Add the TextDocumentItem in the tracked files list
 	ls.trackedIdeDocs[ideTextDocItem.URI.AsPath().String()] = ideTextDocItem
+	ls.responseCache.Clear()
+	ls.checkRecoveredDoc(logger, ideTextDocItem)
+	ls.checkOutOfSyncDoc(logger, ideTextDocItem)
+	ls.updateReducedFeaturesOnTabsChange(logger)
 
 	// If we are tracking a .ino...
 	if ideTextDocItem.URI.Ext() == ".ino" {
@@ -1021,6 +1617,16 @@ func (ls *INOLanguageServer) textDocumentDidOpenNotifFromIDE(logger jsonrpc.Func
 		}
 	}
 
+	if err := ls.clangdDidOpen(logger, clangURI, ideTextDocItem); err != nil {
+		// Exit the process and trigger a restart by the client in case of a severe error
+		logger.Logf("Error sending notification to clangd server: %v", err)
+		logger.Logf("Please restart the language server.")
+		ls.Close()
+	}
+}
+
+// clangdDidOpen sends a didOpen notification to clangd for the given IDE document.
+func (ls *INOLanguageServer) clangdDidOpen(logger jsonrpc.FunctionLogger, clangURI lsp.DocumentURI, ideTextDocItem lsp.TextDocumentItem) error {
 	clangTextDocItem := lsp.TextDocumentItem{
 		URI: clangURI,
 	}
@@ -1033,27 +1639,39 @@ func (ls *INOLanguageServer) textDocumentDidOpenNotifFromIDE(logger jsonrpc.Func
 		if err != nil {
 			logger.Logf("Error opening sketch file %s: %s", clangURI.AsPath(), err)
 		}
+		if ls.isExternalFile(clangURI.AsPath()) {
+			if err := ls.setExternalFileCompileCommand(logger, clangURI.AsPath()); err != nil {
+				logger.Logf("Error setting the compile command of %s: %s", clangURI.AsPath(), err)
+			}
+		}
 		clangTextDocItem.LanguageID = ideTextDocItem.LanguageID
 		clangTextDocItem.Version = ideTextDocItem.Version
-		clangTextDocItem.Text = string(clangText)
+		clangTextDocItem.Text = textutils.StripBOM(string(clangText))
 	}
 
-	if err := ls.Clangd.conn.TextDocumentDidOpen(&lsp.DidOpenTextDocumentParams{
+	return ls.Clangd.conn.TextDocumentDidOpen(&lsp.DidOpenTextDocumentParams{
 		TextDocument: clangTextDocItem,
-	}); err != nil {
-		// Exit the process and trigger a restart by the client in case of a severe error
-		logger.Logf("Error sending notification to clangd server: %v", err)
-		logger.Logf("Please restart the language server.")
-		ls.Close()
-	}
+	})
 }
 
 func (ls *INOLanguageServer) textDocumentDidChangeNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *lsp.DidChangeTextDocumentParams) {
+	if isPreviewGeneratedSketchURI(ideParams.TextDocument.URI) {
+		logger.Logf("Ignored change to read-only preview %s", ideParams.TextDocument.URI)
+		return
+	}
+
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
 
-	ls.triggerRebuild()
+	ls.triggerRebuildOnChange()
+	ls.applyIdeDocumentChanges(logger, ideParams)
+}
 
+// applyIdeDocumentChanges applies the changes made in the IDE to the tracked document, to
+// the sketch mapper and to the documents opened in clangd. The caller must hold the
+// write-lock.
+func (ls *INOLanguageServer) applyIdeDocumentChanges(logger jsonrpc.FunctionLogger, ideParams *lsp.DidChangeTextDocumentParams) {
+	ls.responseCache.Clear()
 	logger.Logf("didChange(%s)", ideParams.TextDocument)
 	for _, change := range ideParams.ContentChanges {
 		logger.Logf("  > %s", change)
@@ -1074,12 +1692,18 @@ func (ls *INOLanguageServer) textDocumentDidChangeNotifFromIDE(logger jsonrpc.Fu
 	if doc, ok := ls.trackedIdeDocs[trackedIdeDocID]; !ok {
 		logger.Logf("Error: %s", &UnknownURIError{ideTextDocIdentifier.URI})
 		return
-	} else if updatedDoc, err := textedits.ApplyLSPTextDocumentContentChangeEvent(doc, ideParams); err != nil {
+	} else if updatedDoc, err := textutils.ApplyLSPTextDocumentContentChangeEvent(doc, ideParams); err != nil {
 		logger.Logf("Error: %s", err)
 		return
 	} else {
 		ls.trackedIdeDocs[trackedIdeDocID] = updatedDoc
 		logger.Logf("-----Tracked SKETCH file-----\n" + updatedDoc.Text + "\n-----------------------------")
+
+		// The F() hints are refreshed right away, they are published with the
+		// diagnostics that clangd sends for the new version of the sketch.
+		if updatedDoc.URI.Ext() == ".ino" && ls.flashStringHintsEnabled() {
+			ls.updateFlashStringDiagnostics(updatedDoc.URI, updatedDoc.Text)
+		}
 	}
 
 	clangChanges := []lsp.TextDocumentContentChangeEvent{}
@@ -1121,7 +1745,10 @@ func (ls *INOLanguageServer) textDocumentDidChangeNotifFromIDE(logger jsonrpc.Fu
 		// If changes are applied to a .ino file we increment the global .ino.cpp versioning
 		// for each increment of the single .ino file.
 		clangVersion = ls.sketchMapper.CppText.Version
-		ls.sketchMapper.DebugLogAll()
+		if !ls.reducedFeatures {
+			ls.sketchMapper.DebugLogAll()
+		}
+		ls.trackAnalysisUpdating(logger, ideTextDocIdentifier.URI, ideParams.ContentChanges)
 	}
 
 	// build a cpp equivalent didChange request
@@ -1152,18 +1779,32 @@ func (ls *INOLanguageServer) textDocumentDidSaveNotifFromIDE(logger jsonrpc.Func
 	// so we will not forward notification on saves in the sketch folder.
 	logger.Logf("notification is not forwarded to clang")
 
-	ls.triggerRebuild()
+	if ideParams.Text != "" {
+		ls.resyncSavedDocument(logger, ideParams.TextDocument.URI, textutils.StripBOM(ideParams.Text))
+	} else if savedText, err := ideParams.TextDocument.URI.AsPath().ReadFile(); err == nil {
+		// The text is not included in the notification: the saved file is read instead
+		ls.resyncSavedDocument(logger, ideParams.TextDocument.URI, textutils.StripBOM(string(savedText)))
+	}
+
+	ls.triggerRebuildOnSave()
 }
 
 func (ls *INOLanguageServer) textDocumentDidCloseNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *lsp.DidCloseTextDocumentParams) {
+	if isPreviewGeneratedSketchURI(ideParams.TextDocument.URI) {
+		logger.Logf("Closed read-only preview %s", ideParams.TextDocument.URI)
+		return
+	}
+
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
 
-	ls.triggerRebuild()
+	ls.triggerRebuildOnSave()
 
 	inoIdentifier := ideParams.TextDocument
 	if _, exist := ls.trackedIdeDocs[inoIdentifier.URI.AsPath().String()]; exist {
 		delete(ls.trackedIdeDocs, inoIdentifier.URI.AsPath().String())
+		ls.responseCache.Clear()
+		ls.updateReducedFeaturesOnTabsChange(logger)
 	} else {
 		logger.Logf("didClose of untracked document: %s", inoIdentifier.URI)
 		return
@@ -1203,6 +1844,8 @@ func (ls *INOLanguageServer) fullBuildCompletedFromIDE(logger jsonrpc.FunctionLo
 	defer ls.writeUnlock(logger)
 
 	ls.CopyFullBuildResults(logger, params.BuildOutputURI.AsPath())
+	// The libraries used by the sketch may be changed even if the sketch is not
+	ls.sketchRebuilder.ForgetLastBuild()
 	ls.triggerRebuild()
 }
 
@@ -1218,6 +1861,9 @@ func (ls *INOLanguageServer) CopyFullBuildResults(logger jsonrpc.FunctionLogger,
 }
 
 func (ls *INOLanguageServer) publishDiagnosticsNotifFromClangd(logger jsonrpc.FunctionLogger, clangParams *lsp.PublishDiagnosticsParams) {
+	// clangd has parsed the document again: the cached responses may be stale
+	ls.responseCache.Clear()
+
 	if ls.config.DisableRealTimeDiagnostics {
 		logger.Logf("Ignored by configuration")
 		return
@@ -1231,6 +1877,16 @@ func (ls *INOLanguageServer) publishDiagnosticsNotifFromClangd(logger jsonrpc.Fu
 		logger.Logf("  > %s - %s: %s", diag.Range.Start, diag.Severity, string(diag.Code))
 	}
 
+	// Diagnostics computed by clangd on an older version of the preprocessed sketch can not
+	// be mapped back to the .ino files with the current mapper: drop them, clangd will
+	// publish the diagnostics of the current version shortly.
+	if ls.clangURIRefersToIno(clangParams.URI) && clangParams.Version != 0 && ls.sketchMapper != nil {
+		if cppVersion := ls.sketchMapper.CppText.Version; clangParams.Version != cppVersion {
+			logger.Logf("Dropped diagnostics for version %d of the sketch (current version is %d)", clangParams.Version, cppVersion)
+			return
+		}
+	}
+
 	// the diagnostics on sketch.cpp.ino once mapped into their
 	// .ino counter parts may span over multiple .ino files...
 	allIdeParams, err := ls.clang2IdeDiagnostics(logger, clangParams)
@@ -1241,6 +1897,30 @@ func (ls *INOLanguageServer) publishDiagnosticsNotifFromClangd(logger jsonrpc.Fu
 
 	// If the incoming diagnostics are from sketch.cpp.ino then...
 	if ls.clangURIRefersToIno(clangParams.URI) {
+		// ...merge the sketch-level diagnostics on the main .ino...
+		if len(ls.sketchStructureDiagnostics) > 0 {
+			mainInoURI := ls.sketchMainInoURI()
+			mainInoParams, ok := allIdeParams[mainInoURI]
+			if !ok {
+				mainInoParams = &lsp.PublishDiagnosticsParams{URI: mainInoURI, Diagnostics: []lsp.Diagnostic{}}
+				allIdeParams[mainInoURI] = mainInoParams
+			}
+			mainInoParams.Diagnostics = append(mainInoParams.Diagnostics, ls.sketchStructureDiagnostics...)
+		}
+
+		// ...merge the F() hints on the .ino files...
+		for ideInoURI, flashStringDiags := range ls.flashStringDiagnostics {
+			if len(flashStringDiags) == 0 {
+				continue
+			}
+			ideParams, ok := allIdeParams[ideInoURI]
+			if !ok {
+				ideParams = &lsp.PublishDiagnosticsParams{URI: ideInoURI, Diagnostics: []lsp.Diagnostic{}}
+				allIdeParams[ideInoURI] = ideParams
+			}
+			ideParams.Diagnostics = append(ideParams.Diagnostics, flashStringDiags...)
+		}
+
 		// ...add all the new diagnostics...
 		for ideInoURI := range allIdeParams {
 			ls.ideInoDocsWithDiagnostics[ideInoURI] = true
@@ -1274,6 +1954,8 @@ func (ls *INOLanguageServer) publishDiagnosticsNotifFromClangd(logger jsonrpc.Fu
 			case "drv_unknown_argument":
 				// Skip errors like: "Unknown argument: '-mtext-section-literals'"
 			default:
+				addDiagnosticCodeDescription(&ideDiag, code)
+				annotateBoardConditionalDiagnostic(&ideDiag, code, ls.config.Fqbn, ls.apiProvidersOf)
 				ideParams.Diagnostics[n] = ideDiag
 				n++
 				continue
@@ -1290,21 +1972,45 @@ func (ls *INOLanguageServer) publishDiagnosticsNotifFromClangd(logger jsonrpc.Fu
 		for _, diag := range ideParams.Diagnostics {
 			logger.Logf("    > %s - %s: %s", diag.Range.Start, diag.Severity, diag.Code)
 		}
-		if err := ls.IDE.conn.TextDocumentPublishDiagnostics(ideParams); err != nil {
+		if err := ls.publishIdeDiagnostics(logger, ideParams); err != nil {
 			logger.Logf("Error sending diagnostics to IDE: %s", err)
 			return
 		}
+		if ideParams.URI.Ext() != ".ino" {
+			// Tracked to be cleared when the board is changed
+			if len(ideParams.Diagnostics) > 0 {
+				ls.ideDocsWithDiagnostics[ideParams.URI] = true
+			} else {
+				delete(ls.ideDocsWithDiagnostics, ideParams.URI)
+			}
+		}
+	}
+
+	// ...and summarize the diagnostics of the .ino tabs: the analysis of the edits is complete
+	if ls.clangURIRefersToIno(clangParams.URI) {
+		ls.sendDiagnosticsSummary(logger, allIdeParams)
+		ls.clearAnalysisUpdating(logger)
 	}
 }
 
 func (ls *INOLanguageServer) textDocumentRenameReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.RenameParams) (*lsp.WorkspaceEdit, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/rename") {
+		return nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
 	ls.writeLock(logger, false)
 	defer ls.writeUnlock(logger)
 
 	clangTextDocPositionParams, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 
 	clangParams := &lsp.RenameParams{
@@ -1312,21 +2018,25 @@ func (ls *INOLanguageServer) textDocumentRenameReqFromIDE(ctx context.Context, l
 		NewName:                    ideParams.NewName,
 		WorkDoneProgressParams:     ideParams.WorkDoneProgressParams,
 	}
-	clangWorkspaceEdit, clangErr, err := ls.Clangd.conn.TextDocumentRename(ctx, clangParams)
+	var clangWorkspaceEdit *lsp.WorkspaceEdit
+	clangErr, err := ls.sendClangdRequest(logger, clangParams.TextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangWorkspaceEdit, clangErr, err = ls.Clangd.conn.TextDocumentRename(ctx, clangParams)
+		return
+	})
 	if err != nil {
 		logger.Logf("clangd communication error: %v", err)
 		ls.Close()
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		return nil, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
 	}
 
 	ideWorkspaceEdit, err := ls.clang2IdeWorkspaceEdit(logger, clangWorkspaceEdit)
 	if err != nil {
 		logger.Logf("Error: %s", err)
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return nil, responseError(err)
 	}
 
 	// Check if all edits belongs to the sketch
@@ -1364,16 +2074,81 @@ func (ls *INOLanguageServer) progressNotifFromClangd(logger jsonrpc.FunctionLogg
 	}
 }
 
+// windowWorkDoneProgressCancelNotifFromIDE cancels an operation of the language server,
+// the cancellation of the progress reported by clangd is forwarded to clangd.
+func (ls *INOLanguageServer) windowWorkDoneProgressCancelNotifFromIDE(logger jsonrpc.FunctionLogger, params *lsp.WorkDoneProgressCancelParams) {
+	var token string
+	if err := json.Unmarshal(params.Token, &token); err != nil {
+		logger.Logf("error decoding progress token: %s", err)
+		return
+	}
+	if ls.progressHandler.Cancel(token) {
+		logger.Logf("%s cancelled", token)
+		return
+	}
+
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+	if ls.Clangd == nil {
+		return
+	}
+	if err := ls.Clangd.conn.WindowWorkDoneProgressCancel(params); err != nil {
+		logger.Logf("error forwarding progress cancellation to clangd: %s", err)
+	}
+}
+
 func (ls *INOLanguageServer) windowWorkDoneProgressCreateReqFromClangd(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.WorkDoneProgressCreateParams) *jsonrpc.ResponseError {
 	var token string
 	if err := json.Unmarshal(params.Token, &token); err != nil {
 		logger.Logf("error decoding progress token: %s", err)
-		return &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		return responseError(err)
 	}
 	ls.progressHandler.Create(token)
 	return nil
 }
 
+// workspaceApplyEditReqFromClangd forwards to the IDE the edits requested by clangd
+// (for example when a tweak is applied), converted to the sketch files.
+func (ls *INOLanguageServer) workspaceApplyEditReqFromClangd(ctx context.Context, logger jsonrpc.FunctionLogger, clangParams *lsp.ApplyWorkspaceEditParams) (*lsp.ApplyWorkspaceEditResult, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	ideEdit, err := ls.cpp2inoWorkspaceEdit(logger, &clangParams.Edit)
+	ls.readUnlock(logger)
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		reason := editConversionFailureReason(err)
+		ls.showMessage(logger, lsp.MessageTypeError, reason)
+		return &lsp.ApplyWorkspaceEditResult{Applied: false, FailureReason: reason}, nil
+	}
+
+	ideResult, ideErr, err := ls.IDE.conn.WorkspaceApplyEdit(ctx, &lsp.ApplyWorkspaceEditParams{
+		Label: clangParams.Label,
+		Edit:  *ideEdit,
+	})
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, responseError(err)
+	}
+	return ideResult, ideErr
+}
+
+// windowShowDocumentReqFromClangd forwards to the IDE the request to show a document,
+// the documents in the build folder are converted to the corresponding sketch files.
+func (ls *INOLanguageServer) windowShowDocumentReqFromClangd(ctx context.Context, logger jsonrpc.FunctionLogger, clangParams *lsp.ShowDocumentParams) (*lsp.ShowDocumentResult, *jsonrpc.ResponseError) {
+	ideParams := *clangParams
+	if !clangParams.External && strings.HasPrefix(string(clangParams.URI), "file:") {
+		ls.readLock(logger, false)
+		ideParams.URI, ideParams.Selection = ls.clang2IdeShowDocument(logger, clangParams.URI, clangParams.Selection)
+		ls.readUnlock(logger)
+	}
+
+	ideResult, ideErr, err := ls.IDE.conn.WindowShowDocument(ctx, &ideParams)
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, responseError(err)
+	}
+	return ideResult, ideErr
+}
+
 func (ls *INOLanguageServer) setTraceNotifFromIDE(logger jsonrpc.FunctionLogger, params *lsp.SetTraceParams) {
 	logger.Logf("Notification level set to: %s", params.Value)
 	ls.Clangd.conn.SetTrace(params)
@@ -1387,6 +2162,7 @@ func (ls *INOLanguageServer) removeTemporaryFiles(logger jsonrpc.FunctionLogger)
 		// Nothing to remove
 		return
 	}
+	ls.removeSnapshot(logger)
 
 	// Start a detached process to remove the temp files
 	cwd, err := os.Getwd()
@@ -1411,12 +2187,33 @@ func (ls *INOLanguageServer) removeTemporaryFiles(logger jsonrpc.FunctionLogger)
 	}
 }
 
+// removeTemporaryFilesNow removes the temp files right away instead of leaving the job to a
+// detached process, it can be used only when clangd is not running anymore.
+func (ls *INOLanguageServer) removeTemporaryFilesNow(logger jsonrpc.FunctionLogger) {
+	ls.removeTempMutex.Lock()
+	defer ls.removeTempMutex.Unlock()
+
+	if ls.tempDir == nil {
+		// Nothing to remove
+		return
+	}
+	ls.removeSnapshot(logger)
+	if err := ls.tempDir.RemoveAll(); err != nil {
+		logger.Logf("Error removing temp folder: %s", err)
+	}
+	ls.buildPath, ls.fullBuildPath, ls.buildSketchRoot, ls.tempDir = nil, nil, nil, nil
+}
+
 // Close closes all the json-rpc connections and clean-up temp folders.
 func (ls *INOLanguageServer) Close() {
+	ls.closeMux.Lock()
+	defer ls.closeMux.Unlock()
 	if ls.Clangd != nil {
 		ls.Clangd.Close()
 		ls.Clangd = nil
 	}
+	ls.stopSerialPortsWatch()
+	ls.closeArduinoCLIDaemonConnection()
 	if ls.closing != nil {
 		close(ls.closing)
 		ls.closing = nil
@@ -1428,58 +2225,81 @@ func (ls *INOLanguageServer) CloseNotify() <-chan bool {
 	return ls.closing
 }
 
+// IDEDisconnectNotify returns a channel that is closed when the connection with the IDE is lost
+func (ls *INOLanguageServer) IDEDisconnectNotify() <-chan struct{} {
+	return ls.ideDisconnected
+}
+
 func (ls *INOLanguageServer) extractDataFolderFromArduinoCLI(logger jsonrpc.FunctionLogger) (*paths.Path, error) {
-	var dataDir string
+	return ls.extractDirectoryFromArduinoCLI(logger, "directories.data")
+}
+
+// extractUserFolderFromArduinoCLI returns the sketchbook folder, containing the user's libraries
+func (ls *INOLanguageServer) extractUserFolderFromArduinoCLI(logger jsonrpc.FunctionLogger) (*paths.Path, error) {
+	return ls.extractDirectoryFromArduinoCLI(logger, "directories.user")
+}
+
+func (ls *INOLanguageServer) extractDirectoryFromArduinoCLI(logger jsonrpc.FunctionLogger, key string) (*paths.Path, error) {
+	var dir string
+	err := ls.runArduinoCLIWithRetries(context.Background(), logger, func(ctx context.Context) error {
+		res, err := ls.getDirectoryFromArduinoCLI(ctx, logger, key)
+		dir = res
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dirPath := paths.New(dir)
+	return dirPath.Canonical(), nil
+}
+
+func (ls *INOLanguageServer) getDirectoryFromArduinoCLI(ctx context.Context, logger jsonrpc.FunctionLogger, key string) (string, error) {
 	if ls.config.CliPath == nil {
-		// Establish a connection with the arduino-cli gRPC server
-		conn, err := grpc.Dial(
-			ls.config.CliDaemonAddress,
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithBlock())
+		client, err := ls.arduinoCLIDaemonClient(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("error connecting to arduino-cli rpc server: %w", err)
+			return "", err
 		}
-		defer conn.Close()
-		client := rpc.NewArduinoCoreServiceClient(conn)
 
-		resp, err := client.SettingsGetValue(context.Background(), &rpc.SettingsGetValueRequest{
-			Key: "directories.data",
+		resp, err := client.SettingsGetValue(ctx, &rpc.SettingsGetValueRequest{
+			Key: key,
 		})
 		if err != nil {
-			return nil, fmt.Errorf("error getting arduino data dir: %w", err)
-		}
-		if err := json.Unmarshal([]byte(resp.GetEncodedValue()), &dataDir); err != nil {
-			return nil, fmt.Errorf("error getting arduino data dir: %w", err)
+			return "", fmt.Errorf("error getting arduino %s: %w", key, err)
 		}
-		logger.Logf("Arduino Data Dir -> %s", dataDir)
-	} else {
-		args := []string{
-			"--config-file", ls.config.CliConfigPath.String(),
-			"config", "get", "directories.data",
-			"--json",
-		}
-		cmd, err := paths.NewProcessFromPath(nil, ls.config.CliPath, args...)
-		if err != nil {
-			return nil, errors.Errorf("running %s: %s", strings.Join(args, " "), err)
-		}
-		cmdOutput := &bytes.Buffer{}
-		cmd.RedirectStdoutTo(cmdOutput)
-		logger.Logf("running: %s", strings.Join(args, " "))
-		if err := cmd.Run(); err != nil {
-			return nil, errors.Errorf("running %s: %s", strings.Join(args, " "), err)
+		var dir string
+		if err := json.Unmarshal([]byte(resp.GetEncodedValue()), &dir); err != nil {
+			return "", fmt.Errorf("error getting arduino %s: %w", key, err)
 		}
+		logger.Logf("Arduino %s -> %s", key, dir)
+		return dir, nil
+	}
 
-		var res string
-		if err := json.Unmarshal(cmdOutput.Bytes(), &res); err != nil {
-			return nil, errors.Errorf("parsing arduino-cli output: %s", err)
-		}
-		// Return only the build path
-		logger.Logf("Arduino Data Dir -> %s", res)
-		dataDir = res
+	args := []string{
+		"--config-file", ls.config.CliConfigPath.String(),
+		"config", "get", key,
+		"--json",
+	}
+	cmd, err := paths.NewProcessFromPath(ls.toolsEnv(), ls.config.CliPath, args...)
+	if err != nil {
+		return "", errors.Errorf("running %s: %s", strings.Join(args, " "), err)
+	}
+	cmdOutput := &bytes.Buffer{}
+	cmdErrOutput := &bytes.Buffer{}
+	cmd.RedirectStdoutTo(cmdOutput)
+	cmd.RedirectStderrTo(cmdErrOutput)
+	logger.Logf("running: %s", strings.Join(args, " "))
+	if err := cmd.RunWithinContext(ctx); err != nil {
+		return "", errors.Errorf("running %s: %s\n%s", strings.Join(args, " "), err, cmdErrOutput)
 	}
 
-	dataDirPath := paths.New(dataDir)
-	return dataDirPath.Canonical(), nil
+	var res string
+	if err := json.Unmarshal(cmdOutput.Bytes(), &res); err != nil {
+		return "", errors.Errorf("parsing arduino-cli output: %s", err)
+	}
+	// Return only the directory
+	logger.Logf("Arduino %s -> %s", key, res)
+	return res, nil
 }
 
 func (ls *INOLanguageServer) clang2IdeCodeAction(logger jsonrpc.FunctionLogger, clangCodeAction lsp.CodeAction, origIdeURI lsp.DocumentURI) *lsp.CodeAction {
@@ -1489,7 +2309,15 @@ func (ls *INOLanguageServer) clang2IdeCodeAction(logger jsonrpc.FunctionLogger,
 		Diagnostics: clangCodeAction.Diagnostics,
 		IsPreferred: clangCodeAction.IsPreferred,
 		Disabled:    clangCodeAction.Disabled,
-		Edit:        ls.cpp2inoWorkspaceEdit(logger, clangCodeAction.Edit),
+	}
+	if ideEdit, err := ls.cpp2inoWorkspaceEdit(logger, clangCodeAction.Edit); err != nil {
+		// The action is shown disabled, instead of applying only a part of the fix
+		logger.Logf("Disabling code action '%s': %s", clangCodeAction.Title, err)
+		ideCodeAction.Disabled = &struct {
+			Reason string `json:"reason,required"`
+		}{Reason: editConversionFailureReason(err)}
+	} else {
+		ideCodeAction.Edit = ideEdit
 	}
 	if clangCodeAction.Command != nil {
 		inoCommand := ls.clang2IdeCommand(logger, *clangCodeAction.Command)
@@ -1498,10 +2326,8 @@ func (ls *INOLanguageServer) clang2IdeCodeAction(logger jsonrpc.FunctionLogger,
 		}
 		ideCodeAction.Command = inoCommand
 	}
-	if origIdeURI.Ext() == ".ino" {
-		for i, diag := range ideCodeAction.Diagnostics {
-			_, ideCodeAction.Diagnostics[i].Range = ls.sketchMapper.CppToInoRange(diag.Range)
-		}
+	if len(clangCodeAction.Diagnostics) > 0 {
+		ideCodeAction.Diagnostics = ls.clang2IdeCodeActionDiagnostics(logger, origIdeURI, clangCodeAction.Diagnostics)
 	}
 	return ideCodeAction
 }
@@ -1546,64 +2372,88 @@ func (ls *INOLanguageServer) clang2IdeCommand(logger jsonrpc.FunctionLogger, cla
 	}
 }
 
-func (ls *INOLanguageServer) cpp2inoWorkspaceEdit(logger jsonrpc.FunctionLogger, cppWorkspaceEdit *lsp.WorkspaceEdit) *lsp.WorkspaceEdit {
+// cpp2inoWorkspaceEdit converts the edits of the build folder into the edits of the sketch
+// files. An error is returned if any of the edits can't be converted, for example if it spans
+// more than one .ino tab (see EditAcrossTabsError): applying the other edits would leave the
+// sketch half changed. The edits of the parts generated by the preprocessor are dropped.
+func (ls *INOLanguageServer) cpp2inoWorkspaceEdit(logger jsonrpc.FunctionLogger, cppWorkspaceEdit *lsp.WorkspaceEdit) (*lsp.WorkspaceEdit, error) {
 	if cppWorkspaceEdit == nil {
-		return nil
+		return nil, nil
 	}
 	inoWorkspaceEdit := &lsp.WorkspaceEdit{
 		Changes: map[lsp.DocumentURI][]lsp.TextEdit{},
 	}
 	for editURI, edits := range cppWorkspaceEdit.Changes {
-		// if the edits are not relative to sketch file...
-		if !editURI.AsPath().EquivalentTo(ls.buildSketchCpp) {
+		// if the edits are not relative to sketch files...
+		if inside, _ := editURI.AsPath().IsInsideDir(ls.buildSketchRoot); !inside {
 			// ...pass them through...
 			inoWorkspaceEdit.Changes[editURI] = edits
 			continue
 		}
 
-		// ...otherwise convert edits to the sketch.ino.cpp into multiple .ino edits
+		// ...otherwise convert edits to the sketch.ino.cpp into multiple .ino edits (and
+		// edits to the other sketch sources into edits to the files in the sketch folder)
 		for _, edit := range edits {
-			inoURI, inoRange, inPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, editURI, edit.Range)
+			inoURI, inoEdit, inPreprocessed, err := ls.cpp2inoTextEdit(logger, editURI, edit)
 			if err != nil {
 				logger.Logf("    error converting edit %s:%s: %s", editURI, edit.Range, err)
-				continue
+				if ls.clangURIRefersToIno(editURI) && ls.cppRangeSpansTabs(edit.Range) {
+					return nil, &EditAcrossTabsError{Range: edit.Range}
+				}
+				return nil, err
 			}
 			if inPreprocessed {
 				// XXX: ignore
 				logger.Logf("    ignored in-preprocessed-section change")
 				continue
 			}
-			//inoFile, inoRange := ls.sketchMapper.CppToInoRange(edit.Range)
-			//inoURI := lsp.NewDocumentURI(inoFile)
 			if _, have := inoWorkspaceEdit.Changes[inoURI]; !have {
 				inoWorkspaceEdit.Changes[inoURI] = []lsp.TextEdit{}
 			}
-			inoWorkspaceEdit.Changes[inoURI] = append(inoWorkspaceEdit.Changes[inoURI], lsp.TextEdit{
-				NewText: edit.NewText,
-				Range:   inoRange,
-			})
+			inoWorkspaceEdit.Changes[inoURI] = append(inoWorkspaceEdit.Changes[inoURI], inoEdit)
 		}
 	}
 	logger.Logf("    done converting workspaceEdit")
-	return inoWorkspaceEdit
+	return inoWorkspaceEdit, nil
+}
+
+// cppRangeSpansTabs returns true if the given range of the preprocessed sketch starts and
+// ends in different .ino tabs. The caller must hold the read lock.
+func (ls *INOLanguageServer) cppRangeSpansTabs(cppRange lsp.Range) bool {
+	startFile, _ := ls.sketchMapper.CppToInoLine(cppRange.Start.Line)
+	endFile, _ := ls.sketchMapper.CppToInoLine(cppRange.End.Line)
+	return startFile != endFile
+}
+
+// editConversionFailureReason describes to the user why the edits of a fix can't be applied
+func editConversionFailureReason(err error) string {
+	var acrossTabs *EditAcrossTabsError
+	if errors.As(err, &acrossTabs) {
+		return "The fix changes more than one tab of the sketch at once: apply it by hand."
+	}
+	return "The fix can't be applied to the sketch: " + err.Error()
 }
 
 func (ls *INOLanguageServer) cpp2inoTextEdit(logger jsonrpc.FunctionLogger, cppURI lsp.DocumentURI, cppEdit lsp.TextEdit) (lsp.DocumentURI, lsp.TextEdit, bool, error) {
 	inoURI, inoRange, inPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, cppURI, cppEdit.Range)
 
 	if err != nil {
-		if strings.HasPrefix(cppEdit.NewText, "\n") && cppEdit.Range.Start.Line < cppEdit.Range.End.Line {
+		lineBreak := "\n"
+		if strings.HasPrefix(cppEdit.NewText, "\r\n") {
+			lineBreak = "\r\n"
+		}
+		if strings.HasPrefix(cppEdit.NewText, lineBreak) && cppEdit.Range.Start.Line < cppEdit.Range.End.Line {
 			// Special case: the text-edit may start from the very end of a not-ino section and fallthrough
-			// in the .ino section with a '\n...' at the beginning of the replacement text.
+			// in the .ino section with a '\n...' (or '\r\n...') at the beginning of the replacement text.
 			nextLine := lsp.Position{Line: cppEdit.Range.Start.Line + 1, Character: 0}
-			startOffset, err1 := textedits.GetOffset(ls.sketchMapper.CppText.Text, cppEdit.Range.Start)
-			nextOffset, err2 := textedits.GetOffset(ls.sketchMapper.CppText.Text, nextLine)
-			if err1 == nil && err2 == nil && startOffset+1 == nextOffset {
+			startOffset, err1 := textutils.GetOffset(ls.sketchMapper.CppText.Text, cppEdit.Range.Start)
+			nextOffset, err2 := textutils.GetOffset(ls.sketchMapper.CppText.Text, nextLine)
+			if err1 == nil && err2 == nil && ls.sketchMapper.CppText.Text[startOffset:nextOffset] == lineBreak {
 				// In this can we can generate an equivalent text-edit that fits entirely in the .ino section
-				// by removing the redundant '\n' and by offsetting the start location to the beginning of the
-				// next line.
+				// by removing the redundant line break and by offsetting the start location to the beginning
+				// of the next line.
 				cppEdit.Range.Start = nextLine
-				cppEdit.NewText = cppEdit.NewText[1:]
+				cppEdit.NewText = cppEdit.NewText[len(lineBreak):]
 				return ls.cpp2inoTextEdit(logger, cppURI, cppEdit)
 			}
 		}
@@ -1614,6 +2464,16 @@ func (ls *INOLanguageServer) cpp2inoTextEdit(logger jsonrpc.FunctionLogger, cppU
 	return inoURI, inoEdit, inPreprocessed, err
 }
 
+// EditAcrossTabsError is returned when an edit of the preprocessed sketch spans more than
+// one .ino tab, it can't be split among the tabs.
+type EditAcrossTabsError struct {
+	Range lsp.Range
+}
+
+func (e *EditAcrossTabsError) Error() string {
+	return fmt.Sprintf("the edit at %s of the preprocessed sketch spans more than one tab", e.Range)
+}
+
 // UnknownURIError is an error when an URI is not recognized
 type UnknownURIError struct {
 	URI lsp.DocumentURI
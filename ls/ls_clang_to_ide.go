@@ -16,9 +16,11 @@
 package ls
 
 import (
+	"slices"
 	"strconv"
 
 	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/arduino/go-paths-helper"
 	"github.com/vincecity/go-lsp"
 	"github.com/vincecity/go-lsp/jsonrpc"
 )
@@ -69,8 +71,12 @@ func (ls *INOLanguageServer) clang2IdeRangeAndDocumentURI(logger jsonrpc.Functio
 	}
 	if !inside {
 		ideURI := clangURI
+		if sourcePath, ok := ls.buildTreeSourcePath(clangPath); ok {
+			// /build-path/core/file.cpp -> /packages/.../cores/arduino/file.cpp (same range)
+			ideURI = lsp.NewDocumentURIFromPath(sourcePath)
+		}
 		logger.Logf("Range: %s:%s -> %s:%s (ext file)", clangURI, clangRange, ideURI, ideRange)
-		return clangURI, clangRange, false, nil
+		return ideURI, clangRange, false, nil
 	}
 
 	// Sketchbook/Sketch/AnotherFile.cpp <-> build-path/sketch/AnotherFile.cpp (one line offset)
@@ -79,8 +85,7 @@ func (ls *INOLanguageServer) clang2IdeRangeAndDocumentURI(logger jsonrpc.Functio
 		logger.Logf("ERROR: could not transform '%s' into a relative path on '%s': %s", clangURI, ls.buildSketchRoot, err)
 		return lsp.NilURI, lsp.NilRange, false, err
 	}
-	idePath := ls.sketchRoot.JoinPath(rel).String()
-	ideURI, err := ls.idePathToIdeURI(logger, idePath)
+	ideURI := ls.sketchSourcePathToIdeURI(ls.sketchRoot.JoinPath(rel))
 	if ideRange.End.Line > 0 {
 		ideRange.End.Line--
 	}
@@ -88,7 +93,16 @@ func (ls *INOLanguageServer) clang2IdeRangeAndDocumentURI(logger jsonrpc.Functio
 		ideRange.Start.Line--
 	}
 	logger.Logf("Range: %s:%s -> %s:%s (.cpp/.h)", clangURI, clangRange, ideURI, ideRange)
-	return ideURI, ideRange, false, err
+	return ideURI, ideRange, false, nil
+}
+
+// sketchSourcePathToIdeURI returns the IDE URI of a .cpp/.h file of the sketch: the URI
+// used by the IDE if the file is open, otherwise the URI of the file in the sketch folder.
+func (ls *INOLanguageServer) sketchSourcePathToIdeURI(idePath *paths.Path) lsp.DocumentURI {
+	if doc, ok := ls.trackedIdeDocs[idePath.String()]; ok {
+		return doc.URI
+	}
+	return lsp.NewDocumentURIFromPath(idePath)
 }
 
 func (ls *INOLanguageServer) clang2IdeDocumentURI(logger jsonrpc.FunctionLogger, clangURI lsp.DocumentURI) (lsp.DocumentURI, error) {
@@ -124,10 +138,9 @@ func (ls *INOLanguageServer) clang2IdeDocumentURI(logger jsonrpc.FunctionLogger,
 		logger.Logf("ERROR: could not transform '%s' into a relative path on '%s': %s", clangURI, ls.buildSketchRoot, err)
 		return lsp.DocumentURI{}, err
 	}
-	idePath := ls.sketchRoot.JoinPath(rel).String()
-	ideURI, err := ls.idePathToIdeURI(logger, idePath)
+	ideURI := ls.sketchSourcePathToIdeURI(ls.sketchRoot.JoinPath(rel))
 	logger.Logf("%s -> %s", clangURI, ideURI)
-	return ideURI, err
+	return ideURI, nil
 }
 
 func (ls *INOLanguageServer) clang2IdeDocumentHighlight(logger jsonrpc.FunctionLogger, clangHighlight lsp.DocumentHighlight, cppURI lsp.DocumentURI) (lsp.DocumentHighlight, bool, error) {
@@ -186,6 +199,7 @@ func (ls *INOLanguageServer) clang2IdeDiagnostic(logger jsonrpc.FunctionLogger,
 
 	ideDiagnostic := clangDiagnostic
 	ideDiagnostic.Range = ideRange
+	ideDiagnostic.Data = ls.clang2IdeDiagnosticData(logger, clangURI, clangDiagnostic.Data)
 
 	if len(clangDiagnostic.RelatedInformation) > 0 {
 		ideInfos, err := ls.clang2IdeDiagnosticRelatedInformationArray(logger, clangDiagnostic.RelatedInformation)
@@ -197,6 +211,33 @@ func (ls *INOLanguageServer) clang2IdeDiagnostic(logger jsonrpc.FunctionLogger,
 	return ideURI, ideDiagnostic, false, nil
 }
 
+// clang2IdeCodeActionDiagnostics converts the diagnostics resolved by a code action on the
+// given IDE document, the ones sent in the context of the codeAction request. Their ranges,
+// related information and data are moved to the IDE documents, for the .ino tabs as for the
+// other sources of the sketch. The diagnostics that don't fall in the given document (in the
+// generated parts or in another tab of the preprocessed sketch) are dropped.
+func (ls *INOLanguageServer) clang2IdeCodeActionDiagnostics(logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI, clangDiagnostics []lsp.Diagnostic) []lsp.Diagnostic {
+	clangURI, _, err := ls.ide2ClangDocumentURI(logger, ideURI)
+	if err != nil {
+		logger.Logf("Error converting code action diagnostics: %s", err)
+		return clangDiagnostics
+	}
+	ideDiagnostics := []lsp.Diagnostic{}
+	for _, clangDiagnostic := range clangDiagnostics {
+		diagIdeURI, ideDiagnostic, inPreprocessed, err := ls.clang2IdeDiagnostic(logger, clangURI, clangDiagnostic)
+		if err != nil {
+			logger.Logf("Error converting code action diagnostic: %s", err)
+			continue
+		}
+		if inPreprocessed || diagIdeURI != ideURI {
+			logger.Logf("Ignoring code action diagnostic outside of %s", ideURI)
+			continue
+		}
+		ideDiagnostics = append(ideDiagnostics, ideDiagnostic)
+	}
+	return ideDiagnostics
+}
+
 func (ls *INOLanguageServer) clang2IdeDiagnosticRelatedInformationArray(logger jsonrpc.FunctionLogger, clangInfos []lsp.DiagnosticRelatedInformation) ([]lsp.DiagnosticRelatedInformation, error) {
 	ideInfos := []lsp.DiagnosticRelatedInformation{}
 	for _, clangInfo := range clangInfos {
@@ -261,11 +302,11 @@ func (ls *INOLanguageServer) clang2IdeDocumentSymbols(logger jsonrpc.FunctionLog
 			Range:          ideRange,
 			SelectionRange: ideSelectionRange,
 			Children:       ideChildren,
-			Tags:           ls.clang2IdeSymbolTags(logger, clangSymbol.Tags),
+			Tags:           ls.clang2IdeSymbolTags(logger, clangSymbol.Tags, clangSymbol.Deprecated),
 		})
 	}
 
-	return ideSymbols, nil
+	return dedupeDocumentSymbols(ideSymbols), nil
 }
 
 func (ls *INOLanguageServer) cland2IdeTextEdits(logger jsonrpc.FunctionLogger, clangURI lsp.DocumentURI, clangTextEdits []lsp.TextEdit) (map[lsp.DocumentURI][]lsp.TextEdit, error) {
@@ -312,6 +353,47 @@ func (ls *INOLanguageServer) clang2IdeLocationsArray(logger jsonrpc.FunctionLogg
 	return ideLocations, nil
 }
 
+func (ls *INOLanguageServer) clang2IdeLocationLinksArray(logger jsonrpc.FunctionLogger, clangOriginURI lsp.DocumentURI, clangLocationLinks []lsp.LocationLink) ([]lsp.LocationLink, error) {
+	ideLocationLinks := []lsp.LocationLink{}
+	for _, clangLocationLink := range clangLocationLinks {
+		ideLocationLink, inPreprocessed, err := ls.clang2IdeLocationLink(logger, clangOriginURI, clangLocationLink)
+		if err != nil {
+			logger.Logf("ERROR converting location link %s: %s", clangLocationLink, err)
+			return nil, err
+		}
+		if inPreprocessed {
+			logger.Logf("ignored in-preprocessed-section location link")
+			continue
+		}
+		ideLocationLinks = append(ideLocationLinks, ideLocationLink)
+	}
+	return ideLocationLinks, nil
+}
+
+func (ls *INOLanguageServer) clang2IdeLocationLink(logger jsonrpc.FunctionLogger, clangOriginURI lsp.DocumentURI, clangLocationLink lsp.LocationLink) (lsp.LocationLink, bool, error) {
+	ideTargetURI, ideTargetRange, inPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, clangLocationLink.TargetURI, clangLocationLink.TargetRange)
+	if err != nil || inPreprocessed {
+		return lsp.LocationLink{}, inPreprocessed, err
+	}
+	_, ideTargetSelectionRange, _, err := ls.clang2IdeRangeAndDocumentURI(logger, clangLocationLink.TargetURI, clangLocationLink.TargetSelectionRange)
+	if err != nil {
+		return lsp.LocationLink{}, false, err
+	}
+	ideLocationLink := lsp.LocationLink{
+		TargetURI:            ideTargetURI,
+		TargetRange:          ideTargetRange,
+		TargetSelectionRange: ideTargetSelectionRange,
+	}
+	if clangLocationLink.OriginSelectionRange != nil {
+		_, ideOriginSelectionRange, _, err := ls.clang2IdeRangeAndDocumentURI(logger, clangOriginURI, *clangLocationLink.OriginSelectionRange)
+		if err != nil {
+			return lsp.LocationLink{}, false, err
+		}
+		ideLocationLink.OriginSelectionRange = &ideOriginSelectionRange
+	}
+	return ideLocationLink, false, nil
+}
+
 func (ls *INOLanguageServer) clang2IdeLocation(logger jsonrpc.FunctionLogger, clangLocation lsp.Location) (lsp.Location, bool, error) {
 	ideURI, ideRange, inPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, clangLocation.URI, clangLocation.Range)
 	return lsp.Location{
@@ -320,16 +402,35 @@ func (ls *INOLanguageServer) clang2IdeLocation(logger jsonrpc.FunctionLogger, cl
 	}, inPreprocessed, err
 }
 
-func (ls *INOLanguageServer) clang2IdeSymbolTags(logger jsonrpc.FunctionLogger, clangSymbolTags []lsp.SymbolTag) []lsp.SymbolTag {
-	if len(clangSymbolTags) == 0 || clangSymbolTags == nil {
+// clang2IdeSymbolTags returns the tags of a symbol, adding the Deprecated tag if the symbol is
+// reported as deprecated by clangd only with the legacy deprecated field
+func (ls *INOLanguageServer) clang2IdeSymbolTags(logger jsonrpc.FunctionLogger, clangSymbolTags []lsp.SymbolTag, deprecated bool) []lsp.SymbolTag {
+	if !deprecated || slices.Contains(clangSymbolTags, lsp.SymbolTagDeprecated) {
 		return clangSymbolTags
 	}
-	panic("not implemented")
+	return append(slices.Clone(clangSymbolTags), lsp.SymbolTagDeprecated)
 }
 
+// clang2IdeSymbolsInformation moves the symbols to the IDE documents, the symbols that can't
+// be converted or that are in the preprocessed section of the sketch are dropped
 func (ls *INOLanguageServer) clang2IdeSymbolsInformation(logger jsonrpc.FunctionLogger, clangSymbolsInformation []lsp.SymbolInformation) []lsp.SymbolInformation {
 	logger.Logf("SymbolInformation (%d elements):", len(clangSymbolsInformation))
-	panic("not implemented")
+	ideSymbolsInformation := []lsp.SymbolInformation{}
+	for _, clangSymbolInformation := range clangSymbolsInformation {
+		ideLocation, inPreprocessed, err := ls.clang2IdeLocation(logger, clangSymbolInformation.Location)
+		if err != nil {
+			logger.Logf("Dropped symbol %s: %s", clangSymbolInformation.Name, err)
+			continue
+		}
+		if inPreprocessed || ideLocation.URI == sourcemapper.NotInoURI {
+			continue
+		}
+		ideSymbolInformation := clangSymbolInformation
+		ideSymbolInformation.Location = ideLocation
+		ideSymbolInformation.Tags = ls.clang2IdeSymbolTags(logger, clangSymbolInformation.Tags, clangSymbolInformation.Deprecated)
+		ideSymbolsInformation = append(ideSymbolsInformation, ideSymbolInformation)
+	}
+	return dedupeSymbolsInformation(ideSymbolsInformation)
 }
 
 func (ls *INOLanguageServer) clang2IdeWorkspaceEdit(logger jsonrpc.FunctionLogger, clangWorkspaceEdit *lsp.WorkspaceEdit) (*lsp.WorkspaceEdit, error) {
@@ -362,3 +463,20 @@ func (ls *INOLanguageServer) clang2IdeTextEdit(logger jsonrpc.FunctionLogger, cl
 	}
 	return ideURI, ideTextEdit, isPreprocessed, err
 }
+
+// clang2IdeShowDocument converts the document and the selection of a window/showDocument
+// request from clangd. Documents outside the sketch are shown as they are, if the conversion
+// fails the original document is shown.
+func (ls *INOLanguageServer) clang2IdeShowDocument(logger jsonrpc.FunctionLogger, clangURI lsp.URI, clangSelection lsp.Range) (lsp.URI, lsp.Range) {
+	clangDocURI, err := lsp.NewDocumentURIFromURL(string(clangURI))
+	if err != nil {
+		logger.Logf("ERROR: invalid document URI %s: %s", clangURI, err)
+		return clangURI, clangSelection
+	}
+	ideURI, ideSelection, _, err := ls.clang2IdeRangeAndDocumentURI(logger, clangDocURI, clangSelection)
+	if err != nil || ideURI == sourcemapper.NotInoURI {
+		logger.Logf("Could not convert %s:%s, showing the original document", clangURI, clangSelection)
+		return clangURI, clangSelection
+	}
+	return lsp.URI(ideURI.String()), ideSelection
+}
@@ -0,0 +1,319 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+// newTestSketchLanguageServer returns a language server for a sketch made of
+// Sketch.ino, Helper.h (open in the IDE) and Other.cpp (not open in the IDE).
+func newTestSketchLanguageServer(t *testing.T) *INOLanguageServer {
+	tmp := paths.New(t.TempDir()).Canonical()
+	ls := &INOLanguageServer{
+		sketchRoot:       tmp.Join("Sketch"),
+		sketchName:       "Sketch",
+		buildPath:        tmp.Join("build"),
+		buildSketchRoot:  tmp.Join("build", "sketch"),
+		buildSketchCpp:   tmp.Join("build", "sketch", "Sketch.ino.cpp"),
+		trackedIdeDocs:   map[string]lsp.TextDocumentItem{},
+		outOfSyncIdeDocs: map[lsp.DocumentURI]bool{},
+		sketchSettings:   &SketchSettings{},
+		responseCache:    newResponseCache(responseCacheSize),
+	}
+	for file, text := range map[*paths.Path]string{
+		ls.sketchRoot.Join("Sketch.ino"): "void setup() {}\nvoid loop() {}\n",
+		ls.sketchRoot.Join("Helper.h"):   "#pragma once\n\nvoid helper();\nint counter;\n",
+	} {
+		ls.trackedIdeDocs[file.String()] = lsp.TextDocumentItem{URI: lsp.NewDocumentURIFromPath(file), Text: text}
+	}
+	ls.sketchMapper = sourcemapper.CreateInoMapper([]byte(
+		"#include <Arduino.h>\n" +
+			"#line 1 \"" + ls.sketchRoot.Join("Sketch.ino").String() + "\"\n" +
+			"void setup() {}\n" +
+			"void loop() {}\n"))
+	return ls
+}
+
+func testRange(startLine, startChar, endLine, endChar int) lsp.Range {
+	return lsp.Range{
+		Start: lsp.Position{Line: startLine, Character: startChar},
+		End:   lsp.Position{Line: endLine, Character: endChar},
+	}
+}
+
+func TestClang2IdeHoverRange(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	// .ino
+	ideURI, ideRange, inPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, lsp.NewDocumentURIFromPath(ls.buildSketchCpp), testRange(2, 5, 2, 10))
+	require.NoError(t, err)
+	require.False(t, inPreprocessed)
+	require.Equal(t, lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino")), ideURI)
+	require.Equal(t, testRange(0, 5, 0, 10), ideRange)
+
+	// .h open in the IDE
+	ideURI, ideRange, _, err = ls.clang2IdeRangeAndDocumentURI(logger, lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Helper.h")), testRange(3, 0, 3, 4))
+	require.NoError(t, err)
+	require.Equal(t, lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h")), ideURI)
+	require.Equal(t, testRange(2, 0, 2, 4), ideRange)
+
+	// .cpp not open in the IDE
+	ideURI, ideRange, _, err = ls.clang2IdeRangeAndDocumentURI(logger, lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Other.cpp")), testRange(1, 0, 1, 4))
+	require.NoError(t, err)
+	require.Equal(t, lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Other.cpp")), ideURI)
+	require.Equal(t, testRange(0, 0, 0, 4), ideRange)
+
+	// file outside the sketch
+	extURI := lsp.NewDocumentURIFromPath(paths.New("/usr/include/stdio.h"))
+	ideURI, ideRange, _, err = ls.clang2IdeRangeAndDocumentURI(logger, extURI, testRange(1, 0, 1, 4))
+	require.NoError(t, err)
+	require.Equal(t, extURI, ideURI)
+	require.Equal(t, testRange(1, 0, 1, 4), ideRange)
+}
+
+func TestClang2IdeDefinitionLocations(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	ideLocations, err := ls.clang2IdeLocationsArray(logger, []lsp.Location{
+		{URI: lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Other.cpp")), Range: testRange(5, 5, 5, 8)},
+		{URI: lsp.NewDocumentURIFromPath(ls.buildSketchCpp), Range: testRange(3, 5, 3, 9)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []lsp.Location{
+		{URI: lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Other.cpp")), Range: testRange(4, 5, 4, 8)},
+		{URI: lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino")), Range: testRange(1, 5, 1, 9)},
+	}, ideLocations)
+}
+
+func TestClang2IdeDefinitionLocationLinks(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	origin := testRange(4, 1, 4, 3)
+	ideLocationLinks, err := ls.clang2IdeLocationLinksArray(logger, lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Helper.h")), []lsp.LocationLink{
+		{
+			OriginSelectionRange: &origin,
+			TargetURI:            lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Other.cpp")),
+			TargetRange:          testRange(5, 0, 7, 1),
+			TargetSelectionRange: testRange(5, 5, 5, 8),
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, ideLocationLinks, 1)
+	require.Equal(t, testRange(3, 1, 3, 3), *ideLocationLinks[0].OriginSelectionRange)
+	require.Equal(t, lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Other.cpp")), ideLocationLinks[0].TargetURI)
+	require.Equal(t, testRange(4, 0, 6, 1), ideLocationLinks[0].TargetRange)
+	require.Equal(t, testRange(4, 5, 4, 8), ideLocationLinks[0].TargetSelectionRange)
+}
+
+func TestClang2IdeDocumentHighlight(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	ideHighlight, inPreprocessed, err := ls.clang2IdeDocumentHighlight(logger,
+		lsp.DocumentHighlight{Range: testRange(2, 0, 2, 3), Kind: lsp.DocumentHighlightKindText},
+		lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Helper.h")))
+	require.NoError(t, err)
+	require.False(t, inPreprocessed)
+	require.Equal(t, lsp.DocumentHighlight{Range: testRange(1, 0, 1, 3), Kind: lsp.DocumentHighlightKindText}, ideHighlight)
+}
+
+func TestClang2IdeWorkspaceEdit(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	extURI := lsp.NewDocumentURIFromPath(paths.New("/usr/include/stdio.h"))
+	ideEdit, err := ls.cpp2inoWorkspaceEdit(logger, &lsp.WorkspaceEdit{
+		Changes: map[lsp.DocumentURI][]lsp.TextEdit{
+			lsp.NewDocumentURIFromPath(ls.buildSketchCpp):                    {{Range: testRange(2, 5, 2, 10), NewText: "init"}},
+			lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Other.cpp")): {{Range: testRange(1, 0, 1, 4), NewText: "long"}},
+			extURI: {{Range: testRange(1, 0, 1, 4), NewText: "long"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[lsp.DocumentURI][]lsp.TextEdit{
+		lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino")): {{Range: testRange(0, 5, 0, 10), NewText: "init"}},
+		lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Other.cpp")):  {{Range: testRange(0, 0, 0, 4), NewText: "long"}},
+		extURI: {{Range: testRange(1, 0, 1, 4), NewText: "long"}},
+	}, ideEdit.Changes)
+}
+
+func TestClang2IdeEditAcrossTabs(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	otherIno := ls.sketchRoot.Join("Other.ino")
+	ls.trackedIdeDocs[otherIno.String()] = lsp.TextDocumentItem{URI: lsp.NewDocumentURIFromPath(otherIno), Text: "int counter;\nint total;\n"}
+	ls.sketchMapper = sourcemapper.CreateInoMapper([]byte(
+		"#include <Arduino.h>\n" +
+			"#line 1 \"" + ls.sketchRoot.Join("Sketch.ino").String() + "\"\n" +
+			"void setup() {}\n" +
+			"void loop() {}\n" +
+			"#line 1 \"" + otherIno.String() + "\"\n" +
+			"int counter;\n" +
+			"int total;\n"))
+	cppURI := lsp.NewDocumentURIFromPath(ls.buildSketchCpp)
+
+	// The edits on each side of the boundary between the tabs are converted
+	ideEdit, err := ls.cpp2inoWorkspaceEdit(logger, &lsp.WorkspaceEdit{
+		Changes: map[lsp.DocumentURI][]lsp.TextEdit{
+			cppURI: {
+				{Range: testRange(3, 14, 3, 14), NewText: "\n"},
+				{Range: testRange(5, 0, 5, 3), NewText: "long"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[lsp.DocumentURI][]lsp.TextEdit{
+		lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino")): {{Range: testRange(1, 14, 1, 14), NewText: "\n"}},
+		lsp.NewDocumentURIFromPath(otherIno):                         {{Range: testRange(0, 0, 0, 3), NewText: "long"}},
+	}, ideEdit.Changes)
+
+	// An edit crossing the boundary can't be split between the tabs: the whole edit is rejected
+	acrossTabs := &lsp.WorkspaceEdit{
+		Changes: map[lsp.DocumentURI][]lsp.TextEdit{
+			cppURI: {
+				{Range: testRange(2, 0, 2, 4), NewText: "int"},
+				{Range: testRange(3, 5, 5, 3), NewText: "long"},
+			},
+		},
+	}
+	ideEdit, err = ls.cpp2inoWorkspaceEdit(logger, acrossTabs)
+	require.Nil(t, ideEdit)
+	require.Equal(t, &EditAcrossTabsError{Range: testRange(3, 5, 5, 3)}, err)
+
+	// ...and the code action applying it is disabled
+	ideCodeAction := ls.clang2IdeCodeAction(logger, lsp.CodeAction{Title: "fix", Edit: acrossTabs}, lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino")))
+	require.NotNil(t, ideCodeAction)
+	require.Nil(t, ideCodeAction.Edit)
+	require.NotNil(t, ideCodeAction.Disabled)
+	require.Equal(t, "The fix changes more than one tab of the sketch at once: apply it by hand.", ideCodeAction.Disabled.Reason)
+
+	// ...and the same edit requested by clangd is not applied
+	var ide bytes.Buffer
+	ls.IDE = &IDELSPServer{conn: lsp.NewServer(&bytes.Buffer{}, &ide, nil)}
+	res, respErr := ls.workspaceApplyEditReqFromClangd(context.Background(), logger, &lsp.ApplyWorkspaceEditParams{Edit: *acrossTabs})
+	require.Nil(t, respErr)
+	require.Equal(t, &lsp.ApplyWorkspaceEditResult{Applied: false, FailureReason: ideCodeAction.Disabled.Reason}, res)
+	require.Contains(t, ide.String(), "window/showMessage")
+}
+
+func TestCpp2InoTextEditCRLF(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	lineDirective := "#line 1 \"" + ls.sketchRoot.Join("Sketch.ino").String() + "\""
+	ls.sketchMapper = sourcemapper.CreateInoMapper([]byte(
+		"#include <Arduino.h>\r\n" +
+			lineDirective + "\r\n" +
+			"void setup() {}\r\n" +
+			"void loop() {}\r\n"))
+
+	// The edit starting at the end of the #line directive is moved in the .ino section,
+	// removing the CRLF line terminator at the beginning of the new text
+	cppURI := lsp.NewDocumentURIFromPath(ls.buildSketchCpp)
+	ideURI, ideEdit, _, err := ls.cpp2inoTextEdit(logger, cppURI, lsp.TextEdit{
+		Range:   testRange(1, len(lineDirective), 2, 4),
+		NewText: "\r\nVOID",
+	})
+	require.NoError(t, err)
+	require.Equal(t, lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino")), ideURI)
+	require.Equal(t, lsp.TextEdit{Range: testRange(0, 0, 0, 4), NewText: "VOID"}, ideEdit)
+}
+
+func TestClang2IdeCodeActionDiagnostics(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	ideCodeAction := ls.clang2IdeCodeAction(logger, lsp.CodeAction{
+		Title:       "fix",
+		Diagnostics: []lsp.Diagnostic{{Range: testRange(3, 0, 3, 4), Message: "error"}},
+	}, lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h")))
+	require.NotNil(t, ideCodeAction)
+	require.Equal(t, testRange(2, 0, 2, 4), ideCodeAction.Diagnostics[0].Range)
+
+	// The related information of the diagnostics of a .cpp tab is moved to the sketch
+	otherURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Other.cpp"))
+	clangHelperURI := lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Helper.h"))
+	ideCodeAction = ls.clang2IdeCodeAction(logger, lsp.CodeAction{
+		Title: "fix",
+		Diagnostics: []lsp.Diagnostic{{
+			Range:   testRange(5, 2, 5, 9),
+			Message: "redefinition of 'counter'",
+			RelatedInformation: []lsp.DiagnosticRelatedInformation{{
+				Location: lsp.Location{URI: clangHelperURI, Range: testRange(4, 4, 4, 11)},
+				Message:  "previous definition is here",
+			}},
+		}},
+	}, otherURI)
+	require.NotNil(t, ideCodeAction)
+	require.Equal(t, []lsp.Diagnostic{{
+		Range:   testRange(4, 2, 4, 9),
+		Message: "redefinition of 'counter'",
+		RelatedInformation: []lsp.DiagnosticRelatedInformation{{
+			Location: lsp.Location{URI: lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h")), Range: testRange(3, 4, 3, 11)},
+			Message:  "previous definition is here",
+		}},
+	}}, ideCodeAction.Diagnostics)
+
+	// The diagnostics of a .ino tab are moved from the preprocessed sketch, the ones in its
+	// generated parts are dropped
+	ideCodeAction = ls.clang2IdeCodeAction(logger, lsp.CodeAction{
+		Title: "fix",
+		Diagnostics: []lsp.Diagnostic{
+			{Range: testRange(3, 5, 3, 9), Message: "error"},
+			{Range: testRange(0, 0, 0, 4), Message: "generated"},
+		},
+	}, lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino")))
+	require.NotNil(t, ideCodeAction)
+	require.Equal(t, []lsp.Diagnostic{{Range: testRange(1, 5, 1, 9), Message: "error"}}, ideCodeAction.Diagnostics)
+}
+
+func TestClang2IdeShowDocument(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	// .ino
+	ideURI, ideSelection := ls.clang2IdeShowDocument(logger, lsp.URI(lsp.NewDocumentURIFromPath(ls.buildSketchCpp).String()), testRange(3, 5, 3, 9))
+	require.Equal(t, lsp.URI(lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino")).String()), ideURI)
+	require.Equal(t, testRange(1, 5, 1, 9), ideSelection)
+
+	// .cpp of the sketch
+	ideURI, ideSelection = ls.clang2IdeShowDocument(logger, lsp.URI(lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Other.cpp")).String()), testRange(5, 0, 5, 4))
+	require.Equal(t, lsp.URI(lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Other.cpp")).String()), ideURI)
+	require.Equal(t, testRange(4, 0, 4, 4), ideSelection)
+
+	// library file
+	libURI := lsp.URI(lsp.NewDocumentURIFromPath(paths.New("/libraries/Servo/Servo.h")).String())
+	ideURI, ideSelection = ls.clang2IdeShowDocument(logger, libURI, testRange(10, 0, 10, 4))
+	require.Equal(t, libURI, ideURI)
+	require.Equal(t, testRange(10, 0, 10, 4), ideSelection)
+
+	// the #include added by the preprocessor is not part of any .ino file
+	sketchCppURI := lsp.URI(lsp.NewDocumentURIFromPath(ls.buildSketchCpp).String())
+	ideURI, ideSelection = ls.clang2IdeShowDocument(logger, sketchCppURI, testRange(0, 0, 0, 4))
+	require.Equal(t, sketchCppURI, ideURI)
+	require.Equal(t, testRange(0, 0, 0, 4), ideSelection)
+}
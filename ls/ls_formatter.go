@@ -16,12 +16,27 @@
 package ls
 
 import (
+	"bytes"
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+
 	"github.com/arduino/go-paths-helper"
 	"github.com/vincecity/go-lsp"
 	"github.com/vincecity/go-lsp/jsonrpc"
 )
 
-func (ls *INOLanguageServer) createClangdFormatterConfig(logger jsonrpc.FunctionLogger, cppuri lsp.DocumentURI) (func(), error) {
+// generatedFormatterConfigHeader marks the .clang-format files written by the language server:
+// the ones left behind by a crashed language server are removed at startup.
+const generatedFormatterConfigHeader = "# Generated by arduino-language-server, removed after formatting\n"
+
+// createClangdFormatterConfig writes the .clang-format configuration used to format the given
+// file. The editor tab settings in options are applied to the default configuration, the custom
+// configuration files are used as they are. The returned function removes the configuration.
+// Nothing is written if ctx is canceled, outside the build folder, or if a .clang-format not
+// generated by the language server is already present (it's used by clangd as it is).
+func (ls *INOLanguageServer) createClangdFormatterConfig(ctx context.Context, logger jsonrpc.FunctionLogger, cppuri lsp.DocumentURI, options lsp.FormattingOptions) (func(), error) {
 	// clangd looks for a .clang-format configuration file on the same directory
 	// pointed by the uri passed in the lsp command parameters.
 	// https://github.com/llvm/llvm-project/blob/64d06ed9c9e0389cd27545d2f6e20455a91d89b1/clang-tools-extra/clangd/ClangdLSPServer.cpp#L856-L868
@@ -218,6 +233,7 @@ WhitespaceSensitiveMacros:
   - NS_SWIFT_NAME
   - CF_SWIFT_NAME
 `
+	config = applyFormattingOptions(config, options)
 	try := func(conf *paths.Path) bool {
 		if c, err := conf.ReadFile(); err != nil {
 			logger.Logf("    error reading custom formatter config file %s: %s", conf, err)
@@ -241,11 +257,95 @@ WhitespaceSensitiveMacros:
 		targetFile = targetFile.Parent()
 	}
 	targetFile = targetFile.Join(".clang-format")
-	cleanup := func() {
-		targetFile.Remove()
-		logger.Logf("    formatter config cleaned")
+	if targetFile.Exist() && !isGeneratedFormatterConfig(targetFile) {
+		logger.Logf("    using the formatter config already in: %s", targetFile)
+		return func() {}, nil
+	}
+	if inside, _ := targetFile.IsInsideDir(ls.buildPath); !inside {
+		// Nothing is written outside the build folder (for example in a library), the file is
+		// formatted with the configuration found by clangd, if any
+		logger.Logf("    formatter config not written outside the build folder: %s", targetFile)
+		return func() {}, nil
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// The config is written in a temp file and then moved in place, so clangd never reads
+	// a partially written config
 	logger.Logf("    writing formatter config in: %s", targetFile)
-	err := targetFile.WriteFile([]byte(config))
-	return cleanup, err
+	tmp, err := paths.WriteToTempFile([]byte(generatedFormatterConfigHeader+config), targetFile.Parent(), ".clang-format-")
+	if err != nil {
+		return nil, err
+	}
+	if err := tmp.Rename(targetFile); err != nil {
+		_ = tmp.Remove()
+		return nil, err
+	}
+	cleanup := func() {
+		if isGeneratedFormatterConfig(targetFile) {
+			_ = targetFile.Remove()
+			logger.Logf("    formatter config cleaned")
+		}
+	}
+	return cleanup, nil
+}
+
+// isGeneratedFormatterConfig returns true if the given file is a formatter config written
+// by the language server.
+func isGeneratedFormatterConfig(file *paths.Path) bool {
+	data, err := file.ReadFile()
+	return err == nil && bytes.HasPrefix(data, []byte(generatedFormatterConfigHeader))
+}
+
+// removeLeftoverFormatterConfigs removes the formatter configs left in the given folder and
+// its subfolders by a language server terminated while formatting.
+func removeLeftoverFormatterConfigs(logger jsonrpc.FunctionLogger, folder *paths.Path) {
+	files, err := folder.ReadDirRecursive()
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.Base() != ".clang-format" && !strings.HasPrefix(file.Base(), ".clang-format-") {
+			continue
+		}
+		if isGeneratedFormatterConfig(file) {
+			logger.Logf("Removing leftover formatter config %s", file)
+			_ = file.Remove()
+		}
+	}
+}
+
+// applyFormattingOptions sets the indentation options of the clang-format configuration to
+// honor the tab settings of the editor (tabSize and insertSpaces).
+func applyFormattingOptions(config string, options lsp.FormattingOptions) string {
+	var tabSize int
+	switch value := options["tabSize"].(type) {
+	case float64:
+		tabSize = int(value)
+	case int:
+		tabSize = value
+	}
+	if tabSize > 0 {
+		config = setClangFormatOption(config, "IndentWidth", strconv.Itoa(tabSize))
+		config = setClangFormatOption(config, "TabWidth", strconv.Itoa(tabSize))
+	}
+	if insertSpaces, ok := options["insertSpaces"].(bool); ok {
+		if insertSpaces {
+			config = setClangFormatOption(config, "UseTab", "Never")
+		} else {
+			config = setClangFormatOption(config, "UseTab", "ForIndentation")
+		}
+	}
+	return config
+}
+
+// setClangFormatOption sets the value of a top-level option of the clang-format configuration,
+// the option is added if not already present.
+func setClangFormatOption(config, option, value string) string {
+	optionRegexp := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(option) + `:.*$`)
+	if optionRegexp.MatchString(config) {
+		return optionRegexp.ReplaceAllLiteralString(config, option+": "+value)
+	}
+	return config + option + ": " + value + "\n"
 }
@@ -0,0 +1,100 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"go.bug.st/json"
+)
+
+func TestApplyFormattingOptions(t *testing.T) {
+	config := "ObjCBlockIndentWidth: 2\nIndentWidth: 2\nTabWidth: 2\nUseTab: Never\n"
+
+	// The options are decoded from the IDE request
+	var options lsp.FormattingOptions
+	require.NoError(t, json.Unmarshal([]byte(`{"tabSize":4,"insertSpaces":false}`), &options))
+	require.Equal(t,
+		"ObjCBlockIndentWidth: 2\nIndentWidth: 4\nTabWidth: 4\nUseTab: ForIndentation\n",
+		applyFormattingOptions(config, options))
+
+	require.Equal(t, config, applyFormattingOptions(config, lsp.FormattingOptions{}))
+	require.Equal(t, "IndentWidth: 3\n", setClangFormatOption("", "IndentWidth", "3"))
+}
+
+func TestCreateClangdFormatterConfig(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.config = &Config{}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	folder := ls.buildSketchRoot
+	require.NoError(t, folder.MkdirAll())
+	cppURI := lsp.NewDocumentURIFromPath(folder.Join("Sketch.ino.cpp"))
+	configFile := folder.Join(".clang-format")
+	require.NoError(t, cppURI.AsPath().WriteFile([]byte{}))
+
+	cleanup, err := ls.createClangdFormatterConfig(context.Background(), logger, cppURI, lsp.FormattingOptions{})
+	require.NoError(t, err)
+	require.True(t, isGeneratedFormatterConfig(configFile))
+	cleanup()
+	require.False(t, configFile.Exist())
+
+	// Nothing is written for a canceled request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ls.createClangdFormatterConfig(ctx, logger, cppURI, lsp.FormattingOptions{})
+	require.Error(t, err)
+	require.False(t, configFile.Exist())
+
+	// The config of the user is left untouched
+	require.NoError(t, configFile.WriteFile([]byte("IndentWidth: 8\n")))
+	cleanup, err = ls.createClangdFormatterConfig(context.Background(), logger, cppURI, lsp.FormattingOptions{})
+	require.NoError(t, err)
+	cleanup()
+	data, err := configFile.ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, "IndentWidth: 8\n", string(data))
+
+	// Nothing is written outside the build folder
+	libraryFolder := paths.New(t.TempDir())
+	libraryURI := lsp.NewDocumentURIFromPath(libraryFolder.Join("Library.cpp"))
+	require.NoError(t, libraryURI.AsPath().WriteFile([]byte{}))
+	cleanup, err = ls.createClangdFormatterConfig(context.Background(), logger, libraryURI, lsp.FormattingOptions{})
+	require.NoError(t, err)
+	cleanup()
+	require.False(t, libraryFolder.Join(".clang-format").Exist())
+}
+
+func TestRemoveLeftoverFormatterConfigs(t *testing.T) {
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	folder := paths.New(t.TempDir())
+	require.NoError(t, folder.Join("src").MkdirAll())
+	leftover := folder.Join(".clang-format")
+	leftoverTemp := folder.Join("src", ".clang-format-1234")
+	userConfig := folder.Join("src", ".clang-format")
+	require.NoError(t, leftover.WriteFile([]byte(generatedFormatterConfigHeader+"IndentWidth: 2\n")))
+	require.NoError(t, leftoverTemp.WriteFile([]byte(generatedFormatterConfigHeader)))
+	require.NoError(t, userConfig.WriteFile([]byte("IndentWidth: 8\n")))
+
+	removeLeftoverFormatterConfigs(logger, folder)
+	require.False(t, leftover.Exist())
+	require.False(t, leftoverTemp.Exist())
+	require.True(t, userConfig.Exist())
+}
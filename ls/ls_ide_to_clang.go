@@ -61,7 +61,11 @@ func (ls *INOLanguageServer) ide2ClangDocumentURI(logger jsonrpc.FunctionLogger,
 		logger.Logf("ERROR: could not determine if '%s' is inside '%s'", idePath, ls.sketchRoot)
 		return lsp.NilURI, false, &UnknownURIError{ideURI}
 	}
-	if !inside {
+	if !inside && ls.externalFilesPolicy() == ExternalFilesDecline && ls.isExternalFile(idePath) {
+		return lsp.NilURI, false, &ExternalFileDeclinedError{ideURI}
+	}
+	if !inside || !ls.isCompiledSketchPath(idePath) {
+		// The subfolders of the sketch other than src are not compiled with the sketch
 		clangURI := ideURI
 		logger.Logf("URI: %s -> %s", ideURI, clangURI)
 		return clangURI, false, nil
@@ -104,6 +108,15 @@ func (ls *INOLanguageServer) ide2ClangRange(logger jsonrpc.FunctionLogger, ideUR
 	if err != nil {
 		return lsp.DocumentURI{}, lsp.Range{}, err
 	}
+	if ideDoc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]; ok {
+		// Malformed ranges would be mapped to unrelated parts of the sketch, or not at all
+		validRange, err := validateIdeRange(ideDoc, ideRange)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return lsp.DocumentURI{}, lsp.Range{}, err
+		}
+		ideRange = validRange
+	}
 
 	// Convert .ino ranges using sketchmapper
 	if ls.clangURIRefersToIno(clangURI) {
@@ -173,7 +186,7 @@ func (ls *INOLanguageServer) ide2ClangDiagnostic(logger jsonrpc.FunctionLogger,
 		Source:             ideDiag.Source,
 		Message:            ideDiag.Message,
 		Tags:               ideDiag.Tags,
-		Data:               ideDiag.Data,
+		Data:               ls.ide2ClangDiagnosticData(logger, ideURI, ideDiag.Data),
 	}, nil
 }
 
@@ -19,8 +19,9 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/arduino/arduino-language-server/streams"
 	"github.com/arduino/go-paths-helper"
@@ -31,26 +32,29 @@ import (
 )
 
 type clangdLSPClient struct {
-	conn *lsp.Client
-	ls   *INOLanguageServer
+	conn        *lsp.Client
+	process     *paths.Process
+	ls          *INOLanguageServer
+	closing     atomic.Bool
+	diagnostics *orderedQueue
 }
 
 // newClangdLSPClient creates and returns a new client
 func newClangdLSPClient(logger jsonrpc.FunctionLogger, dataFolder *paths.Path, ls *INOLanguageServer) *clangdLSPClient {
-	clangdConfFile := ls.buildPath.Join(".clangd")
-	clangdConf := fmt.Sprintln("Diagnostics:")
-	clangdConf += fmt.Sprintln("  Suppress: [anon_bitfield_qualifiers]")
-	clangdConf += fmt.Sprintln("CompileFlags:")
-	clangdConf += fmt.Sprintln("  Add: -ferror-limit=0")
-	if err := clangdConfFile.WriteFile([]byte(clangdConf)); err != nil {
+	if _, err := ls.writeClangdConfig(); err != nil {
 		logger.Logf("Error writing clangd configuration: %s", err)
 	}
 
 	// Start clangd
 	args := []string{
-		"-log=verbose",
+		"-log=" + string(ls.clangdLogLevel()),
 		"--pch-storage=memory",
-		fmt.Sprintf(`--compile-commands-dir=%s`, ls.buildPath),
+		fmt.Sprintf(`--compile-commands-dir=%s`, clangdCompilationDatabaseDir(ls.buildPath)),
+	}
+	if limit := ls.config.ClangdLimitResults; limit == -1 {
+		args = append(args, "--limit-results=0")
+	} else if limit > 0 {
+		args = append(args, fmt.Sprintf("--limit-results=%d", limit))
 	}
 	if jobs := ls.config.Jobs; jobs == -1 {
 		// default: limit parallel build jobs to 1
@@ -65,14 +69,10 @@ func newClangdLSPClient(logger jsonrpc.FunctionLogger, dataFolder *paths.Path, l
 	}
 
 	logger.Logf("    Starting clangd: %s %s", ls.config.ClangdPath, strings.Join(args, " "))
+	var clangdProcess *paths.Process
 	var clangdStdin io.WriteCloser
 	var clangdStdout, clangdStderr io.ReadCloser
-	var extraEnv []string
-	if ls.tempDir != nil {
-		extraEnv = append(extraEnv, "TMPDIR="+ls.tempDir.String()) // For unix-based systems
-		extraEnv = append(extraEnv, "TMP="+ls.tempDir.String())    // For Windows
-	}
-	if clangdCmd, err := paths.NewProcessFromPath(extraEnv, ls.config.ClangdPath, args...); err != nil {
+	if clangdCmd, err := paths.NewProcessFromPath(ls.toolsEnv(), ls.config.ClangdPath, args...); err != nil {
 		panic("starting clangd: " + err.Error())
 	} else if cin, err := clangdCmd.StdinPipe(); err != nil {
 		panic("getting clangd stdin: " + err.Error())
@@ -83,29 +83,32 @@ func newClangdLSPClient(logger jsonrpc.FunctionLogger, dataFolder *paths.Path, l
 	} else if err := clangdCmd.Start(); err != nil {
 		panic("running clangd: " + err.Error())
 	} else {
+		clangdProcess = clangdCmd
 		clangdStdin = cin
 		clangdStdout = cout
 		clangdStderr = cerr
 	}
 
-	clangdStdio := streams.NewReadWriteCloser(clangdStdout, clangdStdin)
+	clangdStdio := streams.NewReadWriteCloser(clangdStdout, newInitializeCapabilitiesWriter(clangdStdin))
 	if ls.config.EnableLogging {
 		clangdStdio = streams.LogReadWriteCloserAs(clangdStdio, "inols-clangd.log")
-		go io.Copy(streams.OpenLogFileAs("inols-clangd-err.log"), clangdStderr)
-	} else {
-		go io.Copy(os.Stderr, clangdStderr)
 	}
+	go ls.forwardClangdStderr(clangdStderr)
 
 	client := &clangdLSPClient{
-		ls: ls,
+		process:     clangdProcess,
+		ls:          ls,
+		diagnostics: newOrderedQueue(),
 	}
 	client.conn = lsp.NewClient(clangdStdio, clangdStdio, client)
+	client.conn.RegisterCustomNotification("textDocument/inactiveRegions", client.TextDocumentInactiveRegions)
 	client.conn.SetLogger(&Logger{
 		IncomingPrefix: "IDE     LS <-- Clangd",
 		OutgoingPrefix: "IDE     LS --> Clangd",
 		HiColor:        color.HiRedString,
 		LoColor:        color.RedString,
 		ErrorColor:     color.New(color.BgHiMagenta, color.FgHiWhite, color.BlinkSlow).Sprintf,
+		verbose:        &ls.verboseLogging,
 	})
 	return client
 }
@@ -117,10 +120,41 @@ func (client *clangdLSPClient) Run() {
 
 // Close sends an Exit notification to Clangd
 func (client *clangdLSPClient) Close() {
+	client.closing.Store(true)
 	client.conn.Exit() // send "exit" notification to Clangd
+	client.diagnostics.Close()
 	// TODO: kill client.conn
 }
 
+// Terminate closes the client and waits for the clangd process to exit, the process is
+// killed if it doesn't exit within the given timeout.
+func (client *clangdLSPClient) Terminate(timeout time.Duration) error {
+	client.Close()
+	exited := make(chan struct{})
+	go func() {
+		_ = client.process.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(timeout):
+		return client.process.Kill()
+	}
+}
+
+// Kill closes the client and terminates the clangd process, for example when clangd is
+// not responding: the requests pending on it are never going to be answered.
+func (client *clangdLSPClient) Kill() error {
+	client.Close()
+	return client.process.Kill()
+}
+
+// IsClosing returns true if the connection with Clangd has been closed on purpose
+func (client *clangdLSPClient) IsClosing() bool {
+	return client.closing.Load()
+}
+
 // The following are events incoming from Clangd
 
 // WindowShowMessageRequest is not implemented
@@ -128,9 +162,9 @@ func (client *clangdLSPClient) WindowShowMessageRequest(context.Context, jsonrpc
 	panic("unimplemented")
 }
 
-// WindowShowDocument is not implemented
-func (client *clangdLSPClient) WindowShowDocument(context.Context, jsonrpc.FunctionLogger, *lsp.ShowDocumentParams) (*lsp.ShowDocumentResult, *jsonrpc.ResponseError) {
-	panic("unimplemented")
+// WindowShowDocument forwards a request to show a document to the IDE
+func (client *clangdLSPClient) WindowShowDocument(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.ShowDocumentParams) (*lsp.ShowDocumentResult, *jsonrpc.ResponseError) {
+	return client.ls.windowShowDocumentReqFromClangd(ctx, logger, params)
 }
 
 // WindowWorkDoneProgressCreate is not implemented
@@ -158,9 +192,9 @@ func (client *clangdLSPClient) WorkspaceConfiguration(context.Context, jsonrpc.F
 	panic("unimplemented")
 }
 
-// WorkspaceApplyEdit is not implemented
-func (client *clangdLSPClient) WorkspaceApplyEdit(context.Context, jsonrpc.FunctionLogger, *lsp.ApplyWorkspaceEditParams) (*lsp.ApplyWorkspaceEditResult, *jsonrpc.ResponseError) {
-	panic("unimplemented")
+// WorkspaceApplyEdit forwards an edit request to the IDE
+func (client *clangdLSPClient) WorkspaceApplyEdit(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.ApplyWorkspaceEditParams) (*lsp.ApplyWorkspaceEditResult, *jsonrpc.ResponseError) {
+	return client.ls.workspaceApplyEditReqFromClangd(ctx, logger, params)
 }
 
 // WorkspaceCodeLensRefresh is not implemented
@@ -195,5 +229,9 @@ func (client *clangdLSPClient) TelemetryEvent(jsonrpc.FunctionLogger, json.RawMe
 
 // TextDocumentPublishDiagnostics sends a notification to Publish Dignostics
 func (client *clangdLSPClient) TextDocumentPublishDiagnostics(logger jsonrpc.FunctionLogger, params *lsp.PublishDiagnosticsParams) {
-	go client.ls.publishDiagnosticsNotifFromClangd(logger, params)
+	// The diagnostics are processed in the order they are published by clangd, the
+	// last diagnostics of a document are always the ones sent to the IDE
+	client.diagnostics.Push(func() {
+		client.ls.publishDiagnosticsNotifFromClangd(logger, params)
+	})
 }
@@ -18,9 +18,9 @@ package ls
 import (
 	"fmt"
 	"log"
+	"sync/atomic"
 	"time"
 
-	"github.com/fatih/color"
 	"github.com/vincecity/go-lsp/jsonrpc"
 	"go.bug.st/json"
 )
@@ -30,6 +30,12 @@ type Logger struct {
 	IncomingPrefix, OutgoingPrefix string
 	HiColor, LoColor               func(format string, a ...interface{}) string
 	ErrorColor                     func(format string, a ...interface{}) string
+
+	// history, if not nil, records the incoming requests and notifications
+	history *messageHistory
+	// verbose, if not nil, enables the logging of the content of the messages when set
+	// (see LogLevelDebug)
+	verbose *atomic.Bool
 }
 
 func init() {
@@ -39,6 +45,7 @@ func init() {
 // LogOutgoingRequest prints an outgoing request into the log
 func (l *Logger) LogOutgoingRequest(id string, method string, params json.RawMessage) {
 	log.Print(l.HiColor("%s REQU %s %s", l.OutgoingPrefix, method, id))
+	l.logContent(l.OutgoingPrefix, params)
 }
 
 // LogOutgoingCancelRequest prints an outgoing cancel request into the log
@@ -53,17 +60,21 @@ func (l *Logger) LogIncomingResponse(id string, method string, resp json.RawMess
 		e = l.ErrorColor(" ERROR: %s", respErr.AsError())
 	}
 	log.Print(l.LoColor("%s RESP %s %s%s", l.IncomingPrefix, method, id, e))
+	l.logContent(l.IncomingPrefix, resp)
 }
 
 // LogOutgoingNotification prints an outgoing notification into the log
 func (l *Logger) LogOutgoingNotification(method string, params json.RawMessage) {
 	log.Print(l.HiColor("%s NOTIF %s", l.OutgoingPrefix, method))
+	l.logContent(l.OutgoingPrefix, params)
 }
 
 // LogIncomingRequest prints an incoming request into the log
 func (l *Logger) LogIncomingRequest(id string, method string, params json.RawMessage) jsonrpc.FunctionLogger {
 	spaces := "                                               "
 	log.Print(l.HiColor(fmt.Sprintf("%s REQU %s %s", l.IncomingPrefix, method, id)))
+	l.logContent(l.IncomingPrefix, params)
+	l.history.add(method, id, params)
 	return &FunctionLogger{
 		colorFunc: l.HiColor,
 		prefix:    fmt.Sprintf("%s      %s %s", spaces[:len(l.IncomingPrefix)], method, id),
@@ -82,18 +93,29 @@ func (l *Logger) LogOutgoingResponse(id string, method string, resp json.RawMess
 		e = l.ErrorColor(" ERROR: %s", respErr.AsError())
 	}
 	log.Print(l.LoColor("%s RESP %s %s%s", l.OutgoingPrefix, method, id, e))
+	l.logContent(l.OutgoingPrefix, resp)
 }
 
 // LogIncomingNotification prints an incoming notification into the log
 func (l *Logger) LogIncomingNotification(method string, params json.RawMessage) jsonrpc.FunctionLogger {
 	spaces := "                                               "
 	log.Print(l.HiColor(fmt.Sprintf("%s NOTIF %s", l.IncomingPrefix, method)))
+	l.logContent(l.IncomingPrefix, params)
+	l.history.add(method, "", params)
 	return &FunctionLogger{
 		colorFunc: l.HiColor,
 		prefix:    fmt.Sprintf("%s       %s", spaces[:len(l.IncomingPrefix)], method),
 	}
 }
 
+// logContent prints the content of a message into the log, if the verbose logging is enabled
+func (l *Logger) logContent(prefix string, content json.RawMessage) {
+	if l.verbose == nil || !l.verbose.Load() || len(content) == 0 {
+		return
+	}
+	log.Print(l.LoColor("%s      %s", prefix, content))
+}
+
 // LogIncomingDataDelay prints the delay of incoming data into the log
 func (l *Logger) LogIncomingDataDelay(delay time.Duration) {
 	log.Printf("IN Elapsed: %v", delay)
@@ -112,7 +134,6 @@ type FunctionLogger struct {
 
 // NewLSPFunctionLogger creates a new function logger
 func NewLSPFunctionLogger(colofFunction func(format string, a ...interface{}) string, prefix string) *FunctionLogger {
-	color.NoColor = false
 	return &FunctionLogger{
 		colorFunc: colofFunction,
 		prefix:    prefix,
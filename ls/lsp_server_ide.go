@@ -27,23 +27,43 @@ import (
 
 // IDELSPServer is an IDE lsp server
 type IDELSPServer struct {
-	conn *lsp.Server
-	ls   *INOLanguageServer
+	conn  *lsp.Server
+	inbox *ideInbox
+	ls    *INOLanguageServer
 }
 
 // NewIDELSPServer creates and return a new server
 func NewIDELSPServer(logger jsonrpc.FunctionLogger, in io.Reader, out io.Writer, ls *INOLanguageServer) *IDELSPServer {
 	server := &IDELSPServer{
-		ls: ls,
+		inbox: newIDEInbox(in, ideInboxSize),
+		ls:    ls,
 	}
-	server.conn = lsp.NewServer(in, out, server)
+	server.conn = lsp.NewServer(server.inbox, out, server)
 	server.conn.RegisterCustomNotification("ino/didCompleteBuild", server.ArduinoBuildCompleted)
+	server.conn.RegisterCustomNotification("arduino/documentChecksum", server.ArduinoDocumentChecksum)
+	server.conn.RegisterCustomRequest("arduino/previewGeneratedSketch", server.ArduinoPreviewGeneratedSketch)
+	server.conn.RegisterCustomRequest("arduino/getGeneratedPrototypes", server.ArduinoGetGeneratedPrototypes)
+	server.conn.RegisterCustomRequest("arduino/getSketchInfo", server.ArduinoGetSketchInfo)
+	server.conn.RegisterCustomRequest("arduino/inoToCppPosition", server.ArduinoInoToCppPosition)
+	server.conn.RegisterCustomRequest("arduino/cppToInoPosition", server.ArduinoCppToInoPosition)
+	server.conn.RegisterCustomRequest("arduino/listSerialPorts", server.ArduinoListSerialPorts)
+	server.conn.RegisterCustomRequest("arduino/listLibraryExamples", server.ArduinoListLibraryExamples)
+	server.conn.RegisterCustomRequest("arduino/getLibraryDependencies", server.ArduinoGetLibraryDependencies)
+	server.conn.RegisterCustomRequest("arduino/listTaskComments", server.ArduinoListTaskComments)
+	server.conn.RegisterCustomRequest("arduino/getMetrics", server.ArduinoGetMetrics)
+	server.conn.RegisterCustomRequest("arduino/getDebugInfo", server.ArduinoGetDebugInfo)
+	server.conn.RegisterCustomRequest("arduino/capabilities", server.ArduinoCapabilities)
+	server.conn.RegisterCustomRequest("arduino/getPredefinedMacros", server.ArduinoGetPredefinedMacros)
+	server.conn.RegisterCustomRequest("textDocument/inlineValue", server.TextDocumentInlineValue)
+	registerNotebookDocumentMethods(server.conn)
 	server.conn.SetLogger(&Logger{
 		IncomingPrefix: "IDE --> LS",
 		OutgoingPrefix: "IDE <-- LS",
 		HiColor:        color.HiGreenString,
 		LoColor:        color.GreenString,
 		ErrorColor:     color.New(color.BgHiMagenta, color.FgHiWhite, color.BlinkSlow).Sprintf,
+		history:        ls.ideMessages,
+		verbose:        &ls.verboseLogging,
 	})
 	return server
 }
@@ -59,18 +79,24 @@ func (server *IDELSPServer) Initialize(ctx context.Context, logger jsonrpc.Funct
 }
 
 // Shutdown sends a shutdown request
-func (server *IDELSPServer) Shutdown(ctx context.Context, logger jsonrpc.FunctionLogger) *jsonrpc.ResponseError {
+func (server *IDELSPServer) Shutdown(ctx context.Context, logger jsonrpc.FunctionLogger) (respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
 	return server.ls.shutdownReqFromIDE(ctx, logger)
 }
 
-// WorkspaceSymbol is not implemented
-func (server *IDELSPServer) WorkspaceSymbol(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.WorkspaceSymbolParams) ([]lsp.SymbolInformation, *jsonrpc.ResponseError) {
-	panic("unimplemented")
+// WorkspaceSymbol searches the symbols of the workspace
+func (server *IDELSPServer) WorkspaceSymbol(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.WorkspaceSymbolParams) (_ []lsp.SymbolInformation, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.workspaceSymbolReqFromIDE(ctx, logger, params)
 }
 
-// WorkspaceExecuteCommand is not implemented
-func (server *IDELSPServer) WorkspaceExecuteCommand(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.ExecuteCommandParams) (json.RawMessage, *jsonrpc.ResponseError) {
-	panic("unimplemented")
+// WorkspaceExecuteCommand executes a command
+func (server *IDELSPServer) WorkspaceExecuteCommand(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.ExecuteCommandParams) (_ json.RawMessage, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.workspaceExecuteCommandReqFromIDE(ctx, logger, params)
 }
 
 // WorkspaceWillCreateFiles is not implemented
@@ -78,9 +104,11 @@ func (server *IDELSPServer) WorkspaceWillCreateFiles(ctx context.Context, logger
 	panic("unimplemented")
 }
 
-// WorkspaceWillRenameFiles is not implemented
-func (server *IDELSPServer) WorkspaceWillRenameFiles(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.RenameFilesParams) (*lsp.WorkspaceEdit, *jsonrpc.ResponseError) {
-	panic("unimplemented")
+// WorkspaceWillRenameFiles returns the edits needed to fix the includes of the renamed files
+func (server *IDELSPServer) WorkspaceWillRenameFiles(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.RenameFilesParams) (_ *lsp.WorkspaceEdit, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.workspaceWillRenameFilesReqFromIDE(ctx, logger, params)
 }
 
 // WorkspaceWillDeleteFiles is not implemented
@@ -94,7 +122,12 @@ func (server *IDELSPServer) TextDocumentWillSaveWaitUntil(ctx context.Context, l
 }
 
 // TextDocumentCompletion is not implemented
-func (server *IDELSPServer) TextDocumentCompletion(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.CompletionParams) (*lsp.CompletionList, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentCompletion(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.CompletionParams) (_ *lsp.CompletionList, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
 	return server.ls.textDocumentCompletionReqFromIDE(ctx, logger, params)
 }
 
@@ -104,12 +137,22 @@ func (server *IDELSPServer) CompletionItemResolve(ctx context.Context, logger js
 }
 
 // TextDocumentHover sends a request to hover a text document
-func (server *IDELSPServer) TextDocumentHover(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.HoverParams) (*lsp.Hover, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentHover(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.HoverParams) (_ *lsp.Hover, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
 	return server.ls.textDocumentHoverReqFromIDE(ctx, logger, params)
 }
 
 // TextDocumentSignatureHelp requests help for text document signature
-func (server *IDELSPServer) TextDocumentSignatureHelp(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.SignatureHelpParams) (*lsp.SignatureHelp, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentSignatureHelp(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.SignatureHelpParams) (_ *lsp.SignatureHelp, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
 	return server.ls.textDocumentSignatureHelpReqFromIDE(ctx, logger, params)
 }
 
@@ -119,17 +162,32 @@ func (server *IDELSPServer) TextDocumentDeclaration(ctx context.Context, logger
 }
 
 // TextDocumentDefinition sends a request to define a text document
-func (server *IDELSPServer) TextDocumentDefinition(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.DefinitionParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentDefinition(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.DefinitionParams) (_ []lsp.Location, _ []lsp.LocationLink, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, nil, err
+	}
 	return server.ls.textDocumentDefinitionReqFromIDE(ctx, logger, params)
 }
 
 // TextDocumentTypeDefinition sends a request to define a type for the text document
-func (server *IDELSPServer) TextDocumentTypeDefinition(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.TypeDefinitionParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentTypeDefinition(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.TypeDefinitionParams) (_ []lsp.Location, _ []lsp.LocationLink, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, nil, err
+	}
 	return server.ls.textDocumentTypeDefinitionReqFromIDE(ctx, logger, params)
 }
 
 // TextDocumentImplementation sends a request to implement a text document
-func (server *IDELSPServer) TextDocumentImplementation(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.ImplementationParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentImplementation(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.ImplementationParams) (_ []lsp.Location, _ []lsp.LocationLink, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, nil, err
+	}
 	return server.ls.textDocumentImplementationReqFromIDE(ctx, logger, params)
 }
 
@@ -139,17 +197,32 @@ func (server *IDELSPServer) TextDocumentReferences(ctx context.Context, logger j
 }
 
 // TextDocumentDocumentHighlight sends a request to highlight a text document
-func (server *IDELSPServer) TextDocumentDocumentHighlight(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.DocumentHighlightParams) ([]lsp.DocumentHighlight, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentDocumentHighlight(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.DocumentHighlightParams) (_ []lsp.DocumentHighlight, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
 	return server.ls.textDocumentDocumentHighlightReqFromIDE(ctx, logger, params)
 }
 
 // TextDocumentDocumentSymbol sends a request for text document symbol
-func (server *IDELSPServer) TextDocumentDocumentSymbol(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.DocumentSymbolParams) ([]lsp.DocumentSymbol, []lsp.SymbolInformation, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentDocumentSymbol(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.DocumentSymbolParams) (_ []lsp.DocumentSymbol, _ []lsp.SymbolInformation, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, nil, err
+	}
 	return server.ls.textDocumentDocumentSymbolReqFromIDE(ctx, logger, params)
 }
 
 // TextDocumentCodeAction sends a request for text document code action
-func (server *IDELSPServer) TextDocumentCodeAction(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.CodeActionParams) ([]lsp.CommandOrCodeAction, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentCodeAction(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.CodeActionParams) (_ []lsp.CommandOrCodeAction, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
 	return server.ls.textDocumentCodeActionReqFromIDE(ctx, logger, params)
 }
 
@@ -158,9 +231,14 @@ func (server *IDELSPServer) CodeActionResolve(ctx context.Context, logger jsonrp
 	panic("unimplemented")
 }
 
-// TextDocumentCodeLens is not implemented
-func (server *IDELSPServer) TextDocumentCodeLens(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.CodeLensParams) ([]lsp.CodeLens, *jsonrpc.ResponseError) {
-	panic("unimplemented")
+// TextDocumentCodeLens represent a request for the code lenses of a document
+func (server *IDELSPServer) TextDocumentCodeLens(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.CodeLensParams) (_ []lsp.CodeLens, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
+	return server.ls.textDocumentCodeLensReqFromIDE(ctx, logger, params)
 }
 
 // CodeLensResolve is not implemented
@@ -189,12 +267,22 @@ func (server *IDELSPServer) TextDocumentColorPresentation(ctx context.Context, l
 }
 
 // TextDocumentFormatting sends a request to format a text document
-func (server *IDELSPServer) TextDocumentFormatting(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.DocumentFormattingParams) ([]lsp.TextEdit, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentFormatting(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.DocumentFormattingParams) (_ []lsp.TextEdit, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
 	return server.ls.textDocumentFormattingReqFromIDE(ctx, logger, params)
 }
 
 // TextDocumentRangeFormatting sends a request to format the range a text document
-func (server *IDELSPServer) TextDocumentRangeFormatting(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.DocumentRangeFormattingParams) ([]lsp.TextEdit, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentRangeFormatting(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.DocumentRangeFormattingParams) (_ []lsp.TextEdit, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
 	return server.ls.textDocumentRangeFormattingReqFromIDE(ctx, logger, params)
 }
 
@@ -204,7 +292,12 @@ func (server *IDELSPServer) TextDocumentOnTypeFormatting(ctx context.Context, lo
 }
 
 // TextDocumentRename sends a request to rename a text document
-func (server *IDELSPServer) TextDocumentRename(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.RenameParams) (*lsp.WorkspaceEdit, *jsonrpc.ResponseError) {
+func (server *IDELSPServer) TextDocumentRename(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.RenameParams) (_ *lsp.WorkspaceEdit, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
 	return server.ls.textDocumentRenameReqFromIDE(ctx, logger, params)
 }
 
@@ -233,9 +326,14 @@ func (server *IDELSPServer) CallHierarchyOutgoingCalls(ctx context.Context, logg
 	panic("unimplemented")
 }
 
-// TextDocumentSemanticTokensFull is not implemented
-func (server *IDELSPServer) TextDocumentSemanticTokensFull(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.SemanticTokensParams) (*lsp.SemanticTokens, *jsonrpc.ResponseError) {
-	panic("unimplemented")
+// TextDocumentSemanticTokensFull sends a request for the semantic tokens of a text document
+func (server *IDELSPServer) TextDocumentSemanticTokensFull(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.SemanticTokensParams) (_ *lsp.SemanticTokens, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
+	return server.ls.textDocumentSemanticTokensFullReqFromIDE(ctx, logger, params)
 }
 
 // TextDocumentSemanticTokensFullDelta is not implemented
@@ -258,9 +356,14 @@ func (server *IDELSPServer) TextDocumentLinkedEditingRange(ctx context.Context,
 	panic("unimplemented")
 }
 
-// TextDocumentMoniker is not implemented
-func (server *IDELSPServer) TextDocumentMoniker(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.MonikerParams) ([]lsp.Moniker, *jsonrpc.ResponseError) {
-	panic("unimplemented")
+// TextDocumentMoniker sends a request for the monikers of the symbol at a position
+func (server *IDELSPServer) TextDocumentMoniker(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.MonikerParams) (_ []lsp.Moniker, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
+	return server.ls.textDocumentMonikerReqFromIDE(ctx, logger, params)
 }
 
 // Notifications ->
@@ -272,66 +375,75 @@ func (server *IDELSPServer) Progress(logger jsonrpc.FunctionLogger, params *lsp.
 
 // Initialized sends an initialized notification
 func (server *IDELSPServer) Initialized(logger jsonrpc.FunctionLogger, params *lsp.InitializedParams) {
+	defer replyClangdStartupFailure(nil)
 	server.ls.initializedNotifFromIDE(logger, params)
 }
 
 // Exit sends an exit notification
 func (server *IDELSPServer) Exit(logger jsonrpc.FunctionLogger) {
+	defer replyClangdStartupFailure(nil)
 	server.ls.exitNotifFromIDE(logger)
 }
 
 // SetTrace sends a set trace notification
 func (server *IDELSPServer) SetTrace(logger jsonrpc.FunctionLogger, params *lsp.SetTraceParams) {
+	defer replyClangdStartupFailure(nil)
 	server.ls.setTraceNotifFromIDE(logger, params)
 }
 
-// WindowWorkDoneProgressCancel is not implemented
+// WindowWorkDoneProgressCancel cancels the operation reporting a progress
 func (server *IDELSPServer) WindowWorkDoneProgressCancel(logger jsonrpc.FunctionLogger, params *lsp.WorkDoneProgressCancelParams) {
-	panic("unimplemented")
+	server.ls.windowWorkDoneProgressCancelNotifFromIDE(logger, params)
 }
 
-// WorkspaceDidChangeWorkspaceFolders is not implemented
+// WorkspaceDidChangeWorkspaceFolders follows the sketch folder being moved
 func (server *IDELSPServer) WorkspaceDidChangeWorkspaceFolders(logger jsonrpc.FunctionLogger, params *lsp.DidChangeWorkspaceFoldersParams) {
-	panic("unimplemented")
+	defer replyClangdStartupFailure(nil)
+	server.ls.workspaceDidChangeWorkspaceFoldersNotifFromIDE(logger, params)
 }
 
-// WorkspaceDidChangeConfiguration purpose is explained below
+// WorkspaceDidChangeConfiguration updates the settings of the language server
 func (server *IDELSPServer) WorkspaceDidChangeConfiguration(logger jsonrpc.FunctionLogger, params *lsp.DidChangeConfigurationParams) {
+	defer replyClangdStartupFailure(nil)
 	// At least one LSP client, Eglot, sends this by default when
-	// first connecting, even if the otions are empty.
+	// first connecting, even if the otions are empty: settings not
+	// concerning the language server are ignored.
 	// https://github.com/joaotavora/eglot/blob/e835996e16610d0ded6d862214b3b452b8803ea8/eglot.el#L1080
-	//
-	// Since ALS doesn’t have any workspace configuration yet,
-	// ignore it.
+	server.ls.workspaceDidChangeConfigurationNotifFromIDE(logger, params)
 }
 
-// WorkspaceDidChangeWatchedFiles is not implemented
+// WorkspaceDidChangeWatchedFiles sends a notification that some watched files have been changed on disk
 func (server *IDELSPServer) WorkspaceDidChangeWatchedFiles(logger jsonrpc.FunctionLogger, params *lsp.DidChangeWatchedFilesParams) {
-	panic("unimplemented")
+	server.ls.workspaceDidChangeWatchedFilesNotifFromIDE(logger, params)
 }
 
-// WorkspaceDidCreateFiles is not implemented
+// WorkspaceDidCreateFiles sends a notification that some files have been created
 func (server *IDELSPServer) WorkspaceDidCreateFiles(logger jsonrpc.FunctionLogger, params *lsp.CreateFilesParams) {
-	panic("unimplemented")
+	defer replyClangdStartupFailure(nil)
+	server.ls.workspaceDidCreateFilesNotifFromIDE(logger, params)
 }
 
-// WorkspaceDidRenameFiles is not implemented
+// WorkspaceDidRenameFiles sends a notification that some files have been renamed
 func (server *IDELSPServer) WorkspaceDidRenameFiles(logger jsonrpc.FunctionLogger, params *lsp.RenameFilesParams) {
-	panic("unimplemented")
+	defer replyClangdStartupFailure(nil)
+	server.ls.workspaceDidRenameFilesNotifFromIDE(logger, params)
 }
 
-// WorkspaceDidDeleteFiles is not implemented
+// WorkspaceDidDeleteFiles sends a notification that some files have been deleted
 func (server *IDELSPServer) WorkspaceDidDeleteFiles(logger jsonrpc.FunctionLogger, params *lsp.DeleteFilesParams) {
-	panic("unimplemented")
+	defer replyClangdStartupFailure(nil)
+	server.ls.workspaceDidDeleteFilesNotifFromIDE(logger, params)
 }
 
 // TextDocumentDidOpen sends a notification the a text document is open
 func (server *IDELSPServer) TextDocumentDidOpen(logger jsonrpc.FunctionLogger, params *lsp.DidOpenTextDocumentParams) {
+	defer replyClangdStartupFailure(nil)
 	server.ls.textDocumentDidOpenNotifFromIDE(logger, params)
 }
 
 // TextDocumentDidChange sends a notification the a text document has changed
 func (server *IDELSPServer) TextDocumentDidChange(logger jsonrpc.FunctionLogger, params *lsp.DidChangeTextDocumentParams) {
+	defer replyClangdStartupFailure(nil)
 	server.ls.textDocumentDidChangeNotifFromIDE(logger, params)
 }
 
@@ -342,29 +454,207 @@ func (server *IDELSPServer) TextDocumentWillSave(logger jsonrpc.FunctionLogger,
 
 // TextDocumentDidSave sends a notification the a text document has been saved
 func (server *IDELSPServer) TextDocumentDidSave(logger jsonrpc.FunctionLogger, params *lsp.DidSaveTextDocumentParams) {
+	defer replyClangdStartupFailure(nil)
 	server.ls.textDocumentDidSaveNotifFromIDE(logger, params)
 }
 
 // TextDocumentDidClose sends a notification the a text document has been closed
 func (server *IDELSPServer) TextDocumentDidClose(logger jsonrpc.FunctionLogger, params *lsp.DidCloseTextDocumentParams) {
+	defer replyClangdStartupFailure(nil)
 	server.ls.textDocumentDidCloseNotifFromIDE(logger, params)
 }
 
 // DidCompleteBuildParams is a custom notification from the Arduino IDE, sent
 type DidCompleteBuildParams struct {
 	BuildOutputURI *lsp.DocumentURI `json:"buildOutputUri"`
+	// ExecutableSectionsSize is the size report of the compile response (optional)
+	ExecutableSectionsSize []ExecutableSectionSize `json:"executableSectionsSize,omitempty"`
 }
 
 // ArduinoBuildCompleted handles "buildComplete" messages from the IDE
 func (server *IDELSPServer) ArduinoBuildCompleted(logger jsonrpc.FunctionLogger, raw json.RawMessage) {
+	defer replyClangdStartupFailure(nil)
+	var params DidCompleteBuildParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		logger.Logf("ERROR decoding DidCompleteBuildParams: %s", err)
+		return
+	}
+	server.ls.updateSketchSize(logger, params.ExecutableSectionsSize)
+
 	if !server.ls.config.SkipLibrariesDiscoveryOnRebuild {
 		return
 	}
+	server.ls.fullBuildCompletedFromIDE(logger, &params)
+}
 
-	var params DidCompleteBuildParams
+// ArduinoDocumentChecksum handles "arduino/documentChecksum" notifications from the IDE
+func (server *IDELSPServer) ArduinoDocumentChecksum(logger jsonrpc.FunctionLogger, raw json.RawMessage) {
+	defer replyClangdStartupFailure(nil)
+	var params DocumentChecksumParams
 	if err := json.Unmarshal(raw, &params); err != nil {
-		logger.Logf("ERROR decoding DidCompleteBuildParams: %s", err)
-	} else {
-		server.ls.fullBuildCompletedFromIDE(logger, &params)
+		logger.Logf("ERROR decoding DocumentChecksumParams: %s", err)
+		return
+	}
+	server.ls.documentChecksumNotifFromIDE(logger, &params)
+}
+
+// ArduinoPreviewGeneratedSketch handles "arduino/previewGeneratedSketch" requests from the IDE
+func (server *IDELSPServer) ArduinoPreviewGeneratedSketch(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.previewGeneratedSketchReqFromIDE(ctx, logger)
+}
+
+// ArduinoGetGeneratedPrototypes handles "arduino/getGeneratedPrototypes" requests from the IDE
+func (server *IDELSPServer) ArduinoGetGeneratedPrototypes(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.getGeneratedPrototypesReqFromIDE(ctx, logger)
+}
+
+// TextDocumentInlineValue handles "textDocument/inlineValue" requests from the IDE, not
+// supported by go-lsp
+func (server *IDELSPServer) TextDocumentInlineValue(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	var params InlineValueParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	if err := previewGeneratedSketchRequestError(logger, params.TextDocument.URI); err != nil {
+		return nil, err
+	}
+	return server.ls.textDocumentInlineValueReqFromIDE(ctx, logger, &params)
+}
+
+// ArduinoGetSketchInfo handles "arduino/getSketchInfo" requests from the IDE
+func (server *IDELSPServer) ArduinoGetSketchInfo(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.getSketchInfoReqFromIDE(ctx, logger)
+}
+
+// ArduinoInoToCppPosition handles "arduino/inoToCppPosition" requests from the IDE
+func (server *IDELSPServer) ArduinoInoToCppPosition(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	var params lsp.TextDocumentPositionParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	return server.ls.inoToCppPositionReqFromIDE(ctx, logger, &params)
+}
+
+// ArduinoCppToInoPosition handles "arduino/cppToInoPosition" requests from the IDE
+func (server *IDELSPServer) ArduinoCppToInoPosition(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	var params lsp.TextDocumentPositionParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	return server.ls.cppToInoPositionReqFromIDE(ctx, logger, &params)
+}
+
+// ArduinoListSerialPorts handles "arduino/listSerialPorts" requests from the IDE
+func (server *IDELSPServer) ArduinoListSerialPorts(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	var params ListSerialPortsParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+	}
+	return server.ls.listSerialPortsReqFromIDE(ctx, logger, &params)
+}
+
+// ArduinoListLibraryExamples handles "arduino/listLibraryExamples" requests from the IDE
+func (server *IDELSPServer) ArduinoListLibraryExamples(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.listLibraryExamplesReqFromIDE(ctx, logger)
+}
+
+// ArduinoGetLibraryDependencies handles "arduino/getLibraryDependencies" requests from the IDE
+func (server *IDELSPServer) ArduinoGetLibraryDependencies(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.getLibraryDependenciesReqFromIDE(ctx, logger)
+}
+
+// ArduinoListTaskComments handles "arduino/listTaskComments" requests from the IDE
+func (server *IDELSPServer) ArduinoListTaskComments(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.listTaskCommentsReqFromIDE(ctx, logger)
+}
+
+// ArduinoGetMetrics handles "arduino/getMetrics" requests from the IDE
+func (server *IDELSPServer) ArduinoGetMetrics(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.getMetricsReqFromIDE(ctx, logger)
+}
+
+// ArduinoGetDebugInfo handles "arduino/getDebugInfo" requests from the IDE
+func (server *IDELSPServer) ArduinoGetDebugInfo(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.getDebugInfoReqFromIDE(ctx, logger)
+}
+
+// ArduinoCapabilities handles "arduino/capabilities" requests from the IDE
+func (server *IDELSPServer) ArduinoCapabilities(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.capabilitiesReqFromIDE(ctx, logger)
+}
+
+// ArduinoGetPredefinedMacros handles "arduino/getPredefinedMacros" requests from the IDE
+func (server *IDELSPServer) ArduinoGetPredefinedMacros(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (_ interface{}, respErr *jsonrpc.ResponseError) {
+	defer replyClangdStartupFailure(&respErr)
+	ctx = server.inbox.requestContext(ctx)
+	return server.ls.getPredefinedMacrosReqFromIDE(ctx, logger)
+}
+
+// SerialPortsChanged sends an "arduino/serialPortsChanged" event to the IDE
+func (server *IDELSPServer) SerialPortsChanged(logger jsonrpc.FunctionLogger, params *SerialPortsChangedParams) {
+	server.sendCustomNotification(logger, "arduino/serialPortsChanged", params)
+}
+
+// replyClangdStartupFailure must be deferred by the handlers of the IDE messages: when the
+// session is closed because clangd could not be started (see clangdStartupFailed), or when
+// clangd is needed before the initialize request, the handler is unwound and, for requests,
+// the failure is returned to the IDE as an error response. respErr is nil for notifications.
+func replyClangdStartupFailure(respErr **jsonrpc.ResponseError) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if r != errClangdStartupFailed && r != errServerNotInitialized && r != errMisnamedMainFile {
+		panic(r)
+	}
+	if respErr != nil {
+		*respErr = responseError(r.(error))
+	}
+}
+
+// ArduinoEvent is the payload of the "telemetry/event" notifications used to send the
+// Arduino specific events to the IDE: lsp.Server only allows to send the notifications
+// defined by the LSP specification, so Method tells the IDE the kind of event.
+type ArduinoEvent struct {
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+func (server *IDELSPServer) sendCustomNotification(logger jsonrpc.FunctionLogger, method string, params interface{}) {
+	data, err := json.Marshal(&ArduinoEvent{Method: method, Params: params})
+	if err != nil {
+		logger.Logf("ERROR encoding %s params: %s", method, err)
+		return
+	}
+	if err := server.conn.TelemetryEvent(data); err != nil {
+		logger.Logf("ERROR sending %s: %s", method, err)
 	}
 }
@@ -0,0 +1,157 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// errMisnamedMainFile is the error returned to the IDE for the requests that need clangd
+// while the main file of the sketch is not named as the sketch folder: the sketch can't be
+// built, but the language server keeps running until the file is renamed.
+var errMisnamedMainFile = errors.New("the main file of the sketch must be named as the sketch folder")
+
+// misnamedMainFiles returns the .ino (and legacy .pde) files in the root of the sketch if
+// none of them is named as the sketch folder: arduino-cli refuses to build such a sketch.
+// Any of the returned files may be the intended main file.
+func misnamedMainFiles(sketchRoot *paths.Path, sketchName string) paths.PathList {
+	if sketchRoot.Join(sketchName+".ino").Exist() || sketchRoot.Join(sketchName+".pde").Exist() {
+		return nil
+	}
+	files, err := sketchRoot.ReadDir()
+	if err != nil {
+		return nil
+	}
+	files.FilterOutDirs()
+	files.FilterOutHiddenFiles()
+	files.FilterSuffix(".ino", ".pde")
+	if len(files) == 0 {
+		return nil
+	}
+	files.Sort()
+	return files
+}
+
+// reportMisnamedMainFile publishes a diagnostic on each of the given candidate main files,
+// with a quick-fix to rename it as the sketch folder, and keeps the language server in
+// degraded mode until the file is renamed (see renameMainFile).
+func (ls *INOLanguageServer) reportMisnamedMainFile(logger jsonrpc.FunctionLogger, mainFiles paths.PathList) {
+	ls.writeLock(logger, false)
+	ls.misnamedMainFiles = mainFiles
+	mainFileName := ls.sketchName + ".ino"
+	ls.writeUnlock(logger)
+
+	logger.Logf("The sketch has no main file %s, candidates: %s", mainFileName, mainFiles)
+	ls.setStartupFailure(logger, fmt.Sprintf("the main file of the sketch must be named %s", mainFileName))
+	for _, file := range mainFiles {
+		message := fmt.Sprintf("The main file of the sketch must be named as the sketch folder: rename %s to %s", file.Base(), mainFileName)
+		diag := newSketchDiagnostic(diagnosticCodeMisnamedMainFile, lsp.DiagnosticSeverityError, lsp.Range{}, message)
+		addDiagnosticCodeDescription(&diag, diagnosticCodeMisnamedMainFile)
+		if err := ls.publishIdeDiagnostics(logger, &lsp.PublishDiagnosticsParams{
+			URI:         lsp.NewDocumentURIFromPath(file),
+			Diagnostics: []lsp.Diagnostic{diag},
+		}); err != nil {
+			logger.Logf("Error sending diagnostics to IDE: %s", err)
+		}
+	}
+}
+
+// renameMainFileQuickFix returns a code action that renames the .ino file with the given
+// misnamed main file diagnostic as the sketch folder. lsp.WorkspaceEdit can't carry a file
+// rename, so the quick-fix runs the "arduino/renameMainFile" command instead.
+func (ls *INOLanguageServer) renameMainFileQuickFix(ideURI lsp.DocumentURI, ideDiag lsp.Diagnostic) lsp.CodeAction {
+	title := fmt.Sprintf("Rename %s to %s.ino", ideURI.AsPath().Base(), ls.sketchName)
+	return lsp.CodeAction{
+		Title:       title,
+		Kind:        lsp.CodeActionKindQuickFix,
+		Diagnostics: []lsp.Diagnostic{ideDiag},
+		IsPreferred: len(ls.misnamedMainFiles) == 1,
+		Command: &lsp.Command{
+			Title:     title,
+			Command:   renameMainFileCommand,
+			Arguments: []json.RawMessage{lsp.EncodeMessage(ideURI)},
+		},
+	}
+}
+
+// renameMainFile renames the .ino file given as argument of the "arduino/renameMainFile"
+// command as the sketch folder, and initializes the workbench again. The URI of the renamed
+// file is returned, so that the IDE can open it.
+func (ls *INOLanguageServer) renameMainFile(logger jsonrpc.FunctionLogger, arguments []interface{}) (lsp.DocumentURI, error) {
+	if len(arguments) != 1 {
+		return lsp.NilURI, fmt.Errorf("expected 1 argument (file URI), got %d", len(arguments))
+	}
+	uri, _ := arguments[0].(string)
+	fileURI, err := lsp.NewDocumentURIFromURL(uri)
+	if err != nil {
+		return lsp.NilURI, fmt.Errorf("invalid file URI: %v", arguments[0])
+	}
+
+	ls.writeLock(logger, false)
+	mainFiles := ls.misnamedMainFiles
+	file := fileURI.AsPath()
+	if !mainFiles.ContainsEquivalentTo(file) {
+		ls.writeUnlock(logger)
+		return lsp.NilURI, fmt.Errorf("%s is not a misnamed main file of the sketch", file)
+	}
+	mainFile := ls.sketchRoot.Join(ls.sketchName + ".ino")
+	if mainFile.Exist() {
+		ls.writeUnlock(logger)
+		return lsp.NilURI, fmt.Errorf("%s already exists", mainFile)
+	}
+	if err := file.Rename(mainFile); err != nil {
+		ls.writeUnlock(logger)
+		return lsp.NilURI, fmt.Errorf("renaming %s to %s: %w", file.Base(), mainFile.Base(), err)
+	}
+	logger.Logf("Renamed %s to %s", file, mainFile)
+	if _, tracked := ls.trackedIdeDocs[file.String()]; tracked {
+		// The file has been renamed behind the back of the IDE, that keeps it open: the
+		// document is tracked with the new name, as if the IDE sent workspace/didRenameFiles
+		ls.moveTrackedDoc(logger, file.String(), mainFile)
+	}
+	ls.misnamedMainFiles = nil
+	ls.startupFailure = ""
+	ideParams := ls.ideInitializeParams
+	ls.writeUnlock(logger)
+
+	for _, file := range mainFiles {
+		if err := ls.publishIdeDiagnostics(logger, &lsp.PublishDiagnosticsParams{
+			URI:         lsp.NewDocumentURIFromPath(file),
+			Diagnostics: []lsp.Diagnostic{},
+		}); err != nil {
+			logger.Logf("Error sending diagnostics to IDE: %s", err)
+		}
+	}
+	go ls.initializeWorkbench(ideParams)
+	return lsp.NewDocumentURIFromPath(mainFile), nil
+}
+
+// failIfMisnamedMainFile unwinds the handler of the IDE message with errMisnamedMainFile if
+// clangd has not been started because of a misnamed main file. The write lock is released.
+func (ls *INOLanguageServer) failIfMisnamedMainFile(logger jsonrpc.FunctionLogger) {
+	if ls.misnamedMainFiles == nil {
+		return
+	}
+	logger.Logf("clangd not started: the main file of the sketch is misnamed")
+	ls.writeUnlock(logger)
+	panic(errMisnamedMainFile)
+}
@@ -0,0 +1,95 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"go.bug.st/json"
+)
+
+func TestMisnamedMainFiles(t *testing.T) {
+	sketchRoot := paths.New(t.TempDir()).Join("Sketch")
+	require.NoError(t, sketchRoot.Join("src").MkdirAll())
+	require.Nil(t, misnamedMainFiles(sketchRoot, "Sketch"))
+
+	for _, file := range []string{"Blink.ino", "Old.pde", "Helper.h", ".Hidden.ino", "src/Other.ino"} {
+		require.NoError(t, sketchRoot.Join(file).WriteFile(nil))
+	}
+	require.Equal(t, paths.NewPathList(sketchRoot.Join("Blink.ino").String(), sketchRoot.Join("Old.pde").String()), misnamedMainFiles(sketchRoot, "Sketch"))
+
+	require.NoError(t, sketchRoot.Join("Sketch.ino").WriteFile(nil))
+	require.Nil(t, misnamedMainFiles(sketchRoot, "Sketch"))
+}
+
+func TestMisnamedMainFileDegradedMode(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.config = &Config{}
+	ls.IDE = &IDELSPServer{conn: lsp.NewServer(&bytes.Buffer{}, &bytes.Buffer{}, nil)}
+	ls.ideInitializeParams = &lsp.InitializeParams{}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	require.NoError(t, ls.sketchRoot.MkdirAll())
+	blink := ls.sketchRoot.Join("Blink.ino")
+	require.NoError(t, blink.WriteFile([]byte("void setup() {}\nvoid loop() {}\n")))
+	blinkURI := lsp.NewDocumentURIFromPath(blink)
+
+	mainFiles := misnamedMainFiles(ls.sketchRoot, ls.sketchName)
+	ls.reportMisnamedMainFile(logger, mainFiles)
+	require.Equal(t, "the main file of the sketch must be named Sketch.ino", ls.startupFailure)
+	diags := ls.publishedDiagnostics[blinkURI]
+	require.Len(t, diags, 1)
+	var code string
+	require.NoError(t, json.Unmarshal(diags[0].Code, &code))
+	require.Equal(t, diagnosticCodeMisnamedMainFile, code)
+
+	// The requests needing clangd fail, without closing the session
+	require.PanicsWithValue(t, errMisnamedMainFile, func() { ls.readLock(logger, true) })
+	ls.readLock(logger, false)
+	ls.readUnlock(logger)
+	// ...and the background tasks get an error
+	rebuild := func() (err error) {
+		defer recoverClangdUnavailable(&err)
+		ls.writeLock(logger, true)
+		defer ls.writeUnlock(logger)
+		return nil
+	}
+	require.ErrorIs(t, rebuild(), errMisnamedMainFile)
+
+	// The quick-fix runs the rename command on the file
+	fixes := ls.arduinoQuickFixes(logger, blinkURI, diags)
+	require.Len(t, fixes, 1)
+	fix := fixes[0].Get().(lsp.CodeAction)
+	require.Equal(t, "Rename Blink.ino to Sketch.ino", fix.Title)
+	require.True(t, fix.IsPreferred)
+	require.Equal(t, renameMainFileCommand, fix.Command.Command)
+	var argument string
+	require.NoError(t, json.Unmarshal(fix.Command.Arguments[0], &argument))
+
+	// Only the misnamed main files can be renamed, without overwriting the main file
+	_, err := ls.renameMainFile(logger, []interface{}{lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h")).String()})
+	require.ErrorContains(t, err, "is not a misnamed main file")
+	_, err = ls.renameMainFile(logger, []interface{}{})
+	require.Error(t, err)
+	require.NoError(t, ls.sketchRoot.Join("Sketch.ino").WriteFile(nil))
+	_, err = ls.renameMainFile(logger, []interface{}{argument})
+	require.ErrorContains(t, err, "already exists")
+	require.True(t, blink.Exist())
+}
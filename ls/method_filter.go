@@ -0,0 +1,104 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// MethodFilter selects the requests from the IDE that are forwarded to clangd, the other
+// requests are answered with an empty result. It allows to spare the resources of slow
+// machines from requests that are not useful for sketches.
+type MethodFilter struct {
+	// Allow, if not empty, lists the only methods forwarded to clangd
+	Allow []string
+	// Deny lists the methods never forwarded to clangd
+	Deny []string
+}
+
+// Forwards returns true if the requests with the given method must be forwarded to clangd
+func (f MethodFilter) Forwards(method string) bool {
+	for _, denied := range f.Deny {
+		if denied == method {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range f.Allow {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// workspaceSettings are the settings of the language server sent by the IDE with the
+// workspace/didChangeConfiguration notification.
+type workspaceSettings struct {
+	ArduinoLanguageServer *struct {
+		AllowMethods []string `json:"allowMethods"`
+		DenyMethods  []string `json:"denyMethods"`
+		// Fqbn, if not empty, selects another board
+		Fqbn string `json:"fqbn"`
+		// WorkspaceSymbolsFromCore, if set, includes the symbols of the platform in the
+		// workspace/symbol results
+		WorkspaceSymbolsFromCore *bool `json:"workspaceSymbolsFromCore"`
+	} `json:"arduinoLanguageServer"`
+}
+
+// methodForwarded returns true if the requests with the given method must be forwarded to clangd
+func (ls *INOLanguageServer) methodForwarded(logger jsonrpc.FunctionLogger, method string) bool {
+	ls.methodFilterMutex.Lock()
+	forwards := ls.methodFilter.Forwards(method)
+	ls.methodFilterMutex.Unlock()
+	if !forwards {
+		logger.Logf("%s disabled by configuration, replying with an empty result", method)
+	}
+	return forwards
+}
+
+func (ls *INOLanguageServer) workspaceDidChangeConfigurationNotifFromIDE(logger jsonrpc.FunctionLogger, params *lsp.DidChangeConfigurationParams) {
+	var settings workspaceSettings
+	if err := json.Unmarshal(params.Settings, &settings); err != nil {
+		logger.Logf("Ignoring invalid settings: %s", err)
+		return
+	}
+	if settings.ArduinoLanguageServer == nil {
+		return
+	}
+
+	filter := MethodFilter{
+		Allow: settings.ArduinoLanguageServer.AllowMethods,
+		Deny:  settings.ArduinoLanguageServer.DenyMethods,
+	}
+	logger.Logf("Methods filter updated: allow %v, deny %v", filter.Allow, filter.Deny)
+	ls.methodFilterMutex.Lock()
+	ls.methodFilter = filter
+	ls.methodFilterMutex.Unlock()
+
+	if fromCore := settings.ArduinoLanguageServer.WorkspaceSymbolsFromCore; fromCore != nil {
+		logger.Logf("Platform symbols in workspace/symbol results: %v", *fromCore)
+		ls.workspaceSymbolsFromCore.Store(*fromCore)
+	}
+
+	if fqbn := settings.ArduinoLanguageServer.Fqbn; fqbn != "" {
+		ls.selectBoard(logger, fqbn)
+	}
+}
@@ -0,0 +1,58 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestMethodFilter(t *testing.T) {
+	require.True(t, MethodFilter{}.Forwards("textDocument/hover"))
+
+	deny := MethodFilter{Deny: []string{"textDocument/documentHighlight"}}
+	require.False(t, deny.Forwards("textDocument/documentHighlight"))
+	require.True(t, deny.Forwards("textDocument/hover"))
+
+	allow := MethodFilter{Allow: []string{"textDocument/completion", "textDocument/hover"}, Deny: []string{"textDocument/hover"}}
+	require.True(t, allow.Forwards("textDocument/completion"))
+	require.False(t, allow.Forwards("textDocument/hover"))
+	require.False(t, allow.Forwards("textDocument/documentHighlight"))
+}
+
+func TestWorkspaceDidChangeConfiguration(t *testing.T) {
+	ls := &INOLanguageServer{methodFilter: MethodFilter{Deny: []string{"textDocument/hover"}}}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	// settings of other servers are ignored
+	ls.workspaceDidChangeConfigurationNotifFromIDE(logger, &lsp.DidChangeConfigurationParams{Settings: []byte(`{"other": {}}`)})
+	require.False(t, ls.methodForwarded(logger, "textDocument/hover"))
+
+	ls.workspaceDidChangeConfigurationNotifFromIDE(logger, &lsp.DidChangeConfigurationParams{
+		Settings: []byte(`{"arduinoLanguageServer": {"denyMethods": ["textDocument/documentHighlight"]}}`),
+	})
+	require.True(t, ls.methodForwarded(logger, "textDocument/hover"))
+	require.False(t, ls.methodForwarded(logger, "textDocument/documentHighlight"))
+	require.False(t, ls.workspaceSymbolsFromCore.Load())
+
+	ls.workspaceDidChangeConfigurationNotifFromIDE(logger, &lsp.DidChangeConfigurationParams{
+		Settings: []byte(`{"arduinoLanguageServer": {"workspaceSymbolsFromCore": true}}`),
+	})
+	require.True(t, ls.workspaceSymbolsFromCore.Load())
+}
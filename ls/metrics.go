@@ -0,0 +1,46 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// Metrics is the response to the custom "arduino/getMetrics" request
+type Metrics struct {
+	// ClangdRequestsInFlight is the number of requests currently processed by clangd
+	ClangdRequestsInFlight int `json:"clangdRequestsInFlight"`
+	// ClangdRequestsQueued is the number of requests waiting to be sent to clangd
+	ClangdRequestsQueued int `json:"clangdRequestsQueued"`
+	// ClangdRequestsLimit is the max number of concurrent requests to clangd (0 if unlimited)
+	ClangdRequestsLimit int `json:"clangdRequestsLimit"`
+	// LastRebuild is the breakdown of the duration of the last build of the sketch (nil if
+	// no build has been completed yet)
+	LastRebuild *RebuildTimings `json:"lastRebuild,omitempty"`
+}
+
+func (ls *INOLanguageServer) getMetricsReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*Metrics, *jsonrpc.ResponseError) {
+	metrics := &Metrics{
+		ClangdRequestsInFlight: ls.clangdRequests.InFlight(),
+		ClangdRequestsQueued:   ls.clangdRequests.Queued(),
+		ClangdRequestsLimit:    ls.clangdRequests.Limit(),
+		LastRebuild:            ls.lastRebuildTimings.Load(),
+	}
+	logger.Logf("<-- getMetrics(%d in-flight, %d queued)", metrics.ClangdRequestsInFlight, metrics.ClangdRequestsQueued)
+	return metrics, nil
+}
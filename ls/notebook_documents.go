@@ -0,0 +1,59 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// notebookDocumentMethods are the notebook synchronization notifications of LSP 3.17, sent
+// by some clients even if the notebooks are not supported by the language server
+var notebookDocumentMethods = []string{
+	"notebookDocument/didOpen",
+	"notebookDocument/didChange",
+	"notebookDocument/didSave",
+	"notebookDocument/didClose",
+}
+
+// registerNotebookDocumentMethods answers the notebook methods locally: go-lsp doesn't know
+// about them, and they can't be forwarded to clangd anyway. The notifications are dropped
+// and the requests (for clients probing the methods) are answered with MethodNotFound.
+func registerNotebookDocumentMethods(conn *lsp.Server) {
+	for _, method := range notebookDocumentMethods {
+		conn.RegisterCustomNotification(method, notebookDocumentNotification(method))
+		conn.RegisterCustomRequest(method, notebookDocumentRequest(method))
+	}
+}
+
+func notebookDocumentNotification(method string) lsp.CustomNotification {
+	return func(logger jsonrpc.FunctionLogger, raw json.RawMessage) {
+		logger.Logf("Notebook documents are not supported: %s ignored", method)
+	}
+}
+
+func notebookDocumentRequest(method string) lsp.CustomRequest {
+	return func(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (interface{}, *jsonrpc.ResponseError) {
+		return nil, &jsonrpc.ResponseError{
+			Code:    jsonrpc.ErrorCodesMethodNotFound,
+			Message: fmt.Sprintf("notebook documents are not supported: %s", method),
+		}
+	}
+}
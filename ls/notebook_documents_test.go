@@ -0,0 +1,44 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestNotebookDocumentMethods(t *testing.T) {
+	frame := func(body string) string {
+		return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	in := frame(`{"jsonrpc":"2.0","method":"notebookDocument/didOpen","params":{}}`) +
+		frame(`{"jsonrpc":"2.0","id":1,"method":"notebookDocument/didChange","params":{}}`)
+	var out bytes.Buffer
+	conn := lsp.NewServer(strings.NewReader(in), &out, nil)
+	registerNotebookDocumentMethods(conn)
+	conn.Run()
+
+	// Only the request is answered
+	require.Equal(t, 1, strings.Count(out.String(), "Content-Length"))
+	require.Contains(t, out.String(), `"id":1`)
+	require.Contains(t, out.String(), `"code":-32601`)
+	require.Contains(t, out.String(), "notebookDocument/didChange")
+}
@@ -0,0 +1,60 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// OfflineEnv is the environment of arduino-cli in offline mode: the connections go through a
+// proxy on a closed port, so the operations that would access the network (like downloading
+// a missing index) fail immediately instead of stalling until the connection times out.
+var OfflineEnv = []string{
+	"ARDUINO_NETWORK_PROXY=http://127.0.0.1:1",
+	"ARDUINO_UPDATER_ENABLE_NOTIFICATION=false",
+}
+
+// offlineIndexes are the indexes that arduino-cli downloads, when missing, to initialize
+var offlineIndexes = []string{"package_index.json", "library_index.json"}
+
+// checkOfflineData checks, in offline mode, that the data needed to build the sketch is
+// available: arduino-cli would otherwise try to download it.
+func (ls *INOLanguageServer) checkOfflineData(logger jsonrpc.FunctionLogger) error {
+	dataFolder, err := ls.extractDataFolderFromArduinoCLI(logger)
+	if err != nil {
+		return fmt.Errorf("retrieving data folder from arduino-cli: %w", err)
+	}
+	if missing := missingOfflineIndexes(dataFolder); len(missing) > 0 {
+		return fmt.Errorf("offline mode: %s not found in %s, update the indexes with arduino-cli (core update-index and lib update-index) while connected to the network",
+			strings.Join(missing, ", "), dataFolder)
+	}
+	return nil
+}
+
+// missingOfflineIndexes returns the indexes missing in the given data folder
+func missingOfflineIndexes(dataFolder *paths.Path) []string {
+	missing := []string{}
+	for _, index := range offlineIndexes {
+		if !dataFolder.Join(index).Exist() {
+			missing = append(missing, index)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,34 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingOfflineIndexes(t *testing.T) {
+	dataFolder := paths.New(t.TempDir())
+	require.Equal(t, []string{"package_index.json", "library_index.json"}, missingOfflineIndexes(dataFolder))
+
+	require.NoError(t, dataFolder.Join("package_index.json").WriteFile([]byte("{}")))
+	require.Equal(t, []string{"library_index.json"}, missingOfflineIndexes(dataFolder))
+
+	require.NoError(t, dataFolder.Join("library_index.json").WriteFile([]byte("{}")))
+	require.Empty(t, missingOfflineIndexes(dataFolder))
+}
@@ -0,0 +1,85 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"sync"
+
+	"github.com/arduino/arduino-language-server/streams"
+)
+
+// orderedQueue runs the queued functions one at a time, in the order they have been
+// queued, on a goroutine of its own.
+//
+// The messages coming from the IDE and from clangd are dispatched by go-lsp in the
+// order they are received, on the goroutine reading the connection. The handlers that
+// must not block that goroutine (for example because they wait for the lock held by a
+// request waiting a response from clangd) are queued here instead of being run on a new
+// goroutine each, that wouldn't keep their order: the diagnostics of an older version
+// of a document could be processed after the ones of the current version.
+type orderedQueue struct {
+	mux     sync.Mutex
+	cond    *sync.Cond
+	pending []func()
+	closed  bool
+}
+
+// newOrderedQueue creates an orderedQueue and starts processing it
+func newOrderedQueue() *orderedQueue {
+	q := &orderedQueue{}
+	q.cond = sync.NewCond(&q.mux)
+	go q.run()
+	return q
+}
+
+// Push queues a function, it never blocks
+func (q *orderedQueue) Push(f func()) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.closed {
+		return
+	}
+	q.pending = append(q.pending, f)
+	q.cond.Signal()
+}
+
+// Close stops the processing of the queue once the functions already queued are done
+func (q *orderedQueue) Close() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.closed = true
+	q.cond.Signal()
+}
+
+func (q *orderedQueue) run() {
+	defer streams.CatchAndLogPanic()
+	for {
+		q.mux.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.pending) == 0 {
+			q.mux.Unlock()
+			return
+		}
+		f := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.mux.Unlock()
+
+		f()
+	}
+}
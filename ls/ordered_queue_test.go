@@ -0,0 +1,116 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+func TestOrderedQueue(t *testing.T) {
+	q := newOrderedQueue()
+
+	var mux sync.Mutex
+	done := []int{}
+	for i := 0; i < 1000; i++ {
+		i := i
+		q.Push(func() {
+			if i%100 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			mux.Lock()
+			done = append(done, i)
+			mux.Unlock()
+		})
+	}
+
+	finished := make(chan bool)
+	q.Push(func() { close(finished) })
+	q.Close()
+	q.Push(func() { t.Error("function queued after Close has been run") })
+
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "queue not processed")
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	require.Len(t, done, 1000)
+	for i, n := range done {
+		require.Equal(t, i, n)
+	}
+}
+
+// orderRecorder records the document version seen by the requests coming from the IDE
+type orderRecorder struct {
+	lsp.ClientMessagesHandler
+	mux     sync.Mutex
+	version int
+	seen    []int
+}
+
+func (r *orderRecorder) TextDocumentDidChange(logger jsonrpc.FunctionLogger, params *lsp.DidChangeTextDocumentParams) {
+	// Make the notifications slower than the requests
+	time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+	r.mux.Lock()
+	r.version = params.TextDocument.Version
+	r.mux.Unlock()
+}
+
+func (r *orderRecorder) TextDocumentHover(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.HoverParams) (*lsp.Hover, *jsonrpc.ResponseError) {
+	r.mux.Lock()
+	r.seen = append(r.seen, r.version)
+	r.mux.Unlock()
+	return nil, nil
+}
+
+// TestIDEMessagesOrder verifies the guarantee the language server relies upon when
+// handling the messages from the IDE: a request is processed after all the
+// notifications received before it, and before the ones received after it.
+func TestIDEMessagesOrder(t *testing.T) {
+	var in bytes.Buffer
+	send := func(msg string) {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(msg), msg)
+	}
+	for v := 1; v <= 500; v++ {
+		send(fmt.Sprintf(`{"jsonrpc":"2.0","method":"textDocument/didChange","params":`+
+			`{"textDocument":{"uri":"file:///tmp/Sketch/Sketch.ino","version":%d},"contentChanges":[{"text":""}]}}`, v))
+		send(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"textDocument/hover","params":`+
+			`{"textDocument":{"uri":"file:///tmp/Sketch/Sketch.ino"},"position":{"line":0,"character":0}}}`, v))
+	}
+
+	recorder := &orderRecorder{}
+	server := lsp.NewServer(&in, io.Discard, recorder)
+	server.Run() // returns at the end of the input
+
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	require.Len(t, recorder.seen, 500)
+	for i, version := range recorder.seen {
+		require.Equal(t, i+1, version)
+	}
+}
@@ -0,0 +1,237 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+var (
+	includeLineRegexp = regexp.MustCompile(`^\s*#\s*include\s*([<"])([^>"]+)[>"]`)
+	pragmaOnceRegexp  = regexp.MustCompile(`^\s*#\s*pragma\s+once\b`)
+	guardIfndefRegexp = regexp.MustCompile(`^\s*#\s*ifndef\s+(\w+)`)
+	guardDefineRegexp = regexp.MustCompile(`^\s*#\s*define\s+(\w+)`)
+)
+
+// includeGroup returns the position of an include in the Arduino ordering: Arduino.h
+// first, then the libraries (included with <...>) and then the local headers ("...").
+func includeGroup(line string) int {
+	match := includeLineRegexp.FindStringSubmatch(line)
+	switch {
+	case match[2] == "Arduino.h":
+		return 0
+	case match[1] == "<":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// organizeIncludesEdits returns the edits ordering each block of consecutive #include
+// lines of the given text (removing the duplicates) and, for the header files, adding a
+// #pragma once if the header has no guard. The includes separated by other lines (for
+// example conditional ones) are not moved across them.
+func organizeIncludesEdits(text string, header bool) []lsp.TextEdit {
+	lines := strings.Split(text, "\n")
+	content := func(i int) string { return strings.TrimSuffix(lines[i], "\r") }
+	eol := "\n"
+	if strings.HasSuffix(lines[0], "\r") {
+		eol = "\r\n"
+	}
+
+	guard := ""
+	guardLine := -1
+	if header {
+		if line, ok := missingHeaderGuardLine(lines); ok {
+			guard = "#pragma once" + eol + eol
+			guardLine = line
+		}
+	}
+
+	edits := []lsp.TextEdit{}
+	for start := 0; start < len(lines); start++ {
+		if !includeLineRegexp.MatchString(content(start)) {
+			if start == guardLine {
+				edits = append(edits, lsp.TextEdit{Range: lsp.Range{Start: lsp.Position{Line: start}, End: lsp.Position{Line: start}}, NewText: guard})
+			}
+			continue
+		}
+		end := start
+		for end+1 < len(lines) && includeLineRegexp.MatchString(content(end+1)) {
+			end++
+		}
+
+		block := []string{}
+		seen := map[string]bool{}
+		for i := start; i <= end; i++ {
+			if trimmed := strings.TrimSpace(content(i)); !seen[trimmed] {
+				seen[trimmed] = true
+				block = append(block, content(i))
+			}
+		}
+		sort.SliceStable(block, func(i, j int) bool { return includeGroup(block[i]) < includeGroup(block[j]) })
+
+		newText := strings.Join(block, eol)
+		original := []string{}
+		for i := start; i <= end; i++ {
+			original = append(original, content(i))
+		}
+		if start == guardLine {
+			newText = guard + newText
+		} else if newText == strings.Join(original, eol) {
+			start = end
+			continue
+		}
+		edits = append(edits, lsp.TextEdit{
+			Range: lsp.Range{
+				Start: lsp.Position{Line: start},
+				End:   lsp.Position{Line: end, Character: len(utf16.Encode([]rune(content(end))))},
+			},
+			NewText: newText,
+		})
+		start = end
+	}
+	return edits
+}
+
+// missingHeaderGuardLine returns the line where a #pragma once should be added, after the
+// leading comments, if the header has neither a #pragma once nor an #ifndef/#define guard.
+// Nothing is added to the headers without code.
+func missingHeaderGuardLine(lines []string) (int, bool) {
+	significant := []int{}
+	inComment := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if inComment {
+			if strings.Contains(trimmed, "*/") {
+				inComment = false
+			}
+			continue
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "//") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "/*") {
+			if !strings.Contains(trimmed, "*/") {
+				inComment = true
+			}
+			continue
+		}
+		significant = append(significant, i)
+		if len(significant) == 2 {
+			break
+		}
+	}
+	if len(significant) == 0 {
+		return 0, false
+	}
+	first := lines[significant[0]]
+	if pragmaOnceRegexp.MatchString(first) {
+		return 0, false
+	}
+	if ifndef := guardIfndefRegexp.FindStringSubmatch(first); ifndef != nil && len(significant) == 2 {
+		if define := guardDefineRegexp.FindStringSubmatch(lines[significant[1]]); define != nil && define[1] == ifndef[1] {
+			return 0, false
+		}
+	}
+	return significant[0], true
+}
+
+// applyTextEdits returns the text with the given (non overlapping) edits applied
+func applyTextEdits(text string, edits []lsp.TextEdit) (string, error) {
+	sorted := append([]lsp.TextEdit{}, edits...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Range.Start, sorted[j].Range.Start
+		return a.Line > b.Line || (a.Line == b.Line && a.Character > b.Character)
+	})
+	for _, edit := range sorted {
+		res, err := textutils.ApplyTextChange(text, edit.Range, edit.NewText)
+		if err != nil {
+			return "", err
+		}
+		text = res
+	}
+	return text, nil
+}
+
+// codeActionKindRequested returns true if the IDE asked for the given kind of code actions
+func codeActionKindRequested(only []lsp.CodeActionKind, kind lsp.CodeActionKind) bool {
+	if len(only) == 0 {
+		return true
+	}
+	for _, requested := range only {
+		if kind == requested || strings.HasPrefix(string(kind), string(requested)+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// organizeIncludesCodeAction returns the source.organizeImports code action of a sketch
+// file, if its includes need to be organized. The caller must hold the lock.
+func (ls *INOLanguageServer) organizeIncludesCodeAction(logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI, only []lsp.CodeActionKind) []lsp.CommandOrCodeAction {
+	if !codeActionKindRequested(only, lsp.CodeActionKindSourceOrganizeImports) {
+		return nil
+	}
+	doc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]
+	if !ok || !ls.ideURIIsPartOfTheSketch(ideURI) {
+		return nil
+	}
+	edits := organizeIncludesEdits(doc.Text, isHeaderFile(ideURI.AsPath()))
+	if len(edits) == 0 {
+		return nil
+	}
+	logger.Logf("        > Arduino organize includes: %d edits", len(edits))
+	item := lsp.CommandOrCodeAction{}
+	item.Set(lsp.CodeAction{
+		Title: "Organize includes",
+		Kind:  lsp.CodeActionKindSourceOrganizeImports,
+		Edit: &lsp.WorkspaceEdit{
+			Changes: map[lsp.DocumentURI][]lsp.TextEdit{ideURI: edits},
+		},
+	})
+	return []lsp.CommandOrCodeAction{item}
+}
+
+// organizeFormattedIncludes applies the organize includes pass to the result of the
+// formatting of a sketch file: if the includes are changed, a single edit replacing the
+// whole document is returned. The caller must hold the lock.
+func (ls *INOLanguageServer) organizeFormattedIncludes(ideURI lsp.DocumentURI, edits []lsp.TextEdit) ([]lsp.TextEdit, error) {
+	doc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]
+	if !ok || !ls.ideURIIsPartOfTheSketch(ideURI) {
+		return edits, nil
+	}
+	formatted, err := applyTextEdits(doc.Text, edits)
+	if err != nil {
+		return nil, err
+	}
+	organizeEdits := organizeIncludesEdits(formatted, isHeaderFile(ideURI.AsPath()))
+	if len(organizeEdits) == 0 {
+		return edits, nil
+	}
+	organized, err := applyTextEdits(formatted, organizeEdits)
+	if err != nil {
+		return nil, err
+	}
+	return []lsp.TextEdit{{Range: fullDocumentRange(doc.Text), NewText: organized}}, nil
+}
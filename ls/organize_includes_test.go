@@ -0,0 +1,103 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestOrganizeIncludesEdits(t *testing.T) {
+	organize := func(text string, header bool) string {
+		res, err := applyTextEdits(text, organizeIncludesEdits(text, header))
+		require.NoError(t, err)
+		return res
+	}
+
+	// Arduino.h first, then the libraries and the local headers
+	require.Equal(t,
+		"#include <Arduino.h>\n#include <Servo.h>\n#include <Wire.h>\n#include \"config.h\"\n\nvoid setup() {}\n",
+		organize("#include \"config.h\"\n#include <Servo.h>\n#include <Arduino.h>\n#include <Wire.h>\n#include <Servo.h>\n\nvoid setup() {}\n", false))
+
+	// The blocks are ordered separately, the line endings are kept
+	require.Equal(t,
+		"#include <Wire.h>\r\n#include \"a.h\" // local\r\n#ifdef DEBUG\r\n#include <Arduino.h>\r\n#include \"debug.h\"\r\n#endif",
+		organize("#include \"a.h\" // local\r\n#include <Wire.h>\r\n#ifdef DEBUG\r\n#include \"debug.h\"\r\n#include <Arduino.h>\r\n#endif", false))
+
+	// Nothing to do
+	require.Empty(t, organizeIncludesEdits("#include <Arduino.h>\n#include \"a.h\"\n", false))
+	require.Empty(t, organizeIncludesEdits("#pragma once\n#include <Arduino.h>\n", true))
+	require.Empty(t, organizeIncludesEdits("// Guard\n#ifndef HELPER_H\n\n#define HELPER_H\nvoid helper();\n#endif\n", true))
+	require.Empty(t, organizeIncludesEdits("/* Empty header */\n", true))
+
+	// The missing guard is added after the leading comments
+	require.Equal(t,
+		"/*\n * Helper\n */\n#pragma once\n\n#include <Arduino.h>\n#include \"a.h\"\nvoid helper();\n",
+		organize("/*\n * Helper\n */\n#include \"a.h\"\n#include <Arduino.h>\nvoid helper();\n", true))
+	require.Equal(t,
+		"#pragma once\n\nvoid helper();\n",
+		organize("void helper();\n", true))
+	require.Equal(t,
+		"#pragma once\n\n#ifndef OTHER_H\n#define HELPER_H\n#endif\n",
+		organize("#ifndef OTHER_H\n#define HELPER_H\n#endif\n", true))
+}
+
+func TestCodeActionKindRequested(t *testing.T) {
+	require.True(t, codeActionKindRequested(nil, lsp.CodeActionKindSourceOrganizeImports))
+	require.True(t, codeActionKindRequested([]lsp.CodeActionKind{lsp.CodeActionKindSource}, lsp.CodeActionKindSourceOrganizeImports))
+	require.True(t, codeActionKindRequested([]lsp.CodeActionKind{lsp.CodeActionKindSourceOrganizeImports}, lsp.CodeActionKindSourceOrganizeImports))
+	require.False(t, codeActionKindRequested([]lsp.CodeActionKind{lsp.CodeActionKindQuickFix}, lsp.CodeActionKindSourceOrganizeImports))
+	require.False(t, codeActionKindRequested([]lsp.CodeActionKind{"sourc"}, lsp.CodeActionKindSourceOrganizeImports))
+}
+
+func TestOrganizeIncludesCodeAction(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	ino := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	helper := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h"))
+
+	// The includes of the sketch are already organized
+	require.Empty(t, ls.organizeIncludesCodeAction(logger, ino, nil))
+	require.Empty(t, ls.organizeIncludesCodeAction(logger, helper, nil))
+
+	ls.trackedIdeDocs[helper.AsPath().String()] = lsp.TextDocumentItem{URI: helper, Text: "#include \"Other.h\"\n#include <Arduino.h>\nvoid helper();\n"}
+	require.Empty(t, ls.organizeIncludesCodeAction(logger, helper, []lsp.CodeActionKind{lsp.CodeActionKindQuickFix}))
+	actions := ls.organizeIncludesCodeAction(logger, helper, []lsp.CodeActionKind{lsp.CodeActionKindSource})
+	require.Len(t, actions, 1)
+	action := actions[0].Get().(lsp.CodeAction)
+	require.Equal(t, lsp.CodeActionKindSourceOrganizeImports, action.Kind)
+	require.Equal(t, []lsp.TextEdit{{
+		Range:   testRange(0, 0, 1, 20),
+		NewText: "#pragma once\n\n#include <Arduino.h>\n#include \"Other.h\"",
+	}}, action.Edit.Changes[helper])
+
+	// The formatting edits are merged with the organized includes
+	edits, err := ls.organizeFormattedIncludes(helper, []lsp.TextEdit{{Range: testRange(2, 0, 2, 0), NewText: "// Helper\n"}})
+	require.NoError(t, err)
+	require.Equal(t, []lsp.TextEdit{{
+		Range:   testRange(0, 0, 3, 0),
+		NewText: "#pragma once\n\n#include <Arduino.h>\n#include \"Other.h\"\n// Helper\nvoid helper();\n",
+	}}, edits)
+
+	// The formatting edits are returned as is if the includes are already organized
+	formatting := []lsp.TextEdit{{Range: testRange(0, 0, 0, 0), NewText: "\n"}}
+	edits, err = ls.organizeFormattedIncludes(ino, formatting)
+	require.NoError(t, err)
+	require.Equal(t, formatting, edits)
+}
@@ -0,0 +1,93 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+
+	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// MappedPosition is the response to the custom "arduino/inoToCppPosition" and
+// "arduino/cppToInoPosition" requests, a position moved between an .ino tab and the
+// preprocessed sketch
+type MappedPosition struct {
+	URI      lsp.DocumentURI `json:"uri"`
+	Position lsp.Position    `json:"position"`
+	// Version is the version of the document the position refers to: the version of the
+	// preprocessed sketch (see arduino/previewGeneratedSketch) or of the .ino tab (0 if
+	// not open in the IDE)
+	Version int `json:"version"`
+}
+
+// inoToCppPositionReqFromIDE moves a position of an .ino tab to the preprocessed sketch
+func (ls *INOLanguageServer) inoToCppPositionReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.TextDocumentPositionParams) (*MappedPosition, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	if ls.sketchMapper == nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: "the sketch has not been preprocessed yet"}
+	}
+	ideURI := ideParams.TextDocument.URI
+	if ideURI.Ext() != ".ino" || !ls.ideURIIsPartOfTheSketch(ideURI) {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: "not an .ino file of the sketch: " + ideURI.String()}
+	}
+	clangURI, clangPosition, err := ls.ide2ClangPosition(logger, ideURI, ideParams.Position)
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, responseError(err)
+	}
+	logger.Logf("<-- inoToCppPosition(%s:%s -> %s:%s)", ideURI, ideParams.Position, clangURI, clangPosition)
+	return &MappedPosition{URI: clangURI, Position: clangPosition, Version: ls.sketchMapper.CppText.Version}, nil
+}
+
+// cppToInoPositionReqFromIDE moves a position of the preprocessed sketch (given with the
+// URI of the file in the build folder or of its preview) to the .ino tab it comes from. The
+// response is null for the code generated by the Arduino preprocessor.
+func (ls *INOLanguageServer) cppToInoPositionReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.TextDocumentPositionParams) (*MappedPosition, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	if ls.sketchMapper == nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: "the sketch has not been preprocessed yet"}
+	}
+	cppURI := ideParams.TextDocument.URI
+	if !isPreviewGeneratedSketchURI(cppURI) && !ls.clangURIRefersToIno(cppURI) {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: "not the preprocessed sketch: " + cppURI.String()}
+	}
+	cppLine := ideParams.Position.Line
+	inoPath, inoLine, ok := ls.sketchMapper.CppToInoLineOk(cppLine)
+	if !ok || inoPath == sourcemapper.NotIno.File || ls.sketchMapper.IsPreprocessedCppLine(cppLine) {
+		logger.Logf("<-- cppToInoPosition(%s:%s): generated code", cppURI, ideParams.Position)
+		return nil, nil
+	}
+	ideURI, err := ls.idePathToIdeURI(logger, inoPath)
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, responseError(err)
+	}
+	res := &MappedPosition{
+		URI:      ideURI,
+		Position: lsp.Position{Line: inoLine, Character: ideParams.Position.Character},
+	}
+	if doc, tracked := ls.trackedIdeDocs[inoPath]; tracked {
+		res.Version = doc.Version
+	}
+	logger.Logf("<-- cppToInoPosition(%s:%s -> %s:%s)", cppURI, ideParams.Position, res.URI, res.Position)
+	return res, nil
+}
@@ -0,0 +1,69 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+func TestPositionMapping(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	ctx := context.Background()
+	ino := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	cpp := lsp.NewDocumentURIFromPath(ls.buildSketchCpp)
+	ls.sketchMapper.CppText.Version = 3
+	positionParams := func(uri lsp.DocumentURI, line, character int) *lsp.TextDocumentPositionParams {
+		return &lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+			Position:     lsp.Position{Line: line, Character: character},
+		}
+	}
+
+	res, respErr := ls.inoToCppPositionReqFromIDE(ctx, logger, positionParams(ino, 1, 5))
+	require.Nil(t, respErr)
+	require.Equal(t, &MappedPosition{URI: cpp, Position: lsp.Position{Line: 3, Character: 5}, Version: 3}, res)
+
+	res, respErr = ls.cppToInoPositionReqFromIDE(ctx, logger, positionParams(cpp, 3, 5))
+	require.Nil(t, respErr)
+	require.Equal(t, &MappedPosition{URI: ino, Position: lsp.Position{Line: 1, Character: 5}}, res)
+
+	// The preview of the preprocessed sketch can be used too
+	preview, err := ls.previewGeneratedSketchURI()
+	require.NoError(t, err)
+	res, respErr = ls.cppToInoPositionReqFromIDE(ctx, logger, positionParams(preview, 2, 0))
+	require.Nil(t, respErr)
+	require.Equal(t, &MappedPosition{URI: ino, Position: lsp.Position{Line: 0, Character: 0}}, res)
+
+	// The code generated by the preprocessor has no .ino position
+	res, respErr = ls.cppToInoPositionReqFromIDE(ctx, logger, positionParams(cpp, 0, 0))
+	require.Nil(t, respErr)
+	require.Nil(t, res)
+
+	// Other documents are refused
+	_, respErr = ls.inoToCppPositionReqFromIDE(ctx, logger, positionParams(lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h")), 0, 0))
+	require.NotNil(t, respErr)
+	require.Equal(t, jsonrpc.ErrorCodesInvalidParams, respErr.Code)
+	_, respErr = ls.cppToInoPositionReqFromIDE(ctx, logger, positionParams(lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Helper.h")), 0, 0))
+	require.NotNil(t, respErr)
+	require.Equal(t, jsonrpc.ErrorCodesInvalidParams, respErr.Code)
+}
@@ -0,0 +1,81 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/vincecity/go-lsp"
+)
+
+// InvalidPositionError is an error when a position or a range sent by the IDE is not part
+// of the document, as tracked by the language server
+type InvalidPositionError struct {
+	URI     lsp.DocumentURI
+	Version int
+	Range   lsp.Range
+	Reason  string
+}
+
+func (e *InvalidPositionError) Error() string {
+	return fmt.Sprintf("invalid range %s in %s (version %d): %s", e.Range, e.URI, e.Version, e.Reason)
+}
+
+// validateIdeRange checks that the given range is part of the given document, before
+// mapping it to clangd. Following the LSP rules, a character beyond the end of the line
+// is moved back to the end of the line; for the same reason the position at the start of
+// the line after the last one, often used to select the whole document, is moved to the
+// end of the document. The positions that can't be fixed return an InvalidPositionError.
+func validateIdeRange(doc lsp.TextDocumentItem, rng lsp.Range) (lsp.Range, error) {
+	lines := textutils.SplitLines(doc.Text)
+	invalid := func(reason string, args ...interface{}) error {
+		return &InvalidPositionError{URI: doc.URI, Version: doc.Version, Range: rng, Reason: fmt.Sprintf(reason, args...)}
+	}
+	lineLength := func(line int) int {
+		return len(utf16.Encode([]rune(lines[line])))
+	}
+	validate := func(pos lsp.Position) (lsp.Position, error) {
+		if pos.Line < 0 || pos.Character < 0 {
+			return pos, invalid("negative position %s", pos)
+		}
+		if pos.Line == len(lines) && pos.Character == 0 {
+			last := len(lines) - 1
+			return lsp.Position{Line: last, Character: lineLength(last)}, nil
+		}
+		if pos.Line >= len(lines) {
+			return pos, invalid("line %d is beyond the end of the document (%d lines)", pos.Line, len(lines))
+		}
+		if length := lineLength(pos.Line); pos.Character > length {
+			pos.Character = length
+		}
+		return pos, nil
+	}
+
+	start, err := validate(rng.Start)
+	if err != nil {
+		return rng, err
+	}
+	end, err := validate(rng.End)
+	if err != nil {
+		return rng, err
+	}
+	if end.Line < start.Line || (end.Line == start.Line && end.Character < start.Character) {
+		return rng, invalid("the end precedes the start")
+	}
+	return lsp.Range{Start: start, End: end}, nil
+}
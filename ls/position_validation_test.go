@@ -0,0 +1,83 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+func TestValidateIdeRange(t *testing.T) {
+	doc := lsp.TextDocumentItem{
+		URI:     lsp.NewDocumentURI("/tmp/Sketch/Sketch.ino"),
+		Version: 3,
+		Text:    "void setup() {}\r\nvoid loop() {\n  Serial.print(\"€\");\n}",
+	}
+
+	// Valid ranges are left unchanged
+	rng, err := validateIdeRange(doc, testRange(0, 5, 1, 4))
+	require.NoError(t, err)
+	require.Equal(t, testRange(0, 5, 1, 4), rng)
+
+	// Characters beyond the end of the line (in UTF-16 code units, without the line
+	// terminator) are moved back to the end of the line
+	rng, err = validateIdeRange(doc, testRange(0, 0, 0, 100))
+	require.NoError(t, err)
+	require.Equal(t, testRange(0, 0, 0, 15), rng)
+	rng, err = validateIdeRange(doc, testRange(2, 18, 2, 30))
+	require.NoError(t, err)
+	require.Equal(t, testRange(2, 18, 2, 20), rng)
+
+	// The start of the line after the last one is the end of the document
+	rng, err = validateIdeRange(doc, testRange(0, 0, 4, 0))
+	require.NoError(t, err)
+	require.Equal(t, testRange(0, 0, 3, 1), rng)
+
+	for _, invalid := range []lsp.Range{
+		testRange(-1, 0, 0, 0),
+		testRange(0, -3, 0, 0),
+		testRange(0, 0, 4, 1),
+		testRange(10, 0, 10, 0),
+		testRange(1, 5, 1, 2),
+		testRange(2, 0, 1, 0),
+	} {
+		_, err := validateIdeRange(doc, invalid)
+		require.Error(t, err, "range %s", invalid)
+		respErr := responseError(err)
+		require.Equal(t, jsonrpc.ErrorCodesInvalidParams, respErr.Code)
+		require.Contains(t, respErr.Message, doc.URI.String())
+	}
+}
+
+func TestIde2ClangRangeValidation(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	ideURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+
+	// The range is clamped before being mapped to the preprocessed sketch
+	_, clangRange, err := ls.ide2ClangRange(logger, ideURI, testRange(1, 0, 1, 100))
+	require.NoError(t, err)
+	require.Equal(t, testRange(3, 0, 3, 14), clangRange)
+
+	_, _, err = ls.ide2ClangRange(logger, ideURI, testRange(20, 0, 20, 0))
+	var invalidPosition *InvalidPositionError
+	require.ErrorAs(t, err, &invalidPosition)
+	require.Equal(t, ideURI, invalidPosition.URI)
+}
@@ -0,0 +1,203 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// PredefinedMacros is the response to the custom "arduino/getPredefinedMacros" request, the
+// macros defined before the first line of the sketch is compiled for the selected board. The
+// IDE can tell with them which preprocessor conditionals are active.
+type PredefinedMacros struct {
+	// Fqbn is the board the sketch is compiled for
+	Fqbn string `json:"fqbn"`
+	// Defines are the macros defined with -D in the compile command of the sketch, in the
+	// order they are defined
+	Defines []Macro `json:"defines"`
+	// BuiltIns are the macros predefined by the compiler of the board with the flags of the
+	// sketch, sorted by name (empty if the compiler could not be run)
+	BuiltIns []Macro `json:"builtIns"`
+}
+
+// Macro is a preprocessor macro
+type Macro struct {
+	// Name is the name of the macro, followed by its parameters for the function-like macros
+	Name string `json:"name"`
+	// Value is the replacement list of the macro
+	Value string `json:"value"`
+}
+
+// builtInMacroRegexp matches a line of the output of "gcc -dM -E"
+var builtInMacroRegexp = regexp.MustCompile(`^#define (\w+(?:\([^)]*\))?)(?: (.*))?$`)
+
+// compileCommandDefines returns the macros defined (and not undefined afterwards) by the -D
+// and -U arguments of a compile command. A macro defined without a value is defined as 1, as
+// done by the compiler.
+func compileCommandDefines(args []string) []Macro {
+	defines := []Macro{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if (arg == "-D" || arg == "-U") && i+1 < len(args) {
+			i++
+			arg += args[i]
+		}
+		switch {
+		case strings.HasPrefix(arg, "-D") && len(arg) > 2:
+			name, value, hasValue := strings.Cut(arg[2:], "=")
+			if !hasValue {
+				value = "1"
+			}
+			defines = removeMacro(defines, name)
+			defines = append(defines, Macro{Name: name, Value: value})
+		case strings.HasPrefix(arg, "-U") && len(arg) > 2:
+			defines = removeMacro(defines, arg[2:])
+		}
+	}
+	return defines
+}
+
+func removeMacro(macros []Macro, name string) []Macro {
+	res := macros[:0]
+	for _, macro := range macros {
+		if macro.Name != name {
+			res = append(res, macro)
+		}
+	}
+	return res
+}
+
+// builtInMacrosArguments returns the arguments to run the compiler of the given compile
+// command, so that it prints the macros it predefines: the flags affecting the generated code
+// are kept, the macros defined on the command line, the include paths, the dependency files
+// and the input and output files are removed. The given empty file is preprocessed instead.
+func builtInMacrosArguments(cmd *compileCommand, emptyFile *paths.Path) []string {
+	args := []string{cmd.Arguments[0]}
+	for i := 1; i < len(cmd.Arguments); i++ {
+		arg := cmd.Arguments[i]
+		switch {
+		case arg == "-o", arg == "-MF", arg == "-MT", arg == "-MQ", arg == "-include", arg == "-imacros",
+			arg == "-isystem", arg == "-iquote", arg == "-idirafter", arg == "-iprefix", arg == "-D", arg == "-U", arg == "-I":
+			i++ // Skip the value too
+		case arg == "-c", arg == cmd.File, strings.HasPrefix(arg, "-M"),
+			strings.HasPrefix(arg, "-D"), strings.HasPrefix(arg, "-U"), strings.HasPrefix(arg, "-I"), strings.HasPrefix(arg, "@"):
+		default:
+			args = append(args, arg)
+		}
+	}
+	language := "c++"
+	if strings.HasSuffix(cmd.File, ".c") {
+		language = "c"
+	}
+	return append(args, "-dM", "-E", "-x", language, emptyFile.String())
+}
+
+// parseBuiltInMacros parses the output of "gcc -dM -E", the macros are sorted by name
+func parseBuiltInMacros(output []byte) []Macro {
+	macros := []Macro{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if match := builtInMacroRegexp.FindStringSubmatch(scanner.Text()); match != nil {
+			macros = append(macros, Macro{Name: match[1], Value: match[2]})
+		}
+	}
+	sort.Slice(macros, func(i, j int) bool { return macros[i].Name < macros[j].Name })
+	return macros
+}
+
+// sketchCompileCommand returns the compile command of the preprocessed sketch from the
+// compilation database of the last build. The caller must hold the read lock.
+func (ls *INOLanguageServer) sketchCompileCommand() (*compileCommand, error) {
+	db, err := loadCompilationDatabase(clangdCompilationDatabaseDir(ls.buildPath).Join("compile_commands.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading compile_commands.json: %w", err)
+	}
+	for i, cmd := range db.Contents {
+		if len(cmd.Arguments) > 0 && paths.New(cmd.File).EquivalentTo(ls.buildSketchCpp) {
+			return &db.Contents[i], nil
+		}
+	}
+	return nil, fmt.Errorf("the compile command of the sketch has not been found")
+}
+
+// builtInMacros runs the compiler of the given compile command to get the macros it
+// predefines. The result is kept until the flags of the compile command change.
+func (ls *INOLanguageServer) builtInMacros(ctx context.Context, logger jsonrpc.FunctionLogger, cmd *compileCommand) ([]Macro, error) {
+	emptyFile := ls.tempDir.Join("builtin-macros", "empty")
+	args := builtInMacrosArguments(cmd, emptyFile)
+	key := strings.Join(args, "\x00")
+
+	ls.builtInMacrosMutex.Lock()
+	defer ls.builtInMacrosMutex.Unlock()
+	if ls.builtInMacrosKey == key {
+		return ls.builtInMacrosCache, nil
+	}
+
+	if err := emptyFile.Parent().MkdirAll(); err != nil {
+		return nil, err
+	}
+	if err := emptyFile.WriteFile(nil); err != nil {
+		return nil, err
+	}
+	proc, err := paths.NewProcess(ls.toolsEnv(), args...)
+	if err != nil {
+		return nil, err
+	}
+	proc.SetDirFromPath(paths.New(cmd.Directory))
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	proc.RedirectStdoutTo(stdout)
+	proc.RedirectStderrTo(stderr)
+	logger.Logf("running: %s", strings.Join(args, " "))
+	if err := proc.RunWithinContext(ctx); err != nil {
+		return nil, fmt.Errorf("running %s: %w: %s", args[0], err, stderr)
+	}
+	ls.builtInMacrosKey, ls.builtInMacrosCache = key, parseBuiltInMacros(stdout.Bytes())
+	return ls.builtInMacrosCache, nil
+}
+
+func (ls *INOLanguageServer) getPredefinedMacrosReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*PredefinedMacros, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	fqbn := ls.buildFqbn
+	cmd, err := ls.sketchCompileCommand()
+	ls.readUnlock(logger)
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, responseError(err)
+	}
+
+	res := &PredefinedMacros{
+		Fqbn:     fqbn,
+		Defines:  compileCommandDefines(cmd.Arguments),
+		BuiltIns: []Macro{},
+	}
+	if builtIns, err := ls.builtInMacros(ctx, logger, cmd); err != nil {
+		logger.Logf("Error getting the built-in macros of the compiler: %s", err)
+	} else {
+		res.BuiltIns = builtIns
+	}
+	logger.Logf("<-- getPredefinedMacros(%d defines, %d built-ins)", len(res.Defines), len(res.BuiltIns))
+	return res, nil
+}
@@ -0,0 +1,99 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileCommandDefines(t *testing.T) {
+	defines := compileCommandDefines([]string{
+		"avr-g++", "-c", "-DF_CPU=16000000L", "-DARDUINO_AVR_UNO", "-D", "ARDUINO_ARCH_AVR",
+		"-DUSB_PRODUCT=\"Uno\"", "-DDEBUG=1", "-UDEBUG", "-DF_CPU=8000000L", "-I/tmp/core", "sketch.cpp",
+	})
+	require.Equal(t, []Macro{
+		{Name: "ARDUINO_AVR_UNO", Value: "1"},
+		{Name: "ARDUINO_ARCH_AVR", Value: "1"},
+		{Name: "USB_PRODUCT", Value: "\"Uno\""},
+		{Name: "F_CPU", Value: "8000000L"},
+	}, defines)
+	require.Empty(t, compileCommandDefines([]string{"avr-g++", "-c", "sketch.cpp"}))
+}
+
+func TestBuiltInMacrosArguments(t *testing.T) {
+	emptyFile := paths.New("/tmp", "empty")
+	args := builtInMacrosArguments(&compileCommand{
+		Directory: "/tmp/build",
+		Arguments: []string{
+			"avr-g++", "-c", "-g", "-Os", "-std=gnu++11", "-mmcu=atmega328p", "-MMD", "-MF", "sketch.d",
+			"-DF_CPU=16000000L", "-I/tmp/core", "-isystem", "/tmp/include", "-include", "Arduino.h",
+			"sketch.cpp", "-o", "sketch.o",
+		},
+		File: "sketch.cpp",
+	}, emptyFile)
+	require.Equal(t, []string{"avr-g++", "-g", "-Os", "-std=gnu++11", "-mmcu=atmega328p", "-dM", "-E", "-x", "c++", emptyFile.String()}, args)
+}
+
+func TestParseBuiltInMacros(t *testing.T) {
+	macros := parseBuiltInMacros([]byte("#define __GNUC__ 7\n#define __AVR_ATmega328P__ 1\n#define __STDC__\n#define __has_include(STR) __has_include__(STR)\n"))
+	require.Equal(t, []Macro{
+		{Name: "__AVR_ATmega328P__", Value: "1"},
+		{Name: "__GNUC__", Value: "7"},
+		{Name: "__STDC__", Value: ""},
+		{Name: "__has_include(STR)", Value: "__has_include__(STR)"},
+	}, macros)
+}
+
+func TestGetPredefinedMacros(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake compiler is a shell script")
+	}
+	ls := newTestSketchLanguageServer(t)
+	ls.config = &Config{}
+	ls.buildFqbn = "arduino:avr:uno"
+	ls.tempDir = ls.buildPath.Parent().Join("tmp")
+	compiler := ls.buildPath.Parent().Join("avr-g++")
+	require.NoError(t, compiler.WriteFile([]byte("#!/bin/sh\necho \"$*\" >> \"$(dirname \"$0\")/runs\"\necho '#define __GNUC__ 7'\necho '#define __AVR__ 1'\n")))
+	require.NoError(t, compiler.Chmod(0755))
+	db := clangdCompilationDatabaseDir(ls.buildPath)
+	require.NoError(t, db.MkdirAll())
+	require.NoError(t, db.Join("compile_commands.json").WriteFile([]byte(`[{
+		"directory": "`+ls.buildPath.String()+`",
+		"arguments": ["`+compiler.String()+`", "-c", "-mmcu=atmega328p", "-DARDUINO=10607", "`+ls.buildSketchCpp.String()+`"],
+		"file": "`+ls.buildSketchCpp.String()+`"
+	}]`)))
+
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	res, respErr := ls.getPredefinedMacrosReqFromIDE(context.Background(), logger)
+	require.Nil(t, respErr)
+	require.Equal(t, "arduino:avr:uno", res.Fqbn)
+	require.Equal(t, []Macro{{Name: "ARDUINO", Value: "10607"}}, res.Defines)
+	require.Equal(t, []Macro{{Name: "__AVR__", Value: "1"}, {Name: "__GNUC__", Value: "7"}}, res.BuiltIns)
+
+	// The built-in macros are asked to the compiler only once
+	_, respErr = ls.getPredefinedMacrosReqFromIDE(context.Background(), logger)
+	require.Nil(t, respErr)
+	runs, err := compiler.Parent().Join("runs").ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(runs), "-dM -E"))
+}
@@ -0,0 +1,83 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// previewURIScheme is the URI scheme of the read-only virtual document that
+// shows the preprocessed sketch (the .ino.cpp analyzed by clangd). The document
+// is not synchronized with clangd: the language features are not available on it.
+const previewURIScheme = "arduino-generated"
+
+// PreviewGeneratedSketchResult is the response to the custom "arduino/previewGeneratedSketch" request
+type PreviewGeneratedSketchResult struct {
+	URI     lsp.DocumentURI `json:"uri"`
+	Version int             `json:"version"`
+	Text    string          `json:"text"`
+}
+
+func (ls *INOLanguageServer) previewGeneratedSketchURI() (lsp.DocumentURI, error) {
+	u := url.URL{
+		Scheme: previewURIScheme,
+		Path:   "/" + ls.sketchName + ".ino.cpp",
+	}
+	return lsp.NewDocumentURIFromURL(u.String())
+}
+
+func isPreviewGeneratedSketchURI(uri lsp.DocumentURI) bool {
+	return strings.HasPrefix(uri.String(), previewURIScheme+":")
+}
+
+// previewGeneratedSketchRequestError returns the error for the requests about the preview
+// of the preprocessed sketch: the preview is a read-only document, not part of the sketch,
+// and the language features are not available on it. It returns nil for any other document.
+func previewGeneratedSketchRequestError(logger jsonrpc.FunctionLogger, uri lsp.DocumentURI) *jsonrpc.ResponseError {
+	if !isPreviewGeneratedSketchURI(uri) {
+		return nil
+	}
+	logger.Logf("Request on read-only preview %s rejected", uri)
+	return &jsonrpc.ResponseError{
+		Code:    jsonrpc.ErrorCodesInvalidParams,
+		Message: "the preview of the preprocessed sketch is read-only, language features are not available",
+	}
+}
+
+func (ls *INOLanguageServer) previewGeneratedSketchReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*PreviewGeneratedSketchResult, *jsonrpc.ResponseError) {
+	ls.readLock(logger, true)
+	defer ls.readUnlock(logger)
+
+	if ls.sketchMapper == nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: "the sketch has not been preprocessed yet"}
+	}
+	uri, err := ls.previewGeneratedSketchURI()
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, responseError(err)
+	}
+	logger.Logf("<-- previewGeneratedSketch(%s version %d)", uri, ls.sketchMapper.CppText.Version)
+	return &PreviewGeneratedSketchResult{
+		URI:     uri,
+		Version: ls.sketchMapper.CppText.Version,
+		Text:    ls.sketchMapper.CppText.Text,
+	}, nil
+}
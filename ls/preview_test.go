@@ -0,0 +1,42 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+func TestPreviewGeneratedSketchURI(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	previewURI, err := ls.previewGeneratedSketchURI()
+	require.NoError(t, err)
+	require.Equal(t, "arduino-generated:///Sketch.ino.cpp", previewURI.String())
+	require.True(t, isPreviewGeneratedSketchURI(previewURI))
+	respErr := previewGeneratedSketchRequestError(logger, previewURI)
+	require.NotNil(t, respErr)
+	require.Equal(t, jsonrpc.ErrorCodesInvalidParams, respErr.Code)
+
+	sketchURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	require.False(t, isPreviewGeneratedSketchURI(sketchURI))
+	require.Nil(t, previewGeneratedSketchRequestError(logger, sketchURI))
+}
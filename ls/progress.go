@@ -19,16 +19,22 @@ import (
 	"context"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/arduino/arduino-language-server/streams"
 	"github.com/vincecity/go-lsp"
 )
 
+// progressProxyHandler forwards to the IDE the progress of the language server and of
+// clangd. A nil progressProxyHandler discards the progress, it's used when there is no
+// IDE connected (for example by CheckEnvironment).
 type progressProxyHandler struct {
 	conn               *lsp.Server
+	minReportInterval  time.Duration
 	mux                sync.Mutex
 	actionRequiredCond *sync.Cond
 	proxies            map[string]*progressProxy
+	cancellers         map[string]func()
 }
 
 type progressProxyStatus int
@@ -47,13 +53,19 @@ type progressProxy struct {
 	beginReq       *lsp.WorkDoneProgressBegin
 	reportReq      *lsp.WorkDoneProgressReport
 	endReq         *lsp.WorkDoneProgressEnd
+	lastReport     time.Time
+	wakeUpPending  bool
 }
 
-// newProgressProxy creates a new ProgressProxyHandler and returns its pointer
-func newProgressProxy(conn *lsp.Server) *progressProxyHandler {
+// newProgressProxy creates a new ProgressProxyHandler and returns its pointer. The reports
+// of each progress are sent at most once every minReportInterval (0 for no limit), the
+// reports received in between are merged: only the last one is sent.
+func newProgressProxy(conn *lsp.Server, minReportInterval time.Duration) *progressProxyHandler {
 	res := &progressProxyHandler{
-		conn:    conn,
-		proxies: map[string]*progressProxy{},
+		conn:              conn,
+		minReportInterval: minReportInterval,
+		proxies:           map[string]*progressProxy{},
+		cancellers:        map[string]func(){},
 	}
 	res.actionRequiredCond = sync.NewCond(&res.mux)
 	go func() {
@@ -68,10 +80,13 @@ func (p *progressProxyHandler) handlerLoop() {
 	defer p.mux.Unlock()
 
 	for {
-		p.actionRequiredCond.Wait()
-
+		// The proxies are checked before waiting: the actions required before the
+		// loop started would be lost otherwise
 		for id, proxy := range p.proxies {
 			for proxy.currentStatus != proxy.requiredStatus {
+				if p.reportThrottled(proxy) {
+					break
+				}
 				p.handleProxy(id, proxy)
 			}
 		}
@@ -82,7 +97,33 @@ func (p *progressProxyHandler) handlerLoop() {
 				delete(p.proxies, id)
 			}
 		}
+
+		p.actionRequiredCond.Wait()
+	}
+}
+
+// reportThrottled returns true if the report required by the proxy must be delayed, because
+// the previous one has been sent less than minReportInterval ago: the handler loop is woken
+// up again once the interval has elapsed. The begin and end are never delayed, a pending
+// report is dropped if the progress ends in the meantime.
+func (p *progressProxyHandler) reportThrottled(proxy *progressProxy) bool {
+	if proxy.currentStatus != progressProxyBegin || proxy.requiredStatus != progressProxyReport {
+		return false
+	}
+	wait := p.minReportInterval - time.Since(proxy.lastReport)
+	if wait <= 0 {
+		return false
+	}
+	if !proxy.wakeUpPending {
+		proxy.wakeUpPending = true
+		time.AfterFunc(wait, func() {
+			p.mux.Lock()
+			defer p.mux.Unlock()
+			proxy.wakeUpPending = false
+			p.actionRequiredCond.Broadcast()
+		})
 	}
+	return true
 }
 
 func (p *progressProxyHandler) handleProxy(id string, proxy *progressProxy) {
@@ -124,6 +165,7 @@ func (p *progressProxyHandler) handleProxy(id string, proxy *progressProxy) {
 			})
 
 			proxy.reportReq = nil
+			proxy.lastReport = time.Now()
 			if err != nil {
 				log.Printf("ProgressHandler: error sending report req token %s: %v", id, err)
 			} else {
@@ -147,7 +189,19 @@ func (p *progressProxyHandler) handleProxy(id string, proxy *progressProxy) {
 	}
 }
 
+// progressReportInterval returns the minimum interval between the reports of a progress
+// allowed by the given max rate (reports per second, 0 or less for unlimited)
+func progressReportInterval(maxRate int) time.Duration {
+	if maxRate <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(maxRate)
+}
+
 func (p *progressProxyHandler) Create(id string) {
+	if p == nil {
+		return
+	}
 	p.mux.Lock()
 	defer p.mux.Unlock()
 
@@ -164,6 +218,9 @@ func (p *progressProxyHandler) Create(id string) {
 }
 
 func (p *progressProxyHandler) Begin(id string, req *lsp.WorkDoneProgressBegin) {
+	if p == nil {
+		return
+	}
 	p.mux.Lock()
 	defer p.mux.Unlock()
 
@@ -184,6 +241,9 @@ func (p *progressProxyHandler) Begin(id string, req *lsp.WorkDoneProgressBegin)
 }
 
 func (p *progressProxyHandler) Report(id string, req *lsp.WorkDoneProgressReport) {
+	if p == nil {
+		return
+	}
 	p.mux.Lock()
 	defer p.mux.Unlock()
 
@@ -200,9 +260,14 @@ func (p *progressProxyHandler) Report(id string, req *lsp.WorkDoneProgressReport
 }
 
 func (p *progressProxyHandler) End(id string, req *lsp.WorkDoneProgressEnd) {
+	if p == nil {
+		return
+	}
 	p.mux.Lock()
 	defer p.mux.Unlock()
 
+	delete(p.cancellers, id)
+
 	proxy, ok := p.proxies[id]
 	if !ok {
 		return
@@ -213,6 +278,35 @@ func (p *progressProxyHandler) End(id string, req *lsp.WorkDoneProgressEnd) {
 	p.actionRequiredCond.Broadcast()
 }
 
+// SetCancel sets the function called when the IDE cancels the progress with the given id,
+// the progress must be begun as Cancellable.
+func (p *progressProxyHandler) SetCancel(id string, cancel func()) {
+	if p == nil {
+		return
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.cancellers[id] = cancel
+}
+
+// Cancel cancels the operation reporting the progress with the given id, it returns false
+// if the progress is not cancellable by the language server (for example because it's
+// reported by clangd).
+func (p *progressProxyHandler) Cancel(id string) bool {
+	if p == nil {
+		return false
+	}
+	p.mux.Lock()
+	cancel, ok := p.cancellers[id]
+	p.mux.Unlock()
+
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
 func (p *progressProxyHandler) Shutdown() {
 	p.mux.Lock()
 	defer p.mux.Unlock()
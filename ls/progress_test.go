@@ -0,0 +1,96 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestProgressCancel(t *testing.T) {
+	p := newProgressProxy(nil, 0)
+	defer p.Shutdown()
+
+	require.False(t, p.Cancel(rebuildProgressToken))
+
+	cancelled := 0
+	p.SetCancel(rebuildProgressToken, func() { cancelled++ })
+	require.True(t, p.Cancel(rebuildProgressToken))
+	require.Equal(t, 1, cancelled)
+
+	// The operation can't be cancelled anymore once ended
+	p.End(rebuildProgressToken, &lsp.WorkDoneProgressEnd{Message: "done"})
+	require.False(t, p.Cancel(rebuildProgressToken))
+	require.Equal(t, 1, cancelled)
+}
+
+// progressOutput collects the messages sent to the IDE by the progress handler
+type progressOutput struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (o *progressOutput) Write(p []byte) (int, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.buf.Write(p)
+}
+
+func (o *progressOutput) String() string {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.buf.String()
+}
+
+func TestProgressReportThrottling(t *testing.T) {
+	var out progressOutput
+	p := newProgressProxy(lsp.NewServer(&bytes.Buffer{}, &out, nil), 200*time.Millisecond)
+
+	// The token is already created in the IDE: the creation request is never answered here
+	p.mux.Lock()
+	p.proxies["index"] = &progressProxy{currentStatus: progressProxyBegin, requiredStatus: progressProxyBegin}
+	p.mux.Unlock()
+
+	p.Report("index", &lsp.WorkDoneProgressReport{Message: "file 0"})
+	require.Eventually(t, func() bool { return strings.Contains(out.String(), "file 0") }, time.Second, 5*time.Millisecond)
+
+	// The reports sent too early are merged, only the last one is sent
+	for i := 1; i <= 50; i++ {
+		p.Report("index", &lsp.WorkDoneProgressReport{Message: "file " + strings.Repeat("#", i)})
+	}
+	last := "file " + strings.Repeat("#", 50) + `"`
+	require.Never(t, func() bool { return strings.Contains(out.String(), last) }, 100*time.Millisecond, 5*time.Millisecond)
+	require.Eventually(t, func() bool { return strings.Contains(out.String(), last) }, time.Second, 5*time.Millisecond)
+	require.Equal(t, 2, strings.Count(out.String(), `"method":"$/progress"`))
+
+	// The end is not delayed and drops the pending report
+	p.Report("index", &lsp.WorkDoneProgressReport{Message: "dropped"})
+	p.End("index", &lsp.WorkDoneProgressEnd{Message: "done"})
+	require.Eventually(t, func() bool { return strings.Contains(out.String(), `"kind":"end"`) }, 100*time.Millisecond, 5*time.Millisecond)
+	require.NotContains(t, out.String(), "dropped")
+}
+
+func TestProgressReportInterval(t *testing.T) {
+	require.Equal(t, time.Duration(0), progressReportInterval(0))
+	require.Equal(t, time.Duration(0), progressReportInterval(-1))
+	require.Equal(t, 100*time.Millisecond, progressReportInterval(10))
+}
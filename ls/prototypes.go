@@ -0,0 +1,105 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// GeneratedPrototype is a function prototype inserted by the Arduino preprocessor
+type GeneratedPrototype struct {
+	// Name is the name of the function
+	Name string `json:"name"`
+	// Signature is the prototype, as inserted in the preprocessed sketch
+	Signature string `json:"signature"`
+	// InsertionLine is the line of the preprocessed sketch (see "arduino/previewGeneratedSketch")
+	// where the prototype is inserted
+	InsertionLine int `json:"insertionLine"`
+	// Definition is the line of the .ino file where the function is defined
+	Definition lsp.Location `json:"definition"`
+}
+
+// GetGeneratedPrototypesResult is the response to the custom "arduino/getGeneratedPrototypes" request
+type GetGeneratedPrototypesResult struct {
+	// Version is the version of the preprocessed sketch the prototypes refer to
+	Version    int                  `json:"version"`
+	Prototypes []GeneratedPrototype `json:"prototypes"`
+}
+
+// prototypeNameRegexp matches the name of the function in a prototype, the first identifier
+// followed by the parameters list
+var prototypeNameRegexp = regexp.MustCompile(`(\w+)\s*\(`)
+
+func (ls *INOLanguageServer) getGeneratedPrototypesReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*GetGeneratedPrototypesResult, *jsonrpc.ResponseError) {
+	ls.readLock(logger, true)
+	defer ls.readUnlock(logger)
+
+	if ls.sketchMapper == nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: "the sketch has not been preprocessed yet"}
+	}
+	res := &GetGeneratedPrototypesResult{
+		Version:    ls.sketchMapper.CppText.Version,
+		Prototypes: ls.generatedPrototypes(),
+	}
+	logger.Logf("<-- getGeneratedPrototypes(version %d, %d prototypes)", res.Version, len(res.Prototypes))
+	return res, nil
+}
+
+// generatedPrototypes returns the prototypes inserted by the Arduino preprocessor in the
+// preprocessed sketch, in the order they are inserted. The sketch is not preprocessed
+// again: the prototypes are the ones of the last rebuild.
+func (ls *INOLanguageServer) generatedPrototypes() []GeneratedPrototype {
+	cppLines := textutils.SplitLines(ls.sketchMapper.CppText.Text)
+	res := []GeneratedPrototype{}
+	for _, cppLine := range ls.sketchMapper.PreprocessedCppLines() {
+		if cppLine >= len(cppLines) {
+			continue
+		}
+		signature := strings.TrimSuffix(strings.TrimSpace(cppLines[cppLine]), ";")
+		match := prototypeNameRegexp.FindStringSubmatch(signature)
+		if match == nil {
+			continue
+		}
+		file, line, ok := ls.sketchMapper.CppToInoLineOk(cppLine)
+		if !ok {
+			continue
+		}
+		definition := lsp.NewDocumentURIFromPath(paths.New(file))
+		if doc, ok := ls.trackedIdeDocs[file]; ok {
+			definition = doc.URI
+		}
+		res = append(res, GeneratedPrototype{
+			Name:          match[1],
+			Signature:     signature,
+			InsertionLine: cppLine,
+			Definition: lsp.Location{
+				URI: definition,
+				Range: lsp.Range{
+					Start: lsp.Position{Line: line},
+					End:   lsp.Position{Line: line},
+				},
+			},
+		})
+	}
+	return res
+}
@@ -0,0 +1,62 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestGeneratedPrototypes(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	sketchIno := ls.sketchRoot.Join("Sketch.ino").String()
+	otherIno := ls.sketchRoot.Join("Other.ino").String()
+	ls.sketchMapper = sourcemapper.CreateInoMapper([]byte(
+		"#include <Arduino.h>\n" +
+			"#line 1 \"" + sketchIno + "\"\n" +
+			"int counter = 0;\n" +
+			"\n" +
+			"#line 3 \"" + sketchIno + "\"\n" +
+			"void setup();\n" +
+			"#line 5 \"" + sketchIno + "\"\n" +
+			"void loop();\n" +
+			"#line 1 \"" + otherIno + "\"\n" +
+			"unsigned long elapsed(int (*clock)(void));\n" +
+			"#line 3 \"" + sketchIno + "\"\n" +
+			"void setup() {}\n" +
+			"\n" +
+			"void loop() {}\n" +
+			"\n" +
+			"#line 1 \"" + otherIno + "\"\n" +
+			"unsigned long elapsed(int (*clock)(void)) { return clock(); }\n"))
+
+	definition := func(uri lsp.DocumentURI, line int) lsp.Location {
+		return lsp.Location{URI: uri, Range: testRange(line, 0, line, 0)}
+	}
+	sketchURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	otherURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Other.ino"))
+	require.Equal(t, []GeneratedPrototype{
+		{Name: "setup", Signature: "void setup()", InsertionLine: 5, Definition: definition(sketchURI, 2)},
+		{Name: "loop", Signature: "void loop()", InsertionLine: 7, Definition: definition(sketchURI, 4)},
+		{Name: "elapsed", Signature: "unsigned long elapsed(int (*clock)(void))", InsertionLine: 9, Definition: definition(otherURI, 0)},
+	}, ls.generatedPrototypes())
+
+	// No prototypes
+	require.Empty(t, newTestSketchLanguageServer(t).generatedPrototypes())
+}
@@ -0,0 +1,151 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"reflect"
+	"slices"
+	"sort"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// diagnosticsFileVersion is the version of the format of the diagnostics file
+const diagnosticsFileVersion = 1
+
+// DiagnosticsFile is the content of the file where the diagnostics published to the IDE
+// are mirrored (see Config.DiagnosticsFile), to be used by the CI and by external tools.
+type DiagnosticsFile struct {
+	Version    int               `json:"version"`
+	SketchRoot string            `json:"sketchRoot"`
+	Fqbn       string            `json:"fqbn"`
+	Files      []FileDiagnostics `json:"files"`
+}
+
+// FileDiagnostics are the diagnostics of a file of the sketch
+type FileDiagnostics struct {
+	URI         lsp.DocumentURI  `json:"uri"`
+	Path        string           `json:"path"`
+	Diagnostics []lsp.Diagnostic `json:"diagnostics"`
+}
+
+// publishIdeDiagnostics sends the diagnostics of a document to the IDE, keeping track of
+// the last diagnostics published for each document. The diagnostics are not sent again if
+// they didn't change since the last time: clangd publishes the diagnostics of the whole
+// preprocessed sketch after each change, most of the .ino tabs get the same diagnostics
+// (often none) every time.
+func (ls *INOLanguageServer) publishIdeDiagnostics(logger jsonrpc.FunctionLogger, ideParams *lsp.PublishDiagnosticsParams) error {
+	ls.publishedDiagnosticsMutex.Lock()
+	if ls.publishedDiagnostics == nil {
+		ls.publishedDiagnostics = map[lsp.DocumentURI][]lsp.Diagnostic{}
+	}
+	if sameDiagnostics(ls.publishedDiagnostics[ideParams.URI], ideParams.Diagnostics) {
+		ls.publishedDiagnosticsMutex.Unlock()
+		logger.Logf("Diagnostics of %s unchanged: not sent", ideParams.URI)
+		return nil
+	}
+	if len(ideParams.Diagnostics) == 0 {
+		delete(ls.publishedDiagnostics, ideParams.URI)
+	} else {
+		ls.publishedDiagnostics[ideParams.URI] = append([]lsp.Diagnostic{}, ideParams.Diagnostics...)
+	}
+	ls.writeDiagnosticsFile(logger)
+	ls.publishedDiagnosticsMutex.Unlock()
+
+	return ls.IDE.conn.TextDocumentPublishDiagnostics(ideParams)
+}
+
+// sameDiagnostics returns true if the given lists contain the same diagnostics, in the same
+// order. A missing list is the same as an empty one.
+func sameDiagnostics(a, b []lsp.Diagnostic) bool {
+	return slices.EqualFunc(a, b, func(x, y lsp.Diagnostic) bool {
+		return reflect.DeepEqual(x, y)
+	})
+}
+
+// currentDiagnostics returns the last diagnostics published for each document, sorted by URI
+func (ls *INOLanguageServer) currentDiagnostics() []FileDiagnostics {
+	ls.publishedDiagnosticsMutex.Lock()
+	defer ls.publishedDiagnosticsMutex.Unlock()
+	return ls.currentDiagnosticsUnlocked()
+}
+
+func (ls *INOLanguageServer) currentDiagnosticsUnlocked() []FileDiagnostics {
+	res := []FileDiagnostics{}
+	for uri, diags := range ls.publishedDiagnostics {
+		res = append(res, FileDiagnostics{
+			URI:         uri,
+			Path:        uri.AsPath().String(),
+			Diagnostics: diags,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].URI.String() < res[j].URI.String() })
+	return res
+}
+
+// diagnosticsFile returns the file where the diagnostics are mirrored, or nil if disabled.
+// A relative path is resolved against the build path.
+func (ls *INOLanguageServer) diagnosticsFile() *paths.Path {
+	if ls.config == nil || ls.config.DiagnosticsFile == "" {
+		return nil
+	}
+	file := paths.New(ls.config.DiagnosticsFile)
+	if file.IsAbs() {
+		return file
+	}
+	if ls.buildPath == nil {
+		return nil
+	}
+	return ls.buildPath.JoinPath(file)
+}
+
+// writeDiagnosticsFile mirrors the published diagnostics into the diagnostics file, if
+// enabled. The caller must hold the publishedDiagnosticsMutex.
+func (ls *INOLanguageServer) writeDiagnosticsFile(logger jsonrpc.FunctionLogger) {
+	file := ls.diagnosticsFile()
+	if file == nil {
+		return
+	}
+	content := &DiagnosticsFile{
+		Version: diagnosticsFileVersion,
+		Fqbn:    ls.config.Fqbn,
+		Files:   ls.currentDiagnosticsUnlocked(),
+	}
+	if ls.sketchRoot != nil {
+		content.SketchRoot = ls.sketchRoot.String()
+	}
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		logger.Logf("Error writing diagnostics file: %s", err)
+		return
+	}
+	if err := file.Parent().MkdirAll(); err != nil {
+		logger.Logf("Error writing diagnostics file: %s", err)
+		return
+	}
+	// Write a temporary file first, so that the readers never see a truncated file
+	tmp := file.Parent().Join(file.Base() + ".tmp")
+	if err := tmp.WriteFile(data); err != nil {
+		logger.Logf("Error writing diagnostics file: %s", err)
+		return
+	}
+	if err := tmp.Rename(file); err != nil {
+		logger.Logf("Error writing diagnostics file: %s", err)
+	}
+}
@@ -0,0 +1,105 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"go.bug.st/json"
+)
+
+func TestDiagnosticsFile(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	var ide bytes.Buffer
+	ls.IDE = &IDELSPServer{conn: lsp.NewServer(&bytes.Buffer{}, &ide, nil)}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	inoURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	helperURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h"))
+	missingLoop := newSketchDiagnostic(diagnosticCodeMissingLoop, lsp.DiagnosticSeverityError, lsp.Range{}, "The sketch has no loop() function")
+	unused := lsp.Diagnostic{Range: testRange(3, 4, 3, 11), Severity: lsp.DiagnosticSeverityWarning, Message: "unused variable"}
+
+	// Disabled
+	ls.config = &Config{Fqbn: "arduino:avr:uno"}
+	require.NoError(t, ls.publishIdeDiagnostics(logger, &lsp.PublishDiagnosticsParams{URI: inoURI, Diagnostics: []lsp.Diagnostic{missingLoop}}))
+	require.Contains(t, ide.String(), "The sketch has no loop() function")
+	require.Nil(t, ls.diagnosticsFile())
+
+	ls.config.DiagnosticsFile = "diagnostics.json"
+	file := ls.buildPath.Join("diagnostics.json")
+	require.Equal(t, file, ls.diagnosticsFile())
+	require.NoError(t, ls.publishIdeDiagnostics(logger, &lsp.PublishDiagnosticsParams{URI: helperURI, Diagnostics: []lsp.Diagnostic{unused}}))
+	readDiagnosticsFile := func() *DiagnosticsFile {
+		data, err := file.ReadFile()
+		require.NoError(t, err)
+		var content DiagnosticsFile
+		require.NoError(t, json.Unmarshal(data, &content))
+		return &content
+	}
+	content := readDiagnosticsFile()
+	require.Equal(t, diagnosticsFileVersion, content.Version)
+	require.Equal(t, ls.sketchRoot.String(), content.SketchRoot)
+	require.Equal(t, "arduino:avr:uno", content.Fqbn)
+	require.Len(t, content.Files, 2)
+	require.Equal(t, helperURI, content.Files[0].URI)
+	require.Equal(t, ls.sketchRoot.Join("Helper.h").String(), content.Files[0].Path)
+	require.Equal(t, []lsp.Diagnostic{unused}, content.Files[0].Diagnostics)
+	require.Equal(t, inoURI, content.Files[1].URI)
+	require.Equal(t, "The sketch has no loop() function", content.Files[1].Diagnostics[0].Message)
+	require.False(t, ls.buildPath.Join("diagnostics.json.tmp").Exist())
+
+	// Cleared diagnostics are removed from the file
+	require.NoError(t, ls.publishIdeDiagnostics(logger, &lsp.PublishDiagnosticsParams{URI: inoURI, Diagnostics: []lsp.Diagnostic{}}))
+	content = readDiagnosticsFile()
+	require.Len(t, content.Files, 1)
+	require.Equal(t, helperURI, content.Files[0].URI)
+	require.Equal(t, content.Files, ls.currentDiagnostics())
+
+	// Absolute path
+	ls.config.DiagnosticsFile = ls.sketchRoot.Join("report.json").String()
+	require.Equal(t, ls.sketchRoot.Join("report.json"), ls.diagnosticsFile())
+}
+
+func TestUnchangedDiagnosticsNotPublished(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	var ide bytes.Buffer
+	ls.IDE = &IDELSPServer{conn: lsp.NewServer(&bytes.Buffer{}, &ide, nil)}
+	ls.config = &Config{}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	inoURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	unused := lsp.Diagnostic{Range: testRange(0, 4, 0, 11), Severity: lsp.DiagnosticSeverityWarning, Message: "unused variable"}
+	publish := func(diags ...lsp.Diagnostic) bool {
+		ide.Reset()
+		require.NoError(t, ls.publishIdeDiagnostics(logger, &lsp.PublishDiagnosticsParams{URI: inoURI, Diagnostics: append([]lsp.Diagnostic{}, diags...)}))
+		return ide.Len() > 0
+	}
+
+	// Nothing to clear on a document without diagnostics
+	require.False(t, publish())
+
+	require.True(t, publish(unused))
+	require.False(t, publish(unused))
+
+	moved := unused
+	moved.Range = testRange(1, 4, 1, 11)
+	require.True(t, publish(moved))
+
+	require.True(t, publish())
+	require.False(t, publish())
+}
@@ -0,0 +1,73 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// RebuildTimings is the breakdown of the duration of a generation of the build environment,
+// the last one is reported by the "arduino/getMetrics" request. The durations are in
+// milliseconds.
+type RebuildTimings struct {
+	// Kind is the kind of build: "bootstrap", "rebuild" or "cleanBuild"
+	Kind string `json:"kind"`
+	// Completed is the time the build has been completed
+	Completed time.Time `json:"completed"`
+	// CliInvocation is the time spent running arduino-cli, that preprocesses the sketch
+	// and discovers the libraries
+	CliInvocation int64 `json:"cliInvocationMs"`
+	// Preprocessing is the time spent loading the preprocessed sketch and regenerating
+	// its source map and diagnostics
+	Preprocessing int64 `json:"preprocessingMs"`
+	// CompilationDatabase is the time spent rewriting the compile_commands.json of clangd
+	// and updating the indexes of the build
+	CompilationDatabase int64 `json:"compilationDatabaseMs"`
+	// ClangdResync is the time spent sending the preprocessed sketch to clangd, or
+	// restarting it for a clean build
+	ClangdResync int64 `json:"clangdResyncMs"`
+	// Total is the whole duration of the build, including the time spent waiting for locks
+	Total int64 `json:"totalMs"`
+
+	start time.Time
+}
+
+// newRebuildTimings starts measuring a build of the given kind
+func newRebuildTimings(kind string) *RebuildTimings {
+	return &RebuildTimings{Kind: kind, start: time.Now()}
+}
+
+// elapsedMs returns the milliseconds elapsed since the given time
+func elapsedMs(start time.Time) int64 {
+	return time.Since(start).Milliseconds()
+}
+
+func (t *RebuildTimings) String() string {
+	return fmt.Sprintf("arduino-cli %dms, preprocessing %dms, compile_commands.json %dms, clangd resync %dms, total %dms",
+		t.CliInvocation, t.Preprocessing, t.CompilationDatabase, t.ClangdResync, t.Total)
+}
+
+// recordRebuildTimings logs the timings of a completed build and keeps them to be reported
+// by the metrics
+func (ls *INOLanguageServer) recordRebuildTimings(logger jsonrpc.FunctionLogger, timings *RebuildTimings) {
+	timings.Total = elapsedMs(timings.start)
+	timings.Completed = time.Now()
+	logger.Logf("Build timings (%s): %s", timings.Kind, timings)
+	ls.lastRebuildTimings.Store(timings)
+}
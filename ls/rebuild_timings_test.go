@@ -0,0 +1,53 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildTimingsInMetrics(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.clangdRequests = newRequestLimiter(0)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	metrics, respErr := ls.getMetricsReqFromIDE(context.Background(), logger)
+	require.Nil(t, respErr)
+	require.Nil(t, metrics.LastRebuild)
+
+	timings := newRebuildTimings("rebuild")
+	timings.start = timings.start.Add(-time.Second)
+	timings.CliInvocation = 700
+	timings.Preprocessing = 20
+	timings.CompilationDatabase = 100
+	timings.ClangdResync = 30
+	ls.recordRebuildTimings(logger, timings)
+
+	metrics, respErr = ls.getMetricsReqFromIDE(context.Background(), logger)
+	require.Nil(t, respErr)
+	require.Equal(t, "rebuild", metrics.LastRebuild.Kind)
+	require.Equal(t, int64(700), metrics.LastRebuild.CliInvocation)
+	require.GreaterOrEqual(t, metrics.LastRebuild.Total, int64(1000))
+	require.False(t, metrics.LastRebuild.Completed.IsZero())
+	require.Equal(t, "arduino-cli 700ms, preprocessing 20ms, compile_commands.json 100ms, clangd resync 30ms, total "+
+		fmt.Sprint(metrics.LastRebuild.Total)+"ms", metrics.LastRebuild.String())
+}
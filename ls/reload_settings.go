@@ -0,0 +1,124 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/arduino/arduino-language-server/streams"
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// ReloadSettingsResult is the result of the "arduino/reloadSettings" command
+type ReloadSettingsResult struct {
+	// Reloaded describes the configuration files reloaded and how they have been applied
+	Reloaded []string `json:"reloaded"`
+}
+
+// writeClangdConfig writes the .clangd configuration of the build path: the settings of the
+// language server and of the sketch settings file are followed by the .clangd of the sketch,
+// if any, that can override them. Returns the .clangd of the sketch, or nil if not present.
+func (ls *INOLanguageServer) writeClangdConfig() (*paths.Path, error) {
+	clangdConf := fmt.Sprintln("Diagnostics:")
+	clangdConf += fmt.Sprintln("  Suppress: [anon_bitfield_qualifiers]")
+	clangdConf += fmt.Sprintln("CompileFlags:")
+	clangdConf += fmt.Sprintln("  Add: -ferror-limit=0")
+	clangdConf += ls.sketchSettings.clangdConfigFragment()
+
+	sketchConf := ls.sketchRoot.Join(".clangd")
+	if data, err := sketchConf.ReadFile(); err == nil {
+		// The fragments of a multi-document configuration are applied in order
+		clangdConf += fmt.Sprintln("---")
+		clangdConf += string(data)
+	} else {
+		sketchConf = nil
+	}
+	return sketchConf, ls.buildPath.Join(".clangd").WriteFile([]byte(clangdConf))
+}
+
+// reloadSettings reads again the configuration files of the sketch and of arduino-cli and
+// applies their changes, without restarting the language server.
+func (ls *INOLanguageServer) reloadSettings(logger jsonrpc.FunctionLogger) (*ReloadSettingsResult, error) {
+	res := &ReloadSettingsResult{Reloaded: []string{}}
+
+	// arduino-cli is queried before taking the lock, to not stall the IDE requests
+	dataFolder, err := ls.extractDataFolderFromArduinoCLI(logger)
+	if err != nil {
+		return nil, fmt.Errorf("reading arduino-cli configuration: %w", err)
+	}
+	if ls.config.cliCore != nil {
+		// The arduino-cli core run by the language server must scan again the installed
+		// platforms and libraries, the ones installed by the IDE are not seen otherwise
+		ctx, cancel := context.WithTimeout(context.Background(), arduinoCLICoreStartTimeout)
+		err := ls.rescanArduinoCLICore(ctx, logger)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("scanning installed platforms and libraries: %w", err)
+		}
+		res.Reloaded = append(res.Reloaded, "installed platforms and libraries")
+	}
+
+	ls.readLock(logger, true)
+	// clangd reads again its configuration when it changes
+	if sketchConf, err := ls.writeClangdConfig(); err != nil {
+		ls.readUnlock(logger)
+		return nil, fmt.Errorf("writing clangd configuration: %w", err)
+	} else if sketchConf != nil {
+		res.Reloaded = append(res.Reloaded, fmt.Sprintf("clangd configuration, including %s", sketchConf))
+	} else {
+		res.Reloaded = append(res.Reloaded, "clangd configuration")
+	}
+	// The formatter configuration is read at each formatting
+	if sketchFormatterConf := ls.sketchRoot.Join(".clang-format"); sketchFormatterConf.Exist() {
+		res.Reloaded = append(res.Reloaded, fmt.Sprintf("formatter configuration %s", sketchFormatterConf))
+	} else if ls.config.FormatterConf != nil && ls.config.FormatterConf.Exist() {
+		res.Reloaded = append(res.Reloaded, fmt.Sprintf("formatter configuration %s", ls.config.FormatterConf))
+	}
+	dataFolderChanged := ls.clangdDataFolder == nil || !ls.clangdDataFolder.EquivalentTo(dataFolder)
+	sketchProject := ls.sketchRoot.Join("sketch.yaml")
+	ls.readUnlock(logger)
+
+	// arduino-cli reads its configuration and the sketch.yaml at each build
+	buildConfig := "arduino-cli configuration"
+	if sketchProject.Exist() {
+		buildConfig += " and " + sketchProject.String()
+	}
+	if dataFolderChanged {
+		// clangd must be restarted to find the compilers in the new data folder
+		logger.Logf("Data folder changed: %s -> %s", ls.clangdDataFolder, dataFolder)
+		ls.cleanBuildInBackground()
+		res.Reloaded = append(res.Reloaded, buildConfig+": data folder changed, clean build started")
+	} else {
+		ls.sketchRebuilder.ForgetLastBuild()
+		ls.triggerRebuild()
+		res.Reloaded = append(res.Reloaded, buildConfig+": sketch rebuild started")
+	}
+
+	// The libraries and platform folders may be changed with the configuration
+	go func() {
+		defer streams.CatchAndLogPanic()
+		ls.registerEnvironmentWatchedFiles(logger)
+	}()
+
+	for _, reloaded := range res.Reloaded {
+		logger.Logf("Reloaded %s", reloaded)
+	}
+	ls.showMessage(logger, lsp.MessageTypeInfo, fmt.Sprintf("Reloaded settings: %d configurations applied", len(res.Reloaded)))
+	return res, nil
+}
@@ -0,0 +1,49 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteClangdConfig(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	require.NoError(t, ls.sketchRoot.MkdirAll())
+	require.NoError(t, ls.buildPath.MkdirAll())
+
+	// Without a .clangd in the sketch only the settings of the language server are written
+	sketchConf, err := ls.writeClangdConfig()
+	require.NoError(t, err)
+	require.Nil(t, sketchConf)
+	data, err := ls.buildPath.Join(".clangd").ReadFile()
+	require.NoError(t, err)
+	require.Contains(t, string(data), "-ferror-limit=0")
+	require.NotContains(t, string(data), "---")
+
+	// The .clangd of the sketch is appended as a separate fragment, overriding the settings
+	userConf := "CompileFlags:\n  Add: -DDEBUG\n"
+	require.NoError(t, ls.sketchRoot.Join(".clangd").WriteFile([]byte(userConf)))
+	sketchConf, err = ls.writeClangdConfig()
+	require.NoError(t, err)
+	require.Equal(t, ls.sketchRoot.Join(".clangd").String(), sketchConf.String())
+	data, err = ls.buildPath.Join(".clangd").ReadFile()
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(string(data), "---\n"+userConf))
+	require.Contains(t, string(data), "-ferror-limit=0")
+}
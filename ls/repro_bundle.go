@@ -0,0 +1,180 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/arduino/arduino-language-server/globals"
+	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// reproBundleVersion is the version of the format of the reproduction bundles
+const reproBundleVersion = 1
+
+// ideMessagesHistorySize is the number of messages from the IDE kept for the reproduction bundles
+const ideMessagesHistorySize = 100
+
+// ReproBundle is a snapshot of the state of the language server, exported with the
+// "arduino/exportReproBundle" command, that allows to reproduce the mapping issues
+// reported by the users. The bundle contains the text of the open documents.
+type ReproBundle struct {
+	Version       int                       `json:"version"`
+	ServerVersion string                    `json:"serverVersion"`
+	SketchRoot    string                    `json:"sketchRoot"`
+	SketchName    string                    `json:"sketchName"`
+	Fqbn          string                    `json:"fqbn"`
+	TrackedDocs   []lsp.TextDocumentItem    `json:"trackedDocs"`
+	Mapper        *sourcemapper.MapperState `json:"mapper,omitempty"`
+	Messages      []HistoryMessage          `json:"messages"`
+}
+
+// HistoryMessage is a request or a notification received from the IDE
+type HistoryMessage struct {
+	Method string          `json:"method"`
+	ID     string          `json:"id,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// messageHistory keeps the last messages received from the IDE
+type messageHistory struct {
+	mutex    sync.Mutex
+	size     int
+	messages []HistoryMessage
+}
+
+func newMessageHistory(size int) *messageHistory {
+	return &messageHistory{size: size}
+}
+
+// add records a message, the oldest message is dropped if the history is full
+func (h *messageHistory) add(method, id string, params json.RawMessage) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.messages) == h.size {
+		h.messages = h.messages[1:]
+	}
+	h.messages = append(h.messages, HistoryMessage{
+		Method: method,
+		ID:     id,
+		Params: append(json.RawMessage(nil), params...),
+	})
+}
+
+// list returns the recorded messages, from the oldest to the newest
+func (h *messageHistory) list() []HistoryMessage {
+	if h == nil {
+		return []HistoryMessage{}
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]HistoryMessage{}, h.messages...)
+}
+
+// reproBundle returns the snapshot of the current state of the language server
+func (ls *INOLanguageServer) reproBundle(logger jsonrpc.FunctionLogger) *ReproBundle {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+	bundle := &ReproBundle{
+		Version:       reproBundleVersion,
+		ServerVersion: globals.VersionInfo.VersionString,
+		SketchName:    ls.sketchName,
+		Fqbn:          ls.buildFqbn,
+		TrackedDocs:   []lsp.TextDocumentItem{},
+		Messages:      ls.ideMessages.list(),
+	}
+	if ls.sketchRoot != nil {
+		bundle.SketchRoot = ls.sketchRoot.String()
+	}
+	for _, doc := range ls.trackedIdeDocs {
+		bundle.TrackedDocs = append(bundle.TrackedDocs, doc)
+	}
+	sort.Slice(bundle.TrackedDocs, func(i, j int) bool {
+		return bundle.TrackedDocs[i].URI.String() < bundle.TrackedDocs[j].URI.String()
+	})
+	if ls.sketchMapper != nil {
+		bundle.Mapper = ls.sketchMapper.State()
+	}
+	return bundle
+}
+
+// parseReproBundleOutput returns the output file given as argument of the
+// "arduino/exportReproBundle" command
+func parseReproBundleOutput(arguments []interface{}) (*paths.Path, error) {
+	if len(arguments) != 1 {
+		return nil, fmt.Errorf("expected 1 argument (output file), got %d", len(arguments))
+	}
+	file, ok := arguments[0].(string)
+	if !ok || file == "" {
+		return nil, fmt.Errorf("invalid output file: %v", arguments[0])
+	}
+	return paths.New(file), nil
+}
+
+// exportReproBundle saves the snapshot of the current state of the language server in the
+// given file
+func (ls *INOLanguageServer) exportReproBundle(logger jsonrpc.FunctionLogger, output *paths.Path) error {
+	data, err := json.MarshalIndent(ls.reproBundle(logger), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := output.WriteFile(data); err != nil {
+		return fmt.Errorf("writing reproduction bundle: %w", err)
+	}
+	logger.Logf("Reproduction bundle saved to %s", output)
+	return nil
+}
+
+// loadReproBundle reads a bundle saved with the "arduino/exportReproBundle" command
+func loadReproBundle(file *paths.Path) (*ReproBundle, error) {
+	data, err := file.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+	var bundle ReproBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Version != reproBundleVersion {
+		return nil, fmt.Errorf("unsupported reproduction bundle version %d", bundle.Version)
+	}
+	return &bundle, nil
+}
+
+// restoreReproBundle replaces the state of the language server with the one of the bundle,
+// it's used to replay the bundles in the tests. The caller must hold the write lock.
+func (ls *INOLanguageServer) restoreReproBundle(bundle *ReproBundle) {
+	ls.sketchRoot = paths.New(bundle.SketchRoot)
+	ls.sketchName = bundle.SketchName
+	ls.buildFqbn = bundle.Fqbn
+	ls.trackedIdeDocs = map[string]lsp.TextDocumentItem{}
+	for _, doc := range bundle.TrackedDocs {
+		ls.trackedIdeDocs[doc.URI.AsPath().String()] = doc
+	}
+	ls.sketchMapper = nil
+	if bundle.Mapper != nil {
+		ls.sketchMapper = sourcemapper.NewSketchMapperFromState(bundle.Mapper)
+	}
+}
@@ -0,0 +1,125 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"go.bug.st/json"
+)
+
+func TestMessageHistory(t *testing.T) {
+	var disabled *messageHistory
+	disabled.add("textDocument/didOpen", "", nil)
+	require.Empty(t, disabled.list())
+
+	history := newMessageHistory(2)
+	history.add("initialize", "1", json.RawMessage(`{}`))
+	history.add("initialized", "", nil)
+	params := json.RawMessage(`{"textDocument":{}}`)
+	history.add("textDocument/didChange", "", params)
+	params[2] = 'X'
+	require.Equal(t, []HistoryMessage{
+		{Method: "initialized"},
+		{Method: "textDocument/didChange", Params: json.RawMessage(`{"textDocument":{}}`)},
+	}, history.list())
+}
+
+func TestExportReproBundle(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.buildFqbn = "arduino:avr:uno"
+	ls.ideMessages = newMessageHistory(ideMessagesHistorySize)
+	ls.ideMessages.add("textDocument/didChange", "", json.RawMessage(`{"contentChanges":[]}`))
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	_, err := parseReproBundleOutput(nil)
+	require.Error(t, err)
+	_, err = parseReproBundleOutput([]interface{}{12})
+	require.Error(t, err)
+	output, err := parseReproBundleOutput([]interface{}{paths.New(t.TempDir(), "bundle.json").String()})
+	require.NoError(t, err)
+
+	// The export is deterministic
+	require.NoError(t, ls.exportReproBundle(logger, output))
+	exported, err := output.ReadFile()
+	require.NoError(t, err)
+	require.NoError(t, ls.exportReproBundle(logger, output))
+	again, err := output.ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, string(exported), string(again))
+
+	bundle, err := loadReproBundle(output)
+	require.NoError(t, err)
+	require.Equal(t, ls.sketchRoot.String(), bundle.SketchRoot)
+	require.Equal(t, "arduino:avr:uno", bundle.Fqbn)
+	require.Len(t, bundle.TrackedDocs, 2)
+	require.Equal(t, lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h")), bundle.TrackedDocs[0].URI)
+	require.Len(t, bundle.Messages, 1)
+
+	restored := newTestSketchLanguageServer(t)
+	restored.restoreReproBundle(bundle)
+	require.Equal(t, ls.sketchRoot, restored.sketchRoot)
+	require.Equal(t, ls.trackedIdeDocs, restored.trackedIdeDocs)
+	require.Equal(t, ls.sketchMapper.State(), restored.sketchMapper.State())
+
+	require.NoError(t, output.WriteFile([]byte(`{"version":99}`)))
+	_, err = loadReproBundle(output)
+	require.Error(t, err)
+}
+
+// TestReplayReproBundles loads the bundles in testdata/repro-bundles and checks that every
+// line of the tracked .ino files is mapped to the same line of the preprocessed sketch. To
+// reproduce a mapping issue add the bundle exported by the user to the folder.
+func TestReplayReproBundles(t *testing.T) {
+	files, err := paths.New("testdata", "repro-bundles").ReadDir()
+	require.NoError(t, err)
+	files.FilterSuffix(".json")
+	require.NotEmpty(t, files)
+	for _, file := range files {
+		t.Run(file.Base(), func(t *testing.T) {
+			bundle, err := loadReproBundle(file)
+			require.NoError(t, err)
+			ls := newTestSketchLanguageServer(t)
+			ls.restoreReproBundle(bundle)
+			require.NotNil(t, ls.sketchMapper)
+			cppLines := textutils.SplitLines(ls.sketchMapper.CppText.Text)
+			for _, doc := range ls.trackedIdeDocs {
+				if doc.URI.Ext() != ".ino" {
+					continue
+				}
+				lines := textutils.SplitLines(doc.Text)
+				for inoLine, text := range lines {
+					cppLine, ok := ls.sketchMapper.InoToCppLineOk(doc.URI, inoLine)
+					if !ok && inoLine == len(lines)-1 && text == "" {
+						// The empty line after the final newline
+						continue
+					}
+					require.True(t, ok, "%s:%d not mapped", doc.URI, inoLine)
+					require.Less(t, cppLine, len(cppLines))
+					require.Equal(t, text, cppLines[cppLine], "%s:%d", doc.URI, inoLine)
+					file, line := ls.sketchMapper.CppToInoLine(cppLine)
+					require.Equal(t, doc.URI.AsPath().String(), file)
+					require.Equal(t, inoLine, line)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// requestLimiter bounds the number of requests in-flight toward clangd, the
+// requests exceeding the limit are queued until a slot is released. The requests
+// of a single IDE connection are processed one at a time, so the same limiter is
+// shared by all the sessions served by a SessionManager.
+type requestLimiter struct {
+	slots    chan bool
+	inFlight atomic.Int64
+	queued   atomic.Int64
+}
+
+// newRequestLimiter creates a requestLimiter allowing at most limit concurrent
+// requests (a limit of 0 or less means unlimited).
+func newRequestLimiter(limit int) *requestLimiter {
+	l := &requestLimiter{}
+	if limit > 0 {
+		l.slots = make(chan bool, limit)
+	}
+	return l
+}
+
+// Acquire waits for a free slot and returns the function to release it. If the context
+// is canceled while waiting no slot is taken and the context error is returned.
+func (l *requestLimiter) Acquire(ctx context.Context) (func(), error) {
+	if l.slots != nil {
+		l.queued.Add(1)
+		select {
+		case l.slots <- true:
+			l.queued.Add(-1)
+		case <-ctx.Done():
+			l.queued.Add(-1)
+			return nil, ctx.Err()
+		}
+	}
+	l.inFlight.Add(1)
+	return func() {
+		l.inFlight.Add(-1)
+		if l.slots != nil {
+			<-l.slots
+		}
+	}, nil
+}
+
+// Limit returns the maximum number of concurrent requests (0 if unlimited)
+func (l *requestLimiter) Limit() int {
+	return cap(l.slots)
+}
+
+// InFlight returns the number of requests currently running
+func (l *requestLimiter) InFlight() int {
+	return int(l.inFlight.Load())
+}
+
+// Queued returns the number of requests waiting for a free slot
+func (l *requestLimiter) Queued() int {
+	return int(l.queued.Load())
+}
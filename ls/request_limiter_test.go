@@ -0,0 +1,102 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	l := newRequestLimiter(2)
+	require.Equal(t, 2, l.Limit())
+
+	release1, err := l.Acquire(context.Background())
+	require.NoError(t, err)
+	release2, err := l.Acquire(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, l.InFlight())
+
+	// The third request waits for a free slot
+	acquired := make(chan func())
+	go func() {
+		release3, _ := l.Acquire(context.Background())
+		acquired <- release3
+	}()
+	require.Eventually(t, func() bool { return l.Queued() == 1 }, time.Second, time.Millisecond)
+	select {
+	case <-acquired:
+		require.FailNow(t, "the limit has been exceeded")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	release1()
+	release3 := <-acquired
+	require.Equal(t, 0, l.Queued())
+	require.Equal(t, 2, l.InFlight())
+
+	release2()
+	release3()
+	require.Equal(t, 0, l.InFlight())
+}
+
+func TestRequestLimiterCanceled(t *testing.T) {
+	l := newRequestLimiter(1)
+	release, err := l.Acquire(context.Background())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	other, err := l.Acquire(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Nil(t, other)
+	require.Equal(t, 0, l.Queued())
+	require.Equal(t, 1, l.InFlight(), "a canceled request must not take a slot")
+
+	release()
+	release, err = l.Acquire(context.Background())
+	require.NoError(t, err)
+	release()
+}
+
+func TestRequestLimiterUnlimited(t *testing.T) {
+	l := newRequestLimiter(0)
+	require.Equal(t, 0, l.Limit())
+	for i := 0; i < 100; i++ {
+		_, err := l.Acquire(context.Background())
+		require.NoError(t, err)
+	}
+	require.Equal(t, 100, l.InFlight())
+}
+
+func TestAcquireClangdSlotCanceled(t *testing.T) {
+	ls := &INOLanguageServer{clangdRequests: newRequestLimiter(1)}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	release, respErr := ls.acquireClangdSlot(context.Background(), logger)
+	require.Nil(t, respErr)
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, respErr = ls.acquireClangdSlot(ctx, logger)
+	require.NotNil(t, respErr)
+	require.Equal(t, jsonrpc.ErrorCodesRequestCancelled, respErr.Code)
+}
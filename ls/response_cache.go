@@ -0,0 +1,142 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/vincecity/go-lsp"
+)
+
+// responseCacheSize is the number of responses kept by the responseCache
+const responseCacheSize = 64
+
+// responseCacheKey identifies a request on a version of a document: the position is
+// the zero value for the requests on the whole document. The generation is the one of the
+// cache when the request has been received.
+type responseCacheKey struct {
+	method     string
+	uri        lsp.DocumentURI
+	version    int
+	position   lsp.Position
+	generation uint64
+}
+
+type responseCacheEntry struct {
+	key   responseCacheKey
+	value interface{}
+}
+
+// cachedDocumentSymbols is the cached response of a documentSymbol request, that may be
+// given in either of the formats
+type cachedDocumentSymbols struct {
+	symbols            []lsp.DocumentSymbol
+	symbolsInformation []lsp.SymbolInformation
+}
+
+// responseCache is a LRU cache of the responses to the idempotent requests (hover,
+// documentSymbol and semanticTokens), that the IDE sends again for the same version of
+// a document when the focus changes. The responses of clangd depend on all the documents
+// of the sketch, so the whole cache is cleared when any of them changes, when the sketch
+// is rebuilt and when clangd publishes the diagnostics of a document (it has been parsed
+// again, for example because an included file changed on disk).
+//
+// The cache may be cleared while clangd computes a response: the generation counts the
+// clears, so that the responses computed before the last one are not cached.
+type responseCache struct {
+	mutex      sync.Mutex
+	capacity   int
+	entries    *list.List
+	index      map[responseCacheKey]*list.Element
+	generation uint64
+}
+
+// newResponseCache creates a responseCache keeping at most capacity responses
+func newResponseCache(capacity int) *responseCache {
+	return &responseCache{
+		capacity: capacity,
+		entries:  list.New(),
+		index:    map[responseCacheKey]*list.Element{},
+	}
+}
+
+// Get returns the cached response for the given key, if any
+func (c *responseCache) Get(key responseCacheKey) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+	c.entries.MoveToFront(elem)
+	return elem.Value.(*responseCacheEntry).value, true
+}
+
+// Put adds a response to the cache, evicting the least recently used one if full. The
+// response is discarded if the cache has been cleared since the key has been created.
+func (c *responseCache) Put(key responseCacheKey, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if key.generation != c.generation {
+		return
+	}
+	if elem, ok := c.index[key]; ok {
+		elem.Value.(*responseCacheEntry).value = value
+		c.entries.MoveToFront(elem)
+		return
+	}
+	c.index[key] = c.entries.PushFront(&responseCacheEntry{key: key, value: value})
+	for c.entries.Len() > c.capacity {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.index, oldest.Value.(*responseCacheEntry).key)
+	}
+}
+
+// Clear removes all the cached responses
+func (c *responseCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries.Init()
+	c.index = map[responseCacheKey]*list.Element{}
+	c.generation++
+}
+
+// Generation returns the number of times the cache has been cleared
+func (c *responseCache) Generation() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generation
+}
+
+// Len returns the number of cached responses
+func (c *responseCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.entries.Len()
+}
+
+// responseCacheKey returns the cache key of a request on the given position of an IDE
+// document, at its current version. It returns false if the document is not tracked.
+// The caller must hold the read lock.
+func (ls *INOLanguageServer) responseCacheKey(method string, ideURI lsp.DocumentURI, position lsp.Position) (responseCacheKey, bool) {
+	doc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]
+	if !ok {
+		return responseCacheKey{}, false
+	}
+	return responseCacheKey{method: method, uri: doc.URI, version: doc.Version, position: position, generation: ls.responseCache.Generation()}, true
+}
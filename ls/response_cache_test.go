@@ -0,0 +1,103 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestResponseCache(t *testing.T) {
+	cache := newResponseCache(2)
+	key := func(line int) responseCacheKey {
+		return responseCacheKey{method: "textDocument/hover", version: 1, position: lsp.Position{Line: line}}
+	}
+
+	_, ok := cache.Get(key(1))
+	require.False(t, ok)
+
+	cache.Put(key(1), "one")
+	cache.Put(key(2), nil)
+	value, ok := cache.Get(key(1))
+	require.True(t, ok)
+	require.Equal(t, "one", value)
+	// The null responses are cached too
+	value, ok = cache.Get(key(2))
+	require.True(t, ok)
+	require.Nil(t, value)
+
+	// The least recently used response is evicted
+	_, _ = cache.Get(key(1))
+	cache.Put(key(3), "three")
+	require.Equal(t, 2, cache.Len())
+	_, ok = cache.Get(key(2))
+	require.False(t, ok)
+	_, ok = cache.Get(key(1))
+	require.True(t, ok)
+
+	// A response can be replaced
+	cache.Put(key(3), "new three")
+	value, _ = cache.Get(key(3))
+	require.Equal(t, "new three", value)
+	require.Equal(t, 2, cache.Len())
+
+	cache.Clear()
+	require.Equal(t, 0, cache.Len())
+	_, ok = cache.Get(key(3))
+	require.False(t, ok)
+
+	// The responses computed before a clear are not cached
+	cache.Put(key(1), "stale")
+	require.Equal(t, 0, cache.Len())
+	current := key(1)
+	current.generation = cache.Generation()
+	cache.Put(current, "one")
+	value, ok = cache.Get(current)
+	require.True(t, ok)
+	require.Equal(t, "one", value)
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.Clangd = &clangdLSPClient{conn: lsp.NewClient(&bytes.Buffer{}, &bytes.Buffer{}, nil)}
+	ls.IDE = &IDELSPServer{conn: lsp.NewServer(&bytes.Buffer{}, &bytes.Buffer{}, nil)}
+	ls.config = &Config{}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	helper := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h"))
+
+	// The documents not tracked can't be cached, their version is unknown
+	_, ok := ls.responseCacheKey("textDocument/hover", lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Other.cpp")), lsp.Position{})
+	require.False(t, ok)
+
+	key, ok := ls.responseCacheKey("textDocument/hover", helper, lsp.Position{Line: 3, Character: 5})
+	require.True(t, ok)
+	require.Equal(t, responseCacheKey{method: "textDocument/hover", uri: helper, position: lsp.Position{Line: 3, Character: 5}}, key)
+	ls.responseCache.Put(key, "counter")
+
+	// A change of any document clears the cache
+	ls.applyIdeDocumentChanges(logger, &lsp.DidChangeTextDocumentParams{
+		TextDocument: lsp.VersionedTextDocumentIdentifier{
+			TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))},
+			Version:                1,
+		},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{Range: &lsp.Range{}, Text: "// Blink\n"}},
+	})
+	require.Equal(t, 0, ls.responseCache.Len())
+}
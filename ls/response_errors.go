@@ -0,0 +1,93 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"errors"
+
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// errServerNotInitialized is the error returned to the IDE for the requests sent before
+// the initialize request: they can't wait for clangd, it's not going to be started.
+var errServerNotInitialized = errors.New("the language server has not been initialized yet")
+
+// ResponseErrorData is the data of the error responses sent to the IDE: it tells which
+// document, and which version of it, the error refers to.
+type ResponseErrorData struct {
+	URI     lsp.DocumentURI `json:"uri"`
+	Version *int            `json:"version,omitempty"`
+}
+
+// responseError returns the error response for the given error: the documents not known
+// by the language server (or not analyzed, see ExternalFilesDecline) and the positions
+// outside of the documents are invalid params of the request, the requests canceled while
+// waiting for clangd are reported as such, everything else is an internal error.
+func responseError(err error) *jsonrpc.ResponseError {
+	var unknownURI *UnknownURIError
+	var declined *ExternalFileDeclinedError
+	var invalidPosition *InvalidPositionError
+	switch {
+	case errors.As(err, &unknownURI):
+		return &jsonrpc.ResponseError{
+			Code:    jsonrpc.ErrorCodesInvalidParams,
+			Message: err.Error(),
+			Data:    lsp.EncodeMessage(&ResponseErrorData{URI: unknownURI.URI}),
+		}
+	case errors.As(err, &declined):
+		return &jsonrpc.ResponseError{
+			Code:    jsonrpc.ErrorCodesInvalidParams,
+			Message: err.Error(),
+			Data:    lsp.EncodeMessage(&ResponseErrorData{URI: declined.URI}),
+		}
+	case errors.As(err, &invalidPosition):
+		return &jsonrpc.ResponseError{
+			Code:    jsonrpc.ErrorCodesInvalidParams,
+			Message: err.Error(),
+			Data:    lsp.EncodeMessage(&ResponseErrorData{URI: invalidPosition.URI, Version: &invalidPosition.Version}),
+		}
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesRequestCancelled, Message: err.Error()}
+	case errors.Is(err, errServerNotInitialized):
+		return &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesServerNotInitialized, Message: err.Error()}
+	default:
+		return &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+	}
+}
+
+// clangdResponseError returns the error response for an error replied by clangd to a
+// request on the given IDE document. The codes the IDE can react to are kept, for example
+// ContentModified tells to retry the request on the new version of the document, and the
+// version of the document seen by clangd is attached. The caller must hold the read-lock.
+func (ls *INOLanguageServer) clangdResponseError(ideURI lsp.DocumentURI, clangErr *jsonrpc.ResponseError) *jsonrpc.ResponseError {
+	code := jsonrpc.ErrorCodesInternalError
+	switch clangErr.Code {
+	case jsonrpc.ErrorCodesInvalidParams, jsonrpc.ErrorCodesContentModified, jsonrpc.ErrorCodesRequestCancelled:
+		code = clangErr.Code
+	}
+	data := &ResponseErrorData{URI: ideURI}
+	if doc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]; ok {
+		version := doc.Version
+		data.Version = &version
+	}
+	return &jsonrpc.ResponseError{
+		Code:    code,
+		Message: clangErr.AsError().Error(),
+		Data:    lsp.EncodeMessage(data),
+	}
+}
@@ -0,0 +1,83 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+func TestResponseError(t *testing.T) {
+	uri := lsp.NewDocumentURI("/tmp/Sketch/Sketch.ino")
+	respErr := responseError(fmt.Errorf("converting position: %w", &UnknownURIError{URI: uri}))
+	require.Equal(t, jsonrpc.ErrorCodesInvalidParams, respErr.Code)
+	var data ResponseErrorData
+	require.NoError(t, json.Unmarshal(respErr.Data, &data))
+	require.Equal(t, uri, data.URI)
+	require.Nil(t, data.Version)
+
+	respErr = responseError(fmt.Errorf("waiting for clangd: %w", context.Canceled))
+	require.Equal(t, jsonrpc.ErrorCodesRequestCancelled, respErr.Code)
+	require.Nil(t, respErr.Data)
+
+	require.Equal(t, jsonrpc.ErrorCodesServerNotInitialized, responseError(errServerNotInitialized).Code)
+	require.Equal(t, jsonrpc.ErrorCodesInternalError, responseError(fmt.Errorf("other")).Code)
+}
+
+func TestClangdResponseError(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ino := ls.sketchRoot.Join("Sketch.ino")
+	ls.trackedIdeDocs[ino.String()] = lsp.TextDocumentItem{URI: lsp.NewDocumentURIFromPath(ino), Version: 7}
+
+	// The codes the IDE can react to are kept, together with the tracked version
+	respErr := ls.clangdResponseError(lsp.NewDocumentURIFromPath(ino), &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesContentModified, Message: "content modified"})
+	require.Equal(t, jsonrpc.ErrorCodesContentModified, respErr.Code)
+	var data ResponseErrorData
+	require.NoError(t, json.Unmarshal(respErr.Data, &data))
+	require.Equal(t, lsp.NewDocumentURIFromPath(ino), data.URI)
+	require.NotNil(t, data.Version)
+	require.Equal(t, 7, *data.Version)
+
+	// The other codes are internal errors of the language server
+	respErr = ls.clangdResponseError(lsp.NewDocumentURIFromPath(ino), &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesUnknownErrorCode, Message: "failure"})
+	require.Equal(t, jsonrpc.ErrorCodesInternalError, respErr.Code)
+}
+
+func TestServerNotInitialized(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	request := func() (res interface{}, respErr *jsonrpc.ResponseError) {
+		defer replyClangdStartupFailure(&respErr)
+		ls.readLock(logger, true)
+		defer ls.readUnlock(logger)
+		return "result", nil
+	}
+	res, respErr := request()
+	require.Nil(t, res)
+	require.NotNil(t, respErr)
+	require.Equal(t, jsonrpc.ErrorCodesServerNotInitialized, respErr.Code)
+
+	// The lock has been released
+	ls.writeLock(logger, false)
+	ls.writeUnlock(logger)
+}
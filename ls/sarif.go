@@ -0,0 +1,238 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/arduino/arduino-language-server/globals"
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// sarifSketchRootBaseID is the base of the URIs of the sketch files in the SARIF reports
+const sarifSketchRootBaseID = "SKETCH_ROOT"
+
+// SarifLog is a SARIF 2.1.0 report, only the fields used by the language server are defined
+type SarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []SarifRun `json:"runs"`
+}
+
+// SarifRun is a run of the tool in a SARIF report
+type SarifRun struct {
+	Tool               SarifTool                        `json:"tool"`
+	OriginalURIBaseIDs map[string]SarifArtifactLocation `json:"originalUriBaseIds,omitempty"`
+	Results            []SarifResult                    `json:"results"`
+}
+
+// SarifTool describes the tool that produced a SARIF report
+type SarifTool struct {
+	Driver SarifToolComponent `json:"driver"`
+}
+
+// SarifToolComponent describes the tool and the rules of its results
+type SarifToolComponent struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version,omitempty"`
+	InformationURI string      `json:"informationUri,omitempty"`
+	Rules          []SarifRule `json:"rules"`
+}
+
+// SarifRule is a rule of the tool: the code of the diagnostics
+type SarifRule struct {
+	ID      string `json:"id"`
+	HelpURI string `json:"helpUri,omitempty"`
+}
+
+// SarifResult is a diagnostic in a SARIF report
+type SarifResult struct {
+	RuleID    string          `json:"ruleId,omitempty"`
+	Level     string          `json:"level"`
+	Message   SarifMessage    `json:"message"`
+	Locations []SarifLocation `json:"locations"`
+}
+
+// SarifMessage is the message of a SARIF result
+type SarifMessage struct {
+	Text string `json:"text"`
+}
+
+// SarifLocation is the location of a SARIF result
+type SarifLocation struct {
+	PhysicalLocation SarifPhysicalLocation `json:"physicalLocation"`
+}
+
+// SarifPhysicalLocation is a region of a file
+type SarifPhysicalLocation struct {
+	ArtifactLocation SarifArtifactLocation `json:"artifactLocation"`
+	Region           SarifRegion           `json:"region"`
+}
+
+// SarifArtifactLocation is the URI of a file, relative to the base with the given id if set
+type SarifArtifactLocation struct {
+	URI       string `json:"uri"`
+	URIBaseID string `json:"uriBaseId,omitempty"`
+}
+
+// SarifRegion is a range of a file: lines and columns are 1-based, the columns are
+// counted in UTF-16 code units as the LSP positions
+type SarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+}
+
+// sarifLevel converts the severity of a diagnostic into the level of a SARIF result
+func sarifLevel(severity lsp.DiagnosticSeverity) string {
+	switch severity {
+	case lsp.DiagnosticSeverityError:
+		return "error"
+	case lsp.DiagnosticSeverityWarning:
+		return "warning"
+	case lsp.DiagnosticSeverityInformation, lsp.DiagnosticSeverityHint:
+		return "note"
+	default:
+		// Diagnostics without severity are handled as errors by the IDEs
+		return "error"
+	}
+}
+
+// diagnosticCode returns the code of the diagnostic as a string (the code may be a number)
+func diagnosticCode(diag lsp.Diagnostic) string {
+	if len(diag.Code) == 0 {
+		return ""
+	}
+	var code string
+	if err := json.Unmarshal(diag.Code, &code); err == nil {
+		return code
+	}
+	return strings.TrimSpace(string(diag.Code))
+}
+
+// buildSarifLog converts the diagnostics into a SARIF report, the files inside the sketch
+// are referenced relative to the sketch root.
+func buildSarifLog(sketchRoot *paths.Path, files []FileDiagnostics) *SarifLog {
+	run := SarifRun{
+		Tool: SarifTool{Driver: SarifToolComponent{
+			Name:           "arduino-language-server",
+			Version:        globals.VersionInfo.VersionString,
+			InformationURI: "https://github.com/arduino/arduino-language-server",
+			Rules:          []SarifRule{},
+		}},
+		Results: []SarifResult{},
+	}
+	if sketchRoot != nil {
+		run.OriginalURIBaseIDs = map[string]SarifArtifactLocation{
+			sarifSketchRootBaseID: {URI: lsp.NewDocumentURIFromPath(sketchRoot).String() + "/"},
+		}
+	}
+
+	rules := map[string]SarifRule{}
+	for _, file := range files {
+		artifact := SarifArtifactLocation{URI: file.URI.String()}
+		if sketchRoot != nil {
+			if rel, err := sketchRoot.RelTo(paths.New(file.Path)); err == nil {
+				if relPath := filepath.ToSlash(rel.String()); relPath != ".." && !strings.HasPrefix(relPath, "../") {
+					artifact = SarifArtifactLocation{URI: (&url.URL{Path: relPath}).String(), URIBaseID: sarifSketchRootBaseID}
+				}
+			}
+		}
+		for _, diag := range file.Diagnostics {
+			result := SarifResult{
+				RuleID:  diagnosticCode(diag),
+				Level:   sarifLevel(diag.Severity),
+				Message: SarifMessage{Text: diag.Message},
+				Locations: []SarifLocation{{PhysicalLocation: SarifPhysicalLocation{
+					ArtifactLocation: artifact,
+					Region: SarifRegion{
+						StartLine:   diag.Range.Start.Line + 1,
+						StartColumn: diag.Range.Start.Character + 1,
+						EndLine:     diag.Range.End.Line + 1,
+						EndColumn:   diag.Range.End.Character + 1,
+					},
+				}}},
+			}
+			if result.RuleID != "" {
+				rule := SarifRule{ID: result.RuleID}
+				if diag.CodeDescription != nil {
+					rule.HelpURI = string(diag.CodeDescription.Href)
+				}
+				if _, ok := rules[rule.ID]; !ok || rules[rule.ID].HelpURI == "" {
+					rules[rule.ID] = rule
+				}
+			}
+			run.Results = append(run.Results, result)
+		}
+	}
+	for _, rule := range rules {
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, rule)
+	}
+	sort.Slice(run.Tool.Driver.Rules, func(i, j int) bool { return run.Tool.Driver.Rules[i].ID < run.Tool.Driver.Rules[j].ID })
+
+	return &SarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []SarifRun{run},
+	}
+}
+
+// exportDiagnostics returns the SARIF report of the diagnostics currently published to the
+// IDE. If an output file is given as argument the report is saved there too.
+func (ls *INOLanguageServer) exportDiagnostics(logger jsonrpc.FunctionLogger, output *paths.Path) (*SarifLog, error) {
+	ls.readLock(logger, false)
+	sketchRoot := ls.sketchRoot
+	ls.readUnlock(logger)
+
+	report := buildSarifLog(sketchRoot, ls.currentDiagnostics())
+	logger.Logf("Exported %d diagnostics", len(report.Runs[0].Results))
+	if output == nil {
+		return report, nil
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := output.WriteFile(data); err != nil {
+		return nil, fmt.Errorf("writing diagnostics report: %w", err)
+	}
+	logger.Logf("Diagnostics report saved to %s", output)
+	return report, nil
+}
+
+// parseExportDiagnosticsOutput returns the optional output file given as argument of the
+// "arduino/exportDiagnostics" command
+func parseExportDiagnosticsOutput(arguments []interface{}) (*paths.Path, error) {
+	if len(arguments) == 0 {
+		return nil, nil
+	}
+	if len(arguments) > 1 {
+		return nil, fmt.Errorf("expected at most 1 argument (output file), got %d", len(arguments))
+	}
+	file, ok := arguments[0].(string)
+	if !ok || file == "" {
+		return nil, fmt.Errorf("invalid output file: %v", arguments[0])
+	}
+	return paths.New(file), nil
+}
@@ -0,0 +1,115 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"go.bug.st/json"
+)
+
+func TestBuildSarifLog(t *testing.T) {
+	sketchRoot := paths.New("/home/user/Arduino/Blink")
+	library := paths.New("/home/user/Arduino/libraries/Servo/Servo.h")
+	missingLoop := newSketchDiagnostic(diagnosticCodeMissingLoop, lsp.DiagnosticSeverityError, lsp.Range{}, "The sketch has no loop() function")
+	addDiagnosticCodeDescription(&missingLoop, diagnosticCodeMissingLoop)
+	files := []FileDiagnostics{
+		{
+			URI:  lsp.NewDocumentURIFromPath(sketchRoot.Join("Blink.ino")),
+			Path: sketchRoot.Join("Blink.ino").String(),
+			Diagnostics: []lsp.Diagnostic{
+				missingLoop,
+				{Range: testRange(4, 2, 4, 7), Severity: lsp.DiagnosticSeverityHint, Code: json.RawMessage(`42`), Message: "hint"},
+			},
+		},
+		{
+			URI:         lsp.NewDocumentURIFromPath(sketchRoot.Join("src", "My Helper.h")),
+			Path:        sketchRoot.Join("src", "My Helper.h").String(),
+			Diagnostics: []lsp.Diagnostic{{Range: testRange(1, 0, 1, 3), Severity: lsp.DiagnosticSeverityWarning, Message: "unused"}},
+		},
+		{
+			URI:         lsp.NewDocumentURIFromPath(library),
+			Path:        library.String(),
+			Diagnostics: []lsp.Diagnostic{{Range: testRange(0, 0, 0, 1), Message: "library error"}},
+		},
+	}
+
+	report := buildSarifLog(sketchRoot, files)
+	require.Equal(t, "2.1.0", report.Version)
+	require.Len(t, report.Runs, 1)
+	run := report.Runs[0]
+	require.Equal(t, "arduino-language-server", run.Tool.Driver.Name)
+	require.Equal(t, "file:///home/user/Arduino/Blink/", run.OriginalURIBaseIDs[sarifSketchRootBaseID].URI)
+	require.Equal(t, []SarifRule{
+		{ID: "42"},
+		{ID: diagnosticCodeMissingLoop, HelpURI: diagnosticCodeDescriptions[diagnosticCodeMissingLoop]},
+	}, run.Tool.Driver.Rules)
+
+	require.Len(t, run.Results, 4)
+	require.Equal(t, SarifResult{
+		RuleID:  diagnosticCodeMissingLoop,
+		Level:   "error",
+		Message: SarifMessage{Text: "The sketch has no loop() function"},
+		Locations: []SarifLocation{{PhysicalLocation: SarifPhysicalLocation{
+			ArtifactLocation: SarifArtifactLocation{URI: "Blink.ino", URIBaseID: sarifSketchRootBaseID},
+			Region:           SarifRegion{StartLine: 1, StartColumn: 1, EndLine: 1, EndColumn: 1},
+		}}},
+	}, run.Results[0])
+	require.Equal(t, "note", run.Results[1].Level)
+	require.Equal(t, "42", run.Results[1].RuleID)
+	require.Equal(t, SarifRegion{StartLine: 5, StartColumn: 3, EndLine: 5, EndColumn: 8}, run.Results[1].Locations[0].PhysicalLocation.Region)
+	require.Equal(t, "warning", run.Results[2].Level)
+	require.Empty(t, run.Results[2].RuleID)
+	require.Equal(t, SarifArtifactLocation{URI: "src/My%20Helper.h", URIBaseID: sarifSketchRootBaseID}, run.Results[2].Locations[0].PhysicalLocation.ArtifactLocation)
+	// Files outside the sketch are referenced with their absolute URI
+	require.Equal(t, SarifArtifactLocation{URI: lsp.NewDocumentURIFromPath(library).String()}, run.Results[3].Locations[0].PhysicalLocation.ArtifactLocation)
+	require.Equal(t, "error", run.Results[3].Level)
+}
+
+func TestExportDiagnostics(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	inoURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	ls.publishedDiagnostics = map[lsp.DocumentURI][]lsp.Diagnostic{
+		inoURI: {{Range: testRange(0, 0, 0, 4), Severity: lsp.DiagnosticSeverityError, Message: "error"}},
+	}
+
+	output, err := parseExportDiagnosticsOutput(nil)
+	require.NoError(t, err)
+	require.Nil(t, output)
+	_, err = parseExportDiagnosticsOutput([]interface{}{"a.sarif", "b.sarif"})
+	require.Error(t, err)
+	_, err = parseExportDiagnosticsOutput([]interface{}{true})
+	require.Error(t, err)
+
+	report, err := ls.exportDiagnostics(logger, nil)
+	require.NoError(t, err)
+	require.Len(t, report.Runs[0].Results, 1)
+
+	output, err = parseExportDiagnosticsOutput([]interface{}{paths.New(t.TempDir(), "report.sarif").String()})
+	require.NoError(t, err)
+	_, err = ls.exportDiagnostics(logger, output)
+	require.NoError(t, err)
+	data, err := output.ReadFile()
+	require.NoError(t, err)
+	var saved SarifLog
+	require.NoError(t, json.Unmarshal(data, &saved))
+	require.Equal(t, "Sketch.ino", saved.Runs[0].Results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+}
@@ -0,0 +1,340 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"unicode/utf16"
+
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// Custom semantic token modifiers added to the Arduino specific symbols of the sketch
+const (
+	semanticModifierSketchFunction   = "arduinoSketchFunction"
+	semanticModifierInterruptHandler = "arduinoInterruptHandler"
+	semanticModifierProgmem          = "arduinoProgmem"
+)
+
+// semanticTokensLegend is the legend advertised to the IDE: the standard LSP token
+// types and modifiers, followed by the ones reported by clangd and by the Arduino ones.
+// The tokens received from clangd are remapped on this legend by name.
+var semanticTokensLegend = lsp.SemanticTokensLegend{
+	TokenTypes: []string{
+		"namespace", "type", "class", "enum", "interface", "struct", "typeParameter",
+		"parameter", "variable", "property", "enumMember", "event", "function", "method",
+		"macro", "keyword", "modifier", "comment", "string", "number", "regexp", "operator",
+		"unknown", "concept", "bracket", "label",
+	},
+	TokenModifiers: []string{
+		"declaration", "definition", "readonly", "static", "deprecated", "abstract",
+		"async", "modification", "documentation", "defaultLibrary",
+		"deduced", "virtual", "dependentName", "usedAsMutableReference", "usedAsMutablePointer",
+		"constructorOrDestructor", "userDefined", "functionScope", "classScope", "fileScope",
+		"globalScope",
+		semanticModifierSketchFunction, semanticModifierInterruptHandler, semanticModifierProgmem,
+	},
+}
+
+// attachInterruptRegexp matches the handler passed to attachInterrupt(pin, handler, mode)
+var attachInterruptRegexp = regexp.MustCompile(`\battachInterrupt\s*\([^,;]*,\s*&?\s*(\w+)\s*,`)
+
+// isrRegexp matches the vector of an AVR interrupt service routine defined with ISR(vector)
+var isrRegexp = regexp.MustCompile(`\bISR\s*\(\s*(\w+)`)
+
+// progmemDeclarationRegexp matches the declarations (up to the initializer) containing PROGMEM
+var progmemDeclarationRegexp = regexp.MustCompile(`(?m)^[ \t]*([^;={}#\n]*\bPROGMEM\b[^;={}\n]*)[=;]`)
+
+var arraySizeRegexp = regexp.MustCompile(`\[[^\]]*\]`)
+var identifierRegexp = regexp.MustCompile(`\w+`)
+
+// semanticToken is a decoded semantic token with absolute position and named type and modifiers
+type semanticToken struct {
+	Line      int
+	Char      int
+	Length    int
+	Type      string
+	Modifiers []string
+}
+
+func (tok *semanticToken) hasModifier(modifier string) bool {
+	for _, m := range tok.Modifiers {
+		if m == modifier {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSemanticTokens converts the relative encoding of the LSP semantic tokens
+// into a list of tokens with absolute positions.
+func decodeSemanticTokens(data []int, legend lsp.SemanticTokensLegend) []semanticToken {
+	res := []semanticToken{}
+	line, char := 0, 0
+	for i := 0; i+4 < len(data); i += 5 {
+		if data[i] > 0 {
+			line += data[i]
+			char = 0
+		}
+		char += data[i+1]
+		tok := semanticToken{Line: line, Char: char, Length: data[i+2]}
+		if tokenType := data[i+3]; tokenType >= 0 && tokenType < len(legend.TokenTypes) {
+			tok.Type = legend.TokenTypes[tokenType]
+		}
+		for bit, modifier := range legend.TokenModifiers {
+			if data[i+4]&(1<<bit) != 0 {
+				tok.Modifiers = append(tok.Modifiers, modifier)
+			}
+		}
+		res = append(res, tok)
+	}
+	return res
+}
+
+// encodeSemanticTokens converts the tokens into the relative encoding of the LSP
+// semantic tokens. The tokens with a type unknown to the legend are dropped.
+func encodeSemanticTokens(tokens []semanticToken, legend lsp.SemanticTokensLegend) []int {
+	typeIndexes := map[string]int{}
+	for i, tokenType := range legend.TokenTypes {
+		typeIndexes[tokenType] = i
+	}
+	modifierBits := map[string]int{}
+	for bit, modifier := range legend.TokenModifiers {
+		modifierBits[modifier] = bit
+	}
+
+	sort.SliceStable(tokens, func(i, j int) bool {
+		if tokens[i].Line != tokens[j].Line {
+			return tokens[i].Line < tokens[j].Line
+		}
+		return tokens[i].Char < tokens[j].Char
+	})
+
+	data := []int{}
+	prevLine, prevChar := 0, 0
+	for _, tok := range tokens {
+		tokenType, ok := typeIndexes[tok.Type]
+		if !ok {
+			continue
+		}
+		modifiers := 0
+		for _, modifier := range tok.Modifiers {
+			if bit, ok := modifierBits[modifier]; ok {
+				modifiers |= 1 << bit
+			}
+		}
+		deltaChar := tok.Char
+		if tok.Line == prevLine {
+			deltaChar -= prevChar
+		}
+		data = append(data, tok.Line-prevLine, deltaChar, tok.Length, tokenType, modifiers)
+		prevLine, prevChar = tok.Line, tok.Char
+	}
+	return data
+}
+
+// arduinoSymbols are the names of the sketch symbols highlighted with an Arduino modifier
+type arduinoSymbols struct {
+	interruptHandlers map[string]bool
+	progmemVariables  map[string]bool
+}
+
+// findArduinoSymbols collects the interrupt handlers and the PROGMEM variables defined in the text
+func findArduinoSymbols(text string) arduinoSymbols {
+	symbols := arduinoSymbols{
+		interruptHandlers: map[string]bool{},
+		progmemVariables:  map[string]bool{},
+	}
+	for _, match := range attachInterruptRegexp.FindAllStringSubmatch(text, -1) {
+		symbols.interruptHandlers[match[1]] = true
+	}
+	for _, match := range isrRegexp.FindAllStringSubmatch(text, -1) {
+		symbols.interruptHandlers[match[1]] = true
+	}
+	for _, match := range progmemDeclarationRegexp.FindAllStringSubmatch(text, -1) {
+		// The declared name is the last identifier before the initializer, not counting
+		// PROGMEM itself and the array sizes.
+		words := identifierRegexp.FindAllString(arraySizeRegexp.ReplaceAllString(match[1], ""), -1)
+		for i := len(words) - 1; i >= 0; i-- {
+			if words[i] != "PROGMEM" {
+				symbols.progmemVariables[words[i]] = true
+				break
+			}
+		}
+	}
+	return symbols
+}
+
+// addArduinoModifiers adds the Arduino modifiers to the tokens of the given document text.
+// The setup and loop functions are marked only in the .ino tabs.
+func addArduinoModifiers(tokens []semanticToken, text string, symbols arduinoSymbols, isIno bool) {
+	lines := textutils.SplitLines(text)
+	for i := range tokens {
+		tok := &tokens[i]
+		name := semanticTokenText(lines, *tok)
+		if name == "" {
+			continue
+		}
+		if isIno && tok.Type == "function" && (name == "setup" || name == "loop") {
+			tok.Modifiers = append(tok.Modifiers, semanticModifierSketchFunction)
+		}
+		if symbols.interruptHandlers[name] {
+			tok.Modifiers = append(tok.Modifiers, semanticModifierInterruptHandler)
+		}
+		if tok.Type == "variable" && symbols.progmemVariables[name] {
+			tok.Modifiers = append(tok.Modifiers, semanticModifierProgmem)
+		}
+	}
+}
+
+// semanticTokenText returns the text covered by the token, the token position is in UTF-16 units
+func semanticTokenText(lines []string, tok semanticToken) string {
+	if tok.Line >= len(lines) {
+		return ""
+	}
+	line := utf16.Encode([]rune(lines[tok.Line]))
+	if tok.Char+tok.Length > len(line) {
+		return ""
+	}
+	return string(utf16.Decode(line[tok.Char : tok.Char+tok.Length]))
+}
+
+func (ls *INOLanguageServer) textDocumentSemanticTokensFullReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.SemanticTokensParams) (res *lsp.SemanticTokens, respErr *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "textDocument/semanticTokens/full") {
+		return nil, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
+	ls.readLock(logger, true)
+	defer ls.readUnlock(logger)
+
+	if ls.clangdTokensLegend == nil {
+		logger.Logf("clangd does not provide semantic tokens")
+		return nil, nil
+	}
+	if ls.reducedFeatures {
+		logger.Logf("Semantic tokens disabled: the sketch is too large")
+		return nil, nil
+	}
+
+	ideURI := ideParams.TextDocument.URI
+	if cacheKey, cacheable := ls.responseCacheKey("textDocument/semanticTokens/full", ideURI, lsp.Position{}); cacheable {
+		if cached, ok := ls.responseCache.Get(cacheKey); ok {
+			logger.Logf("Cached response")
+			return cached.(*lsp.SemanticTokens), nil
+		}
+		defer func() {
+			if respErr == nil {
+				ls.responseCache.Put(cacheKey, res)
+			}
+		}()
+	}
+	tokens, clangURI, respErr := ls.clangdSemanticTokens(ctx, logger, ideParams)
+	if tokens == nil {
+		return nil, respErr
+	}
+	if doc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]; ok {
+		isIno := ls.clangURIRefersToIno(clangURI)
+		symbolsSource := doc.Text
+		if isIno {
+			// The handlers and the PROGMEM data may be defined in another tab
+			symbolsSource = ls.sketchMapper.CppText.Text
+		}
+		addArduinoModifiers(tokens, doc.Text, findArduinoSymbols(symbolsSource), isIno)
+	}
+	return &lsp.SemanticTokens{Data: encodeSemanticTokens(tokens, semanticTokensLegend)}, nil
+}
+
+// clangdSemanticTokens requests to clangd the semantic tokens of an IDE document and returns
+// them moved to the IDE document, together with the URI of the clangd document. The returned
+// tokens are nil if clangd doesn't provide them. The caller must hold the read lock.
+func (ls *INOLanguageServer) clangdSemanticTokens(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.SemanticTokensParams) ([]semanticToken, lsp.DocumentURI, *jsonrpc.ResponseError) {
+	clangTextDocument, err := ls.ide2ClangTextDocumentIdentifier(logger, ideParams.TextDocument)
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, lsp.NilURI, responseError(err)
+	}
+	clangParams := &lsp.SemanticTokensParams{
+		WorkDoneProgressParams: ideParams.WorkDoneProgressParams,
+		PartialResultParams:    ideParams.PartialResultParams,
+		TextDocument:           clangTextDocument,
+	}
+	var clangTokens *lsp.SemanticTokens
+	clangErr, err := ls.sendClangdRequest(logger, clangTextDocument.URI, func() (clangErr *jsonrpc.ResponseError, err error) {
+		clangTokens, clangErr, err = ls.Clangd.conn.TextDocumentSemanticTokensFull(ctx, clangParams)
+		return
+	})
+	if err != nil {
+		logger.Logf("clangd communication ERROR: %v", err)
+		ls.Close()
+		return nil, lsp.NilURI, responseError(err)
+	}
+	if clangErr != nil {
+		logger.Logf("clangd response ERROR: %v", clangErr.AsError())
+		return nil, lsp.NilURI, ls.clangdResponseError(ideParams.TextDocument.URI, clangErr)
+	}
+	if clangTokens == nil {
+		logger.Logf("null response from clangd")
+		return nil, lsp.NilURI, nil
+	}
+	tokens := decodeSemanticTokens(clangTokens.Data, *ls.clangdTokensLegend)
+	return ls.clang2IdeSemanticTokens(tokens, ideParams.TextDocument.URI, clangTextDocument.URI), clangTextDocument.URI, nil
+}
+
+// clang2IdeSemanticTokens moves the tokens from the clangd document to the IDE one:
+// for the .ino tabs only the tokens of the requested tab are kept.
+func (ls *INOLanguageServer) clang2IdeSemanticTokens(tokens []semanticToken, ideURI, clangURI lsp.DocumentURI) []semanticToken {
+	if ls.clangURIRefersToIno(clangURI) {
+		idePath := ideURI.AsPath().String()
+		res := []semanticToken{}
+		for _, tok := range tokens {
+			if ls.sketchMapper.IsPreprocessedCppLine(tok.Line) {
+				continue
+			}
+			inoFile, inoLine, ok := ls.sketchMapper.CppToInoLineOk(tok.Line)
+			if !ok || inoFile != idePath {
+				continue
+			}
+			tok.Line = inoLine
+			res = append(res, tok)
+		}
+		return res
+	}
+
+	if inside, _ := clangURI.AsPath().IsInsideDir(ls.buildSketchRoot); !inside {
+		return tokens
+	}
+
+	// The .cpp/.h files of the sketch are copied in the build folder with an additional #line directive
+	res := []semanticToken{}
+	for _, tok := range tokens {
+		if tok.Line == 0 {
+			continue
+		}
+		tok.Line--
+		res = append(res, tok)
+	}
+	return res
+}
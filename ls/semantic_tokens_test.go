@@ -0,0 +1,82 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestSemanticTokensEncoding(t *testing.T) {
+	clangdLegend := lsp.SemanticTokensLegend{
+		TokenTypes:     []string{"variable", "function", "unsupported"},
+		TokenModifiers: []string{"declaration", "unsupported", "globalScope"},
+	}
+	data := []int{
+		1, 5, 5, 1, 1, // function "setup" with declaration at 1:5
+		0, 10, 3, 0, 6, // variable at 1:15 with unsupported+globalScope
+		2, 2, 4, 2, 0, // unsupported type at 3:2
+	}
+	tokens := decodeSemanticTokens(data, clangdLegend)
+	require.Equal(t, []semanticToken{
+		{Line: 1, Char: 5, Length: 5, Type: "function", Modifiers: []string{"declaration"}},
+		{Line: 1, Char: 15, Length: 3, Type: "variable", Modifiers: []string{"unsupported", "globalScope"}},
+		{Line: 3, Char: 2, Length: 4, Type: "unsupported"},
+	}, tokens)
+
+	legend := lsp.SemanticTokensLegend{
+		TokenTypes:     []string{"function", "variable"},
+		TokenModifiers: []string{"globalScope", "declaration"},
+	}
+	require.Equal(t, []int{
+		1, 5, 5, 0, 2,
+		0, 10, 3, 1, 1,
+	}, encodeSemanticTokens(tokens, legend))
+}
+
+func TestArduinoSemanticModifiers(t *testing.T) {
+	text := "const char message[] PROGMEM = \"hello\";\n" +
+		"const PROGMEM uint8_t table[4][2] = {};\n" +
+		"void onPulse() {}\n" +
+		"ISR(TIMER1_COMPA_vect) {}\n" +
+		"void setup() {\n" +
+		"  attachInterrupt(digitalPinToInterrupt(2), onPulse, RISING);\n" +
+		"}\n"
+	symbols := findArduinoSymbols(text)
+	require.Equal(t, map[string]bool{"onPulse": true, "TIMER1_COMPA_vect": true}, symbols.interruptHandlers)
+	require.Equal(t, map[string]bool{"message": true, "table": true}, symbols.progmemVariables)
+
+	tokens := []semanticToken{
+		{Line: 0, Char: 11, Length: 7, Type: "variable"},
+		{Line: 1, Char: 22, Length: 5, Type: "variable"},
+		{Line: 2, Char: 5, Length: 7, Type: "function"},
+		{Line: 3, Char: 4, Length: 17, Type: "macro"},
+		{Line: 4, Char: 5, Length: 5, Type: "function"},
+	}
+	addArduinoModifiers(tokens, text, symbols, true)
+	require.Equal(t, []string{semanticModifierProgmem}, tokens[0].Modifiers)
+	require.Equal(t, []string{semanticModifierProgmem}, tokens[1].Modifiers)
+	require.Equal(t, []string{semanticModifierInterruptHandler}, tokens[2].Modifiers)
+	require.Equal(t, []string{semanticModifierInterruptHandler}, tokens[3].Modifiers)
+	require.Equal(t, []string{semanticModifierSketchFunction}, tokens[4].Modifiers)
+
+	// setup and loop are not special outside the .ino tabs
+	tokens = []semanticToken{{Line: 4, Char: 5, Length: 5, Type: "function"}}
+	addArduinoModifiers(tokens, text, symbols, false)
+	require.False(t, tokens[0].hasModifier(semanticModifierSketchFunction))
+}
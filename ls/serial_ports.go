@@ -0,0 +1,291 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+
+	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// ListSerialPortsParams are the parameters of the custom "arduino/listSerialPorts" request
+type ListSerialPortsParams struct {
+	// Watch enables (or disables, if false) the "arduino/serialPortsChanged" events
+	// sent when a board is plugged or unplugged.
+	Watch bool `json:"watch"`
+}
+
+// ListSerialPortsResult is the response to the custom "arduino/listSerialPorts" request
+type ListSerialPortsResult struct {
+	Ports []*SerialPort `json:"ports"`
+}
+
+// SerialPortsChangedParams are the parameters of the "arduino/serialPortsChanged" event,
+// sent to the IDE as a "telemetry/event" notification (see ArduinoEvent)
+type SerialPortsChangedParams struct {
+	// EventType is "add" or "remove"
+	EventType string      `json:"eventType"`
+	Port      *SerialPort `json:"port,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// SerialPort is a port detected by the arduino-cli pluggable discoveries
+type SerialPort struct {
+	Address       string            `json:"address"`
+	Label         string            `json:"label,omitempty"`
+	Protocol      string            `json:"protocol"`
+	ProtocolLabel string            `json:"protocolLabel,omitempty"`
+	HardwareID    string            `json:"hardwareId,omitempty"`
+	Properties    map[string]string `json:"properties,omitempty"`
+	// Boards are the boards that match the identification properties of the port
+	Boards []DetectedBoard `json:"boards"`
+}
+
+// DetectedBoard is a board that may be connected to a SerialPort
+type DetectedBoard struct {
+	Name string `json:"name"`
+	Fqbn string `json:"fqbn,omitempty"`
+}
+
+// cliDetectedPort is a port in the JSON output of "arduino-cli board list"
+type cliDetectedPort struct {
+	MatchingBoards []DetectedBoard `json:"matching_boards"`
+	Port           *struct {
+		Address       string            `json:"address"`
+		Label         string            `json:"label"`
+		Protocol      string            `json:"protocol"`
+		ProtocolLabel string            `json:"protocol_label"`
+		Properties    map[string]string `json:"properties"`
+		HardwareID    string            `json:"hardware_id"`
+	} `json:"port"`
+}
+
+func (p *cliDetectedPort) toSerialPort() *SerialPort {
+	if p.Port == nil {
+		return nil
+	}
+	res := &SerialPort{
+		Address:       p.Port.Address,
+		Label:         p.Port.Label,
+		Protocol:      p.Port.Protocol,
+		ProtocolLabel: p.Port.ProtocolLabel,
+		HardwareID:    p.Port.HardwareID,
+		Properties:    p.Port.Properties,
+		Boards:        p.MatchingBoards,
+	}
+	if res.Boards == nil {
+		res.Boards = []DetectedBoard{}
+	}
+	return res
+}
+
+func newSerialPortFromRPC(p *rpc.DetectedPort) *SerialPort {
+	if p.GetPort() == nil {
+		return nil
+	}
+	res := &SerialPort{
+		Address:       p.GetPort().GetAddress(),
+		Label:         p.GetPort().GetLabel(),
+		Protocol:      p.GetPort().GetProtocol(),
+		ProtocolLabel: p.GetPort().GetProtocolLabel(),
+		HardwareID:    p.GetPort().GetHardwareId(),
+		Properties:    p.GetPort().GetProperties(),
+		Boards:        []DetectedBoard{},
+	}
+	for _, board := range p.GetMatchingBoards() {
+		res.Boards = append(res.Boards, DetectedBoard{Name: board.GetName(), Fqbn: board.GetFqbn()})
+	}
+	return res
+}
+
+func (ls *INOLanguageServer) listSerialPortsReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, params *ListSerialPortsParams) (*ListSerialPortsResult, *jsonrpc.ResponseError) {
+	var ports []*SerialPort
+	err := ls.runArduinoCLIWithRetries(ctx, logger, func(ctx context.Context) error {
+		var err error
+		if ls.config.CliPath == nil {
+			ports, err = ls.listSerialPortsWithArduinoCLIDaemon(ctx)
+		} else {
+			ports, err = ls.listSerialPortsWithArduinoCLI(ctx, logger)
+		}
+		return err
+	})
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, responseError(err)
+	}
+	logger.Logf("<-- listSerialPorts(%d ports)", len(ports))
+
+	if params.Watch {
+		ls.startSerialPortsWatch()
+	} else {
+		ls.stopSerialPortsWatch()
+	}
+	return &ListSerialPortsResult{Ports: ports}, nil
+}
+
+func (ls *INOLanguageServer) listSerialPortsWithArduinoCLIDaemon(ctx context.Context) ([]*SerialPort, error) {
+	client, err := ls.arduinoCLIDaemonClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.BoardList(ctx, &rpc.BoardListRequest{
+		Instance: &rpc.Instance{Id: int32(ls.config.CliInstanceNumber)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing serial ports: %w", err)
+	}
+	ports := []*SerialPort{}
+	for _, detectedPort := range resp.GetPorts() {
+		if port := newSerialPortFromRPC(detectedPort); port != nil {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+func (ls *INOLanguageServer) listSerialPortsWithArduinoCLI(ctx context.Context, logger jsonrpc.FunctionLogger) ([]*SerialPort, error) {
+	cmdOutput, err := ls.runArduinoCLI(ctx, logger, "board", "list", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		DetectedPorts []*cliDetectedPort `json:"detected_ports"`
+	}
+	if err := json.Unmarshal(cmdOutput, &res); err != nil {
+		return nil, fmt.Errorf("parsing arduino-cli output: %w", err)
+	}
+	ports := []*SerialPort{}
+	for _, detectedPort := range res.DetectedPorts {
+		if port := detectedPort.toSerialPort(); port != nil {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// startSerialPortsWatch starts sending "arduino/serialPortsChanged" events to the IDE,
+// if not already running.
+func (ls *INOLanguageServer) startSerialPortsWatch() {
+	ls.serialPortsWatchMutex.Lock()
+	defer ls.serialPortsWatchMutex.Unlock()
+	if ls.serialPortsWatchCancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ls.serialPortsWatchCancel = cancel
+
+	go func() {
+		defer cancel()
+		logger := NewLSPFunctionLogger(color.HiBlueString, "PORTS WATCH --- ")
+		logger.Logf("Started")
+		var err error
+		if ls.config.CliPath == nil {
+			err = ls.watchSerialPortsWithArduinoCLIDaemon(ctx, logger)
+		} else {
+			err = ls.watchSerialPortsWithArduinoCLI(ctx, logger)
+		}
+		if err != nil && ctx.Err() == nil {
+			logger.Logf("Error: %s", err)
+		}
+		logger.Logf("Stopped")
+
+		ls.serialPortsWatchMutex.Lock()
+		if ctx.Err() == nil {
+			// the watcher terminated by itself, allow a new request to restart it
+			ls.serialPortsWatchCancel = nil
+		}
+		ls.serialPortsWatchMutex.Unlock()
+	}()
+}
+
+// stopSerialPortsWatch stops the "arduino/serialPortsChanged" events
+func (ls *INOLanguageServer) stopSerialPortsWatch() {
+	ls.serialPortsWatchMutex.Lock()
+	defer ls.serialPortsWatchMutex.Unlock()
+	if ls.serialPortsWatchCancel != nil {
+		ls.serialPortsWatchCancel()
+		ls.serialPortsWatchCancel = nil
+	}
+}
+
+func (ls *INOLanguageServer) watchSerialPortsWithArduinoCLIDaemon(ctx context.Context, logger jsonrpc.FunctionLogger) error {
+	client, err := ls.arduinoCLIDaemonClient(ctx)
+	if err != nil {
+		return err
+	}
+	stream, err := client.BoardListWatch(ctx, &rpc.BoardListWatchRequest{
+		Instance: &rpc.Instance{Id: int32(ls.config.CliInstanceNumber)},
+	})
+	if err != nil {
+		return fmt.Errorf("watching serial ports: %w", err)
+	}
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return fmt.Errorf("watching serial ports: %w", err)
+		}
+		ls.IDE.SerialPortsChanged(logger, &SerialPortsChangedParams{
+			EventType: event.GetEventType(),
+			Port:      newSerialPortFromRPC(event.GetPort()),
+			Error:     event.GetError(),
+		})
+	}
+}
+
+func (ls *INOLanguageServer) watchSerialPortsWithArduinoCLI(ctx context.Context, logger jsonrpc.FunctionLogger) error {
+	args := []string{"--config-file", ls.config.CliConfigPath.String(), "board", "list", "--watch", "--format", "jsonmini"}
+	cmd, err := paths.NewProcessFromPath(ls.toolsEnv(), ls.config.CliPath, args...)
+	if err != nil {
+		return fmt.Errorf("watching serial ports: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("watching serial ports: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("watching serial ports: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = cmd.Kill()
+	}()
+
+	// Each event is printed as a JSON object on a single line
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var event struct {
+			cliDetectedPort
+			EventType string `json:"eventType"`
+			Error     string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			logger.Logf("Error decoding serial port event %q: %s", scanner.Text(), err)
+			continue
+		}
+		ls.IDE.SerialPortsChanged(logger, &SerialPortsChangedParams{
+			EventType: event.EventType,
+			Port:      event.toSerialPort(),
+			Error:     event.Error,
+		})
+	}
+	return cmd.Wait()
+}
@@ -0,0 +1,149 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/arduino/arduino-language-server/streams"
+)
+
+// SessionManager accepts IDE connections and serves each one of them with a
+// separate INOLanguageServer, so that every session (usually an IDE window with
+// its own sketch) has its own tracked documents, sketch mapper, build folders
+// and clangd instance.
+type SessionManager struct {
+	config   *Config
+	listener net.Listener
+	mux      sync.Mutex
+	sessions map[int]*INOLanguageServer
+	nextID   int
+	closed   bool
+}
+
+// NewSessionManager creates a SessionManager that will start the sessions with the given configuration.
+// Every session gets its own copy of the configuration.
+func NewSessionManager(config *Config) *SessionManager {
+	sessionsConfig := *config
+	sessionsConfig.MultiSession = true
+	sessionsConfig.clangdRequests = newRequestLimiter(config.ClangdMaxConcurrentRequests)
+	return &SessionManager{
+		config:   &sessionsConfig,
+		sessions: map[int]*INOLanguageServer{},
+	}
+}
+
+// Serve accepts the connections from the given listener and starts a new session for each
+// one of them. It blocks until the listener is closed.
+func (m *SessionManager) Serve(listener net.Listener) error {
+	m.mux.Lock()
+	if m.closed {
+		m.mux.Unlock()
+		return errors.New("session manager closed")
+	}
+	m.listener = listener
+	m.mux.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			m.mux.Lock()
+			closed := m.closed
+			m.mux.Unlock()
+			if closed {
+				return nil
+			}
+			return fmt.Errorf("accepting connection: %w", err)
+		}
+		go m.runSession(conn)
+	}
+}
+
+func (m *SessionManager) runSession(conn net.Conn) {
+	defer streams.CatchAndLogPanic()
+
+	m.mux.Lock()
+	if m.closed {
+		m.mux.Unlock()
+		conn.Close()
+		return
+	}
+	id := m.nextID
+	m.nextID++
+	m.mux.Unlock()
+
+	log.Printf("Session %d: started for %s", id, conn.RemoteAddr())
+	var stream io.ReadWriteCloser = conn
+	if m.config.EnableLogging {
+		stream = streams.LogReadWriteCloserAs(stream, fmt.Sprintf("inols-session-%d.log", id))
+	}
+	session, err := NewINOLanguageServer(stream, stream, m.newSessionConfig())
+	if err != nil {
+		log.Printf("Session %d: %s", id, err)
+		conn.Close()
+		return
+	}
+	closeNotify := session.CloseNotify()
+
+	m.mux.Lock()
+	m.sessions[id] = session
+	m.mux.Unlock()
+
+	<-closeNotify
+	session.Close()
+	// Stop reading from the IDE, but let the reply to the request being processed
+	// (if any) be delivered before closing the connection.
+	if c, ok := conn.(interface{ CloseRead() error }); ok && c.CloseRead() == nil {
+		<-session.IDEDisconnectNotify()
+	}
+	conn.Close()
+
+	m.mux.Lock()
+	delete(m.sessions, id)
+	m.mux.Unlock()
+	log.Printf("Session %d: closed", id)
+}
+
+// newSessionConfig returns a copy of the configuration for a new session, so that the changes
+// made by a session do not leak into the others.
+func (m *SessionManager) newSessionConfig() *Config {
+	config := *m.config
+	config.ExtraEnv = append([]string(nil), m.config.ExtraEnv...)
+	return &config
+}
+
+// Close stops accepting new connections and closes all the running sessions.
+func (m *SessionManager) Close() {
+	m.mux.Lock()
+	m.closed = true
+	if m.listener != nil {
+		m.listener.Close()
+	}
+	sessions := make([]*INOLanguageServer, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	m.mux.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+}
@@ -0,0 +1,132 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+func TestSessionManagerConfig(t *testing.T) {
+	config := &Config{Fqbn: "arduino:avr:uno", ExtraEnv: []string{"ARDUINO_DIRECTORIES_USER=/tmp"}}
+	m := NewSessionManager(config)
+	require.False(t, config.MultiSession, "the configuration given to the session manager must not be modified")
+
+	first := m.newSessionConfig()
+	second := m.newSessionConfig()
+	require.True(t, first.MultiSession)
+	require.NotSame(t, first, second)
+	require.NotNil(t, first.clangdRequests)
+	require.Same(t, first.clangdRequests, second.clangdRequests, "the clangd requests limit must be shared by the sessions")
+
+	first.Fqbn = "arduino:samd:mkr1000"
+	first.ExtraEnv[0] = "ARDUINO_DIRECTORIES_USER=/home"
+	require.Equal(t, "arduino:avr:uno", second.Fqbn)
+	require.Equal(t, []string{"ARDUINO_DIRECTORIES_USER=/tmp"}, second.ExtraEnv)
+	require.Equal(t, []string{"ARDUINO_DIRECTORIES_USER=/tmp"}, config.ExtraEnv)
+}
+
+func TestSessionManagerServe(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	m := NewSessionManager(&Config{})
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- m.Serve(listener)
+	}()
+
+	sessionsCount := func() int {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		return len(m.sessions)
+	}
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	second, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return sessionsCount() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// Closing a connection closes only its session
+	first.Close()
+	require.Eventually(t, func() bool { return sessionsCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	m.Close()
+	require.NoError(t, <-serveErr)
+	require.Eventually(t, func() bool { return sessionsCount() == 0 }, 5*time.Second, 10*time.Millisecond)
+	second.Close()
+}
+
+func TestReplyClangdStartupFailure(t *testing.T) {
+	request := func() (res interface{}, respErr *jsonrpc.ResponseError) {
+		defer replyClangdStartupFailure(&respErr)
+		panic(errClangdStartupFailed)
+	}
+	res, respErr := request()
+	require.Nil(t, res)
+	require.NotNil(t, respErr)
+	require.Equal(t, jsonrpc.ErrorCodesInternalError, respErr.Code)
+	require.Equal(t, errClangdStartupFailed.Error(), respErr.Message)
+
+	notification := func() {
+		defer replyClangdStartupFailure(nil)
+		panic(errClangdStartupFailed)
+	}
+	require.NotPanics(t, notification)
+
+	other := func() {
+		defer replyClangdStartupFailure(nil)
+		panic("other failure")
+	}
+	require.PanicsWithValue(t, "other failure", other)
+}
+
+func TestRecoverClangdUnavailable(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.config = &Config{}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	rebuild := func() (err error) {
+		defer recoverClangdUnavailable(&err)
+		ls.writeLock(logger, true)
+		defer ls.writeUnlock(logger)
+		return nil
+	}
+	// clangd is not started before the initialize request
+	require.ErrorIs(t, rebuild(), errServerNotInitialized)
+	// The lock has been released
+	ls.writeLock(logger, false)
+	ls.writeUnlock(logger)
+
+	// When running multiple sessions only the session of the failed clangd is closed
+	ls.config.MultiSession = true
+	ls.ideInitializeParams = &lsp.InitializeParams{}
+	ls.clangdFailed = true
+	require.ErrorIs(t, rebuild(), errClangdStartupFailed)
+
+	other := func() (err error) {
+		defer recoverClangdUnavailable(&err)
+		panic("other failure")
+	}
+	require.PanicsWithValue(t, "other failure", func() { _ = other() })
+}
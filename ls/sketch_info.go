@@ -0,0 +1,85 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// SketchInfo is the response to the custom "arduino/getSketchInfo" request
+type SketchInfo struct {
+	SketchRoot lsp.DocumentURI `json:"sketchRoot"`
+	MainFile   lsp.DocumentURI `json:"mainFile"`
+	Tabs       []SketchTab     `json:"tabs"`
+	BuildPath  string          `json:"buildPath"`
+	Fqbn       string          `json:"fqbn"`
+	// BuildFlagsFiles are the files of the sketch with extra compiler flags (see buildFlagsFileNames)
+	BuildFlagsFiles []lsp.DocumentURI `json:"buildFlagsFiles,omitempty"`
+}
+
+// SketchTab is a source file in the sketch root folder
+type SketchTab struct {
+	URI lsp.DocumentURI `json:"uri"`
+	// Open is true if the file is currently open in the IDE
+	Open bool `json:"open"`
+	// Version is the version of the document open in the IDE (0 if not open)
+	Version int `json:"version"`
+}
+
+func (ls *INOLanguageServer) getSketchInfoReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*SketchInfo, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	if ls.sketchRoot == nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: "the language server is not initialized"}
+	}
+
+	files, err := ls.sketchRoot.ReadDir()
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return nil, responseError(err)
+	}
+	files.FilterOutDirs()
+	files.Sort()
+
+	info := &SketchInfo{
+		SketchRoot: lsp.NewDocumentURIFromPath(ls.sketchRoot),
+		MainFile:   ls.sketchMainInoURI(),
+		Tabs:       []SketchTab{},
+		BuildPath:  ls.buildPath.String(),
+		Fqbn:       ls.config.Fqbn,
+	}
+	for _, file := range files {
+		if !isSketchSourceFile(file) {
+			continue
+		}
+		tab := SketchTab{URI: lsp.NewDocumentURIFromPath(file)}
+		if doc, ok := ls.trackedIdeDocs[file.String()]; ok {
+			tab.URI = doc.URI
+			tab.Open = true
+			tab.Version = doc.Version
+		}
+		info.Tabs = append(info.Tabs, tab)
+	}
+	for _, file := range ls.sketchBuildFlagsFiles() {
+		info.BuildFlagsFiles = append(info.BuildFlagsFiles, lsp.NewDocumentURIFromPath(file))
+	}
+	logger.Logf("<-- getSketchInfo(%s, %d tabs)", info.SketchRoot, len(info.Tabs))
+	return info, nil
+}
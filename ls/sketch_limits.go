@@ -0,0 +1,76 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// sketchLimitsExceeded returns why the sketch exceeds the limits configured for the full set
+// of features, or an empty string if it's within the limits. cppSize is the size in bytes of
+// the preprocessed sketch.
+func (ls *INOLanguageServer) sketchLimitsExceeded(cppSize int) string {
+	if limit := ls.config.MaxGeneratedCppSize; limit > 0 && cppSize > limit {
+		return fmt.Sprintf("the preprocessed sketch is %d KiB, the limit is %d KiB", cppSize/1024, limit/1024)
+	}
+	if limit := ls.config.MaxTabs; limit > 0 && len(ls.trackedIdeDocs) > limit {
+		return fmt.Sprintf("%d tabs are open, the limit is %d", len(ls.trackedIdeDocs), limit)
+	}
+	return ""
+}
+
+// updateReducedFeatures switches to the reduced-feature mode when the sketch exceeds the
+// configured limits, and back to the full set of features when it's within the limits again.
+// In the reduced-feature mode the sketch is rebuilt only when saved and the features that scan
+// the whole preprocessed sketch (semantic highlighting and F() hints) are disabled, to avoid
+// keeping more copies of a huge generated file. The user is informed of each switch.
+// The caller must hold the write lock.
+func (ls *INOLanguageServer) updateReducedFeatures(logger jsonrpc.FunctionLogger, cppSize int) {
+	reason := ls.sketchLimitsExceeded(cppSize)
+	if (reason != "") == ls.reducedFeatures {
+		return
+	}
+	ls.reducedFeatures = reason != ""
+
+	msg := &lsp.ShowMessageParams{
+		Type:    lsp.MessageTypeInfo,
+		Message: "The sketch is within the limits again: all the features of the language server are enabled.",
+	}
+	if ls.reducedFeatures {
+		msg = &lsp.ShowMessageParams{
+			Type: lsp.MessageTypeWarning,
+			Message: fmt.Sprintf("The sketch is too large for all the features of the language server (%s): "+
+				"semantic highlighting and F() hints are disabled and the sketch is analyzed again only when saved.", reason),
+		}
+	}
+	logger.Logf("%s", msg.Message)
+	if err := ls.IDE.conn.WindowShowMessage(msg); err != nil {
+		logger.Logf("Error sending message to the IDE: %s", err)
+	}
+}
+
+// updateReducedFeaturesOnTabsChange checks the limits again after a tab has been opened or
+// closed, using the size of the current preprocessed sketch. The caller must hold the write
+// lock.
+func (ls *INOLanguageServer) updateReducedFeaturesOnTabsChange(logger jsonrpc.FunctionLogger) {
+	if ls.sketchMapper == nil {
+		return
+	}
+	ls.updateReducedFeatures(logger, len(ls.sketchMapper.CppText.Text))
+}
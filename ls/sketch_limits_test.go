@@ -0,0 +1,65 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestSketchLimitsExceeded(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+
+	// No limits
+	ls.config = &Config{}
+	require.Empty(t, ls.sketchLimitsExceeded(10*1024*1024))
+
+	ls.config = &Config{MaxGeneratedCppSize: 1024 * 1024, MaxTabs: 2}
+	require.Empty(t, ls.sketchLimitsExceeded(1024*1024))
+	require.Equal(t, "the preprocessed sketch is 1025 KiB, the limit is 1024 KiB", ls.sketchLimitsExceeded(1025*1024))
+
+	ls.config.MaxTabs = 1
+	require.Equal(t, "2 tabs are open, the limit is 1", ls.sketchLimitsExceeded(1024))
+}
+
+func TestReducedFeaturesOnTabsChange(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	var ide bytes.Buffer
+	ls.IDE = &IDELSPServer{conn: lsp.NewServer(&bytes.Buffer{}, &ide, nil)}
+	ls.config = &Config{MaxTabs: 2}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+
+	// Two tabs are open: within the limits
+	ls.updateReducedFeaturesOnTabsChange(logger)
+	require.False(t, ls.reducedFeatures)
+
+	// A third tab is opened
+	other := ls.sketchRoot.Join("Other.cpp")
+	ls.trackedIdeDocs[other.String()] = lsp.TextDocumentItem{URI: lsp.NewDocumentURIFromPath(other)}
+	ls.updateReducedFeaturesOnTabsChange(logger)
+	require.True(t, ls.reducedFeatures)
+	require.Contains(t, ide.String(), "3 tabs are open, the limit is 2")
+
+	// ...and closed again
+	delete(ls.trackedIdeDocs, other.String())
+	ls.updateReducedFeaturesOnTabsChange(logger)
+	require.False(t, ls.reducedFeatures)
+	require.Contains(t, ide.String(), "within the limits again")
+}
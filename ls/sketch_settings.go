@@ -0,0 +1,207 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// sketchSettingsFileName is the name of the file, in the sketch folder, holding the
+// settings of the sketch managed by the language server
+const sketchSettingsFileName = ".arduino-ls.json"
+
+// SketchSettings are the settings of the language server saved in the sketch folder, so
+// they follow the sketch across machines. They are read with the "arduino/getSketchSettings"
+// command and changed with the "arduino/updateSketchSettings" command.
+type SketchSettings struct {
+	// Fqbn is the board of the sketch, used when the language server is started without
+	// the -fqbn flag
+	Fqbn string `json:"fqbn,omitempty"`
+	// Port is the address of the port used to upload the sketch
+	Port string `json:"port,omitempty"`
+	// ExtraFlags are the additional compiler flags passed to clangd
+	ExtraFlags []string `json:"extraFlags,omitempty"`
+	// SuppressedDiagnostics are the codes of the clangd diagnostics not reported
+	SuppressedDiagnostics []string `json:"suppressedDiagnostics,omitempty"`
+	// CompileTargets are the boards the sketch is meant to be compiled for, used when the
+	// language server is started without the -compile-target flags
+	CompileTargets []string `json:"compileTargets,omitempty"`
+}
+
+// SketchSettingsUpdate is the argument of the "arduino/updateSketchSettings" command: only
+// the fields that are present are changed.
+type SketchSettingsUpdate struct {
+	Fqbn                  *string   `json:"fqbn"`
+	Port                  *string   `json:"port"`
+	ExtraFlags            *[]string `json:"extraFlags"`
+	SuppressedDiagnostics *[]string `json:"suppressedDiagnostics"`
+	CompileTargets        *[]string `json:"compileTargets"`
+}
+
+// loadSketchSettings reads the settings file of the given sketch folder, a missing file
+// gives empty settings.
+func loadSketchSettings(sketchRoot *paths.Path) (*SketchSettings, error) {
+	settings := &SketchSettings{}
+	data, err := sketchRoot.Join(sketchSettingsFileName).ReadFile()
+	if err != nil {
+		if sketchRoot.Join(sketchSettingsFileName).NotExist() {
+			return settings, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", sketchSettingsFileName, err)
+	}
+	return settings, nil
+}
+
+// save writes the settings in the given sketch folder
+func (s *SketchSettings) save(sketchRoot *paths.Path) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return sketchRoot.Join(sketchSettingsFileName).WriteFile(append(data, '\n'))
+}
+
+// apply changes the settings with the fields present in the update
+func (u *SketchSettingsUpdate) apply(s *SketchSettings) {
+	if u.Fqbn != nil {
+		s.Fqbn = *u.Fqbn
+	}
+	if u.Port != nil {
+		s.Port = *u.Port
+	}
+	if u.ExtraFlags != nil {
+		s.ExtraFlags = *u.ExtraFlags
+	}
+	if u.SuppressedDiagnostics != nil {
+		s.SuppressedDiagnostics = *u.SuppressedDiagnostics
+	}
+	if u.CompileTargets != nil {
+		s.CompileTargets = *u.CompileTargets
+	}
+}
+
+// clangdConfigFragment returns the fragment of the .clangd configuration applying the
+// extra flags and the suppressed diagnostics, or an empty string if there are none.
+func (s *SketchSettings) clangdConfigFragment() string {
+	if len(s.ExtraFlags) == 0 && len(s.SuppressedDiagnostics) == 0 {
+		return ""
+	}
+	yamlList := func(items []string) string {
+		quoted := []string{}
+		for _, item := range items {
+			quoted = append(quoted, strconv.Quote(item))
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+	fragment := fmt.Sprintln("---")
+	if len(s.SuppressedDiagnostics) > 0 {
+		fragment += fmt.Sprintln("Diagnostics:")
+		fragment += fmt.Sprintln("  Suppress: " + yamlList(s.SuppressedDiagnostics))
+	}
+	if len(s.ExtraFlags) > 0 {
+		fragment += fmt.Sprintln("CompileFlags:")
+		fragment += fmt.Sprintln("  Add: " + yamlList(s.ExtraFlags))
+	}
+	return fragment
+}
+
+// readSketchSettings loads the settings of the sketch, applying the board (or the first
+// compile target) if none has been selected with the -fqbn flag. The caller must hold the write lock.
+func (ls *INOLanguageServer) readSketchSettings(logger jsonrpc.FunctionLogger) {
+	settings, err := loadSketchSettings(ls.sketchRoot)
+	if err != nil {
+		logger.Logf("Error reading the sketch settings: %s", err)
+		settings = &SketchSettings{}
+	}
+	ls.sketchSettings = settings
+	if ls.config.Fqbn == "" && settings.Fqbn != "" {
+		logger.Logf("Board configuration from %s: %s", sketchSettingsFileName, settings.Fqbn)
+		ls.config.Fqbn = settings.Fqbn
+	}
+	if targets := ls.compileTargets(); ls.config.Fqbn == "" && len(targets) > 0 {
+		logger.Logf("Board configuration from the first compile target: %s", targets[0])
+		ls.config.Fqbn = targets[0]
+	}
+}
+
+// getSketchSettings returns a copy of the settings of the sketch
+func (ls *INOLanguageServer) getSketchSettings(logger jsonrpc.FunctionLogger) *SketchSettings {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+	settings := *ls.sketchSettings
+	settings.ExtraFlags = slices.Clone(settings.ExtraFlags)
+	settings.SuppressedDiagnostics = slices.Clone(settings.SuppressedDiagnostics)
+	return &settings
+}
+
+// parseSketchSettingsUpdate decodes the arguments of the "arduino/updateSketchSettings" command
+func parseSketchSettingsUpdate(arguments []interface{}) (*SketchSettingsUpdate, error) {
+	if len(arguments) != 1 {
+		return nil, fmt.Errorf("expected 1 argument (settings), got %d", len(arguments))
+	}
+	data, err := json.Marshal(arguments[0])
+	if err != nil {
+		return nil, err
+	}
+	var update SketchSettingsUpdate
+	if err := json.Unmarshal(data, &update); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+	return &update, nil
+}
+
+// updateSketchSettings changes the settings of the sketch, saves them in the sketch folder
+// and applies them: a new board is selected right away, while new flags or suppressions
+// rewrite the clangd configuration and rebuild the sketch.
+func (ls *INOLanguageServer) updateSketchSettings(logger jsonrpc.FunctionLogger, update *SketchSettingsUpdate) (*SketchSettings, error) {
+	ls.writeLock(logger, false)
+	settings := *ls.sketchSettings
+	update.apply(&settings)
+	if err := settings.save(ls.sketchRoot); err != nil {
+		ls.writeUnlock(logger)
+		return nil, fmt.Errorf("saving %s: %w", sketchSettingsFileName, err)
+	}
+	clangdConfigChanged := !slices.Equal(settings.ExtraFlags, ls.sketchSettings.ExtraFlags) ||
+		!slices.Equal(settings.SuppressedDiagnostics, ls.sketchSettings.SuppressedDiagnostics)
+	ls.sketchSettings = &settings
+	if clangdConfigChanged {
+		// clangd reads again its configuration when it changes
+		if _, err := ls.writeClangdConfig(); err != nil {
+			ls.writeUnlock(logger)
+			return nil, fmt.Errorf("writing clangd configuration: %w", err)
+		}
+	}
+	ls.writeUnlock(logger)
+	logger.Logf("Sketch settings updated: %+v", settings)
+
+	if update.Fqbn != nil && settings.Fqbn != "" {
+		ls.selectBoard(logger, settings.Fqbn)
+	} else if clangdConfigChanged {
+		ls.sketchRebuilder.ForgetLastBuild()
+		ls.triggerRebuild()
+	}
+	return ls.getSketchSettings(logger), nil
+}
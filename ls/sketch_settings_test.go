@@ -0,0 +1,94 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSketchSettings(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.config = &Config{}
+	ls.sketchRebuilder = &sketchRebuilder{ls: ls, trigger: make(chan struct{}, 1), cancel: func() {}}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	settingsFile := ls.sketchRoot.Join(sketchSettingsFileName)
+	require.NoError(t, ls.sketchRoot.MkdirAll())
+	require.NoError(t, ls.buildPath.MkdirAll())
+
+	// A missing file gives empty settings
+	settings, err := loadSketchSettings(ls.sketchRoot)
+	require.NoError(t, err)
+	require.Equal(t, &SketchSettings{}, settings)
+
+	require.NoError(t, settingsFile.WriteFile([]byte("{")))
+	_, err = loadSketchSettings(ls.sketchRoot)
+	require.Error(t, err)
+
+	// The board of the sketch is used when none has been selected with the -fqbn flag
+	require.NoError(t, settingsFile.WriteFile([]byte(`{"fqbn": "arduino:avr:nano", "port": "/dev/ttyUSB0"}`)))
+	ls.readSketchSettings(logger)
+	require.Equal(t, &SketchSettings{Fqbn: "arduino:avr:nano", Port: "/dev/ttyUSB0"}, ls.getSketchSettings(logger))
+	require.Equal(t, "arduino:avr:nano", ls.config.Fqbn)
+	ls.config.Fqbn = "arduino:avr:uno"
+	ls.readSketchSettings(logger)
+	require.Equal(t, "arduino:avr:uno", ls.config.Fqbn)
+
+	// The update changes only the fields present, saves the file and rewrites the clangd configuration
+	update, err := parseSketchSettingsUpdate([]interface{}{map[string]interface{}{
+		"extraFlags":            []string{"-DDEBUG=1", `-DNAME="sketch"`},
+		"suppressedDiagnostics": []string{"unused-includes"},
+	}})
+	require.NoError(t, err)
+	updated, err := ls.updateSketchSettings(logger, update)
+	require.NoError(t, err)
+	expected := &SketchSettings{
+		Fqbn:                  "arduino:avr:nano",
+		Port:                  "/dev/ttyUSB0",
+		ExtraFlags:            []string{"-DDEBUG=1", `-DNAME="sketch"`},
+		SuppressedDiagnostics: []string{"unused-includes"},
+	}
+	require.Equal(t, expected, updated)
+	saved, err := loadSketchSettings(ls.sketchRoot)
+	require.NoError(t, err)
+	require.Equal(t, expected, saved)
+	clangdConf, err := ls.buildPath.Join(".clangd").ReadFile()
+	require.NoError(t, err)
+	require.Contains(t, string(clangdConf), "---\nDiagnostics:\n  Suppress: [\"unused-includes\"]\nCompileFlags:\n  Add: [\"-DDEBUG=1\", \"-DNAME=\\\"sketch\\\"\"]\n")
+	require.Len(t, ls.sketchRebuilder.trigger, 1)
+
+	// Changing only the port doesn't rebuild the sketch
+	<-ls.sketchRebuilder.trigger
+	update, err = parseSketchSettingsUpdate([]interface{}{map[string]interface{}{"port": "COM3"}})
+	require.NoError(t, err)
+	updated, err = ls.updateSketchSettings(logger, update)
+	require.NoError(t, err)
+	require.Equal(t, "COM3", updated.Port)
+	require.Equal(t, expected.ExtraFlags, updated.ExtraFlags)
+	require.Empty(t, ls.sketchRebuilder.trigger)
+
+	_, err = parseSketchSettingsUpdate(nil)
+	require.Error(t, err)
+	_, err = parseSketchSettingsUpdate([]interface{}{"arduino:avr:uno"})
+	require.Error(t, err)
+}
+
+func TestSketchSettingsClangdConfigFragment(t *testing.T) {
+	require.Empty(t, (&SketchSettings{Fqbn: "arduino:avr:uno"}).clangdConfigFragment())
+	require.Equal(t, "---\nCompileFlags:\n  Add: [\"-Wall\"]\n", (&SketchSettings{ExtraFlags: []string{"-Wall"}}).clangdConfigFragment())
+}
@@ -0,0 +1,162 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/arduino/arduino-language-server/streams"
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// ExecutableSectionSize is the size of a section of the compiled sketch, as reported by
+// arduino-cli in the compile response (executable_sections_size): "text" is the program
+// storage and "data" is the dynamic memory. MaxSize is 0 if the board has no limit.
+type ExecutableSectionSize struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	MaxSize int64  `json:"maxSize,omitempty"`
+}
+
+// sketchSize is the memory usage of the last successfully compiled sketch
+type sketchSize struct {
+	Sections []ExecutableSectionSize
+}
+
+// String returns a short summary of the memory usage, shown in the code lens
+func (s *sketchSize) String() string {
+	summary := []string{}
+	for _, section := range s.Sections {
+		name := section.Name
+		switch section.Name {
+		case "text":
+			name = "Program storage"
+		case "data":
+			name = "Dynamic memory"
+		}
+		if section.MaxSize > 0 {
+			summary = append(summary, fmt.Sprintf("%s: %d bytes (%d%%) of %d", name, section.Size, section.Size*100/section.MaxSize, section.MaxSize))
+		} else {
+			summary = append(summary, fmt.Sprintf("%s: %d bytes", name, section.Size))
+		}
+	}
+	return strings.Join(summary, ", ")
+}
+
+// Report returns the memory usage worded as the size report of arduino-cli
+func (s *sketchSize) Report() string {
+	report := []string{}
+	for _, section := range s.Sections {
+		switch {
+		case section.Name == "text" && section.MaxSize > 0:
+			report = append(report, fmt.Sprintf("Sketch uses %d bytes (%d%%) of program storage space. Maximum is %d bytes.",
+				section.Size, section.Size*100/section.MaxSize, section.MaxSize))
+		case section.Name == "text":
+			report = append(report, fmt.Sprintf("Sketch uses %d bytes of program storage space.", section.Size))
+		case section.Name == "data" && section.MaxSize > 0:
+			report = append(report, fmt.Sprintf("Global variables use %d bytes (%d%%) of dynamic memory, leaving %d bytes for local variables. Maximum is %d bytes.",
+				section.Size, section.Size*100/section.MaxSize, section.MaxSize-section.Size, section.MaxSize))
+		case section.Name == "data":
+			report = append(report, fmt.Sprintf("Global variables use %d bytes of dynamic memory.", section.Size))
+		default:
+			report = append(report, fmt.Sprintf("Section %s uses %d bytes.", section.Name, section.Size))
+		}
+	}
+	return strings.Join(report, "\n")
+}
+
+// updateSketchSize stores the size report of the compile completed by the IDE and asks the
+// IDE to refresh the code lenses showing it.
+func (ls *INOLanguageServer) updateSketchSize(logger jsonrpc.FunctionLogger, sections []ExecutableSectionSize) {
+	if len(sections) == 0 {
+		logger.Logf("No size report in the compile response")
+		return
+	}
+
+	ls.writeLock(logger, false)
+	ls.sketchSize = &sketchSize{Sections: sections}
+	logger.Logf("%s", ls.sketchSize)
+	refreshSupported := false
+	if ls.ideInitializeParams != nil {
+		if ws := ls.ideInitializeParams.Capabilities.Workspace; ws != nil && ws.CodeLens != nil {
+			refreshSupported = ws.CodeLens.RefreshSupport
+		}
+	}
+	ls.writeUnlock(logger)
+
+	if !refreshSupported {
+		return
+	}
+	// The refresh is a request to the IDE: it can not be awaited while processing an IDE message
+	go func() {
+		defer streams.CatchAndLogPanic()
+		logger := NewLSPFunctionLogger(color.HiGreenString, "CODE LENS REFRESH --- ")
+		if respErr, err := ls.IDE.conn.WorkspaceCodeLensRefresh(context.Background()); err != nil {
+			logger.Logf("Error: %s", err)
+		} else if respErr != nil {
+			logger.Logf("IDE error: %s", respErr.AsError())
+		}
+	}()
+}
+
+// showSketchSize shows the full size report of the last compile to the user
+func (ls *INOLanguageServer) showSketchSize(logger jsonrpc.FunctionLogger) error {
+	ls.readLock(logger, false)
+	size := ls.sketchSize
+	ls.readUnlock(logger)
+
+	if size == nil {
+		return fmt.Errorf("the sketch has not been compiled yet")
+	}
+	return ls.IDE.conn.WindowShowMessage(&lsp.ShowMessageParams{
+		Type:    lsp.MessageTypeInfo,
+		Message: size.Report(),
+	})
+}
+
+func (ls *INOLanguageServer) textDocumentCodeLensReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.CodeLensParams) ([]lsp.CodeLens, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	codeLenses := []lsp.CodeLens{}
+	if ls.sketchSize == nil || !ideParams.TextDocument.URI.AsPath().EquivalentTo(ls.sketchRoot.Join(ls.sketchName+".ino")) {
+		return codeLenses, nil
+	}
+
+	// Show the memory usage above setup() (or at the top of the main .ino)
+	line := 0
+	if ls.sketchMapper != nil {
+		if file, setupLine, ok := ls.sketchFunctionDefinition(setupPrototypeRegexp); ok && ideParams.TextDocument.URI.AsPath().EquivalentTo(paths.New(file)) {
+			line = setupLine
+		}
+	}
+	codeLenses = append(codeLenses, lsp.CodeLens{
+		Range: lsp.Range{
+			Start: lsp.Position{Line: line, Character: 0},
+			End:   lsp.Position{Line: line, Character: 0},
+		},
+		Command: &lsp.Command{
+			Title:   ls.sketchSize.String(),
+			Command: showSketchSizeCommand,
+		},
+	})
+	return codeLenses, nil
+}
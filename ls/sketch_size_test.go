@@ -0,0 +1,89 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestSketchSizeReport(t *testing.T) {
+	avr := &sketchSize{Sections: []ExecutableSectionSize{
+		{Name: "text", Size: 924, MaxSize: 32256},
+		{Name: "data", Size: 9, MaxSize: 2048},
+	}}
+	require.Equal(t, "Program storage: 924 bytes (2%) of 32256, Dynamic memory: 9 bytes (0%) of 2048", avr.String())
+	require.Equal(t,
+		"Sketch uses 924 bytes (2%) of program storage space. Maximum is 32256 bytes.\n"+
+			"Global variables use 9 bytes (0%) of dynamic memory, leaving 2039 bytes for local variables. Maximum is 2048 bytes.",
+		avr.Report())
+
+	// Boards without a maximum size, or with custom sections
+	unbounded := &sketchSize{Sections: []ExecutableSectionSize{
+		{Name: "text", Size: 264265},
+		{Name: "data", Size: 21152},
+		{Name: "iram", Size: 51080, MaxSize: 131072},
+	}}
+	require.Equal(t, "Program storage: 264265 bytes, Dynamic memory: 21152 bytes, iram: 51080 bytes (38%) of 131072", unbounded.String())
+	require.Equal(t,
+		"Sketch uses 264265 bytes of program storage space.\n"+
+			"Global variables use 21152 bytes of dynamic memory.\n"+
+			"Section iram uses 51080 bytes.",
+		unbounded.Report())
+}
+
+func TestSketchSizeCodeLens(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	mainIno := ls.sketchRoot.Join("Sketch.ino")
+	params := &lsp.CodeLensParams{TextDocument: lsp.TextDocumentIdentifier{URI: lsp.NewDocumentURIFromPath(mainIno)}}
+
+	// No compile completed yet
+	codeLenses, respErr := ls.textDocumentCodeLensReqFromIDE(context.Background(), logger, params)
+	require.Nil(t, respErr)
+	require.Empty(t, codeLenses)
+
+	// A compile response without size report is ignored
+	ls.updateSketchSize(logger, nil)
+	require.Nil(t, ls.sketchSize)
+
+	ls.updateSketchSize(logger, []ExecutableSectionSize{{Name: "text", Size: 924, MaxSize: 32256}})
+	ls.sketchMapper = sourcemapper.CreateInoMapper([]byte(
+		"#include <Arduino.h>\n" +
+			"#line 1 \"" + mainIno.String() + "\"\n" +
+			"int led = 13;\n" +
+			"#line 3 \"" + mainIno.String() + "\"\n" +
+			"void setup();\n" +
+			"#line 3 \"" + mainIno.String() + "\"\n" +
+			"void setup() {}\n"))
+	codeLenses, respErr = ls.textDocumentCodeLensReqFromIDE(context.Background(), logger, params)
+	require.Nil(t, respErr)
+	require.Len(t, codeLenses, 1)
+	require.Equal(t, testRange(2, 0, 2, 0), codeLenses[0].Range)
+	require.Equal(t, "Program storage: 924 bytes (2%) of 32256", codeLenses[0].Command.Title)
+	require.Equal(t, showSketchSizeCommand, codeLenses[0].Command.Command)
+
+	// Code lenses are shown only on the main .ino
+	params.TextDocument.URI = lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h"))
+	codeLenses, respErr = ls.textDocumentCodeLensReqFromIDE(context.Background(), logger, params)
+	require.Nil(t, respErr)
+	require.Empty(t, codeLenses)
+}
@@ -0,0 +1,222 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// sessionSnapshot is the state of a session saved after every successful build. It's
+// removed on a clean shutdown: if it's found at startup the previous language server
+// crashed and, if the sketch is not changed, its build path can be reused as is.
+type sessionSnapshot struct {
+	PID         int                  `json:"pid"`
+	SketchRoot  string               `json:"sketch_root"`
+	TempDir     string               `json:"temp_dir"`
+	Manifest    sketchManifest       `json:"manifest"`
+	Includes    []string             `json:"includes"`
+	TrackedDocs []trackedDocSnapshot `json:"tracked_docs"`
+}
+
+// trackedDocSnapshot describes a document open in the IDE
+type trackedDocSnapshot struct {
+	URI     lsp.DocumentURI `json:"uri"`
+	Version int             `json:"version"`
+	Hash    string          `json:"hash"`
+}
+
+// snapshotFile returns the file where the snapshot of the session is saved, or nil if
+// the snapshots are disabled.
+func (ls *INOLanguageServer) snapshotFile() *paths.Path {
+	if ls.config.SnapshotDir == nil || ls.sketchRoot == nil {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(ls.sketchRoot.String()))
+	return ls.config.SnapshotDir.Join(hex.EncodeToString(hash[:8]) + ".json")
+}
+
+// saveSnapshot saves the snapshot of the session with the given fingerprint of the last
+// successful build, the caller must hold the data lock.
+func (ls *INOLanguageServer) saveSnapshot(logger jsonrpc.FunctionLogger, manifest sketchManifest, includes []string) {
+	file := ls.snapshotFile()
+	if file == nil || ls.tempDir == nil {
+		return
+	}
+	snapshot := &sessionSnapshot{
+		PID:         os.Getpid(),
+		SketchRoot:  ls.sketchRoot.String(),
+		TempDir:     ls.tempDir.String(),
+		Manifest:    manifest,
+		Includes:    includes,
+		TrackedDocs: []trackedDocSnapshot{},
+	}
+	for _, doc := range ls.trackedIdeDocs {
+		hash := sha256.Sum256([]byte(doc.Text))
+		snapshot.TrackedDocs = append(snapshot.TrackedDocs, trackedDocSnapshot{
+			URI:     doc.URI,
+			Version: doc.Version,
+			Hash:    hex.EncodeToString(hash[:]),
+		})
+	}
+	if err := writeSnapshot(file, snapshot); err != nil {
+		logger.Logf("Error saving session snapshot: %s", err)
+	}
+}
+
+// writeSnapshot writes the snapshot to a temporary file first and then renames it,
+// so that a crash while writing can not leave a truncated snapshot.
+func writeSnapshot(file *paths.Path, snapshot *sessionSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := file.Parent().MkdirAll(); err != nil {
+		return err
+	}
+	tmp := file.Parent().Join(file.Base() + ".tmp")
+	if err := tmp.WriteFile(data); err != nil {
+		return err
+	}
+	return tmp.Rename(file)
+}
+
+// loadSnapshot reads a snapshot saved with writeSnapshot
+func loadSnapshot(file *paths.Path) (*sessionSnapshot, error) {
+	data, err := file.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+	var snapshot sessionSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// removeSnapshot removes the snapshot of the session, it must be called on a clean shutdown
+func (ls *INOLanguageServer) removeSnapshot(logger jsonrpc.FunctionLogger) {
+	if file := ls.snapshotFile(); file != nil && file.Exist() {
+		if err := file.Remove(); err != nil {
+			logger.Logf("Error removing session snapshot: %s", err)
+		}
+	}
+}
+
+// recoverFromSnapshot looks for the snapshot left by a crashed language server on the same
+// sketch: if the sketch is not changed since its last build, the build path of the crashed
+// session is reused and the bootstrap build is skipped. Returns true if the session has been
+// recovered.
+func (ls *INOLanguageServer) recoverFromSnapshot(logger jsonrpc.FunctionLogger) bool {
+	ls.readLock(logger, false)
+	file := ls.snapshotFile()
+	ls.readUnlock(logger)
+	if file == nil || !file.Exist() {
+		return false
+	}
+	snapshot, err := loadSnapshot(file)
+	if err != nil {
+		logger.Logf("Ignoring invalid session snapshot %s: %s", file, err)
+		return false
+	}
+	if snapshot.PID == os.Getpid() || processRunning(snapshot.PID) {
+		logger.Logf("The session of the snapshot %s is still running", file)
+		return false
+	}
+	logger.Logf("Found snapshot of a crashed session with %d open documents", len(snapshot.TrackedDocs))
+
+	tempDir := paths.New(snapshot.TempDir)
+	if tempDir == nil {
+		return false
+	}
+	buildPath := tempDir.Join("build")
+	buildSketchCpp := buildPath.Join("sketch", ls.sketchName+".ino.cpp")
+	if !buildSketchCpp.Exist() || !clangdCompilationDatabaseDir(buildPath).Join("compile_commands.json").Exist() {
+		logger.Logf("The build path of the crashed session is not available anymore")
+		return false
+	}
+	manifest, includes, err := ls.computeSketchManifest(logger)
+	if err != nil || !maps.Equal(manifest, snapshot.Manifest) {
+		logger.Logf("The sketch has changed since the last build of the crashed session")
+		return false
+	}
+
+	ls.writeLock(logger, false)
+	if err := ls.tempDir.RemoveAll(); err != nil {
+		logger.Logf("Error removing unused temp folder: %s", err)
+	}
+	ls.tempDir = tempDir
+	if err := writeSessionPID(tempDir); err != nil {
+		logger.Logf("Error marking the temp folder as in use: %s", err)
+	}
+	ls.buildPath = buildPath
+	ls.buildSketchRoot = buildPath.Join("sketch")
+	ls.buildSketchCpp = buildSketchCpp
+	ls.fullBuildPath = tempDir.Join("fullbuild")
+	ls.recoveredDocHashes = map[lsp.DocumentURI]string{}
+	for _, doc := range snapshot.TrackedDocs {
+		ls.recoveredDocHashes[doc.URI] = doc.Hash
+	}
+	ls.writeUnlock(logger)
+
+	ls.sketchRebuilder.SetLastBuild(manifest, includes)
+	ls.updateBuildIndexes(logger, buildPath.Join("compile_commands.json"))
+	logger.Logf("Reusing the build path of the crashed session: %s", buildPath)
+	return true
+}
+
+// checkRecoveredDoc compares a document reopened by the IDE after the recovery of a crashed
+// session with the one tracked by that session: the reused build path has been generated
+// with the text of the crashed session, if the IDE reopens the document with a different
+// text (for example restoring other unsaved changes) the sketch is rebuilt. The caller
+// must hold the write lock.
+func (ls *INOLanguageServer) checkRecoveredDoc(logger jsonrpc.FunctionLogger, doc lsp.TextDocumentItem) {
+	savedHash, ok := ls.recoveredDocHashes[doc.URI]
+	if !ok {
+		return
+	}
+	delete(ls.recoveredDocHashes, doc.URI)
+	hash := sha256.Sum256([]byte(doc.Text))
+	if hex.EncodeToString(hash[:]) == savedHash {
+		return
+	}
+	logger.Logf("%s has changed since the last build of the crashed session", doc.URI)
+	ls.sketchRebuilder.ForgetLastBuild()
+	ls.triggerRebuild()
+}
+
+// processRunning returns true if a process with the given pid is running
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	defer process.Release()
+	if runtime.GOOS == "windows" {
+		// On Windows FindProcess fails if the process does not exist
+		return true
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
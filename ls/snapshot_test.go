@@ -0,0 +1,113 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestRecoverFromSnapshot(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	ls.config = &Config{Fqbn: "arduino:avr:uno", SnapshotDir: paths.New(t.TempDir())}
+	ls.sketchRebuilder = &sketchRebuilder{ls: ls, trigger: make(chan struct{}, 1), cancel: func() {}}
+	newTempDir := ls.buildPath.Parent().Join("arduino-language-server-new")
+	require.NoError(t, newTempDir.MkdirAll())
+	ls.tempDir = newTempDir
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	require.NoError(t, ls.sketchRoot.MkdirAll())
+	require.NoError(t, ls.sketchRoot.Join("Sketch.ino").WriteFile([]byte("void setup() {}\nvoid loop() {}\n")))
+	delete(ls.trackedIdeDocs, ls.sketchRoot.Join("Helper.h").String())
+
+	// Build path left by the crashed session
+	crashedTempDir := paths.New(t.TempDir())
+	crashedBuildPath := crashedTempDir.Join("build")
+	require.NoError(t, crashedBuildPath.Join("sketch").MkdirAll())
+	require.NoError(t, crashedBuildPath.Join("sketch", "Sketch.ino.cpp").WriteFile([]byte("void setup() {}\nvoid loop() {}\n")))
+	require.NoError(t, crashedBuildPath.Join("compile_commands.json").WriteFile([]byte("[]")))
+	require.NoError(t, clangdCompilationDatabaseDir(crashedBuildPath).MkdirAll())
+	require.NoError(t, clangdCompilationDatabaseDir(crashedBuildPath).Join("compile_commands.json").WriteFile([]byte("[]")))
+
+	// A process that is not running anymore
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	require.NoError(t, exited.Run())
+	crashedPID := exited.Process.Pid
+
+	manifest, includes, err := ls.computeSketchManifest(logger)
+	require.NoError(t, err)
+	inoURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+	helperURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.cpp"))
+	hashOf := func(text string) string {
+		hash := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(hash[:])
+	}
+	saveCrashedSnapshot := func(pid int, manifest sketchManifest) {
+		require.NoError(t, writeSnapshot(ls.snapshotFile(), &sessionSnapshot{
+			PID:        pid,
+			SketchRoot: ls.sketchRoot.String(),
+			TempDir:    crashedTempDir.String(),
+			Manifest:   manifest,
+			Includes:   includes,
+			TrackedDocs: []trackedDocSnapshot{
+				{URI: inoURI, Version: 3, Hash: hashOf("void setup() {}\nvoid loop() {}\n")},
+				{URI: helperURI, Version: 7, Hash: hashOf("int helper() { return 1; }\n")},
+			},
+		}))
+	}
+
+	// The sketch changed after the last build of the crashed session
+	saveCrashedSnapshot(crashedPID, sketchManifest{"fqbn": "arduino:avr:uno"})
+	require.False(t, ls.recoverFromSnapshot(logger))
+
+	// The session of the snapshot is still running
+	saveCrashedSnapshot(os.Getpid(), manifest)
+	require.False(t, ls.recoverFromSnapshot(logger))
+
+	saveCrashedSnapshot(crashedPID, manifest)
+	require.True(t, ls.recoverFromSnapshot(logger))
+	require.Equal(t, crashedBuildPath, ls.buildPath)
+	require.Equal(t, crashedBuildPath.Join("sketch", "Sketch.ino.cpp"), ls.buildSketchCpp)
+	require.Equal(t, manifest, ls.sketchRebuilder.lastManifest)
+	require.NoDirExists(t, newTempDir.String())
+
+	// A document reopened with the text of the crashed session doesn't need a rebuild...
+	ls.checkRecoveredDoc(logger, lsp.TextDocumentItem{URI: inoURI, Text: "void setup() {}\nvoid loop() {}\n"})
+	require.Empty(t, ls.sketchRebuilder.trigger)
+	require.Equal(t, manifest, ls.sketchRebuilder.lastManifest)
+	// ...while a document reopened with a different text does
+	ls.checkRecoveredDoc(logger, lsp.TextDocumentItem{URI: helperURI, Text: "int helper() { return 2; }\n"})
+	require.Len(t, ls.sketchRebuilder.trigger, 1)
+	require.Nil(t, ls.sketchRebuilder.lastManifest)
+	require.Empty(t, ls.recoveredDocHashes)
+
+	// The snapshot is removed on a clean shutdown
+	ls.saveSnapshot(logger, manifest, includes)
+	snapshot, err := loadSnapshot(ls.snapshotFile())
+	require.NoError(t, err)
+	require.Equal(t, os.Getpid(), snapshot.PID)
+	require.Equal(t, crashedTempDir.String(), snapshot.TempDir)
+	require.Len(t, snapshot.TrackedDocs, 1)
+	ls.removeSnapshot(logger)
+	require.NoFileExists(t, ls.snapshotFile().String())
+}
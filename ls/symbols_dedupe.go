@@ -0,0 +1,77 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"github.com/vincecity/go-lsp"
+)
+
+// symbolLocation identifies the place of a symbol in the IDE documents
+type symbolLocation struct {
+	name string
+	uri  lsp.DocumentURI
+	line int
+}
+
+// dedupeDocumentSymbols removes the symbols that are mapped on the same line of another
+// symbol with the same name. This happens for the function prototypes generated by the
+// sketch preprocessing, that are mapped back on the line of the function definition: the
+// symbol with the widest range, usually the definition, is kept in place of the first one.
+func dedupeDocumentSymbols(symbols []lsp.DocumentSymbol) []lsp.DocumentSymbol {
+	res := []lsp.DocumentSymbol{}
+	index := map[symbolLocation]int{}
+	for _, symbol := range symbols {
+		location := symbolLocation{name: symbol.Name, line: symbol.SelectionRange.Start.Line}
+		if i, ok := index[location]; ok {
+			if rangeWiderThan(symbol.Range, res[i].Range) {
+				res[i] = symbol
+			}
+			continue
+		}
+		index[location] = len(res)
+		res = append(res, symbol)
+	}
+	return res
+}
+
+// dedupeSymbolsInformation removes the symbols that are mapped on the same line of another
+// symbol with the same name, like dedupeDocumentSymbols does for the document symbols.
+func dedupeSymbolsInformation(symbols []lsp.SymbolInformation) []lsp.SymbolInformation {
+	res := []lsp.SymbolInformation{}
+	index := map[symbolLocation]int{}
+	for _, symbol := range symbols {
+		location := symbolLocation{name: symbol.Name, uri: symbol.Location.URI, line: symbol.Location.Range.Start.Line}
+		if i, ok := index[location]; ok {
+			if rangeWiderThan(symbol.Location.Range, res[i].Location.Range) {
+				res[i] = symbol
+			}
+			continue
+		}
+		index[location] = len(res)
+		res = append(res, symbol)
+	}
+	return res
+}
+
+// rangeWiderThan returns true if the range a spans more lines, or more characters on the
+// same number of lines, than the range b
+func rangeWiderThan(a, b lsp.Range) bool {
+	aLines, bLines := a.End.Line-a.Start.Line, b.End.Line-b.Start.Line
+	if aLines != bLines {
+		return aLines > bLines
+	}
+	return a.End.Character-a.Start.Character > b.End.Character-b.Start.Character
+}
@@ -0,0 +1,65 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestDedupeSymbols(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	cppURI := lsp.NewDocumentURIFromPath(ls.buildSketchCpp)
+	inoURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino"))
+
+	// The prototype and the definition of setup() are mapped on the same line of the sketch
+	prototype := lsp.DocumentSymbol{Name: "setup", Kind: lsp.SymbolKindFunction, Range: testRange(2, 0, 2, 12), SelectionRange: testRange(2, 5, 2, 10)}
+	definition := lsp.DocumentSymbol{Name: "setup", Kind: lsp.SymbolKindFunction, Range: testRange(2, 0, 2, 15), SelectionRange: testRange(2, 5, 2, 10)}
+	loop := lsp.DocumentSymbol{Name: "loop", Kind: lsp.SymbolKindFunction, Range: testRange(3, 0, 3, 14), SelectionRange: testRange(3, 5, 3, 9)}
+	ideSymbols, err := ls.clang2IdeDocumentSymbols(logger, []lsp.DocumentSymbol{prototype, loop, definition}, cppURI, inoURI)
+	require.NoError(t, err)
+	require.Len(t, ideSymbols, 2)
+	require.Equal(t, "setup", ideSymbols[0].Name)
+	require.Equal(t, testRange(0, 0, 0, 15), ideSymbols[0].Range)
+	require.Equal(t, "loop", ideSymbols[1].Name)
+
+	// Symbols with different names on the same line are kept
+	require.Len(t, dedupeDocumentSymbols([]lsp.DocumentSymbol{
+		{Name: "a", SelectionRange: testRange(1, 4, 1, 5)},
+		{Name: "b", SelectionRange: testRange(1, 7, 1, 8)},
+	}), 2)
+
+	ideSymbolsInformation := ls.clang2IdeSymbolsInformation(logger, []lsp.SymbolInformation{
+		{Name: "setup", Location: lsp.Location{URI: cppURI, Range: prototype.Range}},
+		{Name: "setup", Location: lsp.Location{URI: cppURI, Range: definition.Range}},
+		{Name: "loop", Location: lsp.Location{URI: cppURI, Range: loop.Range}},
+	})
+	require.Equal(t, []lsp.SymbolInformation{
+		{Name: "setup", Location: lsp.Location{URI: inoURI, Range: testRange(0, 0, 0, 15)}},
+		{Name: "loop", Location: lsp.Location{URI: inoURI, Range: testRange(1, 0, 1, 14)}},
+	}, ideSymbolsInformation)
+}
+
+func TestRangeWiderThan(t *testing.T) {
+	require.True(t, rangeWiderThan(testRange(1, 0, 5, 1), testRange(1, 0, 1, 20)))
+	require.True(t, rangeWiderThan(testRange(1, 0, 1, 20), testRange(1, 0, 1, 12)))
+	require.False(t, rangeWiderThan(testRange(1, 0, 1, 12), testRange(1, 0, 1, 12)))
+	require.False(t, rangeWiderThan(testRange(1, 0, 1, 20), testRange(0, 0, 3, 1)))
+}
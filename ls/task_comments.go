@@ -0,0 +1,134 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/arduino/arduino-language-server/textutils"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// TaskComment is a TODO, FIXME or HACK comment found in the sketch, listed by the
+// "arduino/listTaskComments" request
+type TaskComment struct {
+	URI   lsp.DocumentURI `json:"uri"`
+	Range lsp.Range       `json:"range"`
+	// Tag is the marker of the comment: "TODO", "FIXME" or "HACK"
+	Tag string `json:"tag"`
+	// Text is the text of the comment following the tag
+	Text string `json:"text"`
+}
+
+// taskCommentRegexp matches the task tags inside a comment, the text of the task is the
+// remaining part of the comment on the same line.
+var taskCommentRegexp = regexp.MustCompile(`\b(TODO|FIXME|HACK)\b:?\s*`)
+
+// listTaskCommentsReqFromIDE scans the sketch source files for task comments. The content of
+// the documents tracked from the IDE is used, so the unsaved changes are taken into account.
+func (ls *INOLanguageServer) listTaskCommentsReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) ([]*TaskComment, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	files, err := ls.sketchSourceFiles()
+	if err != nil {
+		logger.Logf("Error reading sketch folder: %s", err)
+		return nil, responseError(err)
+	}
+	files.Sort()
+	res := []*TaskComment{}
+	for _, file := range files {
+		ideURI, text, err := ls.sketchFileContent(file)
+		if err != nil {
+			logger.Logf("Error reading %s: %s", file, err)
+			continue
+		}
+		for _, task := range findTaskComments(text) {
+			task.URI = ideURI
+			res = append(res, task)
+		}
+	}
+	logger.Logf("<-- listTaskComments(%d comments)", len(res))
+	return res, nil
+}
+
+// findTaskComments returns the task comments in the given source text. The string and
+// character literals are skipped, block comments may span multiple lines.
+func findTaskComments(text string) []*TaskComment {
+	res := []*TaskComment{}
+	inBlockComment := false
+	for line, lineText := range textutils.SplitLines(text) {
+		// The comments found in the line, as [start, end) byte offsets
+		comments := [][2]int{}
+		commentStart := 0
+		inLiteral := byte(0)
+		for i := 0; i < len(lineText); i++ {
+			c := lineText[i]
+			switch {
+			case inBlockComment:
+				if strings.HasPrefix(lineText[i:], "*/") {
+					comments = append(comments, [2]int{commentStart, i})
+					inBlockComment = false
+					i++
+				}
+			case inLiteral != 0:
+				if c == '\\' {
+					i++
+				} else if c == inLiteral {
+					inLiteral = 0
+				}
+			case c == '"' || c == '\'':
+				inLiteral = c
+			case strings.HasPrefix(lineText[i:], "//"):
+				comments = append(comments, [2]int{i + 2, len(lineText)})
+				i = len(lineText)
+			case strings.HasPrefix(lineText[i:], "/*"):
+				inBlockComment = true
+				commentStart = i + 2
+				i++
+			}
+		}
+		if inBlockComment {
+			comments = append(comments, [2]int{commentStart, len(lineText)})
+		}
+
+		for _, comment := range comments {
+			commentText := lineText[comment[0]:comment[1]]
+			match := taskCommentRegexp.FindStringSubmatchIndex(commentText)
+			if match == nil {
+				continue
+			}
+			taskText := strings.TrimRightFunc(commentText[match[1]:], func(r rune) bool {
+				return r == ' ' || r == '\t' || r == '*'
+			})
+			start := comment[0] + match[2]
+			end := comment[0] + match[1] + len(taskText)
+			res = append(res, &TaskComment{
+				Range: lsp.Range{
+					Start: lsp.Position{Line: line, Character: len(utf16.Encode([]rune(lineText[:start])))},
+					End:   lsp.Position{Line: line, Character: len(utf16.Encode([]rune(lineText[:end])))},
+				},
+				Tag:  commentText[match[2]:match[3]],
+				Text: taskText,
+			})
+		}
+	}
+	return res
+}
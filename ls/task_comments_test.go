@@ -0,0 +1,64 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestFindTaskComments(t *testing.T) {
+	text := "// TODO: read the sensor\n" +
+		"const char *s = \"// TODO not a comment\"; // FIXME fix the timeout\n" +
+		"/* first line\n" +
+		" * HACK works around a core bug */ int x; /* TODO é */\n" +
+		"// TODOS are not tags\r\n" +
+		"char c = '\"'; // FIXME\n"
+	tasks := findTaskComments(text)
+	require.Equal(t, []*TaskComment{
+		{Range: lsp.Range{Start: lsp.Position{Line: 0, Character: 3}, End: lsp.Position{Line: 0, Character: 24}}, Tag: "TODO", Text: "read the sensor"},
+		{Range: lsp.Range{Start: lsp.Position{Line: 1, Character: 44}, End: lsp.Position{Line: 1, Character: 65}}, Tag: "FIXME", Text: "fix the timeout"},
+		{Range: lsp.Range{Start: lsp.Position{Line: 3, Character: 3}, End: lsp.Position{Line: 3, Character: 31}}, Tag: "HACK", Text: "works around a core bug"},
+		{Range: lsp.Range{Start: lsp.Position{Line: 3, Character: 45}, End: lsp.Position{Line: 3, Character: 51}}, Tag: "TODO", Text: "é"},
+		{Range: lsp.Range{Start: lsp.Position{Line: 5, Character: 17}, End: lsp.Position{Line: 5, Character: 22}}, Tag: "FIXME", Text: ""},
+	}, tasks)
+}
+
+func TestListTaskComments(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	require.NoError(t, ls.sketchRoot.MkdirAll())
+	inoPath := ls.sketchRoot.Join(ls.sketchName + ".ino")
+	require.NoError(t, inoPath.WriteFile([]byte("// TODO saved on disk\n")))
+	headerPath := ls.sketchRoot.Join("config.h")
+	require.NoError(t, headerPath.WriteFile([]byte("#define PIN 2 // FIXME use the right pin\n")))
+	// The unsaved content of the tracked documents is preferred to the one on disk
+	inoURI := lsp.NewDocumentURIFromPath(inoPath)
+	ls.trackedIdeDocs[inoPath.String()] = lsp.TextDocumentItem{URI: inoURI, Text: "void setup() {}\n// TODO unsaved\n"}
+
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	tasks, respErr := ls.listTaskCommentsReqFromIDE(context.Background(), logger)
+	require.Nil(t, respErr)
+	require.Len(t, tasks, 2)
+	require.Equal(t, inoURI, tasks[0].URI)
+	require.Equal(t, "unsaved", tasks[0].Text)
+	require.Equal(t, 1, tasks[0].Range.Start.Line)
+	require.Equal(t, lsp.NewDocumentURIFromPath(headerPath), tasks[1].URI)
+	require.Equal(t, "use the right pin", tasks[1].Text)
+}
@@ -0,0 +1,138 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// tempDirPrefix is the prefix of the temp folders created by the language server
+const tempDirPrefix = "arduino-language-server"
+
+// sessionPIDFile is the file, in the temp folder of a session, with the pid of the
+// language server running the session
+const sessionPIDFile = "session.pid"
+
+// staleTempDirMinAge is the time a temp folder without sessionPIDFile is kept anyway: it
+// may belong to a language server that is still starting up.
+const staleTempDirMinAge = time.Minute
+
+// TempRoot returns the folder where the temp folders of the language server are created:
+// the -temp-dir folder, or the temp folder of the system if not set.
+func (config *Config) TempRoot() *paths.Path {
+	if config.TempDir != nil {
+		return config.TempDir
+	}
+	return paths.TempDir()
+}
+
+// toolsEnv returns the environment of the tools run by the language server: their temp
+// files are created in the temp folder of the session, so nothing is written elsewhere.
+func (ls *INOLanguageServer) toolsEnv() []string {
+	env := append([]string{}, ls.config.ExtraEnv...)
+	if ls.tempDir != nil {
+		env = append(env, "TMPDIR="+ls.tempDir.String()) // For unix-based systems
+		env = append(env, "TMP="+ls.tempDir.String())    // For Windows
+	}
+	return env
+}
+
+// writeSessionPID marks the given temp folder as used by the running language server
+func writeSessionPID(tempDir *paths.Path) error {
+	return tempDir.Join(sessionPIDFile).WriteFile([]byte(strconv.Itoa(os.Getpid())))
+}
+
+// RemoveStaleTempDirs removes, from the given folder, the temp folders left by the language
+// servers that are not running anymore (for example after a crash) and not modified for
+// more than maxAge (0 to remove them regardless of their age). It returns the removed folders.
+func RemoveStaleTempDirs(tempRoot *paths.Path, maxAge time.Duration) (paths.PathList, error) {
+	dirs, err := tempRoot.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+	dirs.FilterDirs()
+	dirs.FilterPrefix(tempDirPrefix)
+
+	removed := paths.PathList{}
+	var errs []string
+	for _, dir := range dirs {
+		if !isStaleTempDir(dir, maxAge) {
+			continue
+		}
+		if err := dir.RemoveAll(); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		removed = append(removed, dir)
+	}
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("removing stale temp folders: %s", strings.Join(errs, ", "))
+	}
+	return removed, nil
+}
+
+// isStaleTempDir returns true if the given temp folder doesn't belong to a running language
+// server and has not been modified for more than maxAge.
+func isStaleTempDir(dir *paths.Path, maxAge time.Duration) bool {
+	minAge := maxAge
+	if data, err := dir.Join(sessionPIDFile).ReadFile(); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && (pid == os.Getpid() || processRunning(pid)) {
+			return false
+		}
+	} else if minAge < staleTempDirMinAge {
+		minAge = staleTempDirMinAge
+	}
+	return time.Since(tempDirLastModified(dir)) > minAge
+}
+
+// tempDirLastModified returns the last modification time of the given folder and of its
+// direct children: the whole tree is not walked, it may contain a lot of build files.
+func tempDirLastModified(dir *paths.Path) time.Time {
+	var res time.Time
+	if info, err := dir.Stat(); err == nil {
+		res = info.ModTime()
+	}
+	children, _ := dir.ReadDir()
+	for _, child := range children {
+		if info, err := child.Stat(); err == nil && info.ModTime().After(res) {
+			res = info.ModTime()
+		}
+	}
+	return res
+}
+
+// removeStaleTempFiles removes the temp folders of the language servers that are not running
+// anymore, regardless of their age, and informs the user.
+func (ls *INOLanguageServer) removeStaleTempFiles(logger jsonrpc.FunctionLogger) (json.RawMessage, error) {
+	removed, err := RemoveStaleTempDirs(ls.config.TempRoot(), 0)
+	for _, dir := range removed {
+		logger.Logf("Removed stale temp folder %s", dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ls.showMessage(logger, lsp.MessageTypeInfo, fmt.Sprintf("Removed %d stale temp folders", len(removed)))
+	return json.Marshal(removed.AsStrings())
+}
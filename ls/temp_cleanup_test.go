@@ -0,0 +1,86 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveStaleTempDirs(t *testing.T) {
+	// The pid of a terminated process
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	require.NoError(t, cmd.Run())
+	deadPid := cmd.Process.Pid
+
+	tempRoot := paths.New(t.TempDir())
+	old := time.Now().Add(-48 * time.Hour)
+	makeDir := func(name string, pid int, modTime time.Time) *paths.Path {
+		dir := tempRoot.Join(name)
+		require.NoError(t, dir.Join("build").MkdirAll())
+		if pid != 0 {
+			require.NoError(t, dir.Join(sessionPIDFile).WriteFile([]byte(strconv.Itoa(pid))))
+			require.NoError(t, os.Chtimes(dir.Join(sessionPIDFile).String(), modTime, modTime))
+		}
+		require.NoError(t, os.Chtimes(dir.Join("build").String(), modTime, modTime))
+		require.NoError(t, os.Chtimes(dir.String(), modTime, modTime))
+		return dir
+	}
+	running := makeDir("arduino-language-server111", os.Getpid(), old)
+	crashed := makeDir("arduino-language-server222", deadPid, old)
+	crashedRecently := makeDir("arduino-language-server333", deadPid, time.Now().Add(-time.Hour))
+	withoutPid := makeDir("arduino-language-server444", 0, old)
+	starting := makeDir("arduino-language-server555", 0, time.Now())
+	other := makeDir("other-program", 0, old)
+
+	removed, err := RemoveStaleTempDirs(tempRoot, 24*time.Hour)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{crashed.String(), withoutPid.String()}, removed.AsStrings())
+	require.False(t, crashed.Exist())
+	require.False(t, withoutPid.Exist())
+	require.True(t, crashedRecently.Exist())
+
+	// Regardless of the age
+	removed, err = RemoveStaleTempDirs(tempRoot, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{crashedRecently.String()}, removed.AsStrings())
+	require.True(t, running.Exist())
+	require.True(t, starting.Exist())
+	require.True(t, other.Exist())
+}
+
+func TestToolsEnv(t *testing.T) {
+	config := &Config{ExtraEnv: []string{"ARDUINO_DIRECTORIES_USER=/sketchbook"}}
+	require.Equal(t, paths.TempDir(), config.TempRoot())
+	config.TempDir = paths.New("/restricted/tmp")
+	require.Equal(t, paths.New("/restricted/tmp"), config.TempRoot())
+
+	ls := &INOLanguageServer{config: config}
+	require.Equal(t, []string{"ARDUINO_DIRECTORIES_USER=/sketchbook"}, ls.toolsEnv())
+	ls.tempDir = paths.New("/restricted/tmp/arduino-language-server123")
+	require.Equal(t, []string{
+		"ARDUINO_DIRECTORIES_USER=/sketchbook",
+		"TMPDIR=/restricted/tmp/arduino-language-server123",
+		"TMP=/restricted/tmp/arduino-language-server123",
+	}, ls.toolsEnv())
+	require.Len(t, config.ExtraEnv, 1)
+}
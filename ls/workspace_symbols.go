@@ -0,0 +1,101 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"strings"
+
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/jsonrpc"
+)
+
+// workspaceSymbolsAllPrefix is the prefix of the workspace/symbol queries searching all
+// the symbols, including the ones of the platform
+const workspaceSymbolsAllPrefix = "core:"
+
+func (ls *INOLanguageServer) workspaceSymbolReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.WorkspaceSymbolParams) ([]lsp.SymbolInformation, *jsonrpc.ResponseError) {
+	if !ls.methodForwarded(logger, "workspace/symbol") {
+		return []lsp.SymbolInformation{}, nil
+	}
+
+	releaseClangdSlot, slotErr := ls.acquireClangdSlot(ctx, logger)
+	if slotErr != nil {
+		return nil, slotErr
+	}
+	defer releaseClangdSlot()
+
+	ls.readLock(logger, true)
+	defer ls.readUnlock(logger)
+
+	query, all := strings.CutPrefix(ideParams.Query, workspaceSymbolsAllPrefix)
+	all = all || ls.workspaceSymbolsFromCore.Load()
+	clangParams := &lsp.WorkspaceSymbolParams{
+		WorkDoneProgressParams: ideParams.WorkDoneProgressParams,
+		PartialResultParams:    ideParams.PartialResultParams,
+		Query:                  query,
+	}
+	clangSymbols, clangErr, err := ls.Clangd.conn.WorkspaceSymbol(ctx, clangParams)
+	if err != nil {
+		logger.Logf("clangd communication error: %v", err)
+		ls.Close()
+		return nil, responseError(err)
+	}
+	if clangErr != nil {
+		logger.Logf("clangd response error: %v", clangErr.AsError())
+		return nil, clangErr
+	}
+
+	ideSymbols := ls.filterIgnoredSymbols(ls.clang2IdeSymbolsInformation(logger, clangSymbols))
+	if !all {
+		ideSymbols = ls.filterPlatformSymbols(ideSymbols)
+	}
+	logger.Logf("<-- workspaceSymbol(%d symbols)", len(ideSymbols))
+	return ideSymbols, nil
+}
+
+// filterPlatformSymbols keeps only the symbols of the sketch and of the user libraries,
+// dropping the ones of the platform (the core, the platform libraries and the toolchain,
+// installed in the data folder of arduino-cli) and of the build folder. The caller must
+// hold the read lock.
+func (ls *INOLanguageServer) filterPlatformSymbols(symbols []lsp.SymbolInformation) []lsp.SymbolInformation {
+	res := []lsp.SymbolInformation{}
+	for _, symbol := range symbols {
+		path := symbol.Location.URI.AsPath()
+		if ls.clangdDataFolder != nil {
+			if inside, _ := path.IsInsideDir(ls.clangdDataFolder); inside {
+				continue
+			}
+		}
+		if inside, _ := path.IsInsideDir(ls.buildPath); inside {
+			continue
+		}
+		res = append(res, symbol)
+	}
+	return res
+}
+
+// filterIgnoredSymbols drops the symbols of the files ignored by the .gitignore and
+// .arduinoignore files of the sketch. The caller must hold the read lock.
+func (ls *INOLanguageServer) filterIgnoredSymbols(symbols []lsp.SymbolInformation) []lsp.SymbolInformation {
+	res := []lsp.SymbolInformation{}
+	for _, symbol := range symbols {
+		if !ls.ignoreRules.ignored(symbol.Location.URI.AsPath()) {
+			res = append(res, symbol)
+		}
+	}
+	return res
+}
@@ -0,0 +1,68 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestWorkspaceSymbols(t *testing.T) {
+	ls := newTestSketchLanguageServer(t)
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST")
+	ls.clangdDataFolder = ls.sketchRoot.Parent().Join("data")
+	symbol := func(name string, uri lsp.DocumentURI, line int) lsp.SymbolInformation {
+		return lsp.SymbolInformation{Name: name, Kind: lsp.SymbolKindFunction, Location: lsp.Location{URI: uri, Range: testRange(line, 0, line, 4)}}
+	}
+	core := lsp.NewDocumentURIFromPath(ls.clangdDataFolder.Join("packages", "arduino", "hardware", "avr", "1.8.6", "cores", "arduino", "wiring.c"))
+	userLibrary := lsp.NewDocumentURIFromPath(ls.sketchRoot.Parent().Join("libraries", "Servo", "src", "Servo.h"))
+
+	ideSymbols := ls.clang2IdeSymbolsInformation(logger, []lsp.SymbolInformation{
+		// Symbols in the lines added by the sketch preprocessing are dropped
+		symbol("setup", lsp.NewDocumentURIFromPath(ls.buildSketchCpp), 0),
+		symbol("loop", lsp.NewDocumentURIFromPath(ls.buildSketchCpp), 3),
+		symbol("helper", lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("Helper.h")), 3),
+		symbol("delay", core, 10),
+		symbol("attach", userLibrary, 20),
+		symbol("main", lsp.NewDocumentURIFromPath(ls.buildPath.Join("main.cpp")), 1),
+	})
+	require.Equal(t, []lsp.SymbolInformation{
+		symbol("loop", lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino")), 1),
+		symbol("helper", lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h")), 2),
+		symbol("delay", core, 10),
+		symbol("attach", userLibrary, 20),
+		symbol("main", lsp.NewDocumentURIFromPath(ls.buildPath.Join("main.cpp")), 1),
+	}, ideSymbols)
+
+	// The symbols of the platform and of the build folder are filtered out
+	require.Equal(t, []lsp.SymbolInformation{
+		symbol("loop", lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino")), 1),
+		symbol("helper", lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Helper.h")), 2),
+		symbol("attach", userLibrary, 20),
+	}, ls.filterPlatformSymbols(ideSymbols))
+
+	// The symbols of the files ignored by the sketch are filtered out
+	require.NoError(t, ls.sketchRoot.MkdirAll())
+	require.NoError(t, ls.sketchRoot.Join(".arduinoignore").WriteFile([]byte("Helper.h\n")))
+	ls.ignoreRules = loadIgnoreRules(ls.sketchRoot)
+	require.Equal(t, []lsp.SymbolInformation{
+		symbol("loop", lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Sketch.ino")), 1),
+		symbol("attach", userLibrary, 20),
+	}, ls.filterIgnoredSymbols(ls.filterPlatformSymbols(ideSymbols)))
+}
@@ -1,22 +1,27 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"os/exec"
 	"os/signal"
 	"os/user"
 	"path"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/arduino/arduino-language-server/ls"
 	"github.com/arduino/arduino-language-server/streams"
 	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
 	"github.com/mattn/go-isatty"
 )
 
@@ -36,17 +41,21 @@ func main() {
 
 	clangdPath := flag.String(
 		"clangd", "",
-		"Path to clangd executable")
+		"Path to clangd executable (default: search next to the language server, in the Arduino IDE and in the PATH)")
 	cliPath := flag.String(
 		"cli", "",
-		"Path to arduino-cli executable")
+		"Path to arduino-cli executable (default: search next to the language server, in the Arduino IDE and in the PATH)")
 	cliConfigPath := flag.String(
 		"cli-config", "",
 		"Path to arduino-cli config file")
 	fqbn := flag.String(
 		"fqbn", "",
 		"Fully qualified board name to use initially (can be changed via JSON-RPC)")
-	/* unused */ _ = flag.String(
+	var compileTargets listFlag
+	flag.Var(&compileTargets,
+		"compile-target",
+		"Fully qualified board name of a board the sketch is meant to be compiled for, may be repeated: the arduino/selectCompileTarget command switches the diagnostics between the targets")
+	boardName := flag.String(
 		"board-name", "",
 		"User-friendly board name to use initially (can be changed via JSON-RPC)")
 	enableLogging := flag.Bool(
@@ -64,6 +73,9 @@ func main() {
 	cliDaemonInstanceNumber := flag.Int(
 		"cli-daemon-instance", -1,
 		"Instance number of the Arduino CLI daemon")
+	cliInProcess := flag.Bool(
+		"cli-in-process", false,
+		"Run the arduino-cli core inside the language server instead of the arduino-cli executable, keeping its indexes loaded between rebuilds")
 	skipLibrariesDiscoveryOnRebuild := flag.Bool(
 		"skip-libraries-discovery-on-rebuild", false,
 		"Skip libraries discovery on rebuild, it will make rebuilds faster but it will fail if the used libraries changes.")
@@ -71,8 +83,97 @@ func main() {
 		"no-real-time-diagnostics", false,
 		"Disable real time diagnostics")
 	jobs := flag.Int("jobs", -1, "Max number of parallel jobs. Default is 1. Use 0 to match the number of available CPU cores.")
+	var extraEnv envFlag
+	flag.Var(&extraEnv,
+		"env",
+		"Environment variable (in the form KEY=VALUE) to set for arduino-cli and clangd, may be repeated (for example: ARDUINO_DIRECTORIES_USER=/path/to/sketchbook)")
+	networkProxy := flag.String(
+		"network-proxy", "",
+		"Proxy URL to be used by arduino-cli (sets ARDUINO_NETWORK_PROXY)")
+	offline := flag.Bool(
+		"offline", false,
+		"Never access the network: the arduino-cli operations that need it fail immediately and the missing indexes are reported")
+	cliTimeout := flag.Duration(
+		"cli-timeout", 2*time.Minute,
+		"Timeout for each arduino-cli invocation (0 to disable)")
+	cliRetries := flag.Int(
+		"cli-retries", 1,
+		"Number of times a failed arduino-cli invocation is retried")
+	formatOrganizeIncludes := flag.Bool(
+		"format-organize-includes", false,
+		"When formatting, also order the includes (Arduino.h, libraries, local headers) and add a #pragma once to the headers without guard")
+	flashStringHints := flag.Bool(
+		"flash-string-hints", false,
+		"On AVR boards, suggest wrapping long string literals printed on the serial port with F() to save RAM")
+	completionRanking := flag.Bool(
+		"completion-ranking", false,
+		"Rank the completions of the symbols of the sketch and of the Arduino API above the core and library internals")
+	workspaceSymbolsFromCore := flag.Bool(
+		"workspace-symbols-from-core", false,
+		"Include the symbols of the core, of the platform libraries and of the toolchain in the workspace/symbol results (they can be searched anyway with the \"core:\" query prefix)")
+	clangdLimitResults := flag.Int(
+		"clangd-limit-results", 0,
+		"Max number of completion and workspace symbol results returned by clangd (0 for the clangd default, 100; -1 for unlimited)")
+	externalFiles := flag.String(
+		"external-files", string(ls.ExternalFilesSketchFlags),
+		"How the source files opened from outside of the sketch are analyzed: sketch-flags (with the compile flags of the sketch), standalone (on their own) or decline (not analyzed)")
+	rebuildPolicy := flag.String(
+		"rebuild-policy", string(ls.RebuildPolicyAutomatic),
+		"When the sketch is rebuilt to update the preprocessed sketch: automatic (after every change), on-save or manual (with the arduino/rebuild command)")
+	clangdMaxConcurrentRequests := flag.Int(
+		"clangd-max-concurrent-requests", 0,
+		"Max number of requests sent concurrently to clangd by all the sessions, the others are queued (0 for unlimited)")
+	clangdInitTimeout := flag.Duration(
+		"clangd-init-timeout", 30*time.Second,
+		"Timeout for the initialization of clangd, retried once before failing")
+	progressMaxRate := flag.Int(
+		"progress-max-rate", 10,
+		"Max number of progress reports per second sent to the IDE for each progress, the others are merged (0 for unlimited)")
+	clangdLogLevel := flag.String(
+		"clangd-log-level", "",
+		"Verbosity of clangd: verbose, info or error (default: verbose if logging is enabled, error otherwise)")
+	clangdStderrToLog := flag.Bool(
+		"clangd-stderr-to-log", false,
+		"Write the clangd log messages in the language server log instead of a separate file")
+	allowMethods := flag.String(
+		"allow-methods", "",
+		"Comma-separated list of the only requests forwarded to clangd, the others are answered with an empty result (for example: textDocument/completion,textDocument/hover)")
+	denyMethods := flag.String(
+		"deny-methods", "",
+		"Comma-separated list of requests answered with an empty result instead of being forwarded to clangd (for example: textDocument/documentHighlight)")
+	snapshotDir := flag.String(
+		"snapshot-dir", defaultSnapshotDir(),
+		"Folder where the state of the sessions is saved to recover quickly after a crash (empty to disable)")
+	maxGeneratedCppSize := flag.Int(
+		"max-generated-cpp-size", 2048,
+		"Size in KiB of the preprocessed sketch beyond which some features are disabled to save memory (0 for unlimited)")
+	maxTabs := flag.Int(
+		"max-tabs", 100,
+		"Number of open tabs beyond which some features are disabled to save memory (0 for unlimited)")
+	tempDir := flag.String(
+		"temp-dir", "",
+		"Folder where the build folders and the other temp files of the language server, clangd and arduino-cli are created (default: the temp folder of the system)")
+	tempMaxAge := flag.Duration(
+		"temp-max-age", 24*time.Hour,
+		"Age beyond which the temp folders left by crashed language servers are removed at startup (0 to keep them)")
+	diagnosticsFile := flag.String(
+		"diagnostics-file", "",
+		"JSON file where the diagnostics published to the IDE are mirrored, relative to the build path (empty to disable)")
+	checkSketch := flag.String(
+		"check", "",
+		"Check the environment needed to serve the sketch in the given folder, print a JSON report and exit without starting the language server")
+	listenAddress := flag.String(
+		"listen", "",
+		"TCP address to listen on for IDE connections, each connection is served as a separate session (for example: localhost:4389)")
+	logStreamAddress := flag.String(
+		"log-stream", "",
+		"TCP address where the log is streamed live to the connected clients, one JSON object per line (for example: localhost:4390)")
 	flag.Parse()
 
+	// The log is always colored, even if it's not written on a terminal. This must be
+	// set before any logger is used: the sessions run concurrently and read it.
+	color.NoColor = false
+
 	if *loggingBasePath != "" {
 		streams.GlobalLogDirectory = paths.New(*loggingBasePath)
 	} else if *enableLogging {
@@ -93,12 +194,73 @@ func main() {
 	} else {
 		log.SetOutput(os.Stderr)
 	}
+	if *logStreamAddress != "" {
+		startLogStream(*logStreamAddress)
+	}
+
+	switch ls.RebuildPolicy(*rebuildPolicy) {
+	case ls.RebuildPolicyAutomatic, ls.RebuildPolicyOnSave, ls.RebuildPolicyManual:
+	default:
+		log.Fatalf("Invalid rebuild policy: %s", *rebuildPolicy)
+	}
+	switch ls.ExternalFilesPolicy(*externalFiles) {
+	case ls.ExternalFilesSketchFlags, ls.ExternalFilesStandalone, ls.ExternalFilesDecline:
+	default:
+		log.Fatalf("Invalid external files policy: %s", *externalFiles)
+	}
+	switch ls.ClangdLogLevel(*clangdLogLevel) {
+	case "", ls.ClangdLogLevelVerbose, ls.ClangdLogLevelInfo, ls.ClangdLogLevelError:
+	default:
+		log.Fatalf("Invalid clangd log level: %s", *clangdLogLevel)
+	}
+	if *cliRetries < 0 {
+		log.Fatalf("Invalid number of arduino-cli retries: %d", *cliRetries)
+	}
+	if *clangdLimitResults < -1 {
+		log.Fatalf("Invalid clangd results limit: %d", *clangdLimitResults)
+	}
+
+	if *offline && *networkProxy != "" {
+		log.Fatal("The -offline and -network-proxy flags can't be used together.")
+	}
+	if *networkProxy != "" {
+		extraEnv = append(extraEnv, "ARDUINO_NETWORK_PROXY="+*networkProxy)
+	}
+	if *offline {
+		extraEnv = append(extraEnv, ls.OfflineEnv...)
+	}
+	if *tempDir != "" && !slices.ContainsFunc(extraEnv, func(env string) bool { return envKey(env) == "ARDUINO_BUILD_CACHE_PATH" }) {
+		// The cores compiled by arduino-cli are cached in the temp folder too, shared by the sessions
+		extraEnv = append(extraEnv, "ARDUINO_BUILD_CACHE_PATH="+paths.New(*tempDir, "arduino-build-cache").String())
+	}
+	// Only the names of the variables are logged: the values may contain
+	// credentials (for example the user info of ARDUINO_NETWORK_PROXY)
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, "ARDUINO_") {
+			log.Printf("Inherited environment: %s", envKey(env))
+		}
+	}
+	for _, env := range extraEnv {
+		log.Printf("Environment override: %s", envKey(env))
+	}
+
+	// In check mode the missing tools are reported instead of stopping the language server
+	toolNotFound := log.Fatalf
+	if *checkSketch != "" {
+		toolNotFound = log.Printf
+	}
 
+	if *cliInProcess && *cliDaemonAddress != "" {
+		log.Fatal("The -cli-in-process and -cli-daemon-addr flags can't be used together.")
+	}
 	if *cliDaemonAddress != "" || *cliDaemonInstanceNumber != -1 {
 		// if one is set, both must be set
 		if *cliDaemonAddress == "" || *cliDaemonInstanceNumber == -1 {
 			log.Fatal("ArduinoCLI daemon address and instance number must be set.")
 		}
+		if len(extraEnv) > 0 {
+			log.Printf("The ArduinoCLI daemon is not affected by environment overrides, they will be applied to clangd only.")
+		}
 	} else {
 		if *cliConfigPath == "" {
 			if user, _ := user.Current(); user != nil {
@@ -110,47 +272,131 @@ func main() {
 			}
 		}
 		if *cliConfigPath == "" {
-			log.Fatal("Path to ArduinoCLI config file must be set.")
+			toolNotFound("Path to ArduinoCLI config file must be set.")
 		}
-		if *cliPath == "" {
-			bin, _ := exec.LookPath("arduino-cli")
-			if bin == "" {
-				log.Fatal("Path to ArduinoCLI must be set.")
+		if *cliInProcess {
+			if len(extraEnv) > 0 {
+				log.Printf("The arduino-cli core is not affected by environment overrides, they will be applied to clangd only.")
+			}
+		} else if *cliPath == "" {
+			bin, err := findTool("arduino-cli", toolSearchPaths())
+			if err != nil {
+				toolNotFound("Path to ArduinoCLI must be set: %s", err)
+			} else {
+				log.Printf("arduino-cli found at %s\n", bin)
+				*cliPath = bin.String()
 			}
-			log.Printf("arduino-cli found at %s\n", bin)
-			*cliPath = bin
 		}
 	}
 
 	if *clangdPath == "" {
-		bin, _ := exec.LookPath("clangd")
-		if bin == "" {
-			log.Fatal("Path to Clangd must be set.")
+		bin, err := findTool("clangd", toolSearchPaths())
+		if err != nil {
+			toolNotFound("Path to Clangd must be set: %s", err)
+		} else {
+			log.Printf("clangd found at %s\n", bin)
+			*clangdPath = bin.String()
 		}
-		log.Printf("clangd found at %s\n", bin)
-		*clangdPath = bin
 	}
 
 	config := &ls.Config{
 		Fqbn:                            *fqbn,
+		CompileTargets:                  compileTargets,
+		BoardName:                       *boardName,
 		ClangdPath:                      paths.New(*clangdPath),
 		EnableLogging:                   *enableLogging,
 		CliPath:                         paths.New(*cliPath),
 		CliConfigPath:                   paths.New(*cliConfigPath),
 		FormatterConf:                   paths.New(*formatFilePath),
+		TempDir:                         paths.New(*tempDir),
 		CliDaemonAddress:                *cliDaemonAddress,
 		CliInstanceNumber:               *cliDaemonInstanceNumber,
 		SkipLibrariesDiscoveryOnRebuild: *skipLibrariesDiscoveryOnRebuild,
 		DisableRealTimeDiagnostics:      *noRealTimeDiagnostics,
 		Jobs:                            *jobs,
+		ExtraEnv:                        extraEnv,
+		CliTimeout:                      *cliTimeout,
+		CliRetries:                      *cliRetries,
+		FlashStringHints:                *flashStringHints,
+		CompletionRanking:               *completionRanking,
+		WorkspaceSymbolsFromCore:        *workspaceSymbolsFromCore,
+		ClangdLimitResults:              *clangdLimitResults,
+		RebuildPolicy:                   ls.RebuildPolicy(*rebuildPolicy),
+		ExternalFiles:                   ls.ExternalFilesPolicy(*externalFiles),
+		ClangdMaxConcurrentRequests:     *clangdMaxConcurrentRequests,
+		ClangdInitTimeout:               *clangdInitTimeout,
+		ProgressMaxRate:                 *progressMaxRate,
+		ClangdLogLevel:                  ls.ClangdLogLevel(*clangdLogLevel),
+		ClangdStderrToLog:               *clangdStderrToLog,
+		SnapshotDir:                     paths.New(*snapshotDir),
+		MaxGeneratedCppSize:             *maxGeneratedCppSize * 1024,
+		MaxTabs:                         *maxTabs,
+		Offline:                         *offline,
+		DiagnosticsFile:                 *diagnosticsFile,
+		FormatOrganizeIncludes:          *formatOrganizeIncludes,
+		MethodFilter: ls.MethodFilter{
+			Allow: methodsList(*allowMethods),
+			Deny:  methodsList(*denyMethods),
+		},
+	}
+	if config.TempDir != nil {
+		if err := config.TempDir.MkdirAll(); err != nil {
+			log.Fatalf("Could not create the temp folder: %s", err)
+		}
+		config.TempDir = config.TempDir.Canonical()
+	}
+
+	if *checkSketch != "" {
+		report := ls.CheckEnvironment(config, paths.New(*checkSketch).Canonical())
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("Could not encode the report: %s", err)
+		}
+		fmt.Println(string(data))
+		if !report.Success {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *tempMaxAge > 0 {
+		go func() {
+			defer streams.CatchAndLogPanic()
+			removed, err := ls.RemoveStaleTempDirs(config.TempRoot(), *tempMaxAge)
+			for _, dir := range removed {
+				log.Printf("Removed stale temp folder %s", dir)
+			}
+			if err != nil {
+				log.Printf("Error: %s", err)
+			}
+		}()
+	}
+
+	if *cliInProcess {
+		core, err := ls.StartArduinoCLICore(config)
+		if err != nil {
+			log.Fatalf("Could not start the arduino-cli core: %s", err)
+		}
+		defer core.Close()
+	}
+
+	if *listenAddress != "" {
+		serveSessions(*listenAddress, config)
+		return
 	}
 
+	// Writing to a broken stdout pipe must fail instead of killing the process, so that the
+	// loss of the connection with the IDE can be handled
+	signal.Ignore(syscall.SIGPIPE)
 	stdio := streams.NewReadWriteCloser(os.Stdin, os.Stdout)
 	if *enableLogging {
 		stdio = streams.LogReadWriteCloserAs(stdio, "inols.log")
 	}
 
-	inoHandler := ls.NewINOLanguageServer(stdio, stdio, config)
+	inoHandler, err := ls.NewINOLanguageServer(stdio, stdio, config)
+	if err != nil {
+		log.Fatalf("Could not start the language server: %s", err)
+	}
 
 	if isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd()) {
 		fmt.Fprint(os.Stderr, `
@@ -173,3 +419,101 @@ https://microsoft.github.io/language-server-protocol/
 	}
 	inoHandler.Close()
 }
+
+// serveSessions accepts IDE connections on the given address, serving each one of them
+// as a separate session, until the process is interrupted.
+func serveSessions(address string, config *ls.Config) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("Could not listen on %s: %s", address, err)
+	}
+	log.Printf("Listening for IDE connections on %s", listener.Addr())
+
+	sessions := ls.NewSessionManager(config)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- sessions.Serve(listener)
+	}()
+
+	// Intercept kill signal
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, os.Kill)
+
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			log.Printf("Error serving sessions: %s", err)
+		}
+	case <-c:
+		log.Println("INTERRUPTED")
+	}
+	sessions.Close()
+}
+
+// listFlag is a repeatable command line flag collecting its values
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// envFlag is a repeatable command line flag collecting KEY=VALUE environment variables
+type envFlag []string
+
+func (e *envFlag) String() string {
+	return strings.Join(*e, " ")
+}
+
+// envKey returns the name of a KEY=VALUE environment variable
+func envKey(env string) string {
+	key, _, _ := strings.Cut(env, "=")
+	return key
+}
+
+func (e *envFlag) Set(value string) error {
+	if k, _, ok := strings.Cut(value, "="); !ok || k == "" {
+		return fmt.Errorf("invalid environment variable '%s', must be in the form KEY=VALUE", value)
+	}
+	*e = append(*e, value)
+	return nil
+}
+
+// methodsList splits a comma-separated list of LSP methods
+func methodsList(list string) []string {
+	methods := []string{}
+	for _, method := range strings.Split(list, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// defaultSnapshotDir returns the folder of the session snapshots in the user cache
+func defaultSnapshotDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return paths.New(cacheDir, "arduino-language-server", "snapshots").String()
+}
+
+// startLogStream streams the log live to the clients connecting to the given address
+func startLogStream(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("Could not listen on %s: %s", address, err)
+	}
+	streamer := streams.NewLogStreamer()
+	log.SetOutput(io.MultiWriter(log.Writer(), streamer))
+	log.Printf("Streaming the log on %s", listener.Addr())
+	go func() {
+		defer streams.CatchAndLogPanic()
+		log.Printf("Log stream stopped: %s", streamer.Serve(listener))
+	}()
+}
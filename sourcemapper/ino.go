@@ -24,10 +24,10 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/arduino/arduino-language-server/textutils"
 	"github.com/arduino/go-paths-helper"
 	"github.com/pkg/errors"
 	"github.com/vincecity/go-lsp"
-	"github.com/vincecity/go-lsp/textedits"
 )
 
 // SketchMapper is a mapping between the .ino sketch and the preprocessed .cpp file
@@ -160,18 +160,47 @@ func (s *SketchMapper) IsPreprocessedCppLine(cppLine int) bool {
 	return preprocessed || !mapsToIno
 }
 
+// PreprocessedCppLines returns, in ascending order, the .cpp lines added by the arduino
+// preprocessor that refer to a line of an .ino file: these are the prototypes generated
+// for the functions defined in the sketch.
+func (s *SketchMapper) PreprocessedCppLines() []int {
+	res := make([]int, 0, len(s.cppPreprocessed))
+	for cppLine := range s.cppPreprocessed {
+		res = append(res, cppLine)
+	}
+	sort.Ints(res)
+	return res
+}
+
 // CreateInoMapper create a InoMapper from the given target file
 func CreateInoMapper(targetFile []byte) *SketchMapper {
 	mapper := &SketchMapper{
 		CppText: &SourceRevision{
 			Version: 1,
-			Text:    string(targetFile),
+			Text:    stripSourceBOMs(string(targetFile)),
 		},
 	}
 	mapper.regeneratehMapping()
 	return mapper
 }
 
+// stripSourceBOMs removes the byte order marks that the preprocessor copies from the sketch
+// files at the beginning of their first line, right after the #line directive. The IDE does
+// not count the BOM in the positions, leaving it in the .cpp would shift the columns of the
+// first line of each file.
+func stripSourceBOMs(cppText string) string {
+	if !strings.Contains(cppText, textutils.BOM) {
+		return cppText
+	}
+	lines := strings.SplitAfter(textutils.StripBOM(cppText), "\n")
+	for i := 1; i < len(lines); i++ {
+		if strings.HasPrefix(lines[i-1], "#line") {
+			lines[i] = textutils.StripBOM(lines[i])
+		}
+	}
+	return strings.Join(lines, "")
+}
+
 func (s *SketchMapper) regeneratehMapping() {
 	s.inoToCpp = map[InoLine]int{}
 	s.cppToIno = map[int]InoLine{}
@@ -229,6 +258,32 @@ func unquoteCppString(str string) string {
 	return str
 }
 
+// RenameInoFile updates the mapping after the .ino file at oldPath has been renamed to newPath,
+// the preprocessed .cpp is left untouched and will be regenerated by the next sketch rebuild.
+func (s *SketchMapper) RenameInoFile(oldPath, newPath string) {
+	renameKeys := func(m map[InoLine]int) map[InoLine]int {
+		res := map[InoLine]int{}
+		for inoLine, cppLine := range m {
+			if inoLine.File == oldPath {
+				inoLine.File = newPath
+			}
+			res[inoLine] = cppLine
+		}
+		return res
+	}
+	renameValues := func(m map[int]InoLine) {
+		for cppLine, inoLine := range m {
+			if inoLine.File == oldPath {
+				m[cppLine] = InoLine{newPath, inoLine.Line}
+			}
+		}
+	}
+	s.inoToCpp = renameKeys(s.inoToCpp)
+	s.inoPreprocessed = renameKeys(s.inoPreprocessed)
+	renameValues(s.cppToIno)
+	renameValues(s.cppPreprocessed)
+}
+
 // ApplyTextChange performs the text change and updates both .ino and .cpp files.
 // It returns true if the change is "dirty", this happens when the change alters preprocessed lines
 // and a new preprocessing may be probably required.
@@ -242,7 +297,7 @@ func (s *SketchMapper) ApplyTextChange(inoURI lsp.DocumentURI, inoChange lsp.Tex
 	deletedLines := inoRange.End.Line - inoRange.Start.Line
 
 	// Apply text changes
-	newText, err := textedits.ApplyTextChange(s.CppText.Text, cppRange, inoChange.Text)
+	newText, err := textutils.ApplyTextChange(s.CppText.Text, cppRange, inoChange.Text)
 	if err != nil {
 		panic("error replacing text: " + err.Error())
 	}
@@ -398,7 +453,7 @@ func (s *SketchMapper) DebugLogAll() {
 		}
 		return s[l:]
 	}
-	cpp := strings.Split(s.CppText.Text, "\n")
+	cpp := textutils.SplitLines(s.CppText.Text)
 	log.Printf("  > Current sketchmapper content:")
 	for l, cppLine := range cpp {
 		inoFile, inoLine := s.CppToInoLine(l)
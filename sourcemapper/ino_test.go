@@ -17,8 +17,14 @@ package sourcemapper
 
 import (
 	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/arduino/arduino-language-server/textutils"
 	"github.com/arduino/go-paths-helper"
 	"github.com/stretchr/testify/require"
 	"github.com/vincecity/go-lsp"
@@ -69,6 +75,7 @@ func TestCreateSourceMaps(t *testing.T) {
 		5: {sketchJuly2a, 1}, // setup
 		7: {sketchJuly2a, 6}, // loop
 	}, sourceMap.cppPreprocessed)
+	require.Equal(t, []int{5, 7}, sourceMap.PreprocessedCppLines())
 
 	sourceMap.DebugLogAll()
 
@@ -234,6 +241,144 @@ void secondFunction() {
 	dumpInoToCppMap(sourceMap.inoPreprocessed)
 }
 
+func TestRenameInoFile(t *testing.T) {
+	sketch := paths.New("/tmp/Sketch/Sketch.ino").Canonical().String()
+	tab := paths.New("/tmp/Sketch/Tab.ino").Canonical().String()
+	renamed := paths.New("/tmp/Sketch/Renamed.ino").Canonical().String()
+	input := "#include <Arduino.h>\n" +
+		"#line 1 \"" + sketch + "\"\n" +
+		"void setup() {}\n" +
+		"#line 1 \"" + tab + "\"\n" +
+		"void loop() {}\n"
+	sourceMap := CreateInoMapper([]byte(input))
+	sourceMap.RenameInoFile(tab, renamed)
+
+	file, line := sourceMap.CppToInoLine(4)
+	require.Equal(t, renamed, file)
+	require.Equal(t, 0, line)
+	cppLine, ok := sourceMap.InoToCppLineOk(lsp.NewDocumentURI(renamed), 0)
+	require.True(t, ok)
+	require.Equal(t, 4, cppLine)
+	_, ok = sourceMap.InoToCppLineOk(lsp.NewDocumentURI(tab), 0)
+	require.False(t, ok)
+
+	// The other tabs are untouched
+	file, line = sourceMap.CppToInoLine(2)
+	require.Equal(t, sketch, file)
+	require.Equal(t, 0, line)
+}
+
+func TestCRLFSourceMap(t *testing.T) {
+	sketch := paths.New("/tmp/Sketch/Sketch.ino").Canonical().String()
+	// The lines copied from the sketch keep its CRLF line endings, the generated ones use LF
+	input := "#include <Arduino.h>\n" +
+		"#line 1 \"" + sketch + "\"\r\n" +
+		"void setup() {\r\n" +
+		"}\r\n" +
+		"void loop() {}\n"
+	sourceMap := CreateInoMapper([]byte(input))
+	sketchURI := lsp.NewDocumentURI(sketch)
+	for inoLine, cppLine := range []int{2, 3, 4} {
+		mapped, ok := sourceMap.InoToCppLineOk(sketchURI, inoLine)
+		require.True(t, ok)
+		require.Equal(t, cppLine, mapped)
+	}
+
+	// A change at the end of a CRLF line is inserted before the line terminator, even if
+	// the character is beyond the end of the line
+	sourceMap.ApplyTextChange(sketchURI, lsp.TextDocumentContentChangeEvent{
+		Range: &lsp.Range{Start: lsp.Position{Line: 0, Character: 20}, End: lsp.Position{Line: 0, Character: 20}},
+		Text:  "\r\n  delay(1);",
+	})
+	require.Equal(t, "#include <Arduino.h>\n"+
+		"#line 1 \""+sketch+"\"\r\n"+
+		"void setup() {\r\n"+
+		"  delay(1);\r\n"+
+		"}\r\n"+
+		"void loop() {}\n", sourceMap.CppText.Text)
+	for inoLine, cppLine := range []int{2, 3, 4, 5} {
+		mapped, ok := sourceMap.InoToCppLineOk(sketchURI, inoLine)
+		require.True(t, ok)
+		require.Equal(t, cppLine, mapped)
+	}
+
+	// Removing a CRLF line
+	sourceMap.ApplyTextChange(sketchURI, lsp.TextDocumentContentChangeEvent{
+		Range: &lsp.Range{Start: lsp.Position{Line: 1, Character: 0}, End: lsp.Position{Line: 2, Character: 0}},
+		Text:  "",
+	})
+	require.Equal(t, "#include <Arduino.h>\n"+
+		"#line 1 \""+sketch+"\"\r\n"+
+		"void setup() {\r\n"+
+		"}\r\n"+
+		"void loop() {}\n", sourceMap.CppText.Text)
+	file, line := sourceMap.CppToInoLine(4)
+	require.Equal(t, sketch, file)
+	require.Equal(t, 2, line)
+}
+
+func TestBOMSourceMap(t *testing.T) {
+	sketch := paths.New("/tmp/Sketch/Sketch.ino").Canonical().String()
+	tab := paths.New("/tmp/Sketch/Tab.ino").Canonical().String()
+	// The preprocessor copies the BOM of each sketch file after its #line directive
+	input := "\ufeff#include <Arduino.h>\n" +
+		"#line 1 \"" + sketch + "\"\n" +
+		"\ufeffvoid setup() {}\n" +
+		"#line 1 \"" + tab + "\"\r\n" +
+		"\ufeffvoid loop() {}\r\n" +
+		"const char *s = \"\ufeff\";\n"
+	sourceMap := CreateInoMapper([]byte(input))
+	require.Equal(t, "#include <Arduino.h>\n"+
+		"#line 1 \""+sketch+"\"\n"+
+		"void setup() {}\n"+
+		"#line 1 \""+tab+"\"\r\n"+
+		"void loop() {}\r\n"+
+		"const char *s = \"\ufeff\";\n", sourceMap.CppText.Text)
+
+	cppRange, ok := sourceMap.InoToCppLSPRangeOk(lsp.NewDocumentURI(tab), lsp.Range{
+		Start: lsp.Position{Line: 0, Character: 5},
+		End:   lsp.Position{Line: 0, Character: 9},
+	})
+	require.True(t, ok)
+	text, err := textutils.ExtractRange(sourceMap.CppText.Text, cppRange)
+	require.NoError(t, err)
+	require.Equal(t, "loop", text)
+}
+
+func TestMapperState(t *testing.T) {
+	sketch := paths.New("/tmp/Sketch/Sketch.ino").Canonical().String()
+	input := "#include <Arduino.h>\n" +
+		"#line 1 \"" + sketch + "\"\n" +
+		"#line 2 \"" + sketch + "\"\n" +
+		"void setup();\n" +
+		"#line 2 \"" + sketch + "\"\n" +
+		"void setup() {}\n" +
+		"void loop() {}\n"
+	sourceMap := CreateInoMapper([]byte(input))
+	sourceMap.ApplyTextChange(lsp.NewDocumentURI(sketch), lsp.TextDocumentContentChangeEvent{
+		Range: &lsp.Range{Start: lsp.Position{Line: 1, Character: 0}, End: lsp.Position{Line: 1, Character: 0}},
+		Text:  "int a;\n",
+	})
+
+	state := sourceMap.State()
+	require.Equal(t, state, sourceMap.State())
+	require.NotEmpty(t, state.CppPreprocessed)
+	require.True(t, sort.SliceIsSorted(state.CppToIno, func(i, j int) bool {
+		return state.CppToIno[i].CppLine < state.CppToIno[j].CppLine
+	}))
+
+	restored := NewSketchMapperFromState(state)
+	require.Equal(t, sourceMap.CppText, restored.CppText)
+	require.Equal(t, sourceMap.cppToIno, restored.cppToIno)
+	require.Equal(t, sourceMap.inoToCpp, restored.inoToCpp)
+	require.Equal(t, sourceMap.cppPreprocessed, restored.cppPreprocessed)
+	require.Equal(t, sourceMap.inoPreprocessed, restored.inoPreprocessed)
+
+	// The restored mapper is independent from the original one
+	restored.CppText.Text = ""
+	require.NotEmpty(t, sourceMap.CppText.Text)
+}
+
 // func TestUpdateSourceMaps1(t *testing.T) {
 // 	sourceMap := &InoMapper{
 // 		toCpp: map[int]int{
@@ -308,3 +453,105 @@ void secondFunction() {
 // 		t.Error(sourceMap.toIno)
 // 	}
 // }
+
+// editOracle is a naive implementation of the text edits, working on the lines of the
+// document, used to cross-check the incremental updates of the documents and of the mapper
+type editOracle struct {
+	lines []string
+}
+
+func (o *editOracle) apply(r lsp.Range, text string) {
+	prefix := o.lines[r.Start.Line][:r.Start.Character]
+	suffix := o.lines[r.End.Line][r.End.Character:]
+	replaced := strings.Split(prefix+text+suffix, "\n")
+	lines := append([]string{}, o.lines[:r.Start.Line]...)
+	lines = append(lines, replaced...)
+	o.lines = append(lines, o.lines[r.End.Line+1:]...)
+}
+
+// position returns a valid position in the document, on a rune boundary, from the given
+// fuzzer bytes
+func (o *editOracle) position(line, character byte) lsp.Position {
+	l := int(line) % len(o.lines)
+	runeStarts := []int{}
+	for offset := range o.lines[l] {
+		runeStarts = append(runeStarts, offset)
+	}
+	runeStarts = append(runeStarts, len(o.lines[l]))
+	return lsp.Position{Line: l, Character: runeStarts[int(character)%len(runeStarts)]}
+}
+
+// fuzzEditAlphabet are the characters of the text inserted by the fuzzed edits
+var fuzzEditAlphabet = []string{"a", "b", " ", "{", "}", "\n", "é", "😀"}
+
+func FuzzApplyTextChange(f *testing.F) {
+	f.Add([]byte{0, 3, 0, 5, 2, 0, 5})
+	f.Add([]byte{1, 0, 2, 0, 0, 0, 0, 4, 2, 5, 5, 5})
+	f.Add([]byte{2, 1, 0, 0, 3, 5, 6, 7, 0, 0, 1, 3, 1})
+
+	// The mapper logs every change, keep the fuzzer output readable
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	sketch := paths.New("/tmp/Sketch/Sketch.ino").Canonical().String()
+	tab := paths.New("/tmp/Sketch/Tab.ino").Canonical().String()
+	sketchURI := lsp.NewDocumentURI(sketch)
+	f.Fuzz(func(t *testing.T, edits []byte) {
+		oracle := &editOracle{lines: []string{"void setup() {", "  é = 1;", "}", "void loop() {}"}}
+		doc := lsp.TextDocumentItem{URI: sketchURI, Version: 1, Text: strings.Join(oracle.lines, "\n")}
+		mapper := CreateInoMapper([]byte("#include <Arduino.h>\n" +
+			"#line 1 \"" + sketch + "\"\n" +
+			doc.Text + "\n" +
+			"#line 1 \"" + tab + "\"\n" +
+			"void tab() {}\n"))
+
+		// Each edit is made of 5 bytes (start line and character, lines and character of
+		// the end relative to the start, length of the text) followed by the text
+		for len(edits) >= 5 {
+			start := oracle.position(edits[0], edits[1])
+			endLine := start.Line + int(edits[2])%3
+			if endLine >= len(oracle.lines) {
+				endLine = len(oracle.lines) - 1
+			}
+			end := oracle.position(byte(endLine), edits[3])
+			if end.Line == start.Line && end.Character < start.Character {
+				end.Character = start.Character
+			}
+			textLen := int(edits[4]) % 8
+			edits = edits[5:]
+			text := ""
+			for ; textLen > 0 && len(edits) > 0; textLen-- {
+				text += fuzzEditAlphabet[int(edits[0])%len(fuzzEditAlphabet)]
+				edits = edits[1:]
+			}
+			change := lsp.TextDocumentContentChangeEvent{Range: &lsp.Range{Start: start, End: end}, Text: text}
+
+			oracle.apply(*change.Range, text)
+			var err error
+			doc, err = textutils.ApplyLSPTextDocumentContentChangeEvent(doc, &lsp.DidChangeTextDocumentParams{
+				TextDocument:   lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: sketchURI}},
+				ContentChanges: []lsp.TextDocumentContentChangeEvent{change},
+			})
+			require.NoError(t, err)
+			require.Equal(t, strings.Join(oracle.lines, "\n"), doc.Text, "tracked document after %s", change.Range)
+			mapper.ApplyTextChange(sketchURI, change)
+		}
+
+		// The lines of the .ino in the .cpp must match the edited document, the other lines
+		// are left untouched
+		cppLines := textutils.SplitLines(mapper.CppText.Text)
+		require.Equal(t, "#include <Arduino.h>", cppLines[0])
+		for inoLine, text := range oracle.lines {
+			cppLine, ok := mapper.InoToCppLineOk(sketchURI, inoLine)
+			require.True(t, ok, "line %d of the sketch not mapped", inoLine)
+			require.Equal(t, text, cppLines[cppLine], "line %d of the sketch", inoLine)
+			file, line := mapper.CppToInoLine(cppLine)
+			require.Equal(t, sketch, file)
+			require.Equal(t, inoLine, line)
+		}
+		require.Equal(t, []string{"#line 1 \"" + tab + "\"", "void tab() {}", ""}, cppLines[len(cppLines)-3:])
+		file, line := mapper.CppToInoLine(len(cppLines) - 2)
+		require.Equal(t, tab, file)
+		require.Equal(t, 0, line)
+	})
+}
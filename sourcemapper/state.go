@@ -0,0 +1,104 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package sourcemapper
+
+import (
+	"sort"
+)
+
+// MapperState is a copy of the internal state of a SketchMapper that can be serialized,
+// the mappings are sorted so that the same state is always serialized in the same way.
+type MapperState struct {
+	CppVersion      int           `json:"cppVersion"`
+	CppText         string        `json:"cppText"`
+	CppToIno        []LineMapping `json:"cppToIno"`
+	InoToCpp        []LineMapping `json:"inoToCpp"`
+	CppPreprocessed []LineMapping `json:"cppPreprocessed,omitempty"`
+	InoPreprocessed []LineMapping `json:"inoPreprocessed,omitempty"`
+}
+
+// LineMapping is an entry of the mappings between the .cpp lines and the .ino lines
+type LineMapping struct {
+	CppLine int    `json:"cppLine"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+}
+
+// State returns a copy of the internal state of the mapper
+func (s *SketchMapper) State() *MapperState {
+	fromCpp := func(m map[int]InoLine) []LineMapping {
+		res := []LineMapping{}
+		for cppLine, inoLine := range m {
+			res = append(res, LineMapping{CppLine: cppLine, File: inoLine.File, Line: inoLine.Line})
+		}
+		sortLineMappings(res)
+		return res
+	}
+	fromIno := func(m map[InoLine]int) []LineMapping {
+		res := []LineMapping{}
+		for inoLine, cppLine := range m {
+			res = append(res, LineMapping{CppLine: cppLine, File: inoLine.File, Line: inoLine.Line})
+		}
+		sortLineMappings(res)
+		return res
+	}
+	return &MapperState{
+		CppVersion:      s.CppText.Version,
+		CppText:         s.CppText.Text,
+		CppToIno:        fromCpp(s.cppToIno),
+		InoToCpp:        fromIno(s.inoToCpp),
+		CppPreprocessed: fromCpp(s.cppPreprocessed),
+		InoPreprocessed: fromIno(s.inoPreprocessed),
+	}
+}
+
+// NewSketchMapperFromState creates a mapper with the given state. The state is restored
+// as is, even if it's inconsistent: this allows to reproduce the issues of the mapper.
+func NewSketchMapperFromState(state *MapperState) *SketchMapper {
+	s := &SketchMapper{
+		CppText:         &SourceRevision{Version: state.CppVersion, Text: state.CppText},
+		inoToCpp:        map[InoLine]int{},
+		cppToIno:        map[int]InoLine{},
+		inoPreprocessed: map[InoLine]int{},
+		cppPreprocessed: map[int]InoLine{},
+	}
+	for _, m := range state.CppToIno {
+		s.cppToIno[m.CppLine] = InoLine{m.File, m.Line}
+	}
+	for _, m := range state.InoToCpp {
+		s.inoToCpp[InoLine{m.File, m.Line}] = m.CppLine
+	}
+	for _, m := range state.CppPreprocessed {
+		s.cppPreprocessed[m.CppLine] = InoLine{m.File, m.Line}
+	}
+	for _, m := range state.InoPreprocessed {
+		s.inoPreprocessed[InoLine{m.File, m.Line}] = m.CppLine
+	}
+	return s
+}
+
+func sortLineMappings(mappings []LineMapping) {
+	sort.Slice(mappings, func(i, j int) bool {
+		a, b := mappings[i], mappings[j]
+		if a.CppLine != b.CppLine {
+			return a.CppLine < b.CppLine
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+}
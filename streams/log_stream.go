@@ -0,0 +1,130 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package streams
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logStreamClientBuffer is the number of log messages queued for each client, the
+// messages are dropped if a client doesn't keep up with the log.
+const logStreamClientBuffer = 1024
+
+// logStreamWriteTimeout is the time after which a client that doesn't receive a log
+// message is disconnected.
+const logStreamWriteTimeout = 10 * time.Second
+
+var ansiEscapeRegexp = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// LogStreamMessage is a log message sent to the clients of a LogStreamer
+type LogStreamMessage struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// LogStreamer is an io.Writer that sends the log, as it's written, to the clients connected
+// to a TCP endpoint: each log message is sent as a JSON object on a single line.
+type LogStreamer struct {
+	mux     sync.Mutex
+	clients map[chan []byte]bool
+}
+
+// NewLogStreamer creates a new LogStreamer without clients
+func NewLogStreamer() *LogStreamer {
+	return &LogStreamer{clients: map[chan []byte]bool{}}
+}
+
+// Serve accepts the clients connecting to the listener, until the listener is closed
+func (s *LogStreamer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer CatchAndLogPanic()
+			s.serveClient(conn)
+		}()
+	}
+}
+
+func (s *LogStreamer) serveClient(conn net.Conn) {
+	defer conn.Close()
+
+	messages := make(chan []byte, logStreamClientBuffer)
+	s.mux.Lock()
+	s.clients[messages] = true
+	s.mux.Unlock()
+	defer func() {
+		s.mux.Lock()
+		delete(s.clients, messages)
+		s.mux.Unlock()
+	}()
+
+	// The clients are not expected to send anything: the read returns when the
+	// client disconnects, even if no log message is written in the meantime.
+	disconnected := make(chan struct{})
+	go func() {
+		defer CatchAndLogPanic()
+		_, _ = io.Copy(io.Discard, conn)
+		close(disconnected)
+	}()
+
+	for {
+		select {
+		case <-disconnected:
+			return
+		case msg := <-messages:
+			if err := conn.SetWriteDeadline(time.Now().Add(logStreamWriteTimeout)); err != nil {
+				return
+			}
+			if _, err := conn.Write(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Write sends the log message to the connected clients, it never blocks
+func (s *LogStreamer) Write(p []byte) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.clients) == 0 {
+		return len(p), nil
+	}
+
+	msg, err := json.Marshal(&LogStreamMessage{
+		Time:    time.Now(),
+		Message: ansiEscapeRegexp.ReplaceAllString(strings.TrimSuffix(string(p), "\n"), ""),
+	})
+	if err != nil {
+		return len(p), nil
+	}
+	msg = append(msg, '\n')
+	for client := range s.clients {
+		select {
+		case client <- msg:
+		default:
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,80 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package streams
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogStreamer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	streamer := NewLogStreamer()
+	go streamer.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Wait for the client to be registered
+	require.Eventually(t, func() bool {
+		streamer.mux.Lock()
+		defer streamer.mux.Unlock()
+		return len(streamer.clients) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	logger := log.New(streamer, "", 0)
+	logger.Print("\x1b[92mclangd started\x1b[0m")
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	var msg LogStreamMessage
+	require.NoError(t, json.Unmarshal(line, &msg))
+	require.Equal(t, "clangd started", msg.Message)
+	require.False(t, msg.Time.IsZero())
+}
+
+func TestLogStreamerClientDisconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	streamer := NewLogStreamer()
+	go streamer.Serve(listener)
+
+	clientsCount := func() int {
+		streamer.mux.Lock()
+		defer streamer.mux.Unlock()
+		return len(streamer.clients)
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return clientsCount() == 1 }, time.Second, 10*time.Millisecond)
+
+	// The client is unregistered even if nothing is logged after it left
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool { return clientsCount() == 0 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,136 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+// Package textutils provides the text manipulations on the documents tracked by the language
+// server. The lines are terminated by "\n" or by "\r\n": the "\r" of the Windows line endings
+// is not part of the line, so the positions in the files saved with CRLF, or mixed, line
+// endings are the same computed by the IDE and by clangd.
+package textutils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vincecity/go-lsp"
+	"github.com/vincecity/go-lsp/textedits"
+)
+
+// BOM is the UTF-8 byte order mark that some editors put at the beginning of the files
+const BOM = "\ufeff"
+
+// StripBOM removes the UTF-8 byte order mark from the beginning of the text, if present.
+// The IDE does not count the BOM in the positions, so it must not be part of the tracked text.
+func StripBOM(text string) string {
+	return strings.TrimPrefix(text, BOM)
+}
+
+// SplitLines splits the text in lines, without the line terminators. Like strings.Split, a
+// text ending with a line terminator gives an empty last line.
+func SplitLines(text string) []string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines[:len(lines)-1] {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// GetLineOffset returns the offset of the beginning of the given line within the text.
+func GetLineOffset(text string, line int) (int, error) {
+	return textedits.GetLineOffset(text, line)
+}
+
+// GetOffset returns the offset in the text of the given position. A character beyond the
+// end of the line is moved back to the end of the line, before the line terminator.
+func GetOffset(text string, pos lsp.Position) (int, error) {
+	lineOffset, err := GetLineOffset(text, pos.Line)
+	if err != nil {
+		return -1, err
+	}
+	if pos.Character < 0 {
+		return -1, textedits.OutOfRangeError{Type: "Character", Max: lineLength(text[lineOffset:]), Req: pos.Character}
+	}
+	lineText := text[lineOffset:]
+	lineText = lineText[:lineLength(lineText)]
+	for offset := range lineText {
+		if offset == pos.Character {
+			return lineOffset + offset, nil
+		}
+	}
+	// The character is beyond the end of the line (or in the middle of a multi-byte rune)
+	return lineOffset + len(lineText), nil
+}
+
+// lineLength returns the length of the first line of the text, without the line terminator
+func lineLength(text string) int {
+	end := strings.IndexByte(text, '\n')
+	if end == -1 {
+		return len(text)
+	}
+	if end > 0 && text[end-1] == '\r' {
+		end--
+	}
+	return end
+}
+
+// ApplyTextChange replaces the given range of the text with insertText
+func ApplyTextChange(text string, replaceRange lsp.Range, insertText string) (string, error) {
+	start, err := GetOffset(text, replaceRange.Start)
+	if err != nil {
+		return "", err
+	}
+	end, err := GetOffset(text, replaceRange.End)
+	if err != nil {
+		return "", err
+	}
+	if end < start {
+		return "", fmt.Errorf("invalid range %s", replaceRange)
+	}
+	return text[:start] + insertText + text[end:], nil
+}
+
+// ExtractRange returns the text in the given range
+func ExtractRange(text string, textRange lsp.Range) (string, error) {
+	start, err := GetOffset(text, textRange.Start)
+	if err != nil {
+		return "", err
+	}
+	end, err := GetOffset(text, textRange.End)
+	if err != nil {
+		return "", err
+	}
+	if end < start {
+		return "", fmt.Errorf("invalid range %s", textRange)
+	}
+	return text[start:end], nil
+}
+
+// ApplyLSPTextDocumentContentChangeEvent applies the changes of a didChange notification to
+// the given document, incrementing its version.
+func ApplyLSPTextDocumentContentChangeEvent(doc lsp.TextDocumentItem, changes *lsp.DidChangeTextDocumentParams) (lsp.TextDocumentItem, error) {
+	if changes.TextDocument.URI != doc.URI {
+		return lsp.TextDocumentItem{}, fmt.Errorf("expected changes for %s but got changes for: %s", doc.URI, changes.TextDocument.URI)
+	}
+	for _, change := range changes.ContentChanges {
+		if change.Range == nil {
+			doc.Text = StripBOM(change.Text)
+		} else if text, err := ApplyTextChange(doc.Text, *change.Range, change.Text); err != nil {
+			return lsp.TextDocumentItem{}, err
+		} else {
+			doc.Text = text
+		}
+	}
+	doc.Version++
+	return doc, nil
+}
@@ -0,0 +1,115 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2022 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package textutils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vincecity/go-lsp"
+)
+
+func TestSplitLines(t *testing.T) {
+	require.Equal(t, []string{""}, SplitLines(""))
+	require.Equal(t, []string{"a", "b", ""}, SplitLines("a\nb\n"))
+	require.Equal(t, []string{"a", "b", ""}, SplitLines("a\r\nb\r\n"))
+	require.Equal(t, []string{"a", "b", "c"}, SplitLines("a\r\nb\nc"))
+	// A CR not followed by a LF is kept in the line
+	require.Equal(t, []string{"a", "b\r"}, SplitLines("a\nb\r"))
+}
+
+func TestGetOffset(t *testing.T) {
+	pos := func(line, character int) lsp.Position { return lsp.Position{Line: line, Character: character} }
+	for _, text := range []string{"foo\nbar\nbaz", "foo\r\nbar\r\nbaz", "foo\r\nbar\nbaz"} {
+		barOffset, err := GetLineOffset(text, 1)
+		require.NoError(t, err)
+
+		offset, err := GetOffset(text, pos(1, 1))
+		require.NoError(t, err)
+		require.Equal(t, barOffset+1, offset)
+
+		// The end of the line is before the line terminator
+		offset, err = GetOffset(text, pos(1, 3))
+		require.NoError(t, err)
+		require.Equal(t, barOffset+3, offset)
+		offset, err = GetOffset(text, pos(1, 10))
+		require.NoError(t, err)
+		require.Equal(t, barOffset+3, offset)
+
+		offset, err = GetOffset(text, pos(2, 10))
+		require.NoError(t, err)
+		require.Equal(t, len(text), offset)
+
+		_, err = GetOffset(text, pos(3, 0))
+		require.Error(t, err)
+		_, err = GetOffset(text, pos(1, -1))
+		require.Error(t, err)
+	}
+}
+
+func TestApplyTextChange(t *testing.T) {
+	rng := func(startLine, startChar, endLine, endChar int) lsp.Range {
+		return lsp.Range{Start: lsp.Position{Line: startLine, Character: startChar}, End: lsp.Position{Line: endLine, Character: endChar}}
+	}
+	res, err := ApplyTextChange("void setup() {\r\n}\r\n", rng(0, 14, 0, 14), "\r\n  delay(1);")
+	require.NoError(t, err)
+	require.Equal(t, "void setup() {\r\n  delay(1);\r\n}\r\n", res)
+
+	// Replacing the whole line content keeps the CRLF terminator
+	res, err = ApplyTextChange("int a;\r\nint b;\r\n", rng(0, 0, 0, 100), "long a;")
+	require.NoError(t, err)
+	require.Equal(t, "long a;\r\nint b;\r\n", res)
+
+	_, err = ApplyTextChange("int a;\r\n", rng(1, 0, 0, 0), "")
+	require.Error(t, err)
+
+	extracted, err := ExtractRange("int a;\r\nint b;\r\n", rng(0, 4, 1, 100))
+	require.NoError(t, err)
+	require.Equal(t, "a;\r\nint b;", extracted)
+}
+
+func TestStripBOM(t *testing.T) {
+	require.Equal(t, "void setup() {}", StripBOM("\ufeffvoid setup() {}"))
+	require.Equal(t, "void setup() {}", StripBOM("void setup() {}"))
+	require.Equal(t, "a\ufeff", StripBOM("a\ufeff"))
+}
+
+func TestApplyLSPTextDocumentContentChangeEvent(t *testing.T) {
+	doc := lsp.TextDocumentItem{URI: lsp.NewDocumentURI("/tmp/Sketch/Sketch.ino"), Version: 1, Text: "void loop() {}\r\n"}
+	updated, err := ApplyLSPTextDocumentContentChangeEvent(doc, &lsp.DidChangeTextDocumentParams{
+		TextDocument: lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: doc.URI}, Version: 2},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{
+			{Range: &lsp.Range{Start: lsp.Position{Line: 0, Character: 13}, End: lsp.Position{Line: 0, Character: 13}}, Text: " delay(1); "},
+			{Range: &lsp.Range{Start: lsp.Position{Line: 1, Character: 0}, End: lsp.Position{Line: 1, Character: 0}}, Text: "\r\n"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "void loop() { delay(1); }\r\n\r\n", updated.Text)
+	require.Equal(t, 2, updated.Version)
+
+	// The BOM of a full text change is not tracked
+	updated, err = ApplyLSPTextDocumentContentChangeEvent(doc, &lsp.DidChangeTextDocumentParams{
+		TextDocument:   lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: doc.URI}, Version: 2},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{Text: "\ufeffvoid setup() {}\n"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "void setup() {}\n", updated.Text)
+
+	_, err = ApplyLSPTextDocumentContentChangeEvent(doc, &lsp.DidChangeTextDocumentParams{
+		TextDocument: lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: lsp.NewDocumentURI("/tmp/Other.ino")}},
+	})
+	require.Error(t, err)
+}
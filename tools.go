@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// arduinoIDEResourcesPaths returns the folders where the Arduino IDE 2 installers put
+// the tools bundled with the IDE (arduino-cli, clangd and the language server itself).
+func arduinoIDEResourcesPaths() paths.PathList {
+	const resources = "resources/app/lib/backend/resources"
+	res := paths.PathList{}
+	switch runtime.GOOS {
+	case "darwin":
+		res.Add(paths.New("/Applications/Arduino IDE.app/Contents/Resources/app/lib/backend/resources"))
+		if home, err := os.UserHomeDir(); err == nil {
+			res.Add(paths.New(home, "Applications/Arduino IDE.app/Contents/Resources/app/lib/backend/resources"))
+		}
+	case "windows":
+		if localAppData := os.Getenv("LOCALAPPDATA"); localAppData != "" {
+			res.Add(paths.New(localAppData, "Programs", "Arduino IDE", resources))
+		}
+		if programFiles := os.Getenv("ProgramFiles"); programFiles != "" {
+			res.Add(paths.New(programFiles, "Arduino IDE", resources))
+		}
+	default:
+		res.Add(paths.New("/opt/arduino-ide", resources))
+		res.Add(paths.New("/usr/share/arduino-ide", resources))
+	}
+	return res
+}
+
+// toolSearchPaths returns the folders where the tools are searched when their path is
+// not given on the command line, in order of preference: the folder of the language
+// server executable and the Arduino IDE 2 resources folders. The PATH is searched last.
+func toolSearchPaths() paths.PathList {
+	res := paths.PathList{}
+	if exe, err := os.Executable(); err == nil {
+		exePath := paths.New(exe)
+		if err := exePath.FollowSymLink(); err == nil {
+			res.Add(exePath.Parent())
+		}
+	}
+	res.AddAll(arduinoIDEResourcesPaths())
+	return res
+}
+
+// findTool looks for the executable of the given tool (for example "clangd") in the
+// given folders and then in the PATH.
+func findTool(name string, searchPaths paths.PathList) (*paths.Path, error) {
+	exeName := name
+	if runtime.GOOS == "windows" {
+		exeName += ".exe"
+	}
+	for _, dir := range searchPaths {
+		if candidate := dir.Join(exeName); isExecutable(candidate) {
+			return candidate, nil
+		}
+	}
+	if bin, err := exec.LookPath(name); err == nil {
+		return paths.New(bin), nil
+	}
+	return nil, fmt.Errorf("%s not found in %s or in the PATH", name, searchPaths.AsStrings())
+}
+
+// isExecutable returns true if the given path is an executable file
+func isExecutable(file *paths.Path) bool {
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+	// On Windows the executables are recognized by their extension
+	return runtime.GOOS == "windows" || info.Mode()&0111 != 0
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindTool(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("executable permissions are not used on Windows")
+	}
+	t.Setenv("PATH", "")
+	first := paths.New(t.TempDir())
+	second := paths.New(t.TempDir())
+
+	_, err := findTool("clangd", paths.NewPathList(first.String(), second.String()))
+	require.Error(t, err)
+
+	// Files that are not executable are skipped
+	require.NoError(t, first.Join("clangd").WriteFile([]byte("#!/bin/sh\n")))
+	_, err = findTool("clangd", paths.NewPathList(first.String(), second.String()))
+	require.Error(t, err)
+
+	require.NoError(t, second.Join("clangd").WriteFile([]byte("#!/bin/sh\n")))
+	require.NoError(t, second.Join("clangd").Chmod(0755))
+	bin, err := findTool("clangd", paths.NewPathList(first.String(), second.String()))
+	require.NoError(t, err)
+	require.Equal(t, second.Join("clangd").String(), bin.String())
+
+	// The first folder has the precedence
+	require.NoError(t, first.Join("clangd").Chmod(0755))
+	bin, err = findTool("clangd", paths.NewPathList(first.String(), second.String()))
+	require.NoError(t, err)
+	require.Equal(t, first.Join("clangd").String(), bin.String())
+
+	// Then the PATH is searched
+	t.Setenv("PATH", second.String())
+	bin, err = findTool("clangd", paths.NewPathList())
+	require.NoError(t, err)
+	require.Equal(t, second.Join("clangd").String(), bin.String())
+}